@@ -9,45 +9,52 @@ import (
 	"strings"
 )
 
-// SecretKey should ideally be loaded from environment variables
-var SecretKey = []byte("super-secret-key-change-me-in-production")
-
-// SignCookie creates a signed cookie value in the format "value|signature"
+// SignCookie creates a signed cookie value in the format
+// "keyID|value|signature", signed with the current signing key.
 func SignCookie(value string) string {
-	mac := hmac.New(sha256.New, SecretKey)
-	mac.Write([]byte(value))
-	signature := mac.Sum(nil)
-	return fmt.Sprintf("%s|%s", base64.URLEncoding.EncodeToString([]byte(value)), base64.URLEncoding.EncodeToString(signature))
+	key := currentKeyring().Keys[0]
+	encoded := base64.URLEncoding.EncodeToString([]byte(value))
+	return fmt.Sprintf("%s|%s|%s", key.ID, encoded, base64.URLEncoding.EncodeToString(sign(key, encoded)))
 }
 
-// VerifyCookie verifies the signed cookie and returns the original value
+// VerifyCookie verifies the signed cookie against whichever active key signed
+// it and returns the original value
 func VerifyCookie(signedValue string) (string, error) {
 	parts := strings.Split(signedValue, "|")
-	if len(parts) != 2 {
+	if len(parts) != 3 {
 		return "", errors.New("invalid cookie format")
 	}
 
-	valueBase64 := parts[0]
-	signatureBase64 := parts[1]
+	keyID := parts[0]
+	valueBase64 := parts[1]
+	signatureBase64 := parts[2]
+
+	key, ok := currentKeyring().find(keyID)
+	if !ok {
+		return "", errors.New("unknown or retired signing key")
+	}
 
 	valueBytes, err := base64.URLEncoding.DecodeString(valueBase64)
 	if err != nil {
 		return "", errors.New("invalid value encoding")
 	}
-	value := string(valueBytes)
 
 	signature, err := base64.URLEncoding.DecodeString(signatureBase64)
 	if err != nil {
 		return "", errors.New("invalid signature encoding")
 	}
 
-	mac := hmac.New(sha256.New, SecretKey)
-	mac.Write([]byte(value))
-	expectedSignature := mac.Sum(nil)
-
-	if !hmac.Equal(signature, expectedSignature) {
+	if !hmac.Equal(signature, sign(key, valueBase64)) {
 		return "", errors.New("invalid signature")
 	}
 
-	return value, nil
+	return string(valueBytes), nil
+}
+
+// sign covers the key ID as well as the value, so a signature can't be
+// replayed under a different key.
+func sign(key Key, encodedValue string) []byte {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(key.ID + "|" + encodedValue))
+	return mac.Sum(nil)
 }
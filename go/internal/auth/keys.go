@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeysEnvVar names the environment variable that can hold the signing keys
+// instead of a key file, as comma-separated id:base64secret pairs with the
+// signing key first.
+const KeysEnvVar = "CHATTY_COOKIE_KEYS"
+
+// keySize is the length of generated HMAC-SHA256 secrets.
+const keySize = 32
+
+// Key is one cookie signing secret, named by the ID embedded in the cookies
+// it signs.
+type Key struct {
+	ID        string    `json:"id"`
+	Secret    []byte    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Keyring holds the active signing keys. The first key signs new cookies;
+// all of them verify, so a rotated-out key keeps existing cookies valid
+// until it is retired.
+type Keyring struct {
+	Keys []Key `json:"keys"`
+}
+
+// NewKey generates a random signing key.
+func NewKey() (Key, error) {
+	idBytes := make([]byte, 4)
+	secret := make([]byte, keySize)
+	if _, err := rand.Read(idBytes); err != nil {
+		return Key{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, err
+	}
+	return Key{ID: hex.EncodeToString(idBytes), Secret: secret, CreatedAt: time.Now().UTC()}, nil
+}
+
+// LoadKeyring reads a key file written by Save.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var kr Keyring
+	if err := json.Unmarshal(data, &kr); err != nil {
+		return nil, fmt.Errorf("parse key file %s: %w", path, err)
+	}
+	if err := kr.validate(); err != nil {
+		return nil, fmt.Errorf("key file %s: %w", path, err)
+	}
+	return &kr, nil
+}
+
+// ParseKeyring reads keys in the KeysEnvVar format.
+func ParseKeyring(s string) (*Keyring, error) {
+	var kr Keyring
+	for _, entry := range strings.Split(s, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed key %q, want id:base64secret", entry)
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: invalid base64 secret", id)
+		}
+		kr.Keys = append(kr.Keys, Key{ID: id, Secret: secret})
+	}
+	if err := kr.validate(); err != nil {
+		return nil, err
+	}
+	return &kr, nil
+}
+
+func (kr *Keyring) validate() error {
+	if len(kr.Keys) == 0 {
+		return errors.New("no signing keys")
+	}
+	seen := make(map[string]bool)
+	for _, k := range kr.Keys {
+		if k.ID == "" || strings.Contains(k.ID, "|") {
+			return fmt.Errorf("invalid key ID %q", k.ID)
+		}
+		if seen[k.ID] {
+			return fmt.Errorf("duplicate key ID %q", k.ID)
+		}
+		seen[k.ID] = true
+		if len(k.Secret) < 16 {
+			return fmt.Errorf("key %s: secret must be at least 16 bytes", k.ID)
+		}
+	}
+	return nil
+}
+
+// Save writes the keyring to path, readable only by its owner. The file is
+// replaced atomically so a running server never reads a partial write.
+func (kr *Keyring) Save(path string) error {
+	data, err := json.MarshalIndent(kr, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Rotate makes a freshly generated key the signing key and retires all but
+// the keep most recent keys, new one included. Keep at least 2 so cookies
+// signed by the previous key stay valid until they expire.
+func (kr *Keyring) Rotate(keep int) (Key, []Key, error) {
+	if keep < 1 {
+		return Key{}, nil, errors.New("must keep at least one key")
+	}
+	key, err := NewKey()
+	if err != nil {
+		return Key{}, nil, err
+	}
+	kr.Keys = append([]Key{key}, kr.Keys...)
+
+	var retired []Key
+	if len(kr.Keys) > keep {
+		retired = kr.Keys[keep:]
+		kr.Keys = kr.Keys[:keep:keep]
+	}
+	return key, retired, nil
+}
+
+func (kr *Keyring) find(id string) (Key, bool) {
+	for _, k := range kr.Keys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+var (
+	keyringMu sync.RWMutex
+	keyring   *Keyring
+)
+
+// SetKeyring installs the keys used by SignCookie and VerifyCookie.
+func SetKeyring(kr *Keyring) error {
+	if err := kr.validate(); err != nil {
+		return err
+	}
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	keyring = kr
+	return nil
+}
+
+func currentKeyring() *Keyring {
+	keyringMu.RLock()
+	defer keyringMu.RUnlock()
+	return keyring
+}
+
+// Until SetKeyring is called, cookies are signed with a key generated at
+// startup, so they stop verifying when the process restarts.
+func init() {
+	key, err := NewKey()
+	if err != nil {
+		panic(err)
+	}
+	keyring = &Keyring{Keys: []Key{key}}
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useKeyring installs kr for the duration of a test.
+func useKeyring(t *testing.T, kr *Keyring) {
+	t.Helper()
+	previous := currentKeyring()
+	if err := SetKeyring(kr); err != nil {
+		t.Fatalf("SetKeyring failed: %v", err)
+	}
+	t.Cleanup(func() { SetKeyring(previous) })
+}
+
+func TestCookieKeyRotation(t *testing.T) {
+	kr := &Keyring{}
+	first, _, err := kr.Rotate(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useKeyring(t, kr)
+
+	oldCookie := SignCookie("session-1")
+	if !strings.HasPrefix(oldCookie, first.ID+"|") {
+		t.Errorf("Expected cookie to carry key ID %s, got %s", first.ID, oldCookie)
+	}
+
+	// Rotating keeps the previous key for verification only
+	second, retired, _ := kr.Rotate(2)
+	if len(retired) != 0 {
+		t.Errorf("Expected nothing retired yet, got %d keys", len(retired))
+	}
+	newCookie := SignCookie("session-2")
+	if !strings.HasPrefix(newCookie, second.ID+"|") {
+		t.Errorf("Expected new cookies signed with %s, got %s", second.ID, newCookie)
+	}
+	if value, err := VerifyCookie(oldCookie); err != nil || value != "session-1" {
+		t.Errorf("Expected old cookie to still verify, got %q %v", value, err)
+	}
+
+	// A third rotation retires the first key and its cookies
+	_, retired, _ = kr.Rotate(2)
+	if len(retired) != 1 || retired[0].ID != first.ID {
+		t.Errorf("Expected %s to be retired, got %+v", first.ID, retired)
+	}
+	if _, err := VerifyCookie(oldCookie); err == nil {
+		t.Error("Expected cookie signed by a retired key to be rejected")
+	}
+	if _, err := VerifyCookie(newCookie); err != nil {
+		t.Errorf("Expected cookie signed by an active key to verify: %v", err)
+	}
+}
+
+func TestVerifyCookieRejectsTampering(t *testing.T) {
+	kr := &Keyring{}
+	kr.Rotate(2)
+	kr.Rotate(2)
+	useKeyring(t, kr)
+
+	cookie := SignCookie("session-1")
+	parts := strings.Split(cookie, "|")
+
+	tests := map[string]string{
+		"legacy format":   parts[1] + "|" + parts[2],
+		"swapped key ID":  kr.Keys[1].ID + "|" + parts[1] + "|" + parts[2],
+		"unknown key ID":  "nope|" + parts[1] + "|" + parts[2],
+		"altered value":   parts[0] + "|" + base64.URLEncoding.EncodeToString([]byte("session-2")) + "|" + parts[2],
+		"bad signature":   parts[0] + "|" + parts[1] + "|invalid_signature",
+		"empty signature": parts[0] + "|" + parts[1] + "|",
+	}
+	for name, value := range tests {
+		if _, err := VerifyCookie(value); err == nil {
+			t.Errorf("%s: expected verification to fail", name)
+		}
+	}
+}
+
+func TestKeyringLoading(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+
+	kr := &Keyring{}
+	kr.Rotate(3)
+	kr.Rotate(3)
+	if err := kr.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	loaded, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatalf("LoadKeyring failed: %v", err)
+	}
+	if len(loaded.Keys) != 2 || loaded.Keys[0].ID != kr.Keys[0].ID || string(loaded.Keys[0].Secret) != string(kr.Keys[0].Secret) {
+		t.Errorf("Loaded keyring doesn't match saved one: %+v", loaded.Keys)
+	}
+
+	secret := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	parsed, err := ParseKeyring("new:" + secret + ", old:" + secret)
+	if err != nil {
+		t.Fatalf("ParseKeyring failed: %v", err)
+	}
+	if len(parsed.Keys) != 2 || parsed.Keys[0].ID != "new" {
+		t.Errorf("Expected signing key first, got %+v", parsed.Keys)
+	}
+
+	for _, bad := range []string{"", "nosecret", "k:not-base64!", "k:" + base64.StdEncoding.EncodeToString([]byte("short")), "k:" + secret + ",k:" + secret} {
+		if _, err := ParseKeyring(bad); err == nil {
+			t.Errorf("Expected ParseKeyring(%q) to fail", bad)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+// SessionCookieName is the cookie carrying the signed session ID.
+const SessionCookieName = "session"
+
+// touchInterval throttles last-seen updates so every request isn't a write.
+const touchInterval = time.Minute
+
+var (
+	ErrNoSession      = errors.New("no session")
+	ErrSessionExpired = errors.New("session expired")
+)
+
+// SessionManager issues, validates and revokes server-side sessions.
+type SessionManager struct {
+	store store.Store
+
+	// IdleTimeout ends a session that hasn't been used for this long.
+	IdleTimeout time.Duration
+	// AbsoluteTimeout ends a session this long after login regardless of use.
+	AbsoluteTimeout time.Duration
+
+	mu       sync.Mutex
+	onRevoke []func(sessionID string)
+}
+
+func NewSessionManager(store store.Store) *SessionManager {
+	return &SessionManager{
+		store:           store,
+		IdleTimeout:     7 * 24 * time.Hour,
+		AbsoluteTimeout: 30 * 24 * time.Hour,
+	}
+}
+
+// OnRevoke registers a callback run after a session is revoked, e.g. to
+// close the WebSocket connections opened under it.
+func (m *SessionManager) OnRevoke(fn func(sessionID string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onRevoke = append(m.onRevoke, fn)
+}
+
+// Create starts a session for a user logging in through r. Password logins
+// act as the user's account device until the client registers its own.
+func (m *SessionManager) Create(userID int, r *http.Request) (*models.Session, error) {
+	device, err := m.store.GetAccountDevice(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	idBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	now := time.Now().UTC()
+	session := &models.Session{
+		ID:         hex.EncodeToString(idBytes),
+		UserID:     userID,
+		DeviceID:   device.ID,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		UserAgent:  r.UserAgent(),
+		IP:         ip,
+	}
+	if err := m.store.CreateSession(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Cookie returns the signed session cookie for a session.
+func (m *SessionManager) Cookie(session *models.Session) *http.Cookie {
+	return &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    SignCookie(session.ID),
+		Path:     "/",
+		Expires:  m.ExpiresAt(session),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// ClearCookie returns a cookie that deletes the session cookie.
+func (m *SessionManager) ClearCookie() *http.Cookie {
+	return &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// ExpiresAt is when a session hits its absolute timeout.
+func (m *SessionManager) ExpiresAt(session *models.Session) time.Time {
+	return session.CreatedAt.Add(m.AbsoluteTimeout)
+}
+
+// Authenticate returns the live session named by r's session cookie. Expired
+// sessions are deleted on the way out.
+func (m *SessionManager) Authenticate(r *http.Request) (*models.Session, error) {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return nil, ErrNoSession
+	}
+	sessionID, err := VerifyCookie(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := m.store.GetSession(sessionID)
+	if err != nil {
+		return nil, ErrNoSession
+	}
+
+	now := time.Now().UTC()
+	if now.After(m.ExpiresAt(session)) || now.Sub(session.LastSeenAt) > m.IdleTimeout {
+		m.Revoke(session.ID)
+		return nil, ErrSessionExpired
+	}
+
+	if now.Sub(session.LastSeenAt) > touchInterval {
+		if err := m.store.TouchSession(session.ID, now); err != nil {
+			return nil, err
+		}
+		session.LastSeenAt = now
+	}
+	return session, nil
+}
+
+// Revoke ends a session and runs the OnRevoke callbacks.
+func (m *SessionManager) Revoke(sessionID string) error {
+	if err := m.store.DeleteSession(sessionID); err != nil {
+		return err
+	}
+	m.notifyRevoked(sessionID)
+	return nil
+}
+
+// Revoked runs the OnRevoke callbacks for sessions the store has already
+// ended, e.g. along with the account they belonged to.
+func (m *SessionManager) Revoked(sessions []models.Session) {
+	for _, session := range sessions {
+		m.notifyRevoked(session.ID)
+	}
+}
+
+func (m *SessionManager) notifyRevoked(sessionID string) {
+	m.mu.Lock()
+	callbacks := m.onRevoke
+	m.mu.Unlock()
+	for _, fn := range callbacks {
+		fn(sessionID)
+	}
+}
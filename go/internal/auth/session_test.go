@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store/sqlstore"
+)
+
+func TestSessionExpiry(t *testing.T) {
+	store, err := sqlstore.New("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	user, _ := store.GetUserByUsername("user1")
+
+	sessions := NewSessionManager(store)
+	sessions.IdleTimeout = time.Hour
+	sessions.AbsoluteTimeout = 24 * time.Hour
+
+	var revoked []string
+	sessions.OnRevoke(func(id string) { revoked = append(revoked, id) })
+
+	// start creates a session as if it was last used idle ago and created age ago.
+	start := func(age, idle time.Duration) string {
+		session, err := sessions.Create(user.ID, httptest.NewRequest("POST", "/login", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.DeleteSession(session.ID)
+		session.CreatedAt = time.Now().UTC().Add(-age)
+		session.LastSeenAt = time.Now().UTC().Add(-idle)
+		store.CreateSession(session)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(sessions.Cookie(session))
+		_, err = sessions.Authenticate(req)
+		if err != nil && !errors.Is(err, ErrSessionExpired) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err != nil {
+			return "expired"
+		}
+		return "live"
+	}
+
+	if got := start(0, 0); got != "live" {
+		t.Errorf("Expected fresh session to be live, got %s", got)
+	}
+	if got := start(2*time.Hour, 30*time.Minute); got != "live" {
+		t.Errorf("Expected recently used session to be live, got %s", got)
+	}
+	if got := start(2*time.Hour, 2*time.Hour); got != "expired" {
+		t.Errorf("Expected idle session to expire, got %s", got)
+	}
+	if got := start(25*time.Hour, time.Minute); got != "expired" {
+		t.Errorf("Expected session past its absolute timeout to expire, got %s", got)
+	}
+
+	if len(revoked) != 2 {
+		t.Errorf("Expected the 2 expired sessions to be revoked, got %d", len(revoked))
+	}
+	if remaining, _ := store.GetUserSessions(user.ID); len(remaining) != 2 {
+		t.Errorf("Expected 2 live sessions to remain, got %d", len(remaining))
+	}
+}
@@ -0,0 +1,24 @@
+// Package blob stores attachment data. Clients encrypt attachments before
+// uploading them, so stores only ever see ciphertext.
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned when reading an object that doesn't exist.
+var ErrNotFound = errors.New("blob not found")
+
+// Store holds opaque objects by key. Keys are slash-separated paths chosen
+// by the server, never by clients.
+type Store interface {
+	// Put writes an object of size bytes read from r, replacing any object
+	// already stored under key.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens an object for reading. The caller closes it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes an object. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+}
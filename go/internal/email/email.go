@@ -59,22 +59,76 @@ const verificationTemplate = `
 </html>
 `
 
+const passwordResetTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <style>
+        body { font-family: Arial, sans-serif; line-height: 1.6; color: #333; }
+        .container { max-width: 600px; margin: 0 auto; padding: 20px; border: 1px solid #ddd; border-radius: 5px; }
+        .header { background-color: #6200ee; color: white; padding: 10px; text-align: center; border-radius: 5px 5px 0 0; }
+        .content { padding: 20px; }
+        .button { display: inline-block; padding: 10px 20px; background-color: #03dac6; color: black; text-decoration: none; border-radius: 4px; font-weight: bold; }
+        .footer { margin-top: 20px; font-size: 0.8em; color: #777; text-align: center; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <div class="header">
+            <h1>Reset your password</h1>
+        </div>
+        <div class="content">
+            <p>Hi {{.Username}},</p>
+            <p>Someone asked to reset the password for your Chatty account. The link below works once and expires in {{.ExpiresIn}}.</p>
+            <p style="text-align: center;">
+                <a href="{{.Link}}" class="button">Reset Password</a>
+            </p>
+            <p>Because your messages are end-to-end encrypted, resetting your password on a device that no longer holds your keys gives you new ones. Chats you are already in can't be read there until another member re-shares them with you.</p>
+            <p>If you didn't ask for this, you can safely ignore this email; your password won't change.</p>
+        </div>
+        <div class="footer">
+            <p>&copy; 2025 Chatty Inc.</p>
+        </div>
+    </div>
+</body>
+</html>
+`
+
 func (s *Sender) SendVerificationEmail(to, username, link string) error {
-	t, err := template.New("verification").Parse(verificationTemplate)
+	body, err := render("verification", verificationTemplate, map[string]string{"Username": username, "Link": link})
 	if err != nil {
-		return fmt.Errorf("failed to parse template: %w", err)
+		return err
+	}
+	return s.send(to, "Verify your Chatty email", body)
+}
+
+func (s *Sender) SendPasswordResetEmail(to, username, link, expiresIn string) error {
+	body, err := render("password_reset", passwordResetTemplate, map[string]string{"Username": username, "Link": link, "ExpiresIn": expiresIn})
+	if err != nil {
+		return err
+	}
+	return s.send(to, "Reset your Chatty password", body)
+}
+
+func render(name, text string, data map[string]string) (string, error) {
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template: %w", err)
 	}
 
 	var body bytes.Buffer
-	if err := t.Execute(&body, map[string]string{"Username": username, "Link": link}); err != nil {
-		return fmt.Errorf("failed to execute template: %w", err)
+	if err := t.Execute(&body, data); err != nil {
+		return "", fmt.Errorf("failed to execute template: %w", err)
 	}
+	return body.String(), nil
+}
 
+func (s *Sender) send(to, subject, body string) error {
 	// Email headers
 	headers := make(map[string]string)
 	headers["From"] = s.From
 	headers["To"] = to
-	headers["Subject"] = "Verify your Chatty email"
+	headers["Subject"] = subject
 	headers["MIME-Version"] = "1.0"
 	headers["Content-Type"] = "text/html; charset=\"UTF-8\""
 
@@ -82,7 +136,7 @@ func (s *Sender) SendVerificationEmail(to, username, link string) error {
 	for k, v := range headers {
 		message += fmt.Sprintf("%s: %s\r\n", k, v)
 	}
-	message += "\r\n" + body.String()
+	message += "\r\n" + body
 
 	auth := smtp.PlainAuth("", s.Username, s.Password, s.Host)
 	addr := fmt.Sprintf("%s:%s", s.Host, s.Port)
@@ -92,7 +146,7 @@ func (s *Sender) SendVerificationEmail(to, username, link string) error {
 		fmt.Println("==================================================")
 		fmt.Printf("MOCK EMAIL TO: %s\n", to)
 		fmt.Printf("SUBJECT: %s\n", headers["Subject"])
-		fmt.Println(body.String())
+		fmt.Println(body)
 		fmt.Println("==================================================")
 		return nil
 	}
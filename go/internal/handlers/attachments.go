@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/middleware"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+// AttachmentLimits bounds what users can upload, in bytes.
+type AttachmentLimits struct {
+	MaxSize   int64 // Largest single attachment
+	Quota     int64 // Most a user may store across all their attachments
+	ChunkSize int64 // Size of every upload chunk but the last
+}
+
+// DefaultAttachmentLimits allow 25 MiB attachments, 1 GiB per user, in
+// 1 MiB chunks.
+var DefaultAttachmentLimits = AttachmentLimits{
+	MaxSize:   25 << 20,
+	Quota:     1 << 30,
+	ChunkSize: 1 << 20,
+}
+
+// maxContentTypeLength bounds the declared content type of an attachment.
+const maxContentTypeLength = 255
+
+// chunkKey names the blob holding one chunk of an attachment.
+func chunkKey(attachmentID, chunk int) string {
+	return fmt.Sprintf("attachments/%d/%d", attachmentID, chunk)
+}
+
+// discardBlobs deletes the stored chunks of attachments whose rows are
+// gone. Failures only leave garbage behind, so they are logged.
+func (h *ChatHandler) discardBlobs(attachments []models.Attachment) {
+	if h.Blobs == nil {
+		return
+	}
+	for _, a := range attachments {
+		for chunk := 0; chunk < a.Chunks(); chunk++ {
+			if err := h.Blobs.Delete(context.Background(), chunkKey(a.ID, chunk)); err != nil {
+				log.Printf("Error deleting chunk %d of attachment %d: %v", chunk, a.ID, err)
+			}
+		}
+	}
+}
+
+// chatAttachment loads the attachment named by the route, checking that it
+// belongs to the chat in the route and that the caller participates in
+// that chat. Attachments that haven't been sent are only visible to their
+// uploader.
+func (h *ChatHandler) chatAttachment(w http.ResponseWriter, r *http.Request) (*models.Attachment, bool) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+	attachmentID, _ := strconv.Atoi(vars["attachmentID"])
+
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	isParticipant, err := h.Store.IsParticipant(chatID, userID)
+	if err != nil || !isParticipant {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+
+	attachment, err := h.Store.GetAttachment(attachmentID)
+	if err != nil || attachment.ChatID != chatID || (attachment.MessageID == 0 && attachment.UserID != userID) {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return nil, false
+	}
+	return attachment, true
+}
+
+// CreateAttachment starts an upload of an encrypted attachment of the
+// declared size and content type. The response says which chunk size to
+// upload it in.
+func (h *ChatHandler) CreateAttachment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	var req struct {
+		Size        int64  `json:"size"`
+		ContentType string `json:"content_type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Size <= 0 || req.Size > h.Attachments.MaxSize {
+		http.Error(w, fmt.Sprintf("Size must be between 1 and %d bytes", h.Attachments.MaxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if req.ContentType == "" {
+		req.ContentType = "application/octet-stream"
+	}
+	if _, _, err := mime.ParseMediaType(req.ContentType); err != nil || len(req.ContentType) > maxContentTypeLength {
+		http.Error(w, "Invalid content type", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := h.authorize(w, chatID, userID, models.ActionPost); !ok {
+		return
+	}
+
+	attachment := &models.Attachment{
+		ChatID:      chatID,
+		UserID:      userID,
+		Size:        req.Size,
+		ContentType: req.ContentType,
+		ChunkSize:   h.Attachments.ChunkSize,
+	}
+	err := h.Store.CreateAttachment(attachment, h.Attachments.Quota)
+	if errors.Is(err, store.ErrQuotaExceeded) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachment)
+}
+
+// GetAttachment returns an attachment's metadata. An interrupted upload
+// resumes from its received byte count.
+func (h *ChatHandler) GetAttachment(w http.ResponseWriter, r *http.Request) {
+	attachment, ok := h.chatAttachment(w, r)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(attachment)
+}
+
+// UploadChunk stores one chunk of an attachment from the raw request body.
+// Chunks are uploaded in order; re-sending a chunk that was already
+// received is a no-op, so uploads can be retried safely.
+func (h *ChatHandler) UploadChunk(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	attachment, ok := h.chatAttachment(w, r)
+	if !ok {
+		return
+	}
+	if attachment.UserID != userID {
+		http.Error(w, "Only the uploader can upload chunks", http.StatusForbidden)
+		return
+	}
+
+	chunk, err := strconv.Atoi(mux.Vars(r)["chunk"])
+	if err != nil || chunk < 0 || chunk >= attachment.Chunks() {
+		http.Error(w, "Chunk out of range", http.StatusBadRequest)
+		return
+	}
+	offset := int64(chunk) * attachment.ChunkSize
+	if offset < attachment.Received {
+		json.NewEncoder(w).Encode(attachment)
+		return
+	}
+	if offset > attachment.Received {
+		http.Error(w, fmt.Sprintf("Expected chunk %d", attachment.Received/attachment.ChunkSize), http.StatusConflict)
+		return
+	}
+
+	size := min(attachment.ChunkSize, attachment.Size-offset)
+	if r.ContentLength != size {
+		http.Error(w, fmt.Sprintf("Chunk %d must be exactly %d bytes", chunk, size), http.StatusBadRequest)
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, size)
+	if err := h.Blobs.Put(r.Context(), chunkKey(attachment.ID, chunk), body, size); err != nil {
+		http.Error(w, "Failed to store chunk", http.StatusInternalServerError)
+		return
+	}
+
+	// A concurrent retry of the same chunk may have been counted already.
+	if _, err := h.Store.AddAttachmentChunk(attachment.ID, offset, size); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	attachment, err = h.Store.GetAttachment(attachment.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(attachment)
+}
+
+// DownloadAttachment streams a complete attachment's encrypted content.
+func (h *ChatHandler) DownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	attachment, ok := h.chatAttachment(w, r)
+	if !ok {
+		return
+	}
+	if !attachment.Complete() {
+		http.Error(w, "Attachment upload is incomplete", http.StatusConflict)
+		return
+	}
+
+	for chunk := 0; chunk < attachment.Chunks(); chunk++ {
+		content, err := h.Blobs.Get(r.Context(), chunkKey(attachment.ID, chunk))
+		if err != nil {
+			// Past the first chunk the response has started, and all that's
+			// left is to cut it short.
+			if chunk == 0 {
+				http.Error(w, "Failed to read attachment", http.StatusInternalServerError)
+			}
+			log.Printf("Error reading chunk %d of attachment %d: %v", chunk, attachment.ID, err)
+			return
+		}
+		if chunk == 0 {
+			// The content is ciphertext; its declared type applies once decrypted.
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+			w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+		}
+		_, err = io.Copy(w, content)
+		content.Close()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// DeleteAttachment abandons an upload that hasn't been sent, freeing its
+// quota. Sent attachments go away with their message.
+func (h *ChatHandler) DeleteAttachment(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	attachment, ok := h.chatAttachment(w, r)
+	if !ok {
+		return
+	}
+	if attachment.UserID != userID || attachment.MessageID != 0 {
+		http.Error(w, "Only unsent attachments can be deleted, by their uploader", http.StatusForbidden)
+		return
+	}
+
+	err := h.Store.DeleteAttachment(attachment.ID)
+	if errors.Is(err, store.ErrAttachmentNotFound) {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.discardBlobs([]models.Attachment{*attachment})
+
+	w.WriteHeader(http.StatusOK)
+}
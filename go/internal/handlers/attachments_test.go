@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/blob"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store/sqlstore"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+func TestAttachmentUpload(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	for _, name := range []string{"uploader", "member", "outsider"} {
+		store.CreateUser(&models.User{Username: name, Email: name + "@example.com", Password: "pass"})
+	}
+	uploader, _ := store.GetUserByUsername("uploader")
+	member, _ := store.GetUserByUsername("member")
+	outsider, _ := store.GetUserByUsername("outsider")
+
+	id, _ := store.CreateChat("Chat", uploader.ID)
+	chatID := int(id)
+	store.AddParticipant(chatID, uploader.ID, uploader.ID, map[int]string{accountDevice(t, store, uploader.ID): "key"})
+	store.AddParticipant(chatID, member.ID, member.ID, map[int]string{accountDevice(t, store, member.ID): "key"})
+
+	blobs, _ := blob.NewFS(t.TempDir())
+	hub := ws.NewHub(store)
+	go hub.Run()
+
+	handler := &ChatHandler{
+		Store:       store,
+		Hub:         hub,
+		Blobs:       blobs,
+		Attachments: AttachmentLimits{MaxSize: 10, Quota: 16, ChunkSize: 4},
+	}
+
+	do := func(userID int, method, path string, body []byte, vars map[string]string, h http.HandlerFunc) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/chats/"+strconv.Itoa(chatID)+path, bytes.NewReader(body))
+		vars["id"] = strconv.Itoa(chatID)
+		req = mux.SetURLVars(req, vars)
+		authenticated := login(t, store, userID, req)
+		rr := httptest.NewRecorder()
+		authenticated(h).ServeHTTP(rr, req)
+		return rr
+	}
+	create := func(userID int, size int64) *httptest.ResponseRecorder {
+		raw, _ := json.Marshal(map[string]interface{}{"size": size, "content_type": "image/png"})
+		return do(userID, "POST", "/attachments", raw, map[string]string{}, handler.CreateAttachment)
+	}
+
+	if rr := create(outsider.ID, 10); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a non-participant, got %v", rr.Code)
+	}
+	if rr := create(uploader.ID, 11); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 past the maximum size, got %v", rr.Code)
+	}
+	rr := create(uploader.ID, 10)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 creating an attachment, got %v: %s", rr.Code, rr.Body)
+	}
+	var attachment models.Attachment
+	json.NewDecoder(rr.Body).Decode(&attachment)
+	if attachment.ChunkSize != 4 || attachment.Received != 0 {
+		t.Errorf("Expected an empty upload in 4-byte chunks, got %+v", attachment)
+	}
+	if rr := create(uploader.ID, 10); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 past the quota, got %v", rr.Code)
+	}
+
+	aid := strconv.Itoa(attachment.ID)
+	upload := func(userID, chunk int, data string) *httptest.ResponseRecorder {
+		vars := map[string]string{"attachmentID": aid, "chunk": strconv.Itoa(chunk)}
+		return do(userID, "PUT", "/attachments/"+aid+"/chunks/"+strconv.Itoa(chunk), []byte(data), vars, handler.UploadChunk)
+	}
+	download := func(userID int) *httptest.ResponseRecorder {
+		return do(userID, "GET", "/attachments/"+aid+"/content", nil, map[string]string{"attachmentID": aid}, handler.DownloadAttachment)
+	}
+
+	if rr := upload(uploader.ID, 1, "efgh"); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for an out-of-order chunk, got %v", rr.Code)
+	}
+	if rr := upload(uploader.ID, 0, "abc"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a short chunk, got %v", rr.Code)
+	}
+	if rr := upload(member.ID, 0, "abcd"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for someone else's unsent attachment, got %v", rr.Code)
+	}
+	if rr := upload(uploader.ID, 0, "abcd"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 uploading a chunk, got %v: %s", rr.Code, rr.Body)
+	}
+	if rr := download(uploader.ID); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 downloading an incomplete attachment, got %v", rr.Code)
+	}
+
+	// A resumed upload picks up from the received byte count
+	rr = do(uploader.ID, "GET", "/attachments/"+aid, nil, map[string]string{"attachmentID": aid}, handler.GetAttachment)
+	json.NewDecoder(rr.Body).Decode(&attachment)
+	if attachment.Received != 4 {
+		t.Errorf("Expected 4 bytes received, got %+v", attachment)
+	}
+	if rr := upload(uploader.ID, 0, "abcd"); rr.Code != http.StatusOK {
+		t.Errorf("Expected a retried chunk to succeed, got %v", rr.Code)
+	}
+	upload(uploader.ID, 1, "efgh")
+	rr = upload(uploader.ID, 2, "ij")
+	json.NewDecoder(rr.Body).Decode(&attachment)
+	if !attachment.Complete() {
+		t.Fatalf("Expected the upload to be complete, got %+v", attachment)
+	}
+
+	// Once sent, every member can download it
+	if rr := download(member.ID); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 before the attachment is sent, got %v", rr.Code)
+	}
+	msg, _, err := store.SaveMessage(chatID, uploader.ID, 1, 0, "photo", "", []int{attachment.ID})
+	if err != nil {
+		t.Fatalf("SaveMessage failed: %v", err)
+	}
+	rr = download(member.ID)
+	if rr.Code != http.StatusOK || rr.Body.String() != "abcdefghij" || rr.Header().Get("Content-Length") != "10" {
+		t.Errorf("Expected the whole attachment, got %v %q", rr.Code, rr.Body)
+	}
+	if rr := download(outsider.ID); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 downloading as a non-participant, got %v", rr.Code)
+	}
+
+	// Deleting the message discards the stored chunks
+	mid := strconv.Itoa(msg.ID)
+	do(uploader.ID, "DELETE", "/messages/"+mid, nil, map[string]string{"messageID": mid}, handler.DeleteMessage)
+	if _, err := blobs.Get(context.Background(), chunkKey(attachment.ID, 0)); !errors.Is(err, blob.ErrNotFound) {
+		t.Errorf("Expected the chunks to be deleted with the message, got %v", err)
+	}
+	if rr := download(member.ID); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after the message was deleted, got %v", rr.Code)
+	}
+}
+
+func TestDeleteUnsentAttachment(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "uploader", Email: "uploader@example.com", Password: "pass"})
+	uploader, _ := store.GetUserByUsername("uploader")
+	id, _ := store.CreateChat("Chat", uploader.ID)
+	chatID := int(id)
+	store.AddParticipant(chatID, uploader.ID, uploader.ID, map[int]string{accountDevice(t, store, uploader.ID): "key"})
+
+	blobs, _ := blob.NewFS(t.TempDir())
+	handler := &ChatHandler{Store: store, Blobs: blobs, Attachments: DefaultAttachmentLimits}
+
+	attachment := &models.Attachment{ChatID: chatID, UserID: uploader.ID, Size: 3, ContentType: "text/plain", ChunkSize: 4}
+	store.CreateAttachment(attachment, DefaultAttachmentLimits.Quota)
+	blobs.Put(context.Background(), chunkKey(attachment.ID, 0), bytes.NewReader([]byte("abc")), 3)
+
+	aid := strconv.Itoa(attachment.ID)
+	req, _ := http.NewRequest("DELETE", "/chats/"+strconv.Itoa(chatID)+"/attachments/"+aid, nil)
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(chatID), "attachmentID": aid})
+	authenticated := login(t, store, uploader.ID, req)
+	rr := httptest.NewRecorder()
+	authenticated(http.HandlerFunc(handler.DeleteAttachment)).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 deleting an unsent attachment, got %v: %s", rr.Code, rr.Body)
+	}
+
+	if content, err := blobs.Get(context.Background(), chunkKey(attachment.ID, 0)); err == nil {
+		data, _ := io.ReadAll(content)
+		content.Close()
+		t.Errorf("Expected the chunk to be deleted, still have %q", data)
+	}
+}
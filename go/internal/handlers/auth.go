@@ -2,16 +2,22 @@ package handlers
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/pliu/chatty/internal/auth"
 	"github.com/pliu/chatty/internal/email"
+	"github.com/pliu/chatty/internal/middleware"
 	"github.com/pliu/chatty/internal/models"
 	"github.com/pliu/chatty/internal/store"
+	"github.com/pliu/chatty/internal/ws"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -20,10 +26,15 @@ type Credentials struct {
 	Password string `json:"password"`
 }
 
+// passwordResetTTL is how long a password reset link stays valid.
+const passwordResetTTL = time.Hour
+
 type AuthHandler struct {
 	Store       store.Store
+	Sessions    *auth.SessionManager
 	BaseURL     string
 	EmailSender *email.Sender
+	Hub         *ws.Hub
 }
 
 func (h *AuthHandler) Signup(w http.ResponseWriter, r *http.Request) {
@@ -121,13 +132,18 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set session cookie (signed)
-	http.SetCookie(w, &http.Cookie{
-		Name:  "user_id",
-		Value: auth.SignCookie(strconv.Itoa(user.ID)),
-		// Expires: time.Now().Add(24 * time.Hour), // Session cookie
-		Path: "/",
-	})
+	if user.DeactivatedAt != nil {
+		http.Error(w, "This account has been deactivated", http.StatusForbidden)
+		return
+	}
+
+	// Start a server-side session; the cookie only carries its signed ID
+	session, err := h.Sessions.Create(user.ID, r)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, h.Sessions.Cookie(session))
 
 	// Also setting a username cookie for frontend convenience
 	http.SetCookie(w, &http.Cookie{
@@ -171,3 +187,239 @@ func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 	http.ServeFile(w, r, "static/verify_success.html")
 }
+
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.Context().Value(middleware.SessionIDKey).(string)
+
+	if err := h.Sessions.Revoke(sessionID); err != nil {
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, h.Sessions.ClearCookie())
+	http.SetCookie(w, &http.Cookie{Name: "username", Value: "", Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *AuthHandler) GetSessions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+	sessionID := r.Context().Value(middleware.SessionIDKey).(string)
+
+	sessions, err := h.Store.GetUserSessions(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == sessionID
+	}
+
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func (h *AuthHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+	targetID := mux.Vars(r)["id"]
+
+	// Only the owner may revoke a session; report others as missing
+	session, err := h.Store.GetSession(targetID)
+	if err != nil || session.UserID != userID {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.Sessions.Revoke(session.ID); err != nil {
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *AuthHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Answer the same way whether or not the account exists so this can't be
+	// used to find out who has one.
+	response := map[string]string{
+		"message": "If that email has an account, a reset link is on its way.",
+	}
+
+	user, err := h.Store.GetUserByEmail(req.Email)
+	if err != nil || user.DeactivatedAt != nil {
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	if err := h.Store.CreatePasswordReset(user.ID, hashToken(token), time.Now().UTC().Add(passwordResetTTL)); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resetLink := fmt.Sprintf("%s/?reset_token=%s", strings.TrimSuffix(h.BaseURL, "/"), token)
+	if h.EmailSender != nil {
+		go func() {
+			if err := h.EmailSender.SendPasswordResetEmail(user.Email, user.Username, resetLink, "1 hour"); err != nil {
+				fmt.Printf("Failed to send email to %s: %v\n", user.Email, err)
+			}
+		}()
+	} else {
+		fmt.Printf("PASSWORD RESET LINK: %s\n", resetLink)
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// ResetPassword sets a new password using an emailed reset token. The
+// private key is only stored wrapped with the password, so the client must
+// send it re-wrapped under the new one; if it no longer has the old key it
+// sends a fresh keypair instead and loses access to existing chat keys.
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token               string `json:"token"`
+		Password            string `json:"password"`
+		PublicKey           string `json:"public_key"`
+		EncryptedPrivateKey string `json:"encrypted_private_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" || req.Password == "" {
+		http.Error(w, "Token and password are required", http.StatusBadRequest)
+		return
+	}
+	if req.EncryptedPrivateKey == "" {
+		http.Error(w, "encrypted_private_key is required: re-wrap the existing key or send a new keypair", http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The token stays usable unless the new credentials are saved
+	var rotated bool
+	var sessions []models.Session
+	var owners map[int]int
+	err = h.Store.WithTx(r.Context(), func(tx store.Store) error {
+		userID, err := tx.ConsumePasswordReset(hashToken(req.Token), time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		user, err := tx.GetUserByID(userID)
+		if err != nil {
+			return err
+		}
+		if user.DeactivatedAt != nil {
+			return store.ErrInvalidToken
+		}
+
+		// Without a new public key the client is re-wrapping the existing private key
+		rotated = req.PublicKey != "" && req.PublicKey != user.PublicKey
+		publicKey := user.PublicKey
+		if rotated {
+			publicKey = req.PublicKey
+		}
+		rekeyChatIDs, err := tx.UpdateUserCredentials(userID, string(hashedPassword), publicKey, req.EncryptedPrivateKey)
+		if err != nil {
+			return err
+		}
+		if owners, err = rekeyOwners(tx, rekeyChatIDs); err != nil {
+			return err
+		}
+
+		// Whoever knew the old password is logged out everywhere
+		if sessions, err = tx.GetUserSessions(userID); err != nil {
+			return err
+		}
+		return tx.DeleteUserSessions(userID)
+	})
+	if errors.Is(err, store.ErrInvalidToken) {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	h.Sessions.Revoked(sessions)
+	// The account key's chat keys went with the old keypair
+	notifyRekeyRequired(h.Hub, owners)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":         "Password reset. Please log in.",
+		"keypair_rotated": rotated,
+	})
+}
+
+// DeactivateAccount closes the caller's account after they confirm their
+// password. They are logged out everywhere and can't log in again, and each
+// group chat they own passes to a successor, as DeactivateUser describes.
+func (h *AuthHandler) DeactivateAccount(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.Store.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	// The sessions end with the account, so none outlive it
+	var sessions []models.Session
+	var successions []models.AuditEntry
+	err = h.Store.WithTx(r.Context(), func(tx store.Store) error {
+		var err error
+		if sessions, err = tx.GetUserSessions(userID); err != nil {
+			return err
+		}
+		successions, err = tx.DeactivateUser(userID, time.Now().UTC())
+		return err
+	})
+	if err != nil {
+		http.Error(w, "Failed to deactivate account", http.StatusInternalServerError)
+		return
+	}
+	h.Sessions.Revoked(sessions)
+	for _, entry := range successions {
+		notifyOwnerChanged(h.Store, h.Hub, entry)
+	}
+	http.SetCookie(w, h.Sessions.ClearCookie())
+	http.SetCookie(w, &http.Cookie{Name: "username", Value: "", Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusOK)
+}
+
+// hashToken is how one-time tokens are stored, so the table can't be used to
+// redeem them.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -6,10 +6,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/pliu/chatty/internal/auth"
+	"github.com/pliu/chatty/internal/middleware"
 	"github.com/pliu/chatty/internal/models"
 	"github.com/pliu/chatty/internal/store/sqlstore"
+	"github.com/pliu/chatty/internal/ws"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -66,7 +70,7 @@ func TestSignup(t *testing.T) {
 
 func TestLogin(t *testing.T) {
 	store, _ := sqlstore.New("sqlite3", ":memory:")
-	handler := &AuthHandler{Store: store, BaseURL: "http://example.com"}
+	handler := &AuthHandler{Store: store, Sessions: auth.NewSessionManager(store), BaseURL: "http://example.com"}
 
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
 
@@ -104,22 +108,28 @@ func TestLogin(t *testing.T) {
 		t.Error("Expected cookies to be set")
 	}
 
-	var userIDCookie *http.Cookie
+	var sessionCookie *http.Cookie
 	for _, c := range cookies {
-		if c.Name == "user_id" {
-			userIDCookie = c
+		if c.Name == auth.SessionCookieName {
+			sessionCookie = c
 			break
 		}
 	}
 
-	if userIDCookie == nil {
-		t.Error("Expected user_id cookie to be set")
+	if sessionCookie == nil {
+		t.Error("Expected session cookie to be set")
 	} else {
-		// Verify signature
-		_, err := auth.VerifyCookie(userIDCookie.Value)
+		// Verify signature and that the session exists server-side
+		sessionID, err := auth.VerifyCookie(sessionCookie.Value)
 		if err != nil {
 			t.Errorf("Cookie verification failed: %v", err)
 		}
+		if _, err := store.GetSession(sessionID); err != nil {
+			t.Errorf("Expected session to be stored: %v", err)
+		}
+		if !sessionCookie.HttpOnly {
+			t.Error("Expected session cookie to be HttpOnly")
+		}
 	}
 
 	// Verify response body contains keys
@@ -135,3 +145,216 @@ func TestLogin(t *testing.T) {
 		t.Errorf("Expected encrypted private key 'mock_private_key', got '%s'", user.EncryptedPrivateKey)
 	}
 }
+
+// login starts a session for userID, adds its cookie to req and returns the
+// auth middleware that will accept it.
+func login(t *testing.T, store *sqlstore.SQLStore, userID int, req *http.Request) func(http.Handler) http.Handler {
+	t.Helper()
+	sessions := auth.NewSessionManager(store)
+	session, err := sessions.Create(userID, httptest.NewRequest("POST", "/login", nil))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	req.AddCookie(sessions.Cookie(session))
+	return middleware.NewAuthMiddleware(sessions)
+}
+
+func TestLogout(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	user, _ := store.GetUserByUsername("user1")
+
+	sessions := auth.NewSessionManager(store)
+	var revoked []string
+	sessions.OnRevoke(func(id string) { revoked = append(revoked, id) })
+	handler := &AuthHandler{Store: store, Sessions: sessions}
+	authenticated := middleware.NewAuthMiddleware(sessions)
+
+	session, _ := sessions.Create(user.ID, httptest.NewRequest("POST", "/login", nil))
+	cookie := sessions.Cookie(session)
+
+	req, _ := http.NewRequest("POST", "/logout", nil)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	authenticated(http.HandlerFunc(handler.Logout)).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if len(revoked) != 1 || revoked[0] != session.ID {
+		t.Errorf("Expected revoke callback for %s, got %v", session.ID, revoked)
+	}
+
+	// The old cookie no longer works
+	req, _ = http.NewRequest("POST", "/logout", nil)
+	req.AddCookie(cookie)
+	rr = httptest.NewRecorder()
+	authenticated(http.HandlerFunc(handler.Logout)).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 after logout, got %v", status)
+	}
+}
+
+func TestSessionsListAndRevoke(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	store.CreateUser(&models.User{Username: "user2", Email: "user2@example.com", Password: "pass"})
+	user, _ := store.GetUserByUsername("user1")
+	other, _ := store.GetUserByUsername("user2")
+
+	sessions := auth.NewSessionManager(store)
+	handler := &AuthHandler{Store: store, Sessions: sessions}
+	authenticated := middleware.NewAuthMiddleware(sessions)
+
+	laptop, _ := sessions.Create(user.ID, httptest.NewRequest("POST", "/login", nil))
+	phone, _ := sessions.Create(user.ID, httptest.NewRequest("POST", "/login", nil))
+	stranger, _ := sessions.Create(other.ID, httptest.NewRequest("POST", "/login", nil))
+
+	req, _ := http.NewRequest("GET", "/sessions", nil)
+	req.AddCookie(sessions.Cookie(laptop))
+	rr := httptest.NewRecorder()
+	authenticated(http.HandlerFunc(handler.GetSessions)).ServeHTTP(rr, req)
+
+	var listed []models.Session
+	json.NewDecoder(rr.Body).Decode(&listed)
+	if len(listed) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(listed))
+	}
+	for _, s := range listed {
+		if s.Current != (s.ID == laptop.ID) {
+			t.Errorf("Expected only the requesting session to be current, got %+v", s)
+		}
+	}
+
+	revoke := func(id string) int {
+		req, _ := http.NewRequest("DELETE", "/sessions/"+id, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		req.AddCookie(sessions.Cookie(laptop))
+		rr := httptest.NewRecorder()
+		authenticated(http.HandlerFunc(handler.RevokeSession)).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if status := revoke(stranger.ID); status != http.StatusNotFound {
+		t.Errorf("Expected 404 revoking another user's session, got %v", status)
+	}
+	if status := revoke(phone.ID); status != http.StatusOK {
+		t.Errorf("Expected 200 revoking own session, got %v", status)
+	}
+	if _, err := store.GetSession(phone.ID); err == nil {
+		t.Error("Expected revoked session to be deleted")
+	}
+	if _, err := store.GetSession(stranger.ID); err != nil {
+		t.Error("Expected other user's session to survive")
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("old-password"), bcrypt.DefaultCost)
+	store.CreateUser(&models.User{
+		Username:            "user1",
+		Email:               "user1@example.com",
+		Password:            string(hashedPassword),
+		PublicKey:           "old_public_key",
+		EncryptedPrivateKey: "old_private_key",
+		IsVerified:          true,
+	})
+	user, _ := store.GetUserByUsername("user1")
+	store.CreateUser(&models.User{Username: "owner", Email: "owner@example.com", Password: "pass"})
+	owner, _ := store.GetUserByUsername("owner")
+	chatID, _ := store.CreateChat("Chat", owner.ID)
+	store.AddParticipant(int(chatID), owner.ID, owner.ID, map[int]string{accountDevice(t, store, owner.ID): "owner-1"})
+	store.AddParticipant(int(chatID), user.ID, user.ID, map[int]string{accountDevice(t, store, user.ID): "user-1"})
+
+	hub := ws.NewHub(store)
+	go hub.Run()
+	ownerConn := connect(t, hub, owner.ID)
+
+	sessions := auth.NewSessionManager(store)
+	handler := &AuthHandler{Store: store, Sessions: sessions, BaseURL: "http://example.com", Hub: hub}
+	session, _ := sessions.Create(user.ID, httptest.NewRequest("POST", "/login", nil))
+
+	post := func(h http.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+		raw, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(raw))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Unknown and known emails get the same answer
+	unknown := post(handler.ForgotPassword, map[string]string{"email": "nobody@example.com"})
+	known := post(handler.ForgotPassword, map[string]string{"email": "user1@example.com"})
+	if unknown.Code != http.StatusOK || known.Code != http.StatusOK || unknown.Body.String() != known.Body.String() {
+		t.Errorf("Expected identical 200 responses, got %d %q and %d %q", unknown.Code, unknown.Body, known.Code, known.Body)
+	}
+
+	store.CreatePasswordReset(user.ID, hashToken("token1"), time.Now().Add(time.Hour))
+
+	if rr := post(handler.ResetPassword, map[string]string{"token": "token1", "password": "new-password"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without encrypted_private_key, got %d", rr.Code)
+	}
+	if rr := post(handler.ResetPassword, map[string]string{"token": "wrong", "password": "new-password", "encrypted_private_key": "k"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for wrong token, got %d", rr.Code)
+	}
+
+	// A reset that fails to save the credentials leaves the token usable
+	faulty := &AuthHandler{Store: &faultyStore{Store: store, fail: "UpdateUserCredentials"}, Sessions: sessions}
+	if rr := post(faulty.ResetPassword, map[string]string{"token": "token1", "password": "lost", "encrypted_private_key": "k"}); rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when saving the credentials fails, got %d", rr.Code)
+	}
+	if user, _ := store.GetUserByID(user.ID); user.EncryptedPrivateKey != "old_private_key" {
+		t.Errorf("Expected the credentials to be rolled back, got %q", user.EncryptedPrivateKey)
+	}
+
+	rr := post(handler.ResetPassword, map[string]string{
+		"token":                 "token1",
+		"password":              "new-password",
+		"public_key":            "new_public_key",
+		"encrypted_private_key": "new_private_key",
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var resp map[string]interface{}
+	json.NewDecoder(rr.Body).Decode(&resp)
+	if resp["keypair_rotated"] != true {
+		t.Errorf("Expected keypair_rotated, got %v", resp)
+	}
+
+	user, _ = store.GetUserByID(user.ID)
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("new-password")) != nil {
+		t.Error("Expected password to be changed")
+	}
+	if user.PublicKey != "new_public_key" || user.EncryptedPrivateKey != "new_private_key" {
+		t.Errorf("Expected keypair to be replaced, got %q %q", user.PublicKey, user.EncryptedPrivateKey)
+	}
+	if _, err := store.GetSession(session.ID); err == nil {
+		t.Error("Expected existing sessions to be revoked")
+	}
+
+	// Chat keys wrapped for the old keypair are gone, so the owner rekeys
+	var rekey ws.ChatEvent
+	nextEvent(t, ownerConn, ws.TypeRekeyRequired, &rekey)
+	if rekey.ChatID != int(chatID) {
+		t.Errorf("Expected a rekey request for chat %d, got %+v", chatID, rekey)
+	}
+	if chats, _ := store.GetUserChats(user.ID, accountDevice(t, store, user.ID)); len(chats) != 1 || !chats[0].RekeyNeeded || chats[0].EncryptedKey != "" {
+		t.Errorf("Expected the chat to need a rekey without a stale key, got %+v", chats)
+	}
+
+	// Tokens are single-use
+	if rr := post(handler.ResetPassword, map[string]string{"token": "token1", "password": "again", "encrypted_private_key": "k"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 reusing a token, got %d", rr.Code)
+	}
+
+	// Re-wrapping the existing private key keeps the public key
+	store.CreatePasswordReset(user.ID, hashToken("token2"), time.Now().Add(time.Hour))
+	rr = post(handler.ResetPassword, map[string]string{"token": "token2", "password": "third", "encrypted_private_key": "rewrapped"})
+	json.NewDecoder(rr.Body).Decode(&resp)
+	user, _ = store.GetUserByID(user.ID)
+	if resp["keypair_rotated"] != false || user.PublicKey != "new_public_key" || user.EncryptedPrivateKey != "rewrapped" {
+		t.Errorf("Expected re-wrapped key with unchanged public key, got %v %+v", resp, user)
+	}
+}
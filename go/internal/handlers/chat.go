@@ -2,11 +2,14 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 
 	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/blob"
 	"github.com/pliu/chatty/internal/middleware"
+	"github.com/pliu/chatty/internal/models"
 	"github.com/pliu/chatty/internal/store"
 	"github.com/pliu/chatty/internal/ws"
 )
@@ -14,6 +17,10 @@ import (
 type ChatHandler struct {
 	Store store.Store
 	Hub   *ws.Hub
+
+	// Blobs holds attachment content, within the given limits.
+	Blobs       blob.Store
+	Attachments AttachmentLimits
 }
 
 type CreateChatRequest struct {
@@ -24,76 +31,137 @@ type InviteUserRequest struct {
 	Username string `json:"username"`
 }
 
+// WrappedKey is a chat key wrapped for one device's public key.
+type WrappedKey struct {
+	DeviceID     int    `json:"device_id"`
+	EncryptedKey string `json:"encrypted_key"`
+}
+
+// keysByDevice indexes wrapped keys by device, rejecting empty keys.
+func keysByDevice(wrapped []WrappedKey) (map[int]string, error) {
+	keys := make(map[int]string, len(wrapped))
+	for _, k := range wrapped {
+		if k.EncryptedKey == "" {
+			return nil, errors.New("every key must be non-empty")
+		}
+		keys[k.DeviceID] = k.EncryptedKey
+	}
+	return keys, nil
+}
+
 func (h *ChatHandler) CreateChat(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(middleware.UserIDKey).(int)
 
 	var req struct {
-		Name         string `json:"name"`
-		EncryptedKey string `json:"encrypted_key"`
+		Name string       `json:"name"`
+		Keys []WrappedKey `json:"keys"` // One for each of the creator's devices
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	chatID, err := h.Store.CreateChat(req.Name, userID)
+	keys, err := keysByDevice(req.Keys)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := h.Store.AddParticipant(int(chatID), userID, req.EncryptedKey); err != nil {
+	// The chat only exists once its creator is in it
+	var chatID int64
+	err = h.Store.WithTx(r.Context(), func(tx store.Store) error {
+		var err error
+		if chatID, err = tx.CreateChat(req.Name, userID); err != nil {
+			return err
+		}
+		_, err = tx.AddParticipant(int(chatID), userID, userID, keys)
+		return err
+	})
+	if errors.Is(err, store.ErrKeyRecipientsMismatch) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	h.Hub.Subscribe(userID, int(chatID))
 
 	w.WriteHeader(http.StatusCreated)
 }
 
+// errUserNotFound is returned inside a unit of work for a user who doesn't
+// exist or has been deactivated.
+var errUserNotFound = errors.New("user not found")
+
 func (h *ChatHandler) InviteUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	chatID, _ := strconv.Atoi(vars["id"])
-	// userID, _ := strconv.Atoi(getCookie(r, "user_id")) // Inviter's ID
+	userID := r.Context().Value(middleware.UserIDKey).(int)
 
 	var req struct {
-		Username     string `json:"username"`
-		EncryptedKey string `json:"encrypted_key"`
+		Username string       `json:"username"`
+		Keys     []WrappedKey `json:"keys"` // One for each of the invitee's devices
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	user, err := h.Store.GetUserByUsername(req.Username)
+	keys, err := keysByDevice(req.Keys)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Check if user is already a participant
-	isParticipant, err := h.Store.IsParticipant(chatID, user.ID)
-	if err != nil {
-		http.Error(w, "Failed to check participant status", http.StatusInternalServerError)
+	if _, ok := h.authorize(w, chatID, userID, models.ActionInvite); !ok {
+		return
+	}
+
+	// The invitee is checked and added, and the members to notify read, as
+	// one unit of work
+	var user *models.User
+	var joined *models.Message
+	var participants []models.User
+	err = h.Store.WithTx(r.Context(), func(tx store.Store) error {
+		var err error
+		user, err = tx.GetUserByUsername(req.Username)
+		if err != nil || user.DeactivatedAt != nil {
+			return errUserNotFound
+		}
+		isParticipant, err := tx.IsParticipant(chatID, user.ID)
+		if err != nil {
+			return err
+		}
+		if isParticipant {
+			return store.ErrAlreadyParticipant
+		}
+		if joined, err = tx.AddParticipant(chatID, user.ID, userID, keys); err != nil {
+			return err
+		}
+		participants, err = tx.GetChatParticipants(chatID)
+		return err
+	})
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
-	if isParticipant {
+	if errors.Is(err, store.ErrAlreadyParticipant) {
 		http.Error(w, "User is already a participant in this chat", http.StatusConflict)
 		return
 	}
-
-	if err := h.Store.AddParticipant(chatID, user.ID, req.EncryptedKey); err != nil {
+	if errors.Is(err, store.ErrKeyRecipientsMismatch) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
 		http.Error(w, "Failed to add participant", http.StatusInternalServerError)
 		return
 	}
+	h.Hub.Subscribe(user.ID, chatID)
+	h.Hub.Broadcast(chatID, ws.TypeMessage, joined)
 
 	// Notify all participants in the chat to refresh their participants list
-	participants, err := h.Store.GetChatParticipants(chatID)
-	if err == nil {
-		for _, participant := range participants {
-			h.Hub.SendNotification(participant.ID, map[string]interface{}{
-				"type": "new_chat",
-			})
-		}
+	for _, participant := range participants {
+		h.Hub.SendNotification(participant.ID, ws.TypeNewChat, ws.ChatEvent{ChatID: chatID})
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -104,32 +172,45 @@ func (h *ChatHandler) LeaveChat(w http.ResponseWriter, r *http.Request) {
 	chatID, _ := strconv.Atoi(vars["id"])
 	userID := r.Context().Value(middleware.UserIDKey).(int)
 
-	// Verify user is NOT the owner
-	ownerID, err := h.Store.GetChatOwner(chatID)
+	membership, err := h.Store.GetMembership(chatID, userID)
+	if errors.Is(err, store.ErrNotParticipant) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Chat not found", http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	if ownerID == userID {
-		http.Error(w, "Owners cannot leave chats, delete it instead", http.StatusForbidden)
+	if membership.ChatType == models.ChatTypeDirect {
+		http.Error(w, "Direct chats can't be left, hide them instead", http.StatusBadRequest)
+		return
+	}
+	if !membership.Can(models.ActionLeave) {
+		http.Error(w, "Owners cannot leave chats, transfer or delete it instead", http.StatusForbidden)
+		return
+	}
+	ownerID, err := h.Store.GetChatOwner(chatID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if err := h.Store.RemoveParticipant(chatID, userID); err != nil {
+	left, err := h.Store.RemoveParticipant(chatID, userID, userID)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	h.Hub.Unsubscribe(userID, chatID)
+	h.Hub.Broadcast(chatID, ws.TypeMessage, left)
+
+	// The leaver still holds the chat key, so the owner has to rekey
+	h.Hub.SendNotification(ownerID, ws.TypeRekeyRequired, ws.ChatEvent{ChatID: chatID})
 
 	// Notify remaining participants
 	participants, err := h.Store.GetChatParticipants(chatID)
 	if err == nil {
 		for _, p := range participants {
-			h.Hub.SendNotification(p.ID, map[string]interface{}{
-				"type":    "participant_left",
-				"chat_id": chatID,
-				"user_id": userID,
-			})
+			h.Hub.SendNotification(p.ID, ws.TypeParticipantLeft, ws.ParticipantEvent{ChatID: chatID, UserID: userID})
 		}
 	}
 
@@ -142,83 +223,176 @@ func (h *ChatHandler) RemoveParticipant(w http.ResponseWriter, r *http.Request)
 	targetUserID, _ := strconv.Atoi(vars["userID"])
 	requesterID := r.Context().Value(middleware.UserIDKey).(int)
 
-	// Verify requester is the owner
-	ownerID, err := h.Store.GetChatOwner(chatID)
-	if err != nil {
-		http.Error(w, "Chat not found", http.StatusNotFound)
+	requester, ok := h.authorize(w, chatID, requesterID, models.ActionRemove)
+	if !ok {
 		return
 	}
 
-	if ownerID != requesterID {
-		http.Error(w, "Only the owner can remove participants", http.StatusForbidden)
+	// Cannot remove self (use LeaveChat or DeleteChat instead)
+	if targetUserID == requesterID {
+		http.Error(w, "Cannot remove yourself, leave or delete the chat instead", http.StatusBadRequest)
 		return
 	}
 
-	// Cannot remove self (use DeleteChat instead)
-	if targetUserID == ownerID {
-		http.Error(w, "Cannot remove yourself, delete the chat instead", http.StatusBadRequest)
+	target, err := h.Store.GetMembership(chatID, targetUserID)
+	if errors.Is(err, store.ErrNotParticipant) {
+		http.Error(w, "Participant not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !models.Outranks(requester.Role, target.Role) {
+		http.Error(w, "You can only remove participants below your role", http.StatusForbidden)
+		return
+	}
+	ownerID, err := h.Store.GetChatOwner(chatID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if err := h.Store.RemoveParticipant(chatID, targetUserID); err != nil {
+	removed, err := h.Store.RemoveParticipant(chatID, targetUserID, requesterID)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	h.Hub.Unsubscribe(targetUserID, chatID)
+	h.Hub.Broadcast(chatID, ws.TypeMessage, removed)
 
 	// Notify the removed user
-	h.Hub.SendNotification(targetUserID, map[string]interface{}{
-		"type":    "removed_from_chat",
-		"chat_id": chatID,
-	})
+	h.Hub.SendNotification(targetUserID, ws.TypeRemovedFromChat, ws.ChatEvent{ChatID: chatID})
+
+	// The removed user still holds the chat key, so the owner has to rekey
+	h.Hub.SendNotification(ownerID, ws.TypeRekeyRequired, ws.ChatEvent{ChatID: chatID})
 
 	// Notify remaining participants
 	participants, err := h.Store.GetChatParticipants(chatID)
 	if err == nil {
 		for _, p := range participants {
-			h.Hub.SendNotification(p.ID, map[string]interface{}{
-				"type":    "participant_left",
-				"chat_id": chatID,
-				"user_id": targetUserID,
-			})
+			h.Hub.SendNotification(p.ID, ws.TypeParticipantLeft, ws.ParticipantEvent{ChatID: chatID, UserID: targetUserID})
 		}
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *ChatHandler) DeleteChat(w http.ResponseWriter, r *http.Request) {
+// GetChatKeys returns the chat key wrapped for the caller's device for every
+// epoch since it was given one, so history encrypted under earlier epochs
+// stays readable.
+func (h *ChatHandler) GetChatKeys(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	chatID, _ := strconv.Atoi(vars["id"])
 
 	userID := r.Context().Value(middleware.UserIDKey).(int)
 
-	// Verify user is the owner
-	ownerID, err := h.Store.GetChatOwner(chatID)
+	isParticipant, err := h.Store.IsParticipant(chatID, userID)
+	if err != nil || !isParticipant {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	deviceID := r.Context().Value(middleware.DeviceIDKey).(int)
+	keys, err := h.Store.GetChatKeys(chatID, deviceID)
 	if err != nil {
-		http.Error(w, "Chat not found", http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []models.ChatKey{}
+	}
+
+	json.NewEncoder(w).Encode(keys)
+}
+
+// RotateChatKey starts a new key epoch. The owner's client generates a fresh
+// chat key and uploads it wrapped for each remaining member; from then on
+// messages encrypted under the old key are refused.
+func (h *ChatHandler) RotateChatKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	var req struct {
+		Epoch int          `json:"epoch"`
+		Keys  []WrappedKey `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if ownerID != userID {
-		http.Error(w, "Only the chat owner can delete this chat", http.StatusForbidden)
+	// The owner rekeys a group chat; either member can rekey a direct chat
+	if _, ok := h.authorize(w, chatID, userID, models.ActionRekey); !ok {
 		return
 	}
 
-	// Get participants before deleting to notify them
-	participants, _ := h.Store.GetChatParticipants(chatID)
+	keys, err := keysByDevice(req.Keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Delete the chat
-	if err := h.Store.DeleteChat(chatID); err != nil {
+	err = h.Store.RotateChatKey(chatID, req.Epoch, keys)
+	if errors.Is(err, store.ErrStaleKeyEpoch) {
+		http.Error(w, "Epoch must directly follow the chat's current key epoch", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, store.ErrKeyRecipientsMismatch) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	participants, err := h.Store.GetChatParticipants(chatID)
+	if err == nil {
+		for _, p := range participants {
+			h.Hub.SendNotification(p.ID, ws.TypeKeyRotated, ws.KeyRotatedEvent{ChatID: chatID, KeyEpoch: req.Epoch})
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *ChatHandler) DeleteChat(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	if _, ok := h.authorize(w, chatID, userID, models.ActionDelete); !ok {
+		return
+	}
+
+	// Get participants and attachments as they are deleted, to notify and
+	// clean up exactly what went with the chat
+	var participants []models.User
+	var attachments []models.Attachment
+	err := h.Store.WithTx(r.Context(), func(tx store.Store) error {
+		var err error
+		if participants, err = tx.GetChatParticipants(chatID); err != nil {
+			return err
+		}
+		if attachments, err = tx.GetChatAttachments(chatID); err != nil {
+			return err
+		}
+		return tx.DeleteChat(chatID)
+	})
+	if err != nil {
 		http.Error(w, "Failed to delete chat", http.StatusInternalServerError)
 		return
 	}
+	h.discardBlobs(attachments)
+	h.Hub.DropChat(chatID)
 
 	// Notify all participants to refresh their chat list
 	for _, participant := range participants {
-		h.Hub.SendNotification(participant.ID, map[string]interface{}{
-			"type":    "chat_deleted",
-			"chat_id": chatID,
-		})
+		h.Hub.SendNotification(participant.ID, ws.TypeChatDeleted, ws.ChatEvent{ChatID: chatID})
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -227,7 +401,9 @@ func (h *ChatHandler) DeleteChat(w http.ResponseWriter, r *http.Request) {
 func (h *ChatHandler) GetChats(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(middleware.UserIDKey).(int)
 
-	chats, err := h.Store.GetUserChats(userID)
+	deviceID := r.Context().Value(middleware.DeviceIDKey).(int)
+
+	chats, err := h.Store.GetUserChats(userID, deviceID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -248,13 +424,83 @@ func (h *ChatHandler) GetChatMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	messages, err := h.Store.GetChatMessages(chatID)
+	opts, err := parsePageOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.writeMessagePage(w, chatID, opts)
+}
+
+// writeMessagePage responds with a page of a chat's history and the cursors
+// to the pages either side of it.
+func (h *ChatHandler) writeMessagePage(w http.ResponseWriter, chatID int, opts store.PageOptions) {
+	messages, hasMore, err := h.Store.GetChatMessagesPage(chatID, opts)
+	if errors.Is(err, store.ErrInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(messages)
+	page := models.MessagePage{Messages: messages}
+	if page.Messages == nil {
+		page.Messages = []models.Message{}
+	}
+	if len(messages) > 0 {
+		oldest, newest := messages[0].ID, messages[len(messages)-1].ID
+		if opts.After > 0 {
+			// Paging forward: older messages always exist behind the anchor.
+			page.Next = store.EncodeCursor(oldest)
+			if hasMore {
+				page.Prev = store.EncodeCursor(newest)
+			}
+		} else {
+			if hasMore {
+				page.Next = store.EncodeCursor(oldest)
+			}
+			if opts.Before > 0 {
+				page.Prev = store.EncodeCursor(newest)
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(page)
+}
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// parsePageOptions reads the before, after and limit query parameters.
+func parsePageOptions(r *http.Request) (store.PageOptions, error) {
+	opts := store.PageOptions{Limit: defaultPageSize}
+	q := r.URL.Query()
+
+	if limitStr := q.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return opts, errors.New("invalid limit")
+		}
+		opts.Limit = min(limit, maxPageSize)
+	}
+
+	var err error
+	if before := q.Get("before"); before != "" {
+		if opts.Before, err = store.DecodeCursor(before); err != nil {
+			return opts, err
+		}
+	}
+	if after := q.Get("after"); after != "" {
+		if opts.After, err = store.DecodeCursor(after); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
 }
 
 func (h *ChatHandler) GetChatParticipants(w http.ResponseWriter, r *http.Request) {
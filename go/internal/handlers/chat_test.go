@@ -2,16 +2,18 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/pliu/chatty/internal/auth"
-	"github.com/pliu/chatty/internal/middleware"
 	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
 	"github.com/pliu/chatty/internal/store/sqlstore"
 	"github.com/pliu/chatty/internal/ws"
 )
@@ -21,17 +23,24 @@ func TestCreateChat(t *testing.T) {
 	store.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
 	user, _ := store.GetUserByUsername("user1")
 
-	handler := &ChatHandler{Store: store}
+	hub := ws.NewHub(store)
+	go hub.Run()
+
+	handler := &ChatHandler{Store: store, Hub: hub}
 
-	reqBody := map[string]string{"name": "Test Chat", "encrypted_key": "mock_key"}
+	deviceID := accountDevice(t, store, user.ID)
+	reqBody := map[string]interface{}{
+		"name": "Test Chat",
+		"keys": []WrappedKey{{DeviceID: deviceID, EncryptedKey: "mock_key"}},
+	}
 	body, _ := json.Marshal(reqBody)
 
 	req, _ := http.NewRequest("POST", "/chats", bytes.NewBuffer(body))
 	// Simulate logged-in user
-	req.AddCookie(&http.Cookie{Name: "user_id", Value: auth.SignCookie(strconv.Itoa(user.ID))})
+	authenticated := login(t, store, user.ID, req)
 
 	rr := httptest.NewRecorder()
-	middleware.AuthMiddleware(http.HandlerFunc(handler.CreateChat)).ServeHTTP(rr, req)
+	authenticated(http.HandlerFunc(handler.CreateChat)).ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusCreated {
 		t.Errorf("handler returned wrong status code: got %v want %v",
@@ -39,13 +48,154 @@ func TestCreateChat(t *testing.T) {
 	}
 
 	// Verify chat was created
-	chats, _ := store.GetUserChats(user.ID)
+	chats, _ := store.GetUserChats(user.ID, deviceID)
 	if len(chats) != 1 {
 		t.Errorf("Expected 1 chat, got %d", len(chats))
 	}
 	if chats[0].Name != "Test Chat" {
 		t.Errorf("Expected chat name 'Test Chat', got '%s'", chats[0].Name)
 	}
+	if chats[0].EncryptedKey != "mock_key" {
+		t.Errorf("Expected the key wrapped for the creator's device, got '%s'", chats[0].EncryptedKey)
+	}
+}
+
+func TestCreateChatRollsBack(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	user, _ := store.GetUserByUsername("user1")
+
+	hub := ws.NewHub(store)
+	go hub.Run()
+
+	// Adding the creator goes through, but the request fails before commit
+	handler := &ChatHandler{Store: &faultyStore{Store: store, fail: "AddParticipant"}, Hub: hub}
+
+	deviceID := accountDevice(t, store, user.ID)
+	body, _ := json.Marshal(map[string]interface{}{
+		"name": "Test Chat",
+		"keys": []WrappedKey{{DeviceID: deviceID, EncryptedKey: "mock_key"}},
+	})
+	req, _ := http.NewRequest("POST", "/chats", bytes.NewBuffer(body))
+	authenticated := login(t, store, user.ID, req)
+	rr := httptest.NewRecorder()
+	authenticated(http.HandlerFunc(handler.CreateChat)).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when adding the creator fails, got %v", rr.Code)
+	}
+	if chats, _ := store.GetUserChats(user.ID, deviceID); len(chats) != 0 {
+		t.Errorf("Expected the chat to be rolled back, got %+v", chats)
+	}
+	if chat, err := store.GetChat(1); err == nil {
+		t.Errorf("Expected no ownerless chat to be left behind, got %+v", chat)
+	}
+}
+
+func TestDeleteChatRollsBack(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "owner", Email: "owner@example.com", Password: "pass"})
+	owner, _ := store.GetUserByUsername("owner")
+	chatID, _ := store.CreateChat("Chat", owner.ID)
+	store.AddParticipant(int(chatID), owner.ID, owner.ID, map[int]string{accountDevice(t, store, owner.ID): "key"})
+	store.SaveMessage(int(chatID), owner.ID, 1, 0, "hello", "", nil)
+
+	hub := ws.NewHub(store)
+	go hub.Run()
+
+	handler := &ChatHandler{Store: &faultyStore{Store: store, fail: "DeleteChat"}, Hub: hub}
+
+	req, _ := http.NewRequest("DELETE", "/chats/"+strconv.Itoa(int(chatID)), nil)
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(int(chatID))})
+	authenticated := login(t, store, owner.ID, req)
+	rr := httptest.NewRecorder()
+	authenticated(http.HandlerFunc(handler.DeleteChat)).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when deleting fails, got %v", rr.Code)
+	}
+	if _, err := store.GetChat(int(chatID)); err != nil {
+		t.Errorf("Expected the chat to survive, got %v", err)
+	}
+	if participants, _ := store.GetChatParticipants(int(chatID)); len(participants) != 1 {
+		t.Errorf("Expected the owner to stay in the chat, got %+v", participants)
+	}
+	if messages, _ := store.GetChatMessages(int(chatID)); len(messages) == 0 {
+		t.Error("Expected the chat history to survive")
+	}
+}
+
+var errInjected = errors.New("injected fault")
+
+// faultyStore fails the named operation after it has run, as if the request
+// died before its unit of work could commit.
+type faultyStore struct {
+	store.Store
+	fail string
+}
+
+func (s *faultyStore) WithTx(ctx context.Context, fn func(store.Store) error) error {
+	return s.Store.WithTx(ctx, func(tx store.Store) error {
+		return fn(&faultyStore{Store: tx, fail: s.fail})
+	})
+}
+
+func (s *faultyStore) AddParticipant(chatID, userID, addedBy int, keys map[int]string) (*models.Message, error) {
+	msg, err := s.Store.AddParticipant(chatID, userID, addedBy, keys)
+	if err == nil && s.fail == "AddParticipant" {
+		return nil, errInjected
+	}
+	return msg, err
+}
+
+func (s *faultyStore) DeleteChat(chatID int) error {
+	err := s.Store.DeleteChat(chatID)
+	if err == nil && s.fail == "DeleteChat" {
+		return errInjected
+	}
+	return err
+}
+
+func (s *faultyStore) DeleteDevice(id int) ([]int, error) {
+	chatIDs, err := s.Store.DeleteDevice(id)
+	if err == nil && s.fail == "DeleteDevice" {
+		return nil, errInjected
+	}
+	return chatIDs, err
+}
+
+func (s *faultyStore) DeactivateUser(userID int, now time.Time) ([]models.AuditEntry, error) {
+	entries, err := s.Store.DeactivateUser(userID, now)
+	if err == nil && s.fail == "DeactivateUser" {
+		return nil, errInjected
+	}
+	return entries, err
+}
+
+func (s *faultyStore) SetSessionDevice(id string, deviceID int) error {
+	err := s.Store.SetSessionDevice(id, deviceID)
+	if err == nil && s.fail == "SetSessionDevice" {
+		return errInjected
+	}
+	return err
+}
+
+func (s *faultyStore) UpdateUserCredentials(userID int, password, publicKey, encryptedPrivateKey string) ([]int, error) {
+	chatIDs, err := s.Store.UpdateUserCredentials(userID, password, publicKey, encryptedPrivateKey)
+	if err == nil && s.fail == "UpdateUserCredentials" {
+		return nil, errInjected
+	}
+	return chatIDs, err
+}
+
+// accountDevice returns the ID of a user's account device.
+func accountDevice(t *testing.T, store *sqlstore.SQLStore, userID int) int {
+	t.Helper()
+	device, err := store.GetAccountDevice(userID)
+	if err != nil {
+		t.Fatalf("Failed to get account device: %v", err)
+	}
+	return device.ID
 }
 
 func TestInviteUser(t *testing.T) {
@@ -55,7 +205,8 @@ func TestInviteUser(t *testing.T) {
 
 	chatID, _ := store.CreateChat("Test Chat", 1)
 	owner, _ := store.GetUserByUsername("owner")
-	store.AddParticipant(int(chatID), owner.ID, "key")
+	store.AddParticipant(int(chatID), owner.ID, owner.ID, map[int]string{accountDevice(t, store, owner.ID): "key"})
+	invitee, _ := store.GetUserByUsername("invitee")
 
 	// Mock Hub (or use real one, it's safe for tests if we don't attach clients)
 	hub := ws.NewHub(store)
@@ -63,27 +214,52 @@ func TestInviteUser(t *testing.T) {
 
 	handler := &ChatHandler{Store: store, Hub: hub}
 
-	reqBody := map[string]string{"username": "invitee", "encrypted_key": "mock_key_invitee"}
-	body, _ := json.Marshal(reqBody)
+	phone := &models.Device{UserID: invitee.ID, Name: "Phone", PublicKey: "phone"}
+	store.CreateDevice(phone)
 
-	req, _ := http.NewRequest("POST", "/chats/"+strconv.Itoa(int(chatID))+"/invite", bytes.NewBuffer(body))
-	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(int(chatID))})
-	req.AddCookie(&http.Cookie{Name: "user_id", Value: auth.SignCookie(strconv.Itoa(owner.ID))})
+	inviteWith := func(h *ChatHandler, username string, keys []WrappedKey) int {
+		body, _ := json.Marshal(map[string]interface{}{"username": username, "keys": keys})
+		req, _ := http.NewRequest("POST", "/chats/"+strconv.Itoa(int(chatID))+"/invite", bytes.NewBuffer(body))
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(int(chatID))})
+		authenticated := login(t, store, owner.ID, req)
+		rr := httptest.NewRecorder()
+		authenticated(http.HandlerFunc(h.InviteUser)).ServeHTTP(rr, req)
+		return rr.Code
+	}
+	invite := func(keys []WrappedKey) int { return inviteWith(handler, "invitee", keys) }
 
-	rr := httptest.NewRecorder()
-	middleware.AuthMiddleware(http.HandlerFunc(handler.InviteUser)).ServeHTTP(rr, req)
+	// The key has to be wrapped for each of the invitee's devices
+	accountKey := WrappedKey{DeviceID: accountDevice(t, store, invitee.ID), EncryptedKey: "mock_key_invitee"}
+	keys := []WrappedKey{accountKey, {DeviceID: phone.ID, EncryptedKey: "mock_key_phone"}}
+	if status := invite([]WrappedKey{accountKey}); status != http.StatusConflict {
+		t.Errorf("Expected 409 when a device is missing, got %v", status)
+	}
+	if status := inviteWith(handler, "nobody", keys); status != http.StatusNotFound {
+		t.Errorf("Expected 404 inviting an unknown user, got %v", status)
+	}
 
-	if status := rr.Code; status != http.StatusOK {
+	// An invite that fails after adding the invitee leaves them out
+	faulty := &ChatHandler{Store: &faultyStore{Store: store, fail: "AddParticipant"}, Hub: hub}
+	if status := inviteWith(faulty, "invitee", keys); status != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when adding the participant fails, got %v", status)
+	}
+	if isParticipant, _ := store.IsParticipant(int(chatID), invitee.ID); isParticipant {
+		t.Error("Expected the failed invite to be rolled back")
+	}
+
+	if status := invite(keys); status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %v want %v",
 			status, http.StatusOK)
 	}
 
 	// Verify invitee is now a participant
-	invitee, _ := store.GetUserByUsername("invitee")
 	isParticipant, _ := store.IsParticipant(int(chatID), invitee.ID)
 	if !isParticipant {
 		t.Error("Expected invitee to be a participant")
 	}
+	if status := invite(keys); status != http.StatusConflict {
+		t.Errorf("Expected 409 inviting a participant again, got %v", status)
+	}
 }
 
 func TestGetChats(t *testing.T) {
@@ -94,18 +270,18 @@ func TestGetChats(t *testing.T) {
 	_, _ = store.CreateChat("Chat 1", 1)
 	_, _ = store.CreateChat("Chat 2", 1)
 	// Add user to Chat 1 only
-	store.GetUserChats(user.ID) // Should be 0 initially
+	store.GetUserChats(user.ID, 0) // Should be 0 initially
 
 	chatID, _ := store.CreateChat("My Chat", 1)
-	store.AddParticipant(int(chatID), user.ID, "key")
+	store.AddParticipant(int(chatID), user.ID, user.ID, map[int]string{accountDevice(t, store, user.ID): "key"})
 
 	handler := &ChatHandler{Store: store}
 
 	req, _ := http.NewRequest("GET", "/chats", nil)
-	req.AddCookie(&http.Cookie{Name: "user_id", Value: auth.SignCookie(strconv.Itoa(user.ID))})
+	authenticated := login(t, store, user.ID, req)
 
 	rr := httptest.NewRecorder()
-	middleware.AuthMiddleware(http.HandlerFunc(handler.GetChats)).ServeHTTP(rr, req)
+	authenticated(http.HandlerFunc(handler.GetChats)).ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %v want %v",
@@ -119,3 +295,125 @@ func TestGetChats(t *testing.T) {
 		t.Errorf("Expected 1 chat, got %d", len(responseChats))
 	}
 }
+
+func TestGetChatMessagesPagination(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	user, _ := store.GetUserByUsername("user1")
+	chatID, _ := store.CreateChat("Chat", user.ID)
+	store.AddParticipant(int(chatID), user.ID, user.ID, map[int]string{accountDevice(t, store, user.ID): "key"})
+	for i := 0; i < 5; i++ {
+		store.SaveMessage(int(chatID), user.ID, 1, 0, "msg", "", nil)
+	}
+
+	handler := &ChatHandler{Store: store}
+
+	fetch := func(query string) (int, models.MessagePage) {
+		req, _ := http.NewRequest("GET", "/chats/"+strconv.Itoa(int(chatID))+"/messages?"+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(int(chatID))})
+		authenticated := login(t, store, user.ID, req)
+		rr := httptest.NewRecorder()
+		authenticated(http.HandlerFunc(handler.GetChatMessages)).ServeHTTP(rr, req)
+
+		var page models.MessagePage
+		json.NewDecoder(rr.Body).Decode(&page)
+		return rr.Code, page
+	}
+
+	status, page := fetch("limit=3")
+	if status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if len(page.Messages) != 3 || page.Next == "" || page.Prev != "" {
+		t.Fatalf("Expected 3 messages with only a next cursor, got %d next=%q prev=%q", len(page.Messages), page.Next, page.Prev)
+	}
+
+	// The rest of the messages, after the creator joining
+	_, older := fetch("limit=3&before=" + page.Next)
+	if len(older.Messages) != 3 || older.Next != "" || older.Prev == "" {
+		t.Fatalf("Expected 3 messages with only a prev cursor, got %d next=%q prev=%q", len(older.Messages), older.Next, older.Prev)
+	}
+	if older.Messages[0].Kind != models.MessageKindSystem || older.Messages[0].Event.Type != models.EventMemberJoined {
+		t.Errorf("Expected the history to start with the creator joining, got %+v", older.Messages[0])
+	}
+	if older.Messages[1].ID >= page.Messages[0].ID {
+		t.Error("Expected older page to end before the first page starts")
+	}
+
+	if status, _ := fetch("before=garbage"); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid cursor, got %v", status)
+	}
+
+	// Cursors anchored outside the chat are rejected rather than read as the end
+	otherID, _ := store.CreateChat("Other", user.ID)
+	store.AddParticipant(int(otherID), user.ID, user.ID, map[int]string{accountDevice(t, store, user.ID): "key"})
+	elsewhere, _, _ := store.SaveMessage(int(otherID), user.ID, 1, 0, "elsewhere", "", nil)
+	if status, _ := fetch("before=" + cursorAt(elsewhere.ID)); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a cursor from another chat, got %v", status)
+	}
+	if status, _ := fetch("after=" + cursorAt(elsewhere.ID+100)); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a cursor at a missing message, got %v", status)
+	}
+}
+
+// cursorAt is store.EncodeCursor for tests whose store variable shadows the
+// package.
+func cursorAt(messageID int) string {
+	return store.EncodeCursor(messageID)
+}
+
+func TestRotateChatKey(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "owner", Email: "owner@example.com", Password: "pass"})
+	store.CreateUser(&models.User{Username: "member", Email: "member@example.com", Password: "pass"})
+	owner, _ := store.GetUserByUsername("owner")
+	member, _ := store.GetUserByUsername("member")
+
+	chatID, _ := store.CreateChat("Chat", owner.ID)
+	ownerDevice, memberDevice := accountDevice(t, store, owner.ID), accountDevice(t, store, member.ID)
+	store.AddParticipant(int(chatID), owner.ID, owner.ID, map[int]string{ownerDevice: "owner-1"})
+	store.AddParticipant(int(chatID), member.ID, member.ID, map[int]string{memberDevice: "member-1"})
+
+	hub := ws.NewHub(store)
+	go hub.Run()
+
+	handler := &ChatHandler{Store: store, Hub: hub}
+
+	rotate := func(userID, epoch int) int {
+		body, _ := json.Marshal(map[string]interface{}{
+			"epoch": epoch,
+			"keys": []WrappedKey{
+				{DeviceID: ownerDevice, EncryptedKey: "owner-2"},
+				{DeviceID: memberDevice, EncryptedKey: "member-2"},
+			},
+		})
+		req, _ := http.NewRequest("POST", "/chats/"+strconv.Itoa(int(chatID))+"/keys", bytes.NewBuffer(body))
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(int(chatID))})
+		authenticated := login(t, store, userID, req)
+		rr := httptest.NewRecorder()
+		authenticated(http.HandlerFunc(handler.RotateChatKey)).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if status := rotate(member.ID, 2); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for non-owner rekey, got %v", status)
+	}
+	if status := rotate(owner.ID, 2); status != http.StatusOK {
+		t.Errorf("Expected 200 for owner rekey, got %v", status)
+	}
+	if status := rotate(owner.ID, 2); status != http.StatusConflict {
+		t.Errorf("Expected 409 for a repeated epoch, got %v", status)
+	}
+
+	req, _ := http.NewRequest("GET", "/chats/"+strconv.Itoa(int(chatID))+"/keys", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(int(chatID))})
+	authenticated := login(t, store, member.ID, req)
+	rr := httptest.NewRecorder()
+	authenticated(http.HandlerFunc(handler.GetChatKeys)).ServeHTTP(rr, req)
+
+	var keys []models.ChatKey
+	json.NewDecoder(rr.Body).Decode(&keys)
+	if len(keys) != 2 || keys[1].Epoch != 2 || keys[1].EncryptedKey != "member-2" {
+		t.Errorf("Expected member's keys for epochs 1 and 2, got %+v", keys)
+	}
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/auth"
+	"github.com/pliu/chatty/internal/middleware"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+var (
+	errDeviceNotFound = errors.New("device not found")
+	errAccountDevice  = errors.New("account device can't be revoked")
+)
+
+// DeviceHandler manages the devices a user's chat keys are wrapped for.
+type DeviceHandler struct {
+	Store    store.Store
+	Sessions *auth.SessionManager
+	Hub      *ws.Hub
+}
+
+// RegisterDevice adds a device with a keypair generated on it and switches
+// the calling session over to it. The new device holds no chat keys until
+// one of the user's other devices wraps them for it.
+func (h *DeviceHandler) RegisterDevice(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+	sessionID := r.Context().Value(middleware.SessionIDKey).(string)
+
+	var req struct {
+		Name      string `json:"name"`
+		PublicKey string `json:"public_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || req.PublicKey == "" {
+		http.Error(w, "Name and public key are required", http.StatusBadRequest)
+		return
+	}
+
+	// A device no session acts as would be stranded without its keys
+	device := &models.Device{UserID: userID, Name: req.Name, PublicKey: req.PublicKey}
+	err := h.Store.WithTx(r.Context(), func(tx store.Store) error {
+		if err := tx.CreateDevice(device); err != nil {
+			return err
+		}
+		return tx.SetSessionDevice(sessionID, device.ID)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	device.Current = true
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(device)
+}
+
+// GetDevices lists the caller's devices, marking the one this session acts as.
+func (h *DeviceHandler) GetDevices(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+	deviceID := r.Context().Value(middleware.DeviceIDKey).(int)
+
+	devices, err := h.Store.GetUserDevices(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range devices {
+		devices[i].Current = devices[i].ID == deviceID
+	}
+	if devices == nil {
+		devices = []models.Device{}
+	}
+
+	json.NewEncoder(w).Encode(devices)
+}
+
+// RevokeDevice deletes one of the caller's devices, ends its sessions and
+// drops its chat keys. It can still unwrap the current key of its chats, so
+// their owners are asked to rekey.
+func (h *DeviceHandler) RevokeDevice(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+	deviceID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var sessions []models.Session
+	var owners map[int]int
+	err := h.Store.WithTx(r.Context(), func(tx store.Store) error {
+		device, err := tx.GetDevice(deviceID)
+		if err != nil || device.UserID != userID {
+			// Don't reveal whether someone else's device exists
+			return errDeviceNotFound
+		}
+		if device.IsAccount {
+			return errAccountDevice
+		}
+		if sessions, err = deviceSessions(tx, userID, deviceID); err != nil {
+			return err
+		}
+		chatIDs, err := tx.DeleteDevice(deviceID)
+		if err != nil {
+			return err
+		}
+		owners, err = rekeyOwners(tx, chatIDs)
+		return err
+	})
+	if errors.Is(err, errDeviceNotFound) {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errAccountDevice) {
+		http.Error(w, "The account key can't be revoked; reset your password to replace it", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.Sessions.Revoked(sessions)
+	notifyRekeyRequired(h.Hub, owners)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// deviceSessions returns the sessions of a user acting as one of their devices.
+func deviceSessions(s store.Store, userID, deviceID int) ([]models.Session, error) {
+	sessions, err := s.GetUserSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	var onDevice []models.Session
+	for _, session := range sessions {
+		if session.DeviceID == deviceID {
+			onDevice = append(onDevice, session)
+		}
+	}
+	return onDevice, nil
+}
+
+// rekeyOwners maps each chat flagged for a rekey to its owner.
+func rekeyOwners(s store.Store, chatIDs []int) (map[int]int, error) {
+	owners := make(map[int]int, len(chatIDs))
+	for _, chatID := range chatIDs {
+		ownerID, err := s.GetChatOwner(chatID)
+		if err != nil {
+			return nil, err
+		}
+		owners[chatID] = ownerID
+	}
+	return owners, nil
+}
+
+// notifyRekeyRequired asks the owners of chats whose current key a dropped
+// device could unwrap to rekey them.
+func notifyRekeyRequired(hub *ws.Hub, owners map[int]int) {
+	for chatID, ownerID := range owners {
+		hub.SendNotification(ownerID, ws.TypeRekeyRequired, ws.ChatEvent{ChatID: chatID})
+	}
+}
+
+// AddDeviceKeys uploads chat keys wrapped for one of the caller's devices,
+// typically by another device of theirs that already holds them.
+func (h *DeviceHandler) AddDeviceKeys(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+	deviceID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var req struct {
+		Keys []models.ChatKey `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, k := range req.Keys {
+		if k.EncryptedKey == "" {
+			http.Error(w, "Every key must be non-empty", http.StatusBadRequest)
+			return
+		}
+	}
+
+	device, err := h.Store.GetDevice(deviceID)
+	if err != nil || device.UserID != userID {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.Store.AddDeviceChatKeys(deviceID, req.Keys); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/auth"
+	"github.com/pliu/chatty/internal/middleware"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store/sqlstore"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+func TestDevices(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	store.CreateUser(&models.User{Username: "owner", Email: "owner@example.com", Password: "pass"})
+	user, _ := store.GetUserByUsername("user1")
+	owner, _ := store.GetUserByUsername("owner")
+
+	chatID, _ := store.CreateChat("Chat", owner.ID)
+	store.AddParticipant(int(chatID), owner.ID, owner.ID, map[int]string{accountDevice(t, store, owner.ID): "owner-1"})
+	store.AddParticipant(int(chatID), user.ID, user.ID, map[int]string{accountDevice(t, store, user.ID): "user-1"})
+
+	hub := ws.NewHub(store)
+	go hub.Run()
+
+	sessions := auth.NewSessionManager(store)
+	var revoked []string
+	sessions.OnRevoke(func(id string) { revoked = append(revoked, id) })
+	handler := &DeviceHandler{Store: store, Sessions: sessions, Hub: hub}
+	authenticated := middleware.NewAuthMiddleware(sessions)
+
+	desktop, _ := sessions.Create(user.ID, httptest.NewRequest("POST", "/login", nil))
+	phoneSession, _ := sessions.Create(user.ID, httptest.NewRequest("POST", "/login", nil))
+
+	do := func(session *models.Session, method, path string, body interface{}, vars map[string]string, h http.HandlerFunc) *httptest.ResponseRecorder {
+		raw, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(raw))
+		req = mux.SetURLVars(req, vars)
+		req.AddCookie(sessions.Cookie(session))
+		rr := httptest.NewRecorder()
+		authenticated(h).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Registering a device switches the session over to it
+	rr := do(phoneSession, "POST", "/devices", map[string]string{"name": "Phone", "public_key": "phone-key"}, nil, handler.RegisterDevice)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 registering a device, got %v: %s", rr.Code, rr.Body)
+	}
+	var phone models.Device
+	json.NewDecoder(rr.Body).Decode(&phone)
+
+	// A device no session switched to is rolled back
+	faulty := &DeviceHandler{Store: &faultyStore{Store: store, fail: "SetSessionDevice"}, Sessions: sessions, Hub: hub}
+	if rr := do(desktop, "POST", "/devices", map[string]string{"name": "Tablet", "public_key": "tablet-key"}, nil, faulty.RegisterDevice); rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when switching the session fails, got %v", rr.Code)
+	}
+	if devices, _ := store.GetUserDevices(user.ID); len(devices) != 2 {
+		t.Errorf("Expected only the account key and the phone, got %+v", devices)
+	}
+	if session, _ := store.GetSession(phoneSession.ID); session.DeviceID != phone.ID {
+		t.Errorf("Expected session to act as the new device, got device %d", session.DeviceID)
+	}
+
+	rr = do(phoneSession, "GET", "/devices", nil, nil, handler.GetDevices)
+	var listed []models.Device
+	json.NewDecoder(rr.Body).Decode(&listed)
+	if len(listed) != 2 || !listed[0].IsAccount || listed[0].Current || !listed[1].Current {
+		t.Errorf("Expected account device and current phone, got %+v", listed)
+	}
+
+	// Another of the user's devices uploads the phone's chat keys
+	id := strconv.Itoa(phone.ID)
+	keys := map[string]interface{}{"keys": []models.ChatKey{{ChatID: int(chatID), Epoch: 1, EncryptedKey: "phone-1"}}}
+	if rr := do(desktop, "PUT", "/devices/"+id+"/keys", keys, map[string]string{"id": id}, handler.AddDeviceKeys); rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 uploading device keys, got %v: %s", rr.Code, rr.Body)
+	}
+	if chats, _ := store.GetUserChats(user.ID, phone.ID); len(chats) != 1 || chats[0].EncryptedKey != "phone-1" {
+		t.Errorf("Expected the phone to hold the chat key, got %+v", chats)
+	}
+
+	accountID := strconv.Itoa(accountDevice(t, store, user.ID))
+	if rr := do(desktop, "DELETE", "/devices/"+accountID, nil, map[string]string{"id": accountID}, handler.RevokeDevice); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 revoking the account device, got %v", rr.Code)
+	}
+	ownerAccountID := strconv.Itoa(accountDevice(t, store, owner.ID))
+	if rr := do(desktop, "DELETE", "/devices/"+ownerAccountID, nil, map[string]string{"id": ownerAccountID}, handler.RevokeDevice); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 revoking another user's device, got %v", rr.Code)
+	}
+
+	// A revocation that fails to delete the device leaves it and its sessions alone
+	faultyRevoke := &DeviceHandler{Store: &faultyStore{Store: store, fail: "DeleteDevice"}, Sessions: sessions, Hub: hub}
+	if rr := do(desktop, "DELETE", "/devices/"+id, nil, map[string]string{"id": id}, faultyRevoke.RevokeDevice); rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when deleting the device fails, got %v", rr.Code)
+	}
+	if _, err := store.GetDevice(phone.ID); err != nil {
+		t.Errorf("Expected the phone to survive, got %v", err)
+	}
+	if _, err := store.GetSession(phoneSession.ID); err != nil || len(revoked) != 0 {
+		t.Errorf("Expected the phone's session to survive, got %v (revoked %v)", err, revoked)
+	}
+
+	// Revoking the phone ends its sessions and asks for a rekey
+	if rr := do(desktop, "DELETE", "/devices/"+id, nil, map[string]string{"id": id}, handler.RevokeDevice); rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 revoking the phone, got %v: %s", rr.Code, rr.Body)
+	}
+	if len(revoked) != 1 || revoked[0] != phoneSession.ID {
+		t.Errorf("Expected only the phone's session to be revoked, got %v", revoked)
+	}
+	if _, err := store.GetSession(desktop.ID); err != nil {
+		t.Error("Expected the desktop session to survive")
+	}
+	if chats, _ := store.GetUserChats(owner.ID, 0); !chats[0].RekeyNeeded {
+		t.Error("Expected the chat to need a rekey")
+	}
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/middleware"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+// OpenDirectChat returns the caller's direct chat with another user,
+// creating it if needed. Keys are only used when creating it, and must
+// then cover both users' devices; clients can first try without keys to
+// find an existing chat.
+func (h *ChatHandler) OpenDirectChat(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	var req struct {
+		Username string       `json:"username"`
+		Keys     []WrappedKey `json:"keys"` // One for each of both users' devices
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keys, err := keysByDevice(req.Keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	peer, err := h.Store.GetUserByUsername(req.Username)
+	if err != nil || peer.DeactivatedAt != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if peer.ID == userID {
+		http.Error(w, "Cannot open a direct chat with yourself", http.StatusBadRequest)
+		return
+	}
+
+	chatID, created, err := h.Store.GetOrCreateDirectChat(userID, peer.ID, keys)
+	if errors.Is(err, store.ErrKeyRecipientsMismatch) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		for _, id := range []int{userID, peer.ID} {
+			h.Hub.Subscribe(id, chatID)
+			h.Hub.SendNotification(id, ws.TypeNewChat, ws.ChatEvent{ChatID: chatID})
+		}
+	}
+
+	chat, err := h.Store.GetChat(chatID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	chat.Name = peer.Username
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(chat)
+}
+
+// HideChat removes a direct chat from the caller's chat list until it gets
+// a new message. The other member keeps it.
+func (h *ChatHandler) HideChat(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	isParticipant, err := h.Store.IsParticipant(chatID, userID)
+	if err != nil || !isParticipant {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	chat, err := h.Store.GetChat(chatID)
+	if err != nil {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+	if chat.Type != models.ChatTypeDirect {
+		http.Error(w, "Only direct chats can be hidden", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Store.SetChatHidden(chatID, userID, true); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The caller's other devices drop it from their lists too
+	h.Hub.SendNotification(userID, ws.TypeChatHidden, ws.ChatEvent{ChatID: chatID})
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store/sqlstore"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+func TestDirectChats(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	for _, name := range []string{"alice", "bob", "carol"} {
+		store.CreateUser(&models.User{Username: name, Email: name + "@example.com", Password: "pass"})
+	}
+	alice, _ := store.GetUserByUsername("alice")
+	bob, _ := store.GetUserByUsername("bob")
+	carol, _ := store.GetUserByUsername("carol")
+
+	hub := ws.NewHub(store)
+	go hub.Run()
+
+	handler := &ChatHandler{Store: store, Hub: hub}
+
+	do := func(userID int, method, path string, body interface{}, vars map[string]string, h http.HandlerFunc) *httptest.ResponseRecorder {
+		raw, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(raw))
+		req = mux.SetURLVars(req, vars)
+		authenticated := login(t, store, userID, req)
+		rr := httptest.NewRecorder()
+		authenticated(h).ServeHTTP(rr, req)
+		return rr
+	}
+	open := func(userID int, username string, keys []WrappedKey) *httptest.ResponseRecorder {
+		return do(userID, "POST", "/dms", map[string]interface{}{"username": username, "keys": keys}, nil, handler.OpenDirectChat)
+	}
+
+	if rr := open(alice.ID, "alice", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a chat with yourself, got %v", rr.Code)
+	}
+	if rr := open(alice.ID, "bob", nil); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 creating a chat without keys, got %v", rr.Code)
+	}
+	keys := []WrappedKey{
+		{DeviceID: accountDevice(t, store, alice.ID), EncryptedKey: "alice-key"},
+		{DeviceID: accountDevice(t, store, bob.ID), EncryptedKey: "bob-key"},
+	}
+	rr := open(alice.ID, "bob", keys)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 creating a direct chat, got %v: %s", rr.Code, rr.Body)
+	}
+	var chat models.Chat
+	json.NewDecoder(rr.Body).Decode(&chat)
+	if chat.Type != models.ChatTypeDirect || chat.Name != "bob" {
+		t.Errorf("Expected a direct chat named after bob, got %+v", chat)
+	}
+
+	rr = open(bob.ID, "alice", nil)
+	var existing models.Chat
+	json.NewDecoder(rr.Body).Decode(&existing)
+	if rr.Code != http.StatusOK || existing.ID != chat.ID || existing.Name != "alice" {
+		t.Errorf("Expected 200 with the same chat named after alice, got %v %+v", rr.Code, existing)
+	}
+
+	id := strconv.Itoa(chat.ID)
+	vars := map[string]string{"id": id, "userID": strconv.Itoa(bob.ID)}
+	invite := map[string]interface{}{"username": "carol", "keys": []WrappedKey{{DeviceID: accountDevice(t, store, carol.ID), EncryptedKey: "carol-key"}}}
+	if rr := do(alice.ID, "POST", "/chats/"+id+"/invite", invite, vars, handler.InviteUser); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 inviting into a direct chat, got %v", rr.Code)
+	}
+	if rr := do(alice.ID, "DELETE", "/chats/"+id+"/participants/"+strconv.Itoa(bob.ID), nil, vars, handler.RemoveParticipant); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 removing the other member, got %v", rr.Code)
+	}
+	if rr := do(bob.ID, "DELETE", "/chats/"+id+"/leave", nil, vars, handler.LeaveChat); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 leaving a direct chat, got %v", rr.Code)
+	}
+	if rr := do(alice.ID, "DELETE", "/chats/"+id, nil, vars, handler.DeleteChat); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 deleting a direct chat, got %v", rr.Code)
+	}
+
+	// Either member can hide it; only theirs goes away
+	if rr := do(carol.ID, "POST", "/chats/"+id+"/hide", nil, vars, handler.HideChat); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 hiding someone else's chat, got %v", rr.Code)
+	}
+	if rr := do(bob.ID, "POST", "/chats/"+id+"/hide", nil, vars, handler.HideChat); rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 hiding the chat, got %v: %s", rr.Code, rr.Body)
+	}
+	if chats, _ := store.GetUserChats(bob.ID, 0); len(chats) != 0 {
+		t.Errorf("Expected bob's list to leave out the hidden chat, got %+v", chats)
+	}
+	if chats, _ := store.GetUserChats(alice.ID, 0); len(chats) != 1 {
+		t.Errorf("Expected alice to keep the chat, got %+v", chats)
+	}
+
+	groupID, _ := store.CreateChat("Group", alice.ID)
+	store.AddParticipant(int(groupID), alice.ID, alice.ID, map[int]string{accountDevice(t, store, alice.ID): "key"})
+	group := strconv.Itoa(int(groupID))
+	if rr := do(alice.ID, "POST", "/chats/"+group+"/hide", nil, map[string]string{"id": group}, handler.HideChat); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 hiding a group chat, got %v", rr.Code)
+	}
+}
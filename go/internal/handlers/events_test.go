@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+func TestMembershipEventsBroadcast(t *testing.T) {
+	c := newRoleChat(t)
+	member := connect(t, c.handler.Hub, c.users[models.RoleMember].ID)
+
+	if status := c.changeRole(models.RoleAdmin, models.RoleReadOnly, models.RoleMember); status != http.StatusOK {
+		t.Fatalf("Expected 200 changing a role, got %v", status)
+	}
+	var msg models.Message
+	nextEvent(t, member, ws.TypeMessage, &msg)
+	if msg.Kind != models.MessageKindSystem || msg.Event.Type != models.EventRoleChanged || msg.Event.Role != models.RoleMember {
+		t.Errorf("Expected the role change in the timeline, got %+v", msg)
+	}
+
+	if status := c.remove(models.RoleAdmin, models.RoleReadOnly); status != http.StatusOK {
+		t.Fatalf("Expected 200 removing a participant, got %v", status)
+	}
+	nextEvent(t, member, ws.TypeMessage, &msg)
+	if msg.Event == nil || msg.Event.Type != models.EventMemberRemoved || msg.UserID != c.users[models.RoleAdmin].ID || msg.Event.Username != models.RoleReadOnly {
+		t.Errorf("Expected the removal in the timeline, got %+v", msg)
+	}
+}
@@ -0,0 +1,366 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/middleware"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+// inviteCodeBytes is how much randomness goes into an invite code.
+const inviteCodeBytes = 12
+
+// InvitePreview is what someone holding an invite code sees before joining.
+type InvitePreview struct {
+	ChatID           int        `json:"chat_id"`
+	ChatName         string     `json:"chat_name"`
+	MemberCount      int        `json:"member_count"`
+	RequiresApproval bool       `json:"requires_approval"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	IsMember         bool       `json:"is_member"`
+}
+
+// joinAction is what a member needs to be allowed to do to settle a join
+// request: any inviter can let in joiners from an open invite, but only
+// those who manage invites can approve the rest.
+func joinAction(request *models.JoinRequest) models.Action {
+	if request.RequiresApproval {
+		return models.ActionManageInvites
+	}
+	return models.ActionInvite
+}
+
+// notifyJoinDeciders sends an event to every member who may settle the
+// join request.
+func (h *ChatHandler) notifyJoinDeciders(request *models.JoinRequest, eventType string, payload interface{}) {
+	participants, err := h.Store.GetChatParticipants(request.ChatID)
+	if err != nil {
+		return
+	}
+	for _, p := range participants {
+		if models.Can(models.ChatTypeGroup, p.Role, joinAction(request)) {
+			h.Hub.SendNotification(p.ID, eventType, payload)
+		}
+	}
+}
+
+// CreateInvite mints an invite link for the chat. It expires after
+// expires_in seconds and allows max_uses redemptions, where zero means
+// never and no limit.
+func (h *ChatHandler) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	var req struct {
+		ExpiresIn        int  `json:"expires_in"`
+		MaxUses          int  `json:"max_uses"`
+		RequiresApproval bool `json:"requires_approval"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresIn < 0 || req.MaxUses < 0 {
+		http.Error(w, "expires_in and max_uses can't be negative", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := h.authorize(w, chatID, userID, models.ActionManageInvites); !ok {
+		return
+	}
+
+	codeBytes := make([]byte, inviteCodeBytes)
+	if _, err := rand.Read(codeBytes); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	invite := &models.Invite{
+		ChatID:           chatID,
+		Code:             base64.RawURLEncoding.EncodeToString(codeBytes),
+		CreatedBy:        userID,
+		MaxUses:          req.MaxUses,
+		RequiresApproval: req.RequiresApproval,
+	}
+	if req.ExpiresIn > 0 {
+		expiresAt := time.Now().UTC().Add(time.Duration(req.ExpiresIn) * time.Second)
+		invite.ExpiresAt = &expiresAt
+	}
+	if err := h.Store.CreateInvite(invite); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invite)
+}
+
+// GetInvites lists the chat's invites, including spent ones.
+func (h *ChatHandler) GetInvites(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	if _, ok := h.authorize(w, chatID, userID, models.ActionManageInvites); !ok {
+		return
+	}
+
+	invites, err := h.Store.GetChatInvites(chatID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if invites == nil {
+		invites = []models.Invite{}
+	}
+
+	json.NewEncoder(w).Encode(invites)
+}
+
+// RevokeInvite deletes an invite. Requests already filed with it stay
+// pending.
+func (h *ChatHandler) RevokeInvite(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	if _, ok := h.authorize(w, chatID, userID, models.ActionManageInvites); !ok {
+		return
+	}
+
+	err := h.Store.DeleteInvite(chatID, vars["code"])
+	if errors.Is(err, store.ErrInviteNotFound) {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// PreviewInvite describes the chat an invite leads to. Invites that can't
+// be redeemed any more are not found.
+func (h *ChatHandler) PreviewInvite(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	invite, err := h.Store.GetInvite(mux.Vars(r)["code"])
+	if err == nil && !invite.Usable(time.Now().UTC()) {
+		err = store.ErrInviteNotFound
+	}
+	if errors.Is(err, store.ErrInviteNotFound) {
+		http.Error(w, "Invite not found or expired", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	chat, err := h.Store.GetChat(invite.ChatID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	participants, err := h.Store.GetChatParticipants(invite.ChatID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	preview := InvitePreview{
+		ChatID:           chat.ID,
+		ChatName:         chat.Name,
+		MemberCount:      len(participants),
+		RequiresApproval: invite.RequiresApproval,
+		ExpiresAt:        invite.ExpiresAt,
+	}
+	for _, p := range participants {
+		if p.ID == userID {
+			preview.IsMember = true
+		}
+	}
+
+	json.NewEncoder(w).Encode(preview)
+}
+
+// AcceptInvite redeems an invite, filing a request to join its chat. The
+// caller only becomes a participant once a member's client wraps the chat
+// key for their devices, so the request is pushed to the members who can
+// let them in. Accepting again while pending is a no-op.
+func (h *ChatHandler) AcceptInvite(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	request, created, err := h.Store.RedeemInvite(mux.Vars(r)["code"], userID, time.Now().UTC())
+	if errors.Is(err, store.ErrInviteNotFound) {
+		http.Error(w, "Invite not found or expired", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, store.ErrAlreadyParticipant) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if created {
+		request.Devices, err = h.Store.GetUserDevices(userID)
+		if err == nil {
+			h.notifyJoinDeciders(request, ws.TypeJoinRequest, request)
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(request)
+}
+
+// GetJoinRequests lists the chat's pending join requests with the joiners'
+// devices, for members who can let them in.
+func (h *ChatHandler) GetJoinRequests(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	if _, ok := h.authorize(w, chatID, userID, models.ActionInvite); !ok {
+		return
+	}
+
+	requests, err := h.Store.GetJoinRequests(chatID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if requests == nil {
+		requests = []models.JoinRequest{}
+	}
+
+	json.NewEncoder(w).Encode(requests)
+}
+
+// chatJoinRequest loads the join request named by the route and checks that
+// the caller may settle it.
+func (h *ChatHandler) chatJoinRequest(w http.ResponseWriter, r *http.Request) (*models.JoinRequest, bool) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+	joinerID, _ := strconv.Atoi(vars["userID"])
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	membership, err := h.Store.GetMembership(chatID, userID)
+	if errors.Is(err, store.ErrNotParticipant) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	request, err := h.Store.GetJoinRequest(chatID, joinerID)
+	if errors.Is(err, store.ErrJoinRequestNotFound) {
+		http.Error(w, "Join request not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if !membership.Can(joinAction(request)) {
+		http.Error(w, "Your role in this chat doesn't allow that", http.StatusForbidden)
+		return nil, false
+	}
+	return request, true
+}
+
+// ApproveJoinRequest lets a joiner in with the chat key wrapped for each of
+// their devices.
+func (h *ChatHandler) ApproveJoinRequest(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Keys []WrappedKey `json:"keys"` // One for each of the joiner's devices
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keys, err := keysByDevice(req.Keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	request, ok := h.chatJoinRequest(w, r)
+	if !ok {
+		return
+	}
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	joined, err := h.Store.ApproveJoinRequest(request.ChatID, request.UserID, userID, keys)
+	if errors.Is(err, store.ErrJoinRequestNotFound) {
+		http.Error(w, "Join request not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, store.ErrKeyRecipientsMismatch) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.Hub.Subscribe(request.UserID, request.ChatID)
+	h.Hub.Broadcast(request.ChatID, ws.TypeMessage, joined)
+
+	resolved := ws.JoinResolvedEvent{ChatID: request.ChatID, UserID: request.UserID, Approved: true}
+	h.notifyJoinDeciders(request, ws.TypeJoinResolved, resolved)
+
+	// Everyone, the joiner included, refreshes their chat and participant lists
+	participants, err := h.Store.GetChatParticipants(request.ChatID)
+	if err == nil {
+		for _, p := range participants {
+			h.Hub.SendNotification(p.ID, ws.TypeNewChat, ws.ChatEvent{ChatID: request.ChatID})
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// RejectJoinRequest turns a joiner away. Only members who manage invites
+// can reject, even requests any inviter could approve.
+func (h *ChatHandler) RejectJoinRequest(w http.ResponseWriter, r *http.Request) {
+	request, ok := h.chatJoinRequest(w, r)
+	if !ok {
+		return
+	}
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+	if _, ok := h.authorize(w, request.ChatID, userID, models.ActionManageInvites); !ok {
+		return
+	}
+
+	err := h.Store.DeleteJoinRequest(request.ChatID, request.UserID)
+	if errors.Is(err, store.ErrJoinRequestNotFound) {
+		http.Error(w, "Join request not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resolved := ws.JoinResolvedEvent{ChatID: request.ChatID, UserID: request.UserID, Approved: false}
+	h.notifyJoinDeciders(request, ws.TypeJoinResolved, resolved)
+	h.Hub.SendNotification(request.UserID, ws.TypeJoinResolved, resolved)
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+// connect opens a WebSocket to hub as userID and waits until the hub is
+// delivering to it.
+func connect(t *testing.T, hub *ws.Hub, userID int) *websocket.Conn {
+	t.Helper()
+	session := &models.Session{ID: "session-" + strconv.Itoa(userID), UserID: userID}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws.ServeWs(hub, w, r, session, time.Now().Add(time.Hour))
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// The hub has registered the connection once it answers a frame
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"v":1,"type":"ping"}`))
+	var rejected struct{}
+	nextEvent(t, conn, ws.TypeError, &rejected)
+	return conn
+}
+
+// nextEvent reads frames until one of the given type arrives, failing if
+// none does within a second.
+func nextEvent(t *testing.T, conn *websocket.Conn, eventType string, payload interface{}) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var env ws.Envelope
+		if err := conn.ReadJSON(&env); err != nil {
+			t.Fatalf("Expected a %s event, got %v", eventType, err)
+		}
+		if env.Type == eventType {
+			json.Unmarshal(env.Payload, payload)
+			return
+		}
+	}
+}
+
+func TestInviteLinks(t *testing.T) {
+	c := newRoleChat(t)
+	chatID := strconv.Itoa(c.chatID)
+	newcomer := c.users["newcomer"]
+
+	createInvite := func(as string, body map[string]interface{}) (int, models.Invite) {
+		raw, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/chats/"+chatID+"/invites", bytes.NewReader(raw))
+		req = mux.SetURLVars(req, map[string]string{"id": chatID})
+		authenticated := login(t, c.store, c.users[as].ID, req)
+		rr := httptest.NewRecorder()
+		authenticated(http.HandlerFunc(c.handler.CreateInvite)).ServeHTTP(rr, req)
+		var invite models.Invite
+		json.NewDecoder(rr.Body).Decode(&invite)
+		return rr.Code, invite
+	}
+	onInvite := func(method, path, code string, h http.HandlerFunc) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/invites/"+code+path, nil)
+		req = mux.SetURLVars(req, map[string]string{"code": code})
+		authenticated := login(t, c.store, newcomer.ID, req)
+		rr := httptest.NewRecorder()
+		authenticated(h).ServeHTTP(rr, req)
+		return rr
+	}
+
+	if status, _ := createInvite(models.RoleMember, map[string]interface{}{}); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a member creating an invite, got %v", status)
+	}
+	status, invite := createInvite(models.RoleAdmin, map[string]interface{}{"expires_in": 3600, "max_uses": 5})
+	if status != http.StatusCreated || invite.Code == "" || invite.ExpiresAt == nil || invite.MaxUses != 5 {
+		t.Fatalf("Expected an invite with an expiry and a use limit, got %v %+v", status, invite)
+	}
+
+	if rr := onInvite("GET", "", "bogus", c.handler.PreviewInvite); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 previewing an unknown invite, got %v", rr.Code)
+	}
+	rr := onInvite("GET", "", invite.Code, c.handler.PreviewInvite)
+	var preview InvitePreview
+	json.NewDecoder(rr.Body).Decode(&preview)
+	if rr.Code != http.StatusOK || preview.ChatName != "Chat" || preview.MemberCount != 4 || preview.IsMember {
+		t.Errorf("Expected a preview of the chat, got %v %+v", rr.Code, preview)
+	}
+
+	// Accepting files a request that's pushed to online members who can let
+	// the joiner in, with the devices to wrap the key for
+	member := connect(t, c.handler.Hub, c.users[models.RoleMember].ID)
+	if rr := onInvite("POST", "/accept", invite.Code, c.handler.AcceptInvite); rr.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 accepting an invite, got %v: %s", rr.Code, rr.Body)
+	}
+	var pushed models.JoinRequest
+	nextEvent(t, member, ws.TypeJoinRequest, &pushed)
+	if pushed.UserID != newcomer.ID || len(pushed.Devices) != 1 {
+		t.Fatalf("Expected the join request with the joiner's device, got %+v", pushed)
+	}
+	if ok, _ := c.store.IsParticipant(c.chatID, newcomer.ID); ok {
+		t.Error("Expected the joiner to wait for a key")
+	}
+
+	approve := func(as string, keys []WrappedKey) int {
+		userID := strconv.Itoa(newcomer.ID)
+		return c.do(as, "POST", "/join-requests/"+userID, map[string]interface{}{"keys": keys}, map[string]string{"userID": userID}, c.handler.ApproveJoinRequest)
+	}
+	keys := []WrappedKey{{DeviceID: pushed.Devices[0].ID, EncryptedKey: "key"}}
+	if status := approve(models.RoleReadOnly, keys); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a read-only participant letting someone in, got %v", status)
+	}
+	if status := approve(models.RoleMember, nil); status != http.StatusConflict {
+		t.Errorf("Expected 409 without the joiner's keys, got %v", status)
+	}
+	if status := approve(models.RoleMember, keys); status != http.StatusOK {
+		t.Fatalf("Expected 200 for a member letting the joiner in, got %v", status)
+	}
+	if ok, _ := c.store.IsParticipant(c.chatID, newcomer.ID); !ok {
+		t.Error("Expected the joiner to be a participant")
+	}
+	if status := approve(models.RoleOwner, keys); status != http.StatusNotFound {
+		t.Errorf("Expected 404 approving twice, got %v", status)
+	}
+	if rr := onInvite("POST", "/accept", invite.Code, c.handler.AcceptInvite); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 accepting as a participant, got %v", rr.Code)
+	}
+}
+
+func TestInviteApproval(t *testing.T) {
+	c := newRoleChat(t)
+	newcomer := c.users["newcomer"]
+	invite := &models.Invite{ChatID: c.chatID, Code: "approval", CreatedBy: c.users[models.RoleOwner].ID, RequiresApproval: true}
+	c.store.CreateInvite(invite)
+
+	// Only owners and admins hear about requests that need approval
+	admin := connect(t, c.handler.Hub, c.users[models.RoleAdmin].ID)
+	member := connect(t, c.handler.Hub, c.users[models.RoleMember].ID)
+	joiner := connect(t, c.handler.Hub, newcomer.ID)
+	if status := c.do("newcomer", "POST", "", nil, map[string]string{"code": "approval"}, c.handler.AcceptInvite); status != http.StatusAccepted {
+		t.Fatalf("Expected 202 accepting an invite, got %v", status)
+	}
+	var pushed models.JoinRequest
+	nextEvent(t, admin, ws.TypeJoinRequest, &pushed)
+	if !pushed.RequiresApproval {
+		t.Errorf("Expected the request to need approval, got %+v", pushed)
+	}
+	member.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		var env ws.Envelope
+		if err := member.ReadJSON(&env); err != nil {
+			break
+		}
+		if env.Type == ws.TypeJoinRequest {
+			t.Fatal("Expected members not to be asked to approve")
+		}
+	}
+
+	userID := strconv.Itoa(newcomer.ID)
+	keys := []WrappedKey{{DeviceID: accountDevice(t, c.store, newcomer.ID), EncryptedKey: "key"}}
+	body := map[string]interface{}{"keys": keys}
+	if status := c.do(models.RoleMember, "POST", "/join-requests/"+userID, body, map[string]string{"userID": userID}, c.handler.ApproveJoinRequest); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a member approving, got %v", status)
+	}
+	if status := c.do(models.RoleMember, "DELETE", "/join-requests/"+userID, nil, map[string]string{"userID": userID}, c.handler.RejectJoinRequest); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a member rejecting, got %v", status)
+	}
+	if status := c.do(models.RoleAdmin, "DELETE", "/join-requests/"+userID, nil, map[string]string{"userID": userID}, c.handler.RejectJoinRequest); status != http.StatusOK {
+		t.Fatalf("Expected 200 for an admin rejecting, got %v", status)
+	}
+
+	var resolved ws.JoinResolvedEvent
+	nextEvent(t, joiner, ws.TypeJoinResolved, &resolved)
+	if resolved.Approved || resolved.ChatID != c.chatID {
+		t.Errorf("Expected the joiner to hear they were rejected, got %+v", resolved)
+	}
+	if ok, _ := c.store.IsParticipant(c.chatID, newcomer.ID); ok {
+		t.Error("Expected a rejected joiner to stay out")
+	}
+}
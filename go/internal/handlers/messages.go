@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/middleware"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+// chatMessage loads the message named by the route, checking that it belongs
+// to the chat in the route and that the caller participates in that chat.
+func (h *ChatHandler) chatMessage(w http.ResponseWriter, r *http.Request) (*models.Message, bool) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+	messageID, _ := strconv.Atoi(vars["messageID"])
+
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	isParticipant, err := h.Store.IsParticipant(chatID, userID)
+	if err != nil || !isParticipant {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+
+	message, err := h.Store.GetMessage(messageID)
+	if err != nil || message.ChatID != chatID {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return nil, false
+	}
+	return message, true
+}
+
+// EditMessage replaces the content of one of the caller's own messages. The
+// new content is encrypted under the chat's current key epoch.
+func (h *ChatHandler) EditMessage(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	var req struct {
+		Content  string `json:"content"`
+		KeyEpoch int    `json:"key_epoch"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Content == "" {
+		http.Error(w, "Content is required", http.StatusBadRequest)
+		return
+	}
+
+	message, ok := h.chatMessage(w, r)
+	if !ok {
+		return
+	}
+	if message.UserID != userID {
+		http.Error(w, "Only the sender can edit a message", http.StatusForbidden)
+		return
+	}
+	if _, ok := h.authorize(w, message.ChatID, userID, models.ActionPost); !ok {
+		return
+	}
+
+	edited, err := h.Store.EditMessage(message.ID, userID, req.KeyEpoch, req.Content, time.Now().UTC())
+	if errors.Is(err, store.ErrMessageNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, store.ErrStaleKeyEpoch) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.Hub.Broadcast(edited.ChatID, ws.TypeMessageEdited, edited)
+
+	json.NewEncoder(w).Encode(edited)
+}
+
+// DeleteMessage turns a message into a tombstone. Senders can delete their
+// own messages and chat owners and admins can delete anyone's.
+func (h *ChatHandler) DeleteMessage(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	message, ok := h.chatMessage(w, r)
+	if !ok {
+		return
+	}
+	if message.UserID != userID {
+		if _, ok := h.authorize(w, message.ChatID, userID, models.ActionModerate); !ok {
+			return
+		}
+	}
+
+	deleted, notice, err := h.Store.DeleteMessage(message.ID, userID, time.Now().UTC())
+	if errors.Is(err, store.ErrMessageNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.discardBlobs(message.Attachments)
+
+	h.Hub.Broadcast(deleted.ChatID, ws.TypeMessageDeleted, ws.MessageDeletedEvent{
+		ChatID:    deleted.ChatID,
+		MessageID: deleted.ID,
+		DeletedBy: userID,
+	})
+	if notice != nil {
+		h.Hub.Broadcast(notice.ChatID, ws.TypeMessage, notice)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetMessageEdits returns the previous versions of a message, oldest first.
+func (h *ChatHandler) GetMessageEdits(w http.ResponseWriter, r *http.Request) {
+	message, ok := h.chatMessage(w, r)
+	if !ok {
+		return
+	}
+
+	edits, err := h.Store.GetMessageEdits(message.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if edits == nil {
+		edits = []models.MessageEdit{}
+	}
+
+	json.NewEncoder(w).Encode(edits)
+}
+
+// GetThread returns a page of a thread's history: the root message followed
+// by its replies. It pages with the same cursors as GetChatMessages.
+func (h *ChatHandler) GetThread(w http.ResponseWriter, r *http.Request) {
+	root, ok := h.chatMessage(w, r)
+	if !ok {
+		return
+	}
+	if root.ThreadRootID != 0 {
+		http.Error(w, "Message is a reply, not a thread root", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := parsePageOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.ThreadRootID = root.ID
+
+	h.writeMessagePage(w, root.ChatID, opts)
+}
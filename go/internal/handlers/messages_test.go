@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store/sqlstore"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+func TestEditAndDeleteMessage(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	for _, name := range []string{"owner", "member", "outsider"} {
+		store.CreateUser(&models.User{Username: name, Email: name + "@example.com", Password: "pass"})
+	}
+	owner, _ := store.GetUserByUsername("owner")
+	member, _ := store.GetUserByUsername("member")
+	outsider, _ := store.GetUserByUsername("outsider")
+
+	id, _ := store.CreateChat("Chat", owner.ID)
+	chatID := int(id)
+	store.AddParticipant(chatID, owner.ID, owner.ID, map[int]string{accountDevice(t, store, owner.ID): "key"})
+	store.AddParticipant(chatID, member.ID, member.ID, map[int]string{accountDevice(t, store, member.ID): "key"})
+	ownerMsg, _, _ := store.SaveMessage(chatID, owner.ID, 1, 0, "from owner", "", nil)
+	memberMsg, _, _ := store.SaveMessage(chatID, member.ID, 1, 0, "from member", "", nil)
+
+	hub := ws.NewHub(store)
+	go hub.Run()
+
+	handler := &ChatHandler{Store: store, Hub: hub}
+
+	do := func(userID int, method string, msg *models.Message, body interface{}, h http.HandlerFunc) int {
+		raw, _ := json.Marshal(body)
+		path := "/chats/" + strconv.Itoa(chatID) + "/messages/" + strconv.Itoa(msg.ID)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(raw))
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(chatID), "messageID": strconv.Itoa(msg.ID)})
+		authenticated := login(t, store, userID, req)
+		rr := httptest.NewRecorder()
+		authenticated(h).ServeHTTP(rr, req)
+		return rr.Code
+	}
+	edit := map[string]interface{}{"content": "edited", "key_epoch": 1}
+
+	if status := do(owner.ID, "PATCH", memberMsg, edit, handler.EditMessage); status != http.StatusForbidden {
+		t.Errorf("Expected 403 editing someone else's message, got %v", status)
+	}
+	if status := do(outsider.ID, "PATCH", memberMsg, edit, handler.EditMessage); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a non-participant, got %v", status)
+	}
+	if status := do(member.ID, "PATCH", memberMsg, map[string]interface{}{"content": "edited", "key_epoch": 2}, handler.EditMessage); status != http.StatusConflict {
+		t.Errorf("Expected 409 for a stale key epoch, got %v", status)
+	}
+	if status := do(member.ID, "PATCH", memberMsg, edit, handler.EditMessage); status != http.StatusOK {
+		t.Errorf("Expected 200 editing own message, got %v", status)
+	}
+
+	if status := do(member.ID, "DELETE", ownerMsg, nil, handler.DeleteMessage); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a member deleting the owner's message, got %v", status)
+	}
+	if status := do(owner.ID, "DELETE", memberMsg, nil, handler.DeleteMessage); status != http.StatusOK {
+		t.Errorf("Expected 200 for the owner deleting a member's message, got %v", status)
+	}
+	if status := do(member.ID, "DELETE", memberMsg, nil, handler.DeleteMessage); status != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting a tombstone, got %v", status)
+	}
+	if status := do(member.ID, "PATCH", memberMsg, edit, handler.EditMessage); status != http.StatusNotFound {
+		t.Errorf("Expected 404 editing a tombstone, got %v", status)
+	}
+
+	deleted, _ := store.GetMessage(memberMsg.ID)
+	if deleted.DeletedBy != owner.ID || deleted.Content != "" {
+		t.Errorf("Expected a tombstone deleted by the owner, got %+v", deleted)
+	}
+}
+
+func TestGetThread(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "member", Email: "member@example.com", Password: "pass"})
+	store.CreateUser(&models.User{Username: "outsider", Email: "outsider@example.com", Password: "pass"})
+	member, _ := store.GetUserByUsername("member")
+	outsider, _ := store.GetUserByUsername("outsider")
+
+	id, _ := store.CreateChat("Chat", member.ID)
+	chatID := int(id)
+	store.AddParticipant(chatID, member.ID, member.ID, map[int]string{accountDevice(t, store, member.ID): "key"})
+	root, _, _ := store.SaveMessage(chatID, member.ID, 1, 0, "root", "", nil)
+	store.SaveMessage(chatID, member.ID, 1, 0, "unrelated", "", nil)
+	reply, _, _ := store.SaveMessage(chatID, member.ID, 1, root.ID, "reply", "", nil)
+
+	handler := &ChatHandler{Store: store}
+
+	get := func(userID int, messageID int) *httptest.ResponseRecorder {
+		path := "/chats/" + strconv.Itoa(chatID) + "/threads/" + strconv.Itoa(messageID)
+		req, _ := http.NewRequest("GET", path, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(chatID), "messageID": strconv.Itoa(messageID)})
+		authenticated := login(t, store, userID, req)
+		rr := httptest.NewRecorder()
+		authenticated(http.HandlerFunc(handler.GetThread)).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get(member.ID, root.ID)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v: %s", rr.Code, rr.Body)
+	}
+	var page models.MessagePage
+	json.NewDecoder(rr.Body).Decode(&page)
+	if len(page.Messages) != 2 || page.Messages[0].ReplyCount != 1 || page.Messages[1].ID != reply.ID {
+		t.Errorf("Expected the root and its reply, got %+v", page.Messages)
+	}
+
+	if rr := get(member.ID, reply.ID); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a reply as the thread root, got %v", rr.Code)
+	}
+	if rr := get(outsider.ID, root.ID); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a non-participant, got %v", rr.Code)
+	}
+}
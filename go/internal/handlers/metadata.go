@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/middleware"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+// UpdateChat changes a group chat's name, description, topic or avatar. Each
+// text field may be encrypted under the chat's current key. The change shows
+// up in the chat as a system message, which is broadcast like any other.
+func (h *ChatHandler) UpdateChat(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	var changes models.ChatChanges
+	if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if changes.Empty() {
+		http.Error(w, "Nothing to change", http.StatusBadRequest)
+		return
+	}
+	if changes.Name != nil && changes.Name.Value == "" {
+		http.Error(w, "Chat name is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := h.authorize(w, chatID, userID, models.ActionRename); !ok {
+		return
+	}
+
+	msg, err := h.Store.UpdateChat(chatID, userID, changes)
+	if errors.Is(err, store.ErrStaleKeyEpoch) {
+		http.Error(w, "Encrypted details must use the chat's current key epoch", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, store.ErrAttachmentNotFound) {
+		http.Error(w, "Avatar must be a complete upload of yours that hasn't been sent", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, store.ErrChatNotFound) {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.Hub.Broadcast(chatID, ws.TypeMessage, msg)
+
+	json.NewEncoder(w).Encode(msg)
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+func TestUpdateChat(t *testing.T) {
+	c := newRoleChat(t)
+	update := func(as string, body interface{}) int {
+		return c.do(as, "PATCH", "", body, map[string]string{}, c.handler.UpdateChat)
+	}
+	rename := map[string]interface{}{"name": map[string]string{"value": "Renamed"}}
+
+	if status := update(models.RoleMember, rename); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a member renaming the chat, got %v", status)
+	}
+	if status := update(models.RoleAdmin, map[string]interface{}{}); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an empty update, got %v", status)
+	}
+	if status := update(models.RoleAdmin, map[string]interface{}{"name": map[string]string{"value": ""}}); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an empty name, got %v", status)
+	}
+	if status := update(models.RoleAdmin, map[string]interface{}{"topic": map[string]interface{}{"value": "sealed", "key_epoch": 7}}); status != http.StatusConflict {
+		t.Errorf("Expected 409 for a topic under an old key, got %v", status)
+	}
+
+	// Everyone in the chat sees the change in its timeline
+	member := connect(t, c.handler.Hub, c.users[models.RoleMember].ID)
+	if status := update(models.RoleAdmin, rename); status != http.StatusOK {
+		t.Fatalf("Expected 200 renaming the chat, got %v", status)
+	}
+	var msg models.Message
+	nextEvent(t, member, ws.TypeMessage, &msg)
+	if msg.Kind != models.MessageKindSystem || msg.UserID != c.users[models.RoleAdmin].ID || msg.Event == nil || msg.Event.Chat.Name.Value != "Renamed" {
+		t.Errorf("Expected a system message for the rename, got %+v", msg)
+	}
+	if chat, _ := c.store.GetChat(c.chatID); chat.Name != "Renamed" {
+		t.Errorf("Expected the chat to be renamed, got %q", chat.Name)
+	}
+}
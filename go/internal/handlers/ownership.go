@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/middleware"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+// notifyOwnerChanged tells a chat's participants about a handover recorded
+// in entry, and asks the new owner to rekey if a member left since the last
+// rekey, since that request went to the previous owner.
+func notifyOwnerChanged(s store.Store, hub *ws.Hub, entry models.AuditEntry) {
+	if entry.Message != nil {
+		hub.Broadcast(entry.ChatID, ws.TypeMessage, entry.Message)
+	}
+	event := ws.OwnerChangedEvent{ChatID: entry.ChatID, OwnerID: entry.TargetID, PreviousOwnerID: entry.ActorID, Reason: entry.Action}
+	participants, err := s.GetChatParticipants(entry.ChatID)
+	if err == nil {
+		for _, p := range participants {
+			hub.SendNotification(p.ID, ws.TypeOwnerChanged, event)
+		}
+	}
+	if chat, err := s.GetChat(entry.ChatID); err == nil && chat.RekeyNeeded {
+		hub.SendNotification(entry.TargetID, ws.TypeRekeyRequired, ws.ChatEvent{ChatID: entry.ChatID})
+	}
+}
+
+// notifyOwnershipOffer tells a chat's owner and the participant an offer was
+// made to, or withdrawn from, where it stands.
+func (h *ChatHandler) notifyOwnershipOffer(chatID, ownerID, nomineeID, pendingOwnerID int) {
+	event := ws.OwnershipOfferEvent{ChatID: chatID, OwnerID: ownerID, PendingOwnerID: pendingOwnerID}
+	h.Hub.SendNotification(ownerID, ws.TypeOwnershipOffer, event)
+	h.Hub.SendNotification(nomineeID, ws.TypeOwnershipOffer, event)
+}
+
+// OfferOwnership has the owner offer a group chat to another participant.
+// Nothing changes until they accept; a new offer replaces an earlier one.
+func (h *ChatHandler) OfferOwnership(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	var req struct {
+		UserID int `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.UserID == userID {
+		http.Error(w, "You already own this chat", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := h.authorize(w, chatID, userID, models.ActionTransfer); !ok {
+		return
+	}
+	if _, err := h.Store.GetMembership(chatID, req.UserID); errors.Is(err, store.ErrNotParticipant) {
+		http.Error(w, "Participant not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nominee, err := h.Store.GetUserByID(req.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if nominee.DeactivatedAt != nil {
+		http.Error(w, "That account has been deactivated", http.StatusBadRequest)
+		return
+	}
+
+	chat, err := h.Store.GetChat(chatID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := h.Store.SetPendingOwner(chatID, req.UserID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Whoever held the earlier offer hears that it's gone
+	if chat.PendingOwnerID != 0 && chat.PendingOwnerID != req.UserID {
+		h.Hub.SendNotification(chat.PendingOwnerID, ws.TypeOwnershipOffer, ws.OwnershipOfferEvent{ChatID: chatID, OwnerID: userID})
+	}
+	h.notifyOwnershipOffer(chatID, userID, req.UserID, req.UserID)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// AcceptOwnership makes the caller the owner of a chat offered to them. The
+// previous owner becomes an admin.
+func (h *ChatHandler) AcceptOwnership(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	entry, err := h.Store.TransferOwnership(chatID, userID, time.Now().UTC())
+	if errors.Is(err, store.ErrNoPendingTransfer) {
+		http.Error(w, "This chat hasn't been offered to you", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, store.ErrNotParticipant) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	notifyOwnerChanged(h.Store, h.Hub, *entry)
+
+	json.NewEncoder(w).Encode(entry)
+}
+
+// CancelOwnershipOffer withdraws an offer of ownership, if the caller is the
+// owner, or declines it, if it was made to them.
+func (h *ChatHandler) CancelOwnershipOffer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	chat, err := h.Store.GetChat(chatID)
+	if errors.Is(err, store.ErrChatNotFound) {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if userID != chat.OwnerID && userID != chat.PendingOwnerID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if chat.PendingOwnerID == 0 {
+		http.Error(w, "No ownership transfer is pending", http.StatusNotFound)
+		return
+	}
+
+	if err := h.Store.SetPendingOwner(chatID, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.notifyOwnershipOffer(chatID, chat.OwnerID, chat.PendingOwnerID, 0)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetAuditLog lists the changes to who runs a chat.
+func (h *ChatHandler) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	if _, ok := h.authorize(w, chatID, userID, models.ActionViewAudit); !ok {
+		return
+	}
+
+	entries, err := h.Store.GetAuditLog(chatID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []models.AuditEntry{}
+	}
+	json.NewEncoder(w).Encode(entries)
+}
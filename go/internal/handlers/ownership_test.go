@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/auth"
+	"github.com/pliu/chatty/internal/middleware"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/ws"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestOwnershipTransfer(t *testing.T) {
+	c := newRoleChat(t)
+	owner, admin := c.users[models.RoleOwner], c.users[models.RoleAdmin]
+	offer := func(as string, userID int) int {
+		return c.do(as, "POST", "/transfer", map[string]int{"user_id": userID}, map[string]string{}, c.handler.OfferOwnership)
+	}
+	accept := func(as string) int {
+		return c.do(as, "POST", "/transfer/accept", nil, map[string]string{}, c.handler.AcceptOwnership)
+	}
+
+	if status := offer(models.RoleAdmin, c.users[models.RoleMember].ID); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for an admin offering the chat, got %v", status)
+	}
+	if status := offer(models.RoleOwner, c.users["newcomer"].ID); status != http.StatusNotFound {
+		t.Errorf("Expected 404 offering the chat to an outsider, got %v", status)
+	}
+
+	// The nominee hears about the offer and has to accept it
+	nominee := connect(t, c.handler.Hub, admin.ID)
+	if status := offer(models.RoleOwner, admin.ID); status != http.StatusAccepted {
+		t.Fatalf("Expected 202 offering the chat, got %v", status)
+	}
+	var offered ws.OwnershipOfferEvent
+	nextEvent(t, nominee, ws.TypeOwnershipOffer, &offered)
+	if offered.PendingOwnerID != admin.ID || offered.OwnerID != owner.ID {
+		t.Errorf("Expected the offer to reach the admin, got %+v", offered)
+	}
+	if m, _ := c.store.GetMembership(c.chatID, owner.ID); m.Role != models.RoleOwner {
+		t.Errorf("Expected the owner to stay owner until the offer is accepted, got %s", m.Role)
+	}
+	if status := accept(models.RoleMember); status != http.StatusNotFound {
+		t.Errorf("Expected 404 accepting an offer made to someone else, got %v", status)
+	}
+	if status := c.do(models.RoleMember, "DELETE", "/transfer", nil, map[string]string{}, c.handler.CancelOwnershipOffer); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a bystander cancelling the offer, got %v", status)
+	}
+
+	member := connect(t, c.handler.Hub, c.users[models.RoleMember].ID)
+	if status := accept(models.RoleAdmin); status != http.StatusOK {
+		t.Fatalf("Expected 200 accepting the offer, got %v", status)
+	}
+	var changed ws.OwnerChangedEvent
+	nextEvent(t, member, ws.TypeOwnerChanged, &changed)
+	if changed.OwnerID != admin.ID || changed.PreviousOwnerID != owner.ID || changed.Reason != models.AuditOwnershipTransferred {
+		t.Errorf("Expected everyone to hear of the transfer, got %+v", changed)
+	}
+	for userID, want := range map[int]string{admin.ID: models.RoleOwner, owner.ID: models.RoleAdmin} {
+		if m, _ := c.store.GetMembership(c.chatID, userID); m.Role != want {
+			t.Errorf("Expected user %d to be %s, got %s", userID, want, m.Role)
+		}
+	}
+
+	// The former owner can now leave, and only the new one reads the log
+	if status := c.do(models.RoleOwner, "DELETE", "/leave", nil, map[string]string{}, c.handler.LeaveChat); status != http.StatusOK {
+		t.Errorf("Expected the former owner to be able to leave, got %v", status)
+	}
+	if status := c.do(models.RoleMember, "GET", "/audit", nil, map[string]string{}, c.handler.GetAuditLog); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a member reading the audit log, got %v", status)
+	}
+	if status := c.do(models.RoleAdmin, "GET", "/audit", nil, map[string]string{}, c.handler.GetAuditLog); status != http.StatusOK {
+		t.Errorf("Expected the new owner to read the audit log, got %v", status)
+	}
+}
+
+func TestDeactivateAccountSuccession(t *testing.T) {
+	c := newRoleChat(t)
+	owner := c.users[models.RoleOwner]
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	c.store.UpdateUserCredentials(owner.ID, string(hashed), "", "")
+	sessions := auth.NewSessionManager(c.store)
+	var revoked []string
+	sessions.OnRevoke(func(id string) { revoked = append(revoked, id) })
+	handler := &AuthHandler{Store: c.store, Sessions: sessions, Hub: c.handler.Hub}
+
+	deactivate := func(password string) int {
+		body, _ := json.Marshal(map[string]string{"password": password})
+		req, _ := http.NewRequest("POST", "/account/deactivate", bytes.NewReader(body))
+		authenticated := login(t, c.store, owner.ID, req)
+		rr := httptest.NewRecorder()
+		authenticated(http.HandlerFunc(handler.DeactivateAccount)).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if status := deactivate("wrong"); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with the wrong password, got %v", status)
+	}
+
+	// A deactivation that fails to hand the chats over keeps the account
+	faulty := &AuthHandler{Store: &faultyStore{Store: c.store, fail: "DeactivateUser"}, Sessions: sessions, Hub: c.handler.Hub}
+	body, _ := json.Marshal(map[string]string{"password": "password123"})
+	req, _ := http.NewRequest("POST", "/account/deactivate", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	login(t, c.store, owner.ID, req)(http.HandlerFunc(faulty.DeactivateAccount)).ServeHTTP(rr, req)
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when deactivating fails, got %v", rr.Code)
+	}
+	if user, _ := c.store.GetUserByID(owner.ID); user.DeactivatedAt != nil {
+		t.Error("Expected the deactivation to be rolled back")
+	}
+	if sessions, _ := c.store.GetUserSessions(owner.ID); len(sessions) == 0 || len(revoked) != 0 {
+		t.Errorf("Expected the sessions to survive, got %d (revoked %v)", len(sessions), revoked)
+	}
+
+	// A session on another device, and a reset link mailed before the account went
+	phone, _ := sessions.Create(owner.ID, httptest.NewRequest("POST", "/login", nil))
+	c.store.CreatePasswordReset(owner.ID, hashToken("token1"), time.Now().Add(time.Hour))
+
+	// The admin takes over, and everyone hears about it
+	member := connect(t, c.handler.Hub, c.users[models.RoleMember].ID)
+	if status := deactivate("password123"); status != http.StatusOK {
+		t.Fatalf("Expected 200 deactivating the account, got %v", status)
+	}
+	var changed ws.OwnerChangedEvent
+	nextEvent(t, member, ws.TypeOwnerChanged, &changed)
+	if changed.OwnerID != c.users[models.RoleAdmin].ID || changed.Reason != models.AuditOwnershipSucceeded {
+		t.Errorf("Expected the admin to succeed the owner, got %+v", changed)
+	}
+	if sessions, _ := c.store.GetUserSessions(owner.ID); len(sessions) != 0 {
+		t.Errorf("Expected the account to be logged out everywhere, got %d sessions", len(sessions))
+	}
+	if !slices.Contains(revoked, phone.ID) {
+		t.Errorf("Expected the other session's connections to be closed, got %v", revoked)
+	}
+
+	req, _ = http.NewRequest("GET", "/chats", nil)
+	req.AddCookie(sessions.Cookie(phone))
+	rr = httptest.NewRecorder()
+	middleware.NewAuthMiddleware(sessions)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for the deactivated account's other session, got %v", rr.Code)
+	}
+
+	body, _ = json.Marshal(map[string]string{"token": "token1", "password": "new-password", "encrypted_private_key": "k"})
+	req, _ = http.NewRequest("POST", "/reset-password", bytes.NewReader(body))
+	rr = httptest.NewRecorder()
+	handler.ResetPassword(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 resetting a deactivated account's password, got %v", rr.Code)
+	}
+
+	if status := c.do(models.RoleAdmin, "POST", "/invite", map[string]string{"username": models.RoleOwner}, map[string]string{}, c.handler.InviteUser); status != http.StatusNotFound {
+		t.Errorf("Expected 404 inviting a deactivated user, got %v", status)
+	}
+}
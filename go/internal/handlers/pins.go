@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/middleware"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+// pinTarget authorizes the caller to pin in the chat and loads the message
+// named by the route, answering 403 or 404 if either fails.
+func (h *ChatHandler) pinTarget(w http.ResponseWriter, r *http.Request) (*models.Message, bool) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+	messageID, _ := strconv.Atoi(vars["messageID"])
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	if _, ok := h.authorize(w, chatID, userID, models.ActionPin); !ok {
+		return nil, false
+	}
+	message, err := h.Store.GetMessage(messageID)
+	if err != nil || message.ChatID != chatID {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return nil, false
+	}
+	return message, true
+}
+
+// PinMessage pins a message in its chat. Pinning a pinned message is a
+// no-op.
+func (h *ChatHandler) PinMessage(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	message, ok := h.pinTarget(w, r)
+	if !ok {
+		return
+	}
+
+	pinned, err := h.Store.PinMessage(message.ID, userID, time.Now().UTC())
+	if errors.Is(err, store.ErrMessageNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !pinned {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	h.Hub.Broadcast(message.ChatID, ws.TypeMessagePinned, ws.PinEvent{
+		ChatID:    message.ChatID,
+		MessageID: message.ID,
+		UserID:    userID,
+	})
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UnpinMessage unpins a message, whoever pinned it.
+func (h *ChatHandler) UnpinMessage(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	message, ok := h.pinTarget(w, r)
+	if !ok {
+		return
+	}
+
+	unpinned, err := h.Store.UnpinMessage(message.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !unpinned {
+		http.Error(w, "Message isn't pinned", http.StatusNotFound)
+		return
+	}
+
+	h.Hub.Broadcast(message.ChatID, ws.TypeMessageUnpinned, ws.PinEvent{
+		ChatID:    message.ChatID,
+		MessageID: message.ID,
+		UserID:    userID,
+	})
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetPinnedMessages lists a chat's pinned messages, most recently pinned
+// first.
+func (h *ChatHandler) GetPinnedMessages(w http.ResponseWriter, r *http.Request) {
+	chatID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	isParticipant, err := h.Store.IsParticipant(chatID, userID)
+	if err != nil || !isParticipant {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	messages, err := h.Store.GetPinnedMessages(chatID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if messages == nil {
+		messages = []models.Message{}
+	}
+	json.NewEncoder(w).Encode(messages)
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+func TestPins(t *testing.T) {
+	c := newRoleChat(t)
+	member := c.users[models.RoleMember]
+	msg, _, _ := c.store.SaveMessage(c.chatID, c.users[models.RoleOwner].ID, 1, 0, "hello", "", nil)
+	messageID := strconv.Itoa(msg.ID)
+	conn := connect(t, c.handler.Hub, c.users[models.RoleOwner].ID)
+
+	pin := func(as, method string, h http.HandlerFunc) int {
+		return c.do(as, method, "/pins/"+messageID, nil, map[string]string{"messageID": messageID}, h)
+	}
+
+	if status := pin(models.RoleReadOnly, "POST", c.handler.PinMessage); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a read-only participant, got %v", status)
+	}
+	if status := pin("newcomer", "POST", c.handler.PinMessage); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a non-participant, got %v", status)
+	}
+	if status := pin(models.RoleMember, "POST", c.handler.PinMessage); status != http.StatusCreated {
+		t.Fatalf("Expected 201 pinning a message, got %v", status)
+	}
+	var event ws.PinEvent
+	nextEvent(t, conn, ws.TypeMessagePinned, &event)
+	if event.MessageID != msg.ID || event.UserID != member.ID {
+		t.Errorf("Expected the member's pin to be announced, got %+v", event)
+	}
+	if status := pin(models.RoleAdmin, "POST", c.handler.PinMessage); status != http.StatusOK {
+		t.Errorf("Expected 200 pinning a pinned message, got %v", status)
+	}
+
+	if pins, _ := c.store.GetPinnedMessages(c.chatID); len(pins) != 1 || pins[0].PinnedBy != member.ID {
+		t.Errorf("Expected the message pinned by the member, got %+v", pins)
+	}
+	if status := c.do(models.RoleReadOnly, "GET", "/pins", nil, map[string]string{}, c.handler.GetPinnedMessages); status != http.StatusOK {
+		t.Errorf("Expected anyone in the chat to list pins, got %v", status)
+	}
+	if status := c.do("newcomer", "GET", "/pins", nil, map[string]string{}, c.handler.GetPinnedMessages); status != http.StatusForbidden {
+		t.Errorf("Expected 403 listing pins from outside the chat, got %v", status)
+	}
+
+	if status := pin(models.RoleReadOnly, "DELETE", c.handler.UnpinMessage); status != http.StatusForbidden {
+		t.Errorf("Expected 403 unpinning as read-only, got %v", status)
+	}
+	if status := pin(models.RoleAdmin, "DELETE", c.handler.UnpinMessage); status != http.StatusOK {
+		t.Fatalf("Expected 200 unpinning, got %v", status)
+	}
+	nextEvent(t, conn, ws.TypeMessageUnpinned, &event)
+	if status := pin(models.RoleAdmin, "DELETE", c.handler.UnpinMessage); status != http.StatusNotFound {
+		t.Errorf("Expected 404 unpinning a message that isn't pinned, got %v", status)
+	}
+}
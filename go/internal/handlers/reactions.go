@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/pliu/chatty/internal/middleware"
+	"github.com/pliu/chatty/internal/store"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+// maxReactionLength bounds the opaque reaction strings clients choose.
+const maxReactionLength = 64
+
+// decodeReaction reads the {reaction} body shared by both reaction routes.
+func decodeReaction(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req struct {
+		Reaction string `json:"reaction"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	if req.Reaction == "" || len(req.Reaction) > maxReactionLength {
+		http.Error(w, "Reaction must be between 1 and 64 bytes", http.StatusBadRequest)
+		return "", false
+	}
+	return req.Reaction, true
+}
+
+// AddReaction reacts to a message. Reacting twice with the same reaction is
+// a no-op.
+func (h *ChatHandler) AddReaction(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	reaction, ok := decodeReaction(w, r)
+	if !ok {
+		return
+	}
+	message, ok := h.chatMessage(w, r)
+	if !ok {
+		return
+	}
+
+	added, err := h.Store.AddReaction(message.ID, userID, reaction)
+	if errors.Is(err, store.ErrMessageNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !added {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	h.Hub.Broadcast(message.ChatID, ws.TypeReactionAdded, ws.ReactionEvent{
+		ChatID:    message.ChatID,
+		MessageID: message.ID,
+		UserID:    userID,
+		Reaction:  reaction,
+	})
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// RemoveReaction withdraws one of the caller's reactions to a message.
+func (h *ChatHandler) RemoveReaction(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	reaction, ok := decodeReaction(w, r)
+	if !ok {
+		return
+	}
+	message, ok := h.chatMessage(w, r)
+	if !ok {
+		return
+	}
+
+	removed, err := h.Store.RemoveReaction(message.ID, userID, reaction)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Reaction not found", http.StatusNotFound)
+		return
+	}
+
+	h.Hub.Broadcast(message.ChatID, ws.TypeReactionRemoved, ws.ReactionEvent{
+		ChatID:    message.ChatID,
+		MessageID: message.ID,
+		UserID:    userID,
+		Reaction:  reaction,
+	})
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store/sqlstore"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+func TestReactions(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "member", Email: "member@example.com", Password: "pass"})
+	store.CreateUser(&models.User{Username: "outsider", Email: "outsider@example.com", Password: "pass"})
+	member, _ := store.GetUserByUsername("member")
+	outsider, _ := store.GetUserByUsername("outsider")
+
+	id, _ := store.CreateChat("Chat", member.ID)
+	chatID := int(id)
+	store.AddParticipant(chatID, member.ID, member.ID, map[int]string{accountDevice(t, store, member.ID): "key"})
+	msg, _, _ := store.SaveMessage(chatID, member.ID, 1, 0, "hello", "", nil)
+
+	hub := ws.NewHub(store)
+	go hub.Run()
+
+	handler := &ChatHandler{Store: store, Hub: hub}
+
+	do := func(userID int, method, reaction string, h http.HandlerFunc) int {
+		raw, _ := json.Marshal(map[string]string{"reaction": reaction})
+		path := "/chats/" + strconv.Itoa(chatID) + "/messages/" + strconv.Itoa(msg.ID) + "/reactions"
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(raw))
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(chatID), "messageID": strconv.Itoa(msg.ID)})
+		authenticated := login(t, store, userID, req)
+		rr := httptest.NewRecorder()
+		authenticated(h).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if status := do(outsider.ID, "POST", "👍", handler.AddReaction); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a non-participant, got %v", status)
+	}
+	if status := do(member.ID, "POST", "", handler.AddReaction); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an empty reaction, got %v", status)
+	}
+	if status := do(member.ID, "POST", strings.Repeat("x", maxReactionLength+1), handler.AddReaction); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an oversized reaction, got %v", status)
+	}
+	if status := do(member.ID, "POST", "👍", handler.AddReaction); status != http.StatusCreated {
+		t.Errorf("Expected 201 adding a reaction, got %v", status)
+	}
+	if status := do(member.ID, "POST", "👍", handler.AddReaction); status != http.StatusOK {
+		t.Errorf("Expected 200 repeating a reaction, got %v", status)
+	}
+	if status := do(member.ID, "DELETE", "👍", handler.RemoveReaction); status != http.StatusOK {
+		t.Errorf("Expected 200 removing a reaction, got %v", status)
+	}
+	if status := do(member.ID, "DELETE", "👍", handler.RemoveReaction); status != http.StatusNotFound {
+		t.Errorf("Expected 404 removing a reaction twice, got %v", status)
+	}
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store/sqlstore"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+func TestReadReceipts(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "member", Email: "member@example.com", Password: "pass"})
+	store.CreateUser(&models.User{Username: "outsider", Email: "outsider@example.com", Password: "pass"})
+	member, _ := store.GetUserByUsername("member")
+	outsider, _ := store.GetUserByUsername("outsider")
+
+	id, _ := store.CreateChat("Chat", member.ID)
+	chatID := int(id)
+	store.AddParticipant(chatID, member.ID, member.ID, map[int]string{accountDevice(t, store, member.ID): "key"})
+	msg, _, _ := store.SaveMessage(chatID, member.ID, 1, 0, "hello", "", nil)
+
+	hub := ws.NewHub(store)
+	go hub.Run()
+
+	handler := &ChatHandler{Store: store, Hub: hub}
+	vars := map[string]string{"id": strconv.Itoa(chatID)}
+
+	markRead := func(userID int) int {
+		raw, _ := json.Marshal(map[string]int{"message_id": msg.ID})
+		req, _ := http.NewRequest("POST", "/chats/"+strconv.Itoa(chatID)+"/read", bytes.NewBuffer(raw))
+		req = mux.SetURLVars(req, vars)
+		authenticated := login(t, store, userID, req)
+		rr := httptest.NewRecorder()
+		authenticated(http.HandlerFunc(handler.MarkRead)).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if status := markRead(outsider.ID); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a non-participant, got %v", status)
+	}
+	if status := markRead(member.ID); status != http.StatusOK {
+		t.Errorf("Expected 200 marking the chat read, got %v", status)
+	}
+
+	req, _ := http.NewRequest("GET", "/chats/"+strconv.Itoa(chatID)+"/receipts", nil)
+	req = mux.SetURLVars(req, vars)
+	authenticated := login(t, store, member.ID, req)
+	rr := httptest.NewRecorder()
+	authenticated(http.HandlerFunc(handler.GetReadReceipts)).ServeHTTP(rr, req)
+
+	var receipts []models.ReadReceipt
+	json.NewDecoder(rr.Body).Decode(&receipts)
+	if len(receipts) != 1 || receipts[0].UserID != member.ID || receipts[0].MessageID != msg.ID {
+		t.Errorf("Expected the member's receipt, got %+v", receipts)
+	}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/middleware"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+// authorize checks that the user participates in the chat with a role that
+// may take action, answering 403 if not, and returns their membership.
+func (h *ChatHandler) authorize(w http.ResponseWriter, chatID, userID int, action models.Action) (*models.Membership, bool) {
+	membership, err := h.Store.GetMembership(chatID, userID)
+	if errors.Is(err, store.ErrNotParticipant) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if !membership.Can(action) {
+		if membership.ChatType == models.ChatTypeDirect {
+			http.Error(w, "Direct chats don't allow that", http.StatusForbidden)
+		} else {
+			http.Error(w, "Your role in this chat doesn't allow that", http.StatusForbidden)
+		}
+		return nil, false
+	}
+	return membership, true
+}
+
+// ChangeRole gives a participant a new role. Both their current role and
+// the new one must rank below the caller's, so admins manage members and
+// read-only participants, and only the owner manages admins. Ownership
+// itself can't be handed out this way.
+func (h *ChatHandler) ChangeRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatID, _ := strconv.Atoi(vars["id"])
+	targetUserID, _ := strconv.Atoi(vars["userID"])
+	userID := r.Context().Value(middleware.UserIDKey).(int)
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !models.ValidRole(req.Role) || req.Role == models.RoleOwner {
+		http.Error(w, "Role must be admin, member or read_only", http.StatusBadRequest)
+		return
+	}
+
+	actor, ok := h.authorize(w, chatID, userID, models.ActionChangeRole)
+	if !ok {
+		return
+	}
+	target, err := h.Store.GetMembership(chatID, targetUserID)
+	if errors.Is(err, store.ErrNotParticipant) {
+		http.Error(w, "Participant not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !models.Outranks(actor.Role, target.Role) || !models.Outranks(actor.Role, req.Role) {
+		http.Error(w, "You can only move participants below your role to roles below yours", http.StatusForbidden)
+		return
+	}
+
+	changed, err := h.Store.SetParticipantRole(chatID, targetUserID, userID, req.Role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.Hub.Broadcast(chatID, ws.TypeMessage, changed)
+
+	participants, err := h.Store.GetChatParticipants(chatID)
+	if err == nil {
+		for _, p := range participants {
+			h.Hub.SendNotification(p.ID, ws.TypeRoleChanged, ws.RoleChangedEvent{ChatID: chatID, UserID: targetUserID, Role: req.Role})
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store/sqlstore"
+	"github.com/pliu/chatty/internal/ws"
+)
+
+// roleChat is a group chat with one participant of each role and a user
+// waiting to be invited.
+type roleChat struct {
+	t       *testing.T
+	store   *sqlstore.SQLStore
+	handler *ChatHandler
+	chatID  int
+	users   map[string]*models.User // By role, plus "newcomer"
+}
+
+func newRoleChat(t *testing.T) *roleChat {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	users := make(map[string]*models.User)
+	for _, name := range []string{models.RoleOwner, models.RoleAdmin, models.RoleMember, models.RoleReadOnly, "newcomer"} {
+		store.CreateUser(&models.User{Username: name, Email: name + "@example.com", Password: "pass"})
+		users[name], _ = store.GetUserByUsername(name)
+	}
+
+	id, _ := store.CreateChat("Chat", users[models.RoleOwner].ID)
+	chatID := int(id)
+	for _, role := range []string{models.RoleOwner, models.RoleAdmin, models.RoleMember, models.RoleReadOnly} {
+		userID := users[role].ID
+		store.AddParticipant(chatID, userID, userID, map[int]string{accountDevice(t, store, userID): "key"})
+		if role != models.RoleOwner {
+			store.SetParticipantRole(chatID, userID, userID, role)
+		}
+	}
+
+	hub := ws.NewHub(store)
+	go hub.Run()
+	return &roleChat{
+		t:       t,
+		store:   store,
+		handler: &ChatHandler{Store: store, Hub: hub, Attachments: DefaultAttachmentLimits},
+		chatID:  chatID,
+		users:   users,
+	}
+}
+
+func (c *roleChat) do(as string, method, path string, body interface{}, vars map[string]string, h http.HandlerFunc) int {
+	raw, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, "/chats/"+strconv.Itoa(c.chatID)+path, bytes.NewReader(raw))
+	vars["id"] = strconv.Itoa(c.chatID)
+	req = mux.SetURLVars(req, vars)
+	authenticated := login(c.t, c.store, c.users[as].ID, req)
+	rr := httptest.NewRecorder()
+	authenticated(h).ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func (c *roleChat) remove(as, target string) int {
+	userID := strconv.Itoa(c.users[target].ID)
+	return c.do(as, "DELETE", "/participants/"+userID, nil, map[string]string{"userID": userID}, c.handler.RemoveParticipant)
+}
+
+func (c *roleChat) changeRole(as, target, role string) int {
+	userID := strconv.Itoa(c.users[target].ID)
+	body := map[string]string{"role": role}
+	return c.do(as, "PUT", "/participants/"+userID+"/role", body, map[string]string{"userID": userID}, c.handler.ChangeRole)
+}
+
+func TestRolePermissions(t *testing.T) {
+	// Each role acting on a fresh chat, with a target it would outrank if
+	// the action were allowed at all.
+	lowest := func(role string) string {
+		if role == models.RoleReadOnly {
+			return models.RoleMember
+		}
+		return models.RoleReadOnly
+	}
+	actions := map[string]func(c *roleChat, as string) int{
+		"invite": func(c *roleChat, as string) int {
+			newcomer := c.users["newcomer"].ID
+			body := map[string]interface{}{
+				"username": "newcomer",
+				"keys":     []WrappedKey{{DeviceID: accountDevice(t, c.store, newcomer), EncryptedKey: "key"}},
+			}
+			return c.do(as, "POST", "/invite", body, map[string]string{}, c.handler.InviteUser)
+		},
+		"remove": func(c *roleChat, as string) int {
+			return c.remove(as, lowest(as))
+		},
+		"change_role": func(c *roleChat, as string) int {
+			return c.changeRole(as, lowest(as), models.RoleReadOnly)
+		},
+		"delete": func(c *roleChat, as string) int {
+			return c.do(as, "DELETE", "", nil, map[string]string{}, c.handler.DeleteChat)
+		},
+		"post": func(c *roleChat, as string) int {
+			body := map[string]interface{}{"size": 1, "content_type": "text/plain"}
+			if code := c.do(as, "POST", "/attachments", body, map[string]string{}, c.handler.CreateAttachment); code != http.StatusCreated {
+				return code
+			}
+			return http.StatusOK
+		},
+		"pin": func(c *roleChat, as string) int {
+			msg, _, _ := c.store.SaveMessage(c.chatID, c.users[models.RoleOwner].ID, 1, 0, "hello", "", nil)
+			messageID := strconv.Itoa(msg.ID)
+			if code := c.do(as, "POST", "/pins/"+messageID, nil, map[string]string{"messageID": messageID}, c.handler.PinMessage); code != http.StatusCreated {
+				return code
+			}
+			return http.StatusOK
+		},
+		"rekey": func(c *roleChat, as string) int {
+			var keys []WrappedKey
+			participants, _ := c.store.GetChatParticipants(c.chatID)
+			for _, p := range participants {
+				for _, d := range p.Devices {
+					keys = append(keys, WrappedKey{DeviceID: d.ID, EncryptedKey: "key-2"})
+				}
+			}
+			return c.do(as, "POST", "/keys", map[string]interface{}{"epoch": 2, "keys": keys}, map[string]string{}, c.handler.RotateChatKey)
+		},
+		"leave": func(c *roleChat, as string) int {
+			return c.do(as, "POST", "/leave", nil, map[string]string{}, c.handler.LeaveChat)
+		},
+	}
+	allowed := map[string]map[string]bool{
+		models.RoleOwner:    {"invite": true, "remove": true, "change_role": true, "delete": true, "post": true, "pin": true, "rekey": true},
+		models.RoleAdmin:    {"invite": true, "remove": true, "change_role": true, "post": true, "pin": true, "leave": true},
+		models.RoleMember:   {"invite": true, "post": true, "pin": true, "leave": true},
+		models.RoleReadOnly: {"leave": true},
+	}
+
+	for role, granted := range allowed {
+		for action, do := range actions {
+			want := http.StatusForbidden
+			if granted[action] {
+				want = http.StatusOK
+			}
+			if got := do(newRoleChat(t), role); got != want {
+				t.Errorf("%s %s: expected %d, got %d", role, action, want, got)
+			}
+		}
+	}
+}
+
+func TestRoleHierarchy(t *testing.T) {
+	c := newRoleChat(t)
+
+	// Admins can't act on their equals or betters, or hand out their own role
+	if status := c.remove(models.RoleAdmin, models.RoleOwner); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for an admin removing the owner, got %v", status)
+	}
+	if status := c.changeRole(models.RoleAdmin, models.RoleMember, models.RoleAdmin); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for an admin promoting to admin, got %v", status)
+	}
+	if status := c.changeRole(models.RoleAdmin, models.RoleReadOnly, models.RoleMember); status != http.StatusOK {
+		t.Errorf("Expected 200 for an admin promoting a read-only participant, got %v", status)
+	}
+	if status := c.remove(models.RoleOwner, models.RoleOwner); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for removing yourself, got %v", status)
+	}
+
+	// Ownership isn't handed out with a role change
+	if status := c.changeRole(models.RoleOwner, models.RoleAdmin, models.RoleOwner); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 making someone owner, got %v", status)
+	}
+	if status := c.changeRole(models.RoleOwner, "newcomer", models.RoleMember); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for a non-participant, got %v", status)
+	}
+
+	// The owner manages admins
+	if status := c.changeRole(models.RoleOwner, models.RoleAdmin, models.RoleMember); status != http.StatusOK {
+		t.Fatalf("Expected 200 for the owner demoting an admin, got %v", status)
+	}
+	if m, _ := c.store.GetMembership(c.chatID, c.users[models.RoleAdmin].ID); m.Role != models.RoleMember {
+		t.Errorf("Expected the admin to be a member now, got %s", m.Role)
+	}
+	if status := c.remove(models.RoleAdmin, models.RoleReadOnly); status != http.StatusForbidden {
+		t.Errorf("Expected 403 removing after being demoted, got %v", status)
+	}
+}
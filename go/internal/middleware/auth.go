@@ -3,36 +3,33 @@ package middleware
 import (
 	"context"
 	"net/http"
-	"strconv"
 
 	"github.com/pliu/chatty/internal/auth"
 )
 
 type contextKey string
 
-const UserIDKey contextKey = "user_id"
-
-func AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("user_id")
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		userIDStr, err := auth.VerifyCookie(cookie.Value)
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		userID, err := strconv.Atoi(userIDStr)
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+const (
+	UserIDKey    contextKey = "user_id"
+	SessionIDKey contextKey = "session_id"
+	DeviceIDKey  contextKey = "device_id"
+)
 
-		ctx := context.WithValue(r.Context(), UserIDKey, userID)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+// NewAuthMiddleware rejects requests without a live session and puts the
+// session's user, ID and device in the request context.
+func NewAuthMiddleware(sessions *auth.SessionManager) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session, err := sessions.Authenticate(r)
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), UserIDKey, session.UserID)
+			ctx = context.WithValue(ctx, SessionIDKey, session.ID)
+			ctx = context.WithValue(ctx, DeviceIDKey, session.DeviceID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
 }
@@ -8,17 +8,35 @@ import (
 	"testing"
 
 	"github.com/pliu/chatty/internal/auth"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store/sqlstore"
 )
 
 func TestAuthMiddleware(t *testing.T) {
+	store, err := sqlstore.New("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	user, _ := store.GetUserByUsername("user1")
+
+	sessions := auth.NewSessionManager(store)
+	session, err := sessions.Create(user.ID, httptest.NewRequest("POST", "/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// Mock next handler
 	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		userID := r.Context().Value(UserIDKey)
 		if userID == nil {
 			t.Error("Expected userID in context")
 		}
-		if userID.(int) != 123 {
-			t.Errorf("Expected userID 123, got %v", userID)
+		if userID.(int) != user.ID {
+			t.Errorf("Expected userID %d, got %v", user.ID, userID)
+		}
+		if sessionID := r.Context().Value(SessionIDKey); sessionID != session.ID {
+			t.Errorf("Expected sessionID %s, got %v", session.ID, sessionID)
 		}
 		w.WriteHeader(http.StatusOK)
 	})
@@ -30,17 +48,17 @@ func TestAuthMiddleware(t *testing.T) {
 	}{
 		{
 			name:           "Valid Cookie",
-			cookieValue:    auth.SignCookie("123"),
+			cookieValue:    auth.SignCookie(session.ID),
 			expectedStatus: http.StatusOK,
 		},
 		{
 			name:           "Invalid Signature",
-			cookieValue:    "123|invalid_signature",
+			cookieValue:    session.ID + "|invalid_signature",
 			expectedStatus: http.StatusUnauthorized,
 		},
 		{
-			name:           "Invalid Value",
-			cookieValue:    "not_an_int|signature", // Signature won't match anyway
+			name:           "Unknown Session",
+			cookieValue:    auth.SignCookie("no_such_session"),
 			expectedStatus: http.StatusUnauthorized,
 		},
 	}
@@ -48,10 +66,10 @@ func TestAuthMiddleware(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			req := httptest.NewRequest("GET", "/", nil)
-			req.AddCookie(&http.Cookie{Name: "user_id", Value: tt.cookieValue})
+			req.AddCookie(&http.Cookie{Name: auth.SessionCookieName, Value: tt.cookieValue})
 			rr := httptest.NewRecorder()
 
-			AuthMiddleware(nextHandler).ServeHTTP(rr, req)
+			NewAuthMiddleware(sessions)(nextHandler).ServeHTTP(rr, req)
 
 			if rr.Code != tt.expectedStatus {
 				t.Errorf("handler returned wrong status code: got %v want %v",
@@ -64,7 +82,7 @@ func TestAuthMiddleware(t *testing.T) {
 		req := httptest.NewRequest("GET", "/", nil)
 		rr := httptest.NewRecorder()
 
-		AuthMiddleware(nextHandler).ServeHTTP(rr, req)
+		NewAuthMiddleware(sessions)(nextHandler).ServeHTTP(rr, req)
 
 		if rr.Code != http.StatusUnauthorized {
 			t.Errorf("handler returned wrong status code: got %v want %v",
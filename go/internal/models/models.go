@@ -3,28 +3,292 @@ package models
 import "time"
 
 type User struct {
-	ID                  int    `json:"id"`
-	Username            string `json:"username"`
-	Email               string `json:"email"`
-	Password            string `json:"-"`
-	PublicKey           string `json:"public_key"`
-	EncryptedPrivateKey string `json:"encrypted_private_key"`
-	IsVerified          bool   `json:"is_verified"`
-	VerificationToken   string `json:"-"`
+	ID                  int        `json:"id"`
+	Username            string     `json:"username"`
+	Email               string     `json:"email"`
+	Password            string     `json:"-"`
+	PublicKey           string     `json:"public_key"`
+	EncryptedPrivateKey string     `json:"encrypted_private_key"`
+	IsVerified          bool       `json:"is_verified"`
+	VerificationToken   string     `json:"-"`
+	Devices             []Device   `json:"devices,omitempty"`      // Set where clients need to wrap keys for the user
+	LastSeenAt          *time.Time `json:"last_seen_at,omitempty"` // When the user last disconnected, set for chat participants
+	Role                string     `json:"role,omitempty"`         // Set for chat participants
+	DeactivatedAt       *time.Time `json:"deactivated_at,omitempty"`
 }
 
+// Device is one of a user's clients, with its own keypair. Chat keys are
+// wrapped for each device separately. The account device's private key is
+// the one wrapped with the user's password and can't be revoked.
+type Device struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Name      string    `json:"name"`
+	PublicKey string    `json:"public_key"`
+	IsAccount bool      `json:"is_account"`
+	CreatedAt time.Time `json:"created_at"`
+	Current   bool      `json:"current,omitempty"` // Set when listing a user's devices
+}
+
+// Session is a server-side login. Its ID is what the signed session cookie
+// carries, so it is never reused and is deleted on logout or revocation.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	DeviceID   int       `json:"device_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current,omitempty"` // Set when listing a user's sessions
+}
+
+// Chat types. Direct chats have exactly two members, are unique per pair
+// and have no meaningful owner; they are listed under the other member's
+// username.
+const (
+	ChatTypeGroup  = "group"
+	ChatTypeDirect = "direct"
+)
+
 type Chat struct {
 	ID           int    `json:"id"`
 	Name         string `json:"name"`
+	Type         string `json:"type"`
 	OwnerID      int    `json:"owner_id"`
-	EncryptedKey string `json:"encrypted_key,omitempty"` // Per-user encrypted chat key
+	Role         string `json:"role,omitempty"`          // The requesting user's role
+	EncryptedKey string `json:"encrypted_key,omitempty"` // Chat key for KeyEpoch, wrapped for the requesting device
+	KeyEpoch     int    `json:"key_epoch"`
+	RekeyNeeded  bool   `json:"rekey_needed,omitempty"` // A member left since the last rekey
+
+	// PendingOwnerID is the participant the owner offered the chat to; they
+	// become its owner once they accept.
+	PendingOwnerID int `json:"pending_owner_id,omitempty"`
+
+	// Details besides the name. Each text field's key epoch is that of the
+	// chat key the client encrypted it under, or zero for plain text.
+	NameKeyEpoch        int    `json:"name_key_epoch,omitempty"`
+	Description         string `json:"description,omitempty"`
+	DescriptionKeyEpoch int    `json:"description_key_epoch,omitempty"`
+	Topic               string `json:"topic,omitempty"`
+	TopicKeyEpoch       int    `json:"topic_key_epoch,omitempty"`
+	AvatarAttachmentID  int    `json:"avatar_attachment_id,omitempty"`
+
+	// The requesting user's read state: their read pointer and how many
+	// messages from others arrived after it.
+	LastReadMessageID int        `json:"last_read_message_id"`
+	UnreadCount       int        `json:"unread_count"`
+	LastMessageAt     *time.Time `json:"last_message_at,omitempty"`
 }
 
-type Message struct {
+// ChatField is a new value for a chat detail. KeyEpoch is zero for plain
+// text, or the epoch of the chat key the client encrypted Value under.
+type ChatField struct {
+	Value    string `json:"value"`
+	KeyEpoch int    `json:"key_epoch,omitempty"`
+}
+
+// ChatChanges is an update to a group chat's details. Nil fields are left
+// as they are; an AvatarAttachmentID of zero removes the avatar.
+type ChatChanges struct {
+	Name               *ChatField `json:"name,omitempty"`
+	Description        *ChatField `json:"description,omitempty"`
+	Topic              *ChatField `json:"topic,omitempty"`
+	AvatarAttachmentID *int       `json:"avatar_attachment_id,omitempty"`
+}
+
+// Empty reports whether the update changes nothing.
+func (c *ChatChanges) Empty() bool {
+	return c.Name == nil && c.Description == nil && c.Topic == nil && c.AvatarAttachmentID == nil
+}
+
+// Invite is a shareable code that lets users ask to join a group chat. It
+// stops working once it expires, has been used MaxUses times (zero means no
+// limit) or is revoked.
+type Invite struct {
+	ID               int        `json:"id"`
+	ChatID           int        `json:"chat_id"`
+	Code             string     `json:"code"`
+	CreatedBy        int        `json:"created_by"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	MaxUses          int        `json:"max_uses"`
+	Uses             int        `json:"uses"`
+	RequiresApproval bool       `json:"requires_approval"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// Usable reports whether the invite can still be redeemed at now.
+func (i *Invite) Usable(now time.Time) bool {
+	if i.ExpiresAt != nil && !now.Before(*i.ExpiresAt) {
+		return false
+	}
+	return i.MaxUses == 0 || i.Uses < i.MaxUses
+}
+
+// JoinRequest is a user who redeemed an invite and is waiting to join. The
+// server can't hand them the chat key, so they become a participant once a
+// member's client wraps it for their devices; if the invite required
+// approval, that member has to be an owner or admin.
+type JoinRequest struct {
+	ChatID           int       `json:"chat_id"`
+	UserID           int       `json:"user_id"`
+	Username         string    `json:"username"`
+	RequiresApproval bool      `json:"requires_approval"`
+	CreatedAt        time.Time `json:"created_at"`
+	Devices          []Device  `json:"devices,omitempty"` // Set where members need to wrap keys for the joiner
+}
+
+// Audit log actions.
+const (
+	AuditOwnershipTransferred = "ownership_transferred" // The owner handed the chat over and the new owner accepted
+	AuditOwnershipSucceeded   = "ownership_succeeded"   // The owner's account was deactivated and a successor took over
+)
+
+// AuditEntry records a change to who runs a chat. ActorID is the user whose
+// action caused it, and TargetID the user it happened to.
+type AuditEntry struct {
 	ID        int       `json:"id"`
 	ChatID    int       `json:"chat_id"`
-	UserID    int       `json:"user_id"`
-	Username  string    `json:"username"`
-	Content   string    `json:"content"`
+	Action    string    `json:"action"`
+	ActorID   int       `json:"actor_id"`
+	TargetID  int       `json:"target_id"`
 	CreatedAt time.Time `json:"created_at"`
+
+	// Message is the system message announcing the change in the chat,
+	// when it has just been made.
+	Message *Message `json:"message,omitempty"`
+}
+
+// ReadReceipt is a member's read pointer: the newest message they have seen
+// in a chat.
+type ReadReceipt struct {
+	ChatID    int `json:"chat_id"`
+	UserID    int `json:"user_id"`
+	MessageID int `json:"message_id"`
+}
+
+// ChatKey is one epoch's chat key, wrapped for a single device.
+type ChatKey struct {
+	ChatID       int    `json:"chat_id,omitempty"`
+	Epoch        int    `json:"epoch"`
+	EncryptedKey string `json:"encrypted_key"`
+}
+
+// Message kinds. Participants post user messages; the server writes system
+// messages to record changes to the chat in its timeline. System messages
+// have no content, and their Event says what changed and UserID who changed
+// it.
+const (
+	MessageKindUser   = "user"
+	MessageKindSystem = "system"
+)
+
+// System event types. Apart from chat_updated, each is about the
+// participant in the event's UserID.
+const (
+	EventChatUpdated    = "chat_updated"
+	EventMemberJoined   = "member_joined"
+	EventMemberLeft     = "member_left"
+	EventMemberRemoved  = "member_removed"
+	EventRoleChanged    = "role_changed"
+	EventOwnerChanged   = "owner_changed"
+	EventMessageDeleted = "message_deleted" // Someone else's message was deleted by a moderator
+)
+
+// SystemEvent is what a system message records.
+type SystemEvent struct {
+	Type string       `json:"type"`
+	Chat *ChatChanges `json:"chat,omitempty"` // chat_updated: the details that changed, with their new values
+
+	// The participant the event is about, with their name at the time
+	UserID   int    `json:"user_id,omitempty"`
+	Username string `json:"username,omitempty"`
+
+	Role      string `json:"role,omitempty"`       // role_changed: the new role
+	Reason    string `json:"reason,omitempty"`     // owner_changed: the audit action
+	MessageID int    `json:"message_id,omitempty"` // message_deleted: the deleted message
+}
+
+type Message struct {
+	ID          int       `json:"id"`
+	Kind        string    `json:"kind"`
+	ChatID      int       `json:"chat_id"`
+	UserID      int       `json:"user_id"`
+	Username    string    `json:"username"`
+	Content     string    `json:"content"`
+	KeyEpoch    int       `json:"key_epoch"`               // Epoch of the chat key the content is encrypted under
+	ClientMsgID string    `json:"client_msg_id,omitempty"` // Sender-supplied idempotency key
+	CreatedAt   time.Time `json:"created_at"`
+
+	Event *SystemEvent `json:"event,omitempty"` // Set for system messages
+
+	// Replies point at the message they answer and the root of its thread.
+	// Roots carry their number of replies and when the latest arrived.
+	ReplyTo      int        `json:"reply_to,omitempty"`
+	ThreadRootID int        `json:"thread_root_id,omitempty"`
+	ReplyCount   int        `json:"reply_count,omitempty"`
+	LastReplyAt  *time.Time `json:"last_reply_at,omitempty"`
+
+	// A deleted message is a tombstone: its content is cleared and DeletedBy
+	// is the sender or the chat owner or admin who removed it.
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy int        `json:"deleted_by,omitempty"`
+
+	// Pinned messages record when and by whom.
+	PinnedAt *time.Time `json:"pinned_at,omitempty"`
+	PinnedBy int        `json:"pinned_by,omitempty"`
+
+	Reactions   []ReactionCount `json:"reactions,omitempty"`
+	Attachments []Attachment    `json:"attachments,omitempty"`
+}
+
+// ReactionCount aggregates one reaction on a message. Reactions are opaque
+// strings chosen by clients, e.g. an emoji.
+type ReactionCount struct {
+	Reaction string `json:"reaction"`
+	Count    int    `json:"count"`
+	UserIDs  []int  `json:"user_ids"`
+}
+
+// Attachment is an encrypted file uploaded to a chat in chunks of ChunkSize
+// bytes. Size and ContentType are declared by the uploader; the content is
+// ciphertext the server can't inspect. Received counts the bytes uploaded
+// so far, and the attachment can be sent once it reaches Size.
+type Attachment struct {
+	ID          int       `json:"id"`
+	ChatID      int       `json:"chat_id"`
+	UserID      int       `json:"user_id"`
+	MessageID   int       `json:"message_id,omitempty"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	ChunkSize   int64     `json:"chunk_size"`
+	Received    int64     `json:"received"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Complete reports whether every chunk has been uploaded.
+func (a *Attachment) Complete() bool {
+	return a.Received == a.Size
+}
+
+// Chunks returns the number of chunks the attachment is uploaded in.
+func (a *Attachment) Chunks() int {
+	return int((a.Size + a.ChunkSize - 1) / a.ChunkSize)
+}
+
+// MessageEdit is a previous version of an edited message.
+type MessageEdit struct {
+	Content    string    `json:"content"`
+	KeyEpoch   int       `json:"key_epoch"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// MessagePage is one page of a chat's history. Next is a cursor for older
+// messages (pass it as before=) and Prev one for newer messages (after=);
+// each is empty when there is nothing further in that direction.
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	Next     string    `json:"next,omitempty"`
+	Prev     string    `json:"prev,omitempty"`
 }
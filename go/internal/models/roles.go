@@ -0,0 +1,99 @@
+package models
+
+// Participant roles, from most to least privileged. Every group chat has
+// exactly one owner. Members of direct chats are all plain members.
+const (
+	RoleOwner    = "owner"
+	RoleAdmin    = "admin"
+	RoleMember   = "member"
+	RoleReadOnly = "read_only"
+)
+
+// roleRanks orders the roles; a higher rank outranks a lower one.
+var roleRanks = map[string]int{
+	RoleReadOnly: 1,
+	RoleMember:   2,
+	RoleAdmin:    3,
+	RoleOwner:    4,
+}
+
+// ValidRole reports whether role is one of the participant roles.
+func ValidRole(role string) bool {
+	return roleRanks[role] > 0
+}
+
+// Outranks reports whether role is strictly more privileged than other.
+// Removing a participant or changing their role takes a role that outranks
+// theirs, and a role can only hand out roles below itself.
+func Outranks(role, other string) bool {
+	return roleRanks[role] > roleRanks[other]
+}
+
+// Action is something a participant may be allowed to do in a chat.
+type Action string
+
+const (
+	ActionInvite        Action = "invite"         // Add participants and let in joiners from invite links
+	ActionManageInvites Action = "manage_invites" // Create and revoke invite links, and approve or reject joiners
+	ActionRemove        Action = "remove"         // Remove participants of a lower role
+	ActionRename        Action = "rename"         // Change the chat's name and details
+	ActionDelete        Action = "delete"         // Delete the chat
+	ActionPost          Action = "post"           // Send messages and attachments
+	ActionPin           Action = "pin"            // Pin messages
+	ActionModerate      Action = "moderate"       // Delete other participants' messages
+	ActionChangeRole    Action = "change_role"    // Change the role of participants of a lower role
+	ActionRekey         Action = "rekey"          // Rotate the chat key
+	ActionTransfer      Action = "transfer"       // Offer ownership of the chat to another participant
+	ActionViewAudit     Action = "view_audit"     // Read the chat's audit log
+	ActionLeave         Action = "leave"          // Leave the chat; the owner has to hand it over or delete it instead
+)
+
+// permissions lists what each role may do in a group chat.
+var permissions = map[string]map[Action]bool{
+	RoleOwner: {
+		ActionInvite: true, ActionManageInvites: true, ActionRemove: true, ActionRename: true, ActionDelete: true,
+		ActionPost: true, ActionPin: true, ActionModerate: true, ActionChangeRole: true, ActionRekey: true,
+		ActionTransfer: true, ActionViewAudit: true,
+	},
+	RoleAdmin: {
+		ActionInvite: true, ActionManageInvites: true, ActionRemove: true, ActionRename: true,
+		ActionPost: true, ActionPin: true, ActionModerate: true, ActionChangeRole: true, ActionViewAudit: true,
+		ActionLeave: true,
+	},
+	RoleMember: {
+		ActionInvite: true, ActionPost: true, ActionPin: true, ActionLeave: true,
+	},
+	RoleReadOnly: {
+		ActionLeave: true,
+	},
+}
+
+// directPermissions lists what either member of a direct chat may do.
+// Direct chats always have the same two members and nobody runs them.
+var directPermissions = map[Action]bool{
+	ActionPost:  true,
+	ActionPin:   true,
+	ActionRekey: true,
+}
+
+// Can reports whether a participant with role may take action in a chat of
+// chatType. It is the single place chat permissions are decided.
+func Can(chatType, role string, action Action) bool {
+	if chatType == ChatTypeDirect {
+		return ValidRole(role) && directPermissions[action]
+	}
+	return permissions[role][action]
+}
+
+// Membership is a user's standing in a chat they participate in.
+type Membership struct {
+	ChatID   int
+	UserID   int
+	ChatType string
+	Role     string
+}
+
+// Can reports whether the member may take action.
+func (m *Membership) Can(action Action) bool {
+	return Can(m.ChatType, m.Role, action)
+}
@@ -0,0 +1,58 @@
+package models
+
+import "testing"
+
+func TestCan(t *testing.T) {
+	actions := []Action{
+		ActionInvite, ActionManageInvites, ActionRemove, ActionRename, ActionDelete, ActionPost,
+		ActionPin, ActionModerate, ActionChangeRole, ActionRekey, ActionTransfer, ActionViewAudit, ActionLeave,
+	}
+	allowed := map[string]map[string][]Action{
+		ChatTypeGroup: {
+			RoleOwner: {
+				ActionInvite, ActionManageInvites, ActionRemove, ActionRename, ActionDelete, ActionPost,
+				ActionPin, ActionModerate, ActionChangeRole, ActionRekey, ActionTransfer, ActionViewAudit,
+			},
+			RoleAdmin:    {ActionInvite, ActionManageInvites, ActionRemove, ActionRename, ActionPost, ActionPin, ActionModerate, ActionChangeRole, ActionViewAudit, ActionLeave},
+			RoleMember:   {ActionInvite, ActionPost, ActionPin, ActionLeave},
+			RoleReadOnly: {ActionLeave},
+		},
+		ChatTypeDirect: {
+			RoleMember: {ActionPost, ActionPin, ActionRekey},
+		},
+	}
+
+	for chatType, roles := range allowed {
+		for role, granted := range roles {
+			want := make(map[Action]bool)
+			for _, action := range granted {
+				want[action] = true
+			}
+			for _, action := range actions {
+				if got := Can(chatType, role, action); got != want[action] {
+					t.Errorf("Can(%s, %s, %s) = %v, want %v", chatType, role, action, got, want[action])
+				}
+			}
+		}
+	}
+
+	for _, action := range actions {
+		if Can(ChatTypeGroup, "", action) || Can(ChatTypeDirect, "", action) {
+			t.Errorf("Expected no role to be allowed to %s", action)
+		}
+	}
+}
+
+func TestOutranks(t *testing.T) {
+	ranked := []string{RoleReadOnly, RoleMember, RoleAdmin, RoleOwner}
+	for i, role := range ranked {
+		for j, other := range ranked {
+			if got := Outranks(role, other); got != (i > j) {
+				t.Errorf("Outranks(%s, %s) = %v, want %v", role, other, got, i > j)
+			}
+		}
+	}
+	if ValidRole("superuser") || !ValidRole(RoleReadOnly) {
+		t.Error("Expected only the participant roles to be valid")
+	}
+}
@@ -0,0 +1,44 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+)
+
+// Local is an in-process Broker for single-instance deployments and tests.
+// Several hubs sharing one Local behave like several server instances.
+type Local struct {
+	mu     sync.Mutex
+	queues []*queue
+}
+
+func NewLocal() *Local {
+	return &Local{}
+}
+
+func (l *Local) Publish(ctx context.Context, event Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, q := range l.queues {
+		q.push(event)
+	}
+	return nil
+}
+
+func (l *Local) Subscribe() <-chan Event {
+	q := newQueue()
+	l.mu.Lock()
+	l.queues = append(l.queues, q)
+	l.mu.Unlock()
+	return q.out
+}
+
+func (l *Local) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, q := range l.queues {
+		q.close()
+	}
+	l.queues = nil
+	return nil
+}
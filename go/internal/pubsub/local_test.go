@@ -0,0 +1,35 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLocalFansOutToEverySubscriber(t *testing.T) {
+	broker := NewLocal()
+	defer broker.Close()
+
+	first := broker.Subscribe()
+	second := broker.Subscribe()
+
+	// Publishing many events without anyone reading must not block.
+	for i := 1; i <= 1000; i++ {
+		if err := broker.Publish(context.Background(), Event{Kind: KindChat, ChatID: i}); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+
+	for _, sub := range []<-chan Event{first, second} {
+		for i := 1; i <= 1000; i++ {
+			select {
+			case event := <-sub:
+				if event.ChatID != i {
+					t.Fatalf("Expected events in publish order, got chat %d at position %d", event.ChatID, i)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Timed out waiting for event %d", i)
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package pubsub
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Outbox publishes events to a broker on its own goroutine, in the order
+// they were queued, so publishers never wait on the broker. Each publish
+// gets up to timeout; events that fail are logged and dropped.
+type Outbox struct {
+	broker  Broker
+	timeout time.Duration
+	queue   *queue
+}
+
+// NewOutbox starts an outbox publishing to broker.
+func NewOutbox(broker Broker, timeout time.Duration) *Outbox {
+	o := &Outbox{broker: broker, timeout: timeout, queue: newQueue()}
+	go o.run()
+	return o
+}
+
+// Publish queues an event. It never blocks.
+func (o *Outbox) Publish(event Event) {
+	o.queue.push(event)
+}
+
+func (o *Outbox) run() {
+	for event := range o.queue.out {
+		ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+		if err := o.broker.Publish(ctx, event); err != nil {
+			log.Printf("Error publishing %s event: %v", event.Kind, err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,48 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// stuckBroker never completes a publish before its context ends.
+type stuckBroker struct {
+	Local
+	attempts chan Event
+}
+
+func (b *stuckBroker) Publish(ctx context.Context, event Event) error {
+	if _, ok := ctx.Deadline(); !ok {
+		panic("publish without a deadline")
+	}
+	b.attempts <- event
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestOutboxTimesOut(t *testing.T) {
+	broker := &stuckBroker{attempts: make(chan Event, 3)}
+	outbox := NewOutbox(broker, 100*time.Millisecond)
+
+	// Publishing returns at once, however slow the broker
+	start := time.Now()
+	for i := 1; i <= 3; i++ {
+		outbox.Publish(Event{Kind: KindChat, ChatID: i})
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Expected publishing to return at once, took %v", elapsed)
+	}
+
+	// Each stuck publish gives up in turn, in order
+	for i := 1; i <= 3; i++ {
+		select {
+		case event := <-broker.attempts:
+			if event.ChatID != i {
+				t.Errorf("Expected event %d, got %d", i, event.ChatID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for publish %d", i)
+		}
+	}
+}
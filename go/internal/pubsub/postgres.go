@@ -0,0 +1,200 @@
+package pubsub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Channel is the Postgres NOTIFY channel every chatty instance listens on.
+const Channel = "chatty_events"
+
+// maxPayload is Postgres' limit on a NOTIFY payload.
+const maxPayload = 8000
+
+// spillTTL is how long an event too large for a NOTIFY payload is kept in
+// pubsub_events for listeners to load.
+const spillTTL = time.Minute
+
+// loadTimeout bounds loading a spilled event on the listener goroutine.
+const loadTimeout = 5 * time.Second
+
+// notification is a NOTIFY payload: an event, or for one over maxPayload a
+// stub of it with Ref naming the pubsub_events row that holds all of it.
+type notification struct {
+	Event
+	Ref int64 `json:"ref,omitempty"`
+}
+
+// Postgres is a Broker over LISTEN/NOTIFY, letting several chatty instances
+// behind a load balancer deliver each other's events. Events published while
+// a listener is reconnecting are lost; clients recover them via replay.
+// Events too large for NOTIFY go through the pubsub_events table, which the
+// database's migrations create.
+type Postgres struct {
+	db       *sql.DB
+	listener *pq.Listener
+
+	mu     sync.Mutex
+	queues []*queue
+	done   chan struct{}
+}
+
+// NewPostgres connects a listener and a publishing pool to dataSourceName.
+func NewPostgres(dataSourceName string) (*Postgres, error) {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	listener := pq.NewListener(dataSourceName, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("pubsub listener: %v", err)
+		}
+		if ev == pq.ListenerEventReconnected {
+			log.Printf("pubsub listener reconnected; events sent while disconnected were dropped")
+		}
+	})
+	if err := listener.Listen(Channel); err != nil {
+		listener.Close()
+		db.Close()
+		return nil, err
+	}
+
+	p := &Postgres{db: db, listener: listener, done: make(chan struct{})}
+	go p.listen()
+	go p.prune()
+	return p, nil
+}
+
+func (p *Postgres) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(notification{Event: event})
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxPayload {
+		ref, err := p.spill(ctx, payload)
+		if err != nil {
+			return fmt.Errorf("storing event of %d bytes: %w", len(payload), err)
+		}
+		stub := Event{Kind: event.Kind, ChatID: event.ChatID, UserID: event.UserID}
+		if payload, err = json.Marshal(notification{Event: stub, Ref: ref}); err != nil {
+			return err
+		}
+	}
+	_, err = p.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", Channel, string(payload))
+	return err
+}
+
+// spill stores a payload too large to notify and returns its row.
+func (p *Postgres) spill(ctx context.Context, payload []byte) (int64, error) {
+	var id int64
+	err := p.db.QueryRowContext(ctx, "INSERT INTO pubsub_events (payload, created_at) VALUES ($1, $2) RETURNING id", string(payload), time.Now().UTC()).Scan(&id)
+	return id, err
+}
+
+// prune deletes spilled events every listener has had time to load, once
+// per spillTTL until the broker is closed. Every instance sweeps; deleting
+// rows another instance already deleted is harmless.
+func (p *Postgres) prune() {
+	ticker := time.NewTicker(spillTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), loadTimeout)
+			if _, err := p.db.ExecContext(ctx, "DELETE FROM pubsub_events WHERE created_at < $1", time.Now().UTC().Add(-spillTTL)); err != nil {
+				log.Printf("pubsub: pruning spilled events: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// load reads back a spilled event.
+func (p *Postgres) load(ref int64) (Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), loadTimeout)
+	defer cancel()
+
+	var payload string
+	if err := p.db.QueryRowContext(ctx, "SELECT payload FROM pubsub_events WHERE id = $1", ref).Scan(&payload); err != nil {
+		return Event{}, err
+	}
+	var n notification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		return Event{}, err
+	}
+	return n.Event, nil
+}
+
+func (p *Postgres) Subscribe() <-chan Event {
+	q := newQueue()
+	p.mu.Lock()
+	p.queues = append(p.queues, q)
+	p.mu.Unlock()
+	return q.out
+}
+
+func (p *Postgres) Close() error {
+	close(p.done)
+	p.mu.Lock()
+	for _, q := range p.queues {
+		q.close()
+	}
+	p.queues = nil
+	p.mu.Unlock()
+
+	p.listener.Close()
+	return p.db.Close()
+}
+
+func (p *Postgres) listen() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case n, ok := <-p.listener.Notify:
+			if !ok {
+				return
+			}
+			// A nil notification marks a reconnect.
+			if n == nil {
+				continue
+			}
+
+			var note notification
+			if err := json.Unmarshal([]byte(n.Extra), &note); err != nil {
+				log.Printf("pubsub: dropping malformed event: %v", err)
+				continue
+			}
+			event := note.Event
+			if note.Ref != 0 {
+				loaded, err := p.load(note.Ref)
+				if err != nil {
+					// Pass the stub on, so hubs can tell the chat what it missed
+					log.Printf("pubsub: loading event %d: %v", note.Ref, err)
+				} else {
+					event = loaded
+				}
+			}
+
+			p.mu.Lock()
+			for _, q := range p.queues {
+				q.push(event)
+			}
+			p.mu.Unlock()
+		}
+	}
+}
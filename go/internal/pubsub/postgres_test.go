@@ -0,0 +1,53 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/store/sqlstore"
+)
+
+// TestPostgresLargeEvent publishes an event over the NOTIFY payload limit
+// between two brokers, as two chatty instances would.
+func TestPostgresLargeEvent(t *testing.T) {
+	dsn := os.Getenv("CHATTY_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("CHATTY_TEST_POSTGRES_DSN not set")
+	}
+	// Creates pubsub_events
+	store, err := sqlstore.New("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Failed to connect to Postgres: %v", err)
+	}
+	store.Close()
+
+	publisher, err := NewPostgres(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create broker: %v", err)
+	}
+	defer publisher.Close()
+	listener, err := NewPostgres(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create broker: %v", err)
+	}
+	defer listener.Close()
+	events := listener.Subscribe()
+
+	frame, _ := json.Marshal(map[string]string{"content": strings.Repeat("x", 3*maxPayload)})
+	if err := publisher.Publish(context.Background(), Event{Kind: KindChat, ChatID: 7, Frame: frame}); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	select {
+	case event := <-events:
+		if event.Kind != KindChat || event.ChatID != 7 || string(event.Frame) != string(frame) {
+			t.Errorf("Expected the whole event, got %s for chat %d with a %d byte frame", event.Kind, event.ChatID, len(event.Frame))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the event")
+	}
+}
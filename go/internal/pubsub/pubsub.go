@@ -0,0 +1,112 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// Event kinds.
+const (
+	// KindChat frames go to every connected participant of ChatID.
+	KindChat = "chat"
+	// KindUser frames go to every connection of UserID.
+	KindUser = "user"
+
+	// Membership changes carry no frame: KindJoin and KindLeave add or remove
+	// UserID's connections for ChatID, and KindDrop removes everyone's.
+	KindJoin  = "join"
+	KindLeave = "leave"
+	KindDrop  = "drop"
+
+	// KindCloseSession disconnects every connection opened under SessionID.
+	KindCloseSession = "close_session"
+
+	// KindPresence reports that UserID's connections on Instance are now
+	// Status. Hubs combine the reports of every instance and tell the
+	// members of ChatIDs when the user's overall presence changes.
+	KindPresence = "presence"
+)
+
+// Event is a frame to be delivered by every hub instance to its own matching
+// connections. A KindChat or KindUser event arrives without its Frame if the
+// broker lost it on the way.
+type Event struct {
+	Kind      string          `json:"kind"`
+	ChatID    int             `json:"chat_id,omitempty"`
+	UserID    int             `json:"user_id,omitempty"`
+	SessionID string          `json:"session_id,omitempty"`
+	Frame     json.RawMessage `json:"frame,omitempty"`
+
+	Instance string `json:"instance,omitempty"`
+	Status   string `json:"status,omitempty"`
+	ChatIDs  []int  `json:"chat_ids,omitempty"`
+}
+
+// Broker fans events out to every subscriber, including the publisher's own.
+type Broker interface {
+	// Publish must not block on slow subscribers.
+	Publish(ctx context.Context, event Event) error
+	// Subscribe returns a channel receiving every event published from now on.
+	Subscribe() <-chan Event
+	Close() error
+}
+
+// queue is an unbounded FIFO feeding a channel, so publishers never block on
+// a subscriber that is busy (such as a hub publishing from its own loop).
+type queue struct {
+	mu     sync.Mutex
+	events []Event
+	ready  chan struct{}
+	done   chan struct{}
+	out    chan Event
+}
+
+func newQueue() *queue {
+	q := &queue{
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+		out:   make(chan Event),
+	}
+	go q.pump()
+	return q
+}
+
+func (q *queue) push(event Event) {
+	q.mu.Lock()
+	q.events = append(q.events, event)
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *queue) pump() {
+	defer close(q.out)
+	for {
+		select {
+		case <-q.ready:
+		case <-q.done:
+			return
+		}
+
+		q.mu.Lock()
+		events := q.events
+		q.events = nil
+		q.mu.Unlock()
+
+		for _, event := range events {
+			select {
+			case q.out <- event:
+			case <-q.done:
+				return
+			}
+		}
+	}
+}
+
+func (q *queue) close() {
+	close(q.done)
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// PageOptions selects a window of a chat's history. Before and After are
+// message IDs decoded from cursors; zero leaves that side unbounded. A
+// non-zero ThreadRootID narrows the history to that root and its replies.
+type PageOptions struct {
+	Before       int
+	After        int
+	Limit        int
+	ThreadRootID int
+}
+
+// EncodeCursor returns an opaque pagination cursor anchored at a message.
+// The store resolves the anchor to its (created_at, id) key, so the cursor
+// stays valid however many messages arrive after it was issued.
+func EncodeCursor(messageID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("m:" + strconv.Itoa(messageID)))
+}
+
+// DecodeCursor returns the message ID a cursor is anchored at.
+func DecodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	idStr, ok := strings.CutPrefix(string(raw), "m:")
+	if !ok {
+		return 0, ErrInvalidCursor
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil || id <= 0 {
+		return 0, ErrInvalidCursor
+	}
+	return id, nil
+}
@@ -0,0 +1,133 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+const attachmentColumns = "id, chat_id, user_id, COALESCE(message_id, 0), size, content_type, chunk_size, received, created_at"
+
+func scanAttachment(row interface{ Scan(...any) error }) (models.Attachment, error) {
+	var a models.Attachment
+	err := row.Scan(&a.ID, &a.ChatID, &a.UserID, &a.MessageID, &a.Size, &a.ContentType, &a.ChunkSize, &a.Received, &a.CreatedAt)
+	return a, err
+}
+
+// queryAttachments runs query on q, which may be the database or a
+// transaction, and scans every row.
+func queryAttachments(q interface {
+	Query(string, ...any) (*sql.Rows, error)
+}, query string, args ...any) ([]models.Attachment, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []models.Attachment
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+func (s *SQLStore) CreateAttachment(a *models.Attachment, quota int64) error {
+	// The quota is checked in the insert itself so concurrent uploads can't
+	// both squeeze under it.
+	query := s.rebind(`
+		INSERT INTO attachments (chat_id, user_id, size, content_type, chunk_size)
+		SELECT ?, ?, ?, ?, ?
+		WHERE (SELECT COALESCE(SUM(size), 0) FROM attachments WHERE user_id = ?) + ? <= ?
+		RETURNING id, created_at
+	`)
+	err := s.db.QueryRow(query, a.ChatID, a.UserID, a.Size, a.ContentType, a.ChunkSize, a.UserID, a.Size, quota).Scan(&a.ID, &a.CreatedAt)
+	if err == sql.ErrNoRows {
+		return store.ErrQuotaExceeded
+	}
+	return err
+}
+
+func (s *SQLStore) GetAttachment(id int) (*models.Attachment, error) {
+	query := s.rebind("SELECT " + attachmentColumns + " FROM attachments WHERE id = ?")
+	a, err := scanAttachment(s.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, store.ErrAttachmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s *SQLStore) GetChatAttachments(chatID int) ([]models.Attachment, error) {
+	query := s.rebind("SELECT " + attachmentColumns + " FROM attachments WHERE chat_id = ? ORDER BY id")
+	return queryAttachments(s.db, query, chatID)
+}
+
+func (s *SQLStore) AddAttachmentChunk(id int, offset, n int64) (bool, error) {
+	query := s.rebind("UPDATE attachments SET received = received + ? WHERE id = ? AND received = ? AND received + ? <= size")
+	result, err := s.db.Exec(query, n, id, offset, n)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+func (s *SQLStore) DeleteAttachment(id int) error {
+	query := s.rebind("DELETE FROM attachments WHERE id = ? AND message_id IS NULL")
+	result, err := s.db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return store.ErrAttachmentNotFound
+	}
+	return nil
+}
+
+// attachAttachments fills in the attachments of each message.
+func (s *SQLStore) attachAttachments(messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	index := make(map[int]*models.Message, len(messages))
+	placeholders := make([]string, len(messages))
+	args := make([]interface{}, len(messages))
+	for i := range messages {
+		index[messages[i].ID] = &messages[i]
+		placeholders[i] = "?"
+		args[i] = messages[i].ID
+	}
+
+	query := s.rebind("SELECT " + attachmentColumns + " FROM attachments WHERE message_id IN (" + strings.Join(placeholders, ", ") + ") ORDER BY id")
+	attachments, err := queryAttachments(s.db, query, args...)
+	if err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		m := index[a.MessageID]
+		m.Attachments = append(m.Attachments, a)
+	}
+	return nil
+}
+
+// attachDetails fills in what hangs off each message: its reactions and
+// attachments.
+func (s *SQLStore) attachDetails(messages []models.Message) error {
+	if err := s.attachReactions(messages); err != nil {
+		return err
+	}
+	return s.attachAttachments(messages)
+}
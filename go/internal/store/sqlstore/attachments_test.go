@@ -0,0 +1,98 @@
+package sqlstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func TestAttachments(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "uploader", Email: "uploader@example.com", Password: "pass"})
+	testStore.CreateUser(&models.User{Username: "other", Email: "other@example.com", Password: "pass"})
+	uploader, _ := testStore.GetUserByUsername("uploader")
+	other, _ := testStore.GetUserByUsername("other")
+
+	id, _ := testStore.CreateChat("Chat", uploader.ID)
+	chatID := int(id)
+	testStore.AddParticipant(chatID, uploader.ID, uploader.ID, accountKey(t, uploader.ID, "key"))
+	testStore.AddParticipant(chatID, other.ID, other.ID, accountKey(t, other.ID, "key"))
+
+	attachment := &models.Attachment{ChatID: chatID, UserID: uploader.ID, Size: 10, ContentType: "image/png", ChunkSize: 4}
+	if err := testStore.CreateAttachment(attachment, 15); err != nil {
+		t.Fatalf("CreateAttachment failed: %v", err)
+	}
+	if attachment.ID == 0 || attachment.Chunks() != 3 {
+		t.Errorf("Expected a stored attachment of three chunks, got %+v", attachment)
+	}
+	if err := testStore.CreateAttachment(&models.Attachment{ChatID: chatID, UserID: uploader.ID, Size: 6, ContentType: "image/png", ChunkSize: 4}, 15); !errors.Is(err, store.ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded past the quota, got %v", err)
+	}
+
+	// Incomplete attachments can't be sent
+	if _, _, err := testStore.SaveMessage(chatID, uploader.ID, 1, 0, "photo", "", []int{attachment.ID}); !errors.Is(err, store.ErrAttachmentNotFound) {
+		t.Errorf("Expected ErrAttachmentNotFound for an incomplete attachment, got %v", err)
+	}
+
+	// Chunks are counted once, in order
+	if added, _ := testStore.AddAttachmentChunk(attachment.ID, 4, 4); added {
+		t.Error("Expected a chunk past the received bytes to be refused")
+	}
+	testStore.AddAttachmentChunk(attachment.ID, 0, 4)
+	if added, _ := testStore.AddAttachmentChunk(attachment.ID, 0, 4); added {
+		t.Error("Expected a repeated chunk to be counted once")
+	}
+	testStore.AddAttachmentChunk(attachment.ID, 4, 4)
+	testStore.AddAttachmentChunk(attachment.ID, 8, 2)
+	if stored, _ := testStore.GetAttachment(attachment.ID); !stored.Complete() {
+		t.Fatalf("Expected the attachment to be complete, got %+v", stored)
+	}
+
+	if _, _, err := testStore.SaveMessage(chatID, other.ID, 1, 0, "stolen", "", []int{attachment.ID}); !errors.Is(err, store.ErrAttachmentNotFound) {
+		t.Errorf("Expected ErrAttachmentNotFound sending someone else's attachment, got %v", err)
+	}
+	msg, _, err := testStore.SaveMessage(chatID, uploader.ID, 1, 0, "photo", "photo-1", []int{attachment.ID})
+	if err != nil {
+		t.Fatalf("SaveMessage failed: %v", err)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].ContentType != "image/png" || msg.Attachments[0].MessageID != msg.ID {
+		t.Errorf("Expected the message to carry its attachment, got %+v", msg.Attachments)
+	}
+	if retry, _, _ := testStore.SaveMessage(chatID, uploader.ID, 1, 0, "photo", "photo-1", []int{attachment.ID}); len(retry.Attachments) != 1 {
+		t.Errorf("Expected a retry to return the original attachments, got %+v", retry.Attachments)
+	}
+	if _, _, err := testStore.SaveMessage(chatID, uploader.ID, 1, 0, "again", "", []int{attachment.ID}); !errors.Is(err, store.ErrAttachmentNotFound) {
+		t.Errorf("Expected ErrAttachmentNotFound sending an attachment twice, got %v", err)
+	}
+	if err := testStore.DeleteAttachment(attachment.ID); !errors.Is(err, store.ErrAttachmentNotFound) {
+		t.Errorf("Expected sent attachments to stay with their message, got %v", err)
+	}
+
+	messages, _, _ := testStore.GetChatMessagesPage(chatID, store.PageOptions{Limit: 10})
+	messages = userMessages(messages)
+	if len(messages) != 1 || len(messages[0].Attachments) != 1 || messages[0].Attachments[0].Size != 10 {
+		t.Errorf("Expected the history to include the attachment, got %+v", messages)
+	}
+
+	// Deleting the message frees the quota
+	testStore.DeleteMessage(msg.ID, uploader.ID, time.Now().UTC())
+	if _, err := testStore.GetAttachment(attachment.ID); !errors.Is(err, store.ErrAttachmentNotFound) {
+		t.Errorf("Expected the attachment to go with its message, got %v", err)
+	}
+	unsent := &models.Attachment{ChatID: chatID, UserID: uploader.ID, Size: 15, ContentType: "text/plain", ChunkSize: 4}
+	if err := testStore.CreateAttachment(unsent, 15); err != nil {
+		t.Fatalf("Expected the freed quota to be reusable, got %v", err)
+	}
+
+	if err := testStore.DeleteChat(chatID); err != nil {
+		t.Fatalf("DeleteChat with attachments failed: %v", err)
+	}
+	if _, err := testStore.GetAttachment(unsent.ID); !errors.Is(err, store.ErrAttachmentNotFound) {
+		t.Errorf("Expected unsent attachments to go with the chat, got %v", err)
+	}
+}
@@ -1,9 +1,12 @@
 package sqlstore
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
 )
 
 func TestCreateChat(t *testing.T) {
@@ -28,7 +31,7 @@ func TestAddParticipant(t *testing.T) {
 	chatID, _ := testStore.CreateChat("Chat 1", 1)
 	user, _ := testStore.GetUserByUsername("user1")
 
-	err := testStore.AddParticipant(int(chatID), user.ID, "encrypted_key_mock")
+	_, err := testStore.AddParticipant(int(chatID), user.ID, user.ID, accountKey(t, user.ID, "encrypted_key_mock"))
 	if err != nil {
 		t.Errorf("Failed to add participant: %v", err)
 	}
@@ -51,9 +54,12 @@ func TestSaveMessage(t *testing.T) {
 	chatID, _ := testStore.CreateChat("Chat 1", 1)
 	user, _ := testStore.GetUserByUsername("user1")
 
-	err := testStore.SaveMessage(int(chatID), user.ID, "Hello")
+	saved, _, err := testStore.SaveMessage(int(chatID), user.ID, 1, 0, "Hello", "", nil)
 	if err != nil {
-		t.Errorf("Failed to save message: %v", err)
+		t.Fatalf("Failed to save message: %v", err)
+	}
+	if saved.ID == 0 || saved.CreatedAt.IsZero() || saved.Username != "user1" {
+		t.Errorf("Expected saved message to carry ID, timestamp and username, got %+v", saved)
 	}
 
 	messages, err := testStore.GetChatMessages(int(chatID))
@@ -70,6 +76,54 @@ func TestSaveMessage(t *testing.T) {
 	}
 }
 
+func TestSaveMessageIdempotent(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	testStore.CreateUser(&models.User{Username: "user2", Email: "user2@example.com", Password: "pass"})
+	user1, _ := testStore.GetUserByUsername("user1")
+	user2, _ := testStore.GetUserByUsername("user2")
+	chatID, _ := testStore.CreateChat("Chat 1", user1.ID)
+
+	first, created, err := testStore.SaveMessage(int(chatID), user1.ID, 1, 0, "Hello", "retry-me", nil)
+	if err != nil || !created {
+		t.Fatalf("Expected first save to create a message, got created=%v err=%v", created, err)
+	}
+
+	retry, created, err := testStore.SaveMessage(int(chatID), user1.ID, 1, 0, "Hello again", "retry-me", nil)
+	if err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	if created || retry.ID != first.ID || retry.Content != "Hello" {
+		t.Errorf("Expected retry to return original message %d, got %+v created=%v", first.ID, retry, created)
+	}
+
+	// The key is only unique per sender
+	other, created, _ := testStore.SaveMessage(int(chatID), user2.ID, 1, 0, "Hi", "retry-me", nil)
+	if !created || other.ID == first.ID {
+		t.Error("Expected the same key from another sender to create a new message")
+	}
+
+	// Messages without a key never deduplicate
+	testStore.SaveMessage(int(chatID), user1.ID, 1, 0, "no key", "", nil)
+	testStore.SaveMessage(int(chatID), user1.ID, 1, 0, "no key", "", nil)
+
+	messages, _ := testStore.GetChatMessages(int(chatID))
+	if len(messages) != 4 {
+		t.Errorf("Expected 4 messages, got %d", len(messages))
+	}
+
+	// Messages saved in the same instant keep the order they were sent in
+	testStore.db.Exec("UPDATE messages SET created_at = ?", first.CreatedAt)
+	messages, _ = testStore.GetChatMessages(int(chatID))
+	for i := 1; i < len(messages); i++ {
+		if messages[i].ID < messages[i-1].ID {
+			t.Errorf("Expected messages with equal timestamps in ID order, got %d before %d", messages[i-1].ID, messages[i].ID)
+		}
+	}
+}
+
 func TestDeleteChat(t *testing.T) {
 	SetupTestDB(t)
 	defer TeardownTestDB()
@@ -79,8 +133,8 @@ func TestDeleteChat(t *testing.T) {
 	chatID, _ := testStore.CreateChat("Chat to Delete", owner.ID)
 
 	// Add participant and message
-	testStore.AddParticipant(int(chatID), owner.ID, "key")
-	testStore.SaveMessage(int(chatID), owner.ID, "Message")
+	testStore.AddParticipant(int(chatID), owner.ID, owner.ID, accountKey(t, owner.ID, "key"))
+	testStore.SaveMessage(int(chatID), owner.ID, 1, 0, "Message", "", nil)
 
 	// Delete chat
 	err := testStore.DeleteChat(int(chatID))
@@ -102,3 +156,58 @@ func TestDeleteChat(t *testing.T) {
 		t.Error("Expected messages to be deleted")
 	}
 }
+
+func TestGetChatMessagesPage(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	user, _ := testStore.GetUserByUsername("user1")
+	chatID, _ := testStore.CreateChat("Chat 1", user.ID)
+
+	// Messages saved within the same second share created_at, so the id
+	// tie-breaker is what keeps the order stable.
+	for i := 1; i <= 5; i++ {
+		testStore.SaveMessage(int(chatID), user.ID, 1, 0, fmt.Sprintf("msg %d", i), "", nil)
+	}
+
+	latest, hasMore, err := testStore.GetChatMessagesPage(int(chatID), store.PageOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("GetChatMessagesPage failed: %v", err)
+	}
+	if !hasMore || len(latest) != 2 || latest[0].Content != "msg 4" || latest[1].Content != "msg 5" {
+		t.Fatalf("Expected [msg 4, msg 5] with more, got %v hasMore=%v", contents(latest), hasMore)
+	}
+
+	older, hasMore, _ := testStore.GetChatMessagesPage(int(chatID), store.PageOptions{Before: latest[0].ID, Limit: 2})
+	if !hasMore || len(older) != 2 || older[0].Content != "msg 2" || older[1].Content != "msg 3" {
+		t.Fatalf("Expected [msg 2, msg 3] with more, got %v hasMore=%v", contents(older), hasMore)
+	}
+
+	oldest, hasMore, _ := testStore.GetChatMessagesPage(int(chatID), store.PageOptions{Before: older[0].ID, Limit: 2})
+	if hasMore || len(oldest) != 1 || oldest[0].Content != "msg 1" {
+		t.Fatalf("Expected [msg 1] without more, got %v hasMore=%v", contents(oldest), hasMore)
+	}
+
+	newer, hasMore, _ := testStore.GetChatMessagesPage(int(chatID), store.PageOptions{After: oldest[0].ID, Limit: 3})
+	if !hasMore || len(newer) != 3 || newer[0].Content != "msg 2" || newer[2].Content != "msg 4" {
+		t.Fatalf("Expected [msg 2, msg 3, msg 4] with more, got %v hasMore=%v", contents(newer), hasMore)
+	}
+
+	otherID, _ := testStore.CreateChat("Chat 2", user.ID)
+	elsewhere, _, _ := testStore.SaveMessage(int(otherID), user.ID, 1, 0, "elsewhere", "", nil)
+	if _, _, err := testStore.GetChatMessagesPage(int(chatID), store.PageOptions{Before: elsewhere.ID, Limit: 2}); !errors.Is(err, store.ErrInvalidCursor) {
+		t.Errorf("Expected ErrInvalidCursor for an anchor in another chat, got %v", err)
+	}
+	if _, _, err := testStore.GetChatMessagesPage(int(chatID), store.PageOptions{After: elsewhere.ID + 1, Limit: 2}); !errors.Is(err, store.ErrInvalidCursor) {
+		t.Errorf("Expected ErrInvalidCursor for a missing anchor, got %v", err)
+	}
+}
+
+func contents(messages []models.Message) []string {
+	var out []string
+	for _, m := range messages {
+		out = append(out, m.Content)
+	}
+	return out
+}
@@ -0,0 +1,187 @@
+package sqlstore
+
+import (
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+const deviceColumns = "id, user_id, name, public_key, is_account, created_at"
+
+func scanDevice(row interface{ Scan(...any) error }) (models.Device, error) {
+	var d models.Device
+	err := row.Scan(&d.ID, &d.UserID, &d.Name, &d.PublicKey, &d.IsAccount, &d.CreatedAt)
+	return d, err
+}
+
+func (s *SQLStore) CreateDevice(device *models.Device) error {
+	query := s.rebind("INSERT INTO devices (user_id, name, public_key, is_account) VALUES (?, ?, ?, ?) RETURNING id, created_at")
+	return s.db.QueryRow(query, device.UserID, device.Name, device.PublicKey, device.IsAccount).Scan(&device.ID, &device.CreatedAt)
+}
+
+func (s *SQLStore) GetDevice(id int) (*models.Device, error) {
+	query := s.rebind("SELECT " + deviceColumns + " FROM devices WHERE id = ?")
+	d, err := scanDevice(s.db.QueryRow(query, id))
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *SQLStore) GetAccountDevice(userID int) (*models.Device, error) {
+	query := s.rebind("SELECT " + deviceColumns + " FROM devices WHERE user_id = ? AND is_account")
+	d, err := scanDevice(s.db.QueryRow(query, userID))
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *SQLStore) GetUserDevices(userID int) ([]models.Device, error) {
+	query := s.rebind("SELECT " + deviceColumns + " FROM devices WHERE user_id = ? ORDER BY id")
+	return s.queryDevices(query, userID)
+}
+
+func (s *SQLStore) queryDevices(query string, args ...interface{}) ([]models.Device, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []models.Device
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func (s *SQLStore) DeleteDevice(id int) ([]int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	chatIDs, err := s.dropDeviceKeys(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	query := s.rebind("DELETE FROM sessions WHERE device_id = ?")
+	if _, err := tx.Exec(query, id); err != nil {
+		return nil, err
+	}
+	query = s.rebind("DELETE FROM devices WHERE id = ?")
+	if _, err := tx.Exec(query, id); err != nil {
+		return nil, err
+	}
+	return chatIDs, tx.Commit()
+}
+
+// dropDeviceKeys deletes a device's wrapped chat keys and flags every chat
+// whose current key it could unwrap for a rekey, returning those chats.
+func (s *SQLStore) dropDeviceKeys(tx txn, deviceID int) ([]int, error) {
+	query := s.rebind(`
+		SELECT DISTINCT k.chat_id
+		FROM chat_keys k
+		JOIN chats c ON c.id = k.chat_id AND c.key_epoch = k.epoch
+		WHERE k.device_id = ?
+	`)
+	rows, err := tx.Query(query, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chatIDs []int
+	for rows.Next() {
+		var chatID int
+		if err := rows.Scan(&chatID); err != nil {
+			return nil, err
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	query = s.rebind("UPDATE chats SET rekey_needed = TRUE WHERE id = ?")
+	for _, chatID := range chatIDs {
+		if _, err := tx.Exec(query, chatID); err != nil {
+			return nil, err
+		}
+	}
+
+	query = s.rebind("DELETE FROM chat_keys WHERE device_id = ?")
+	if _, err := tx.Exec(query, deviceID); err != nil {
+		return nil, err
+	}
+	return chatIDs, nil
+}
+
+func (s *SQLStore) AddDeviceChatKeys(deviceID int, keys []models.ChatKey) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := s.rebind(`
+		INSERT INTO chat_keys (chat_id, device_id, user_id, epoch, encrypted_key)
+		SELECT c.id, d.id, d.user_id, ?, ?
+		FROM chats c
+		JOIN participants p ON p.chat_id = c.id
+		JOIN devices d ON d.user_id = p.user_id
+		WHERE c.id = ? AND d.id = ? AND c.key_epoch >= ?
+		ON CONFLICT (chat_id, device_id, epoch) DO UPDATE SET encrypted_key = excluded.encrypted_key
+	`)
+	for _, k := range keys {
+		if _, err := tx.Exec(query, k.Epoch, k.EncryptedKey, k.ChatID, deviceID, k.Epoch); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insertChatKeys stores one epoch's key wrapped for each device in keys,
+// after checking that keys covers exactly the devices of the users that
+// membersQuery selects.
+func (s *SQLStore) insertChatKeys(tx txn, chatID, epoch int, keys map[int]string, membersQuery string, args ...interface{}) error {
+	query := s.rebind("SELECT d.id, d.user_id FROM devices d WHERE d.user_id IN (" + membersQuery + ")")
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	owners := make(map[int]int, len(keys))
+	for rows.Next() {
+		var deviceID, userID int
+		if err := rows.Scan(&deviceID, &userID); err != nil {
+			return err
+		}
+		if _, ok := keys[deviceID]; !ok {
+			return store.ErrKeyRecipientsMismatch
+		}
+		owners[deviceID] = userID
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(owners) != len(keys) {
+		return store.ErrKeyRecipientsMismatch
+	}
+	rows.Close()
+
+	query = s.rebind("INSERT INTO chat_keys (chat_id, device_id, user_id, epoch, encrypted_key) VALUES (?, ?, ?, ?, ?)")
+	for deviceID, encryptedKey := range keys {
+		if _, err := tx.Exec(query, chatID, deviceID, owners[deviceID], epoch, encryptedKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
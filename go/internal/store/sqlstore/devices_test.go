@@ -0,0 +1,99 @@
+package sqlstore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func TestDevices(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "owner", Email: "owner@example.com", Password: "pass", PublicKey: "owner-account"})
+	testStore.CreateUser(&models.User{Username: "member", Email: "member@example.com", Password: "pass", PublicKey: "member-account"})
+	owner, _ := testStore.GetUserByUsername("owner")
+	member, _ := testStore.GetUserByUsername("member")
+
+	// Every user starts with their account device
+	account, err := testStore.GetAccountDevice(member.ID)
+	if err != nil || !account.IsAccount || account.PublicKey != "member-account" {
+		t.Fatalf("Expected account device with the user's public key, got %+v %v", account, err)
+	}
+
+	phone := &models.Device{UserID: member.ID, Name: "Phone", PublicKey: "member-phone"}
+	if err := testStore.CreateDevice(phone); err != nil || phone.ID == 0 {
+		t.Fatalf("CreateDevice failed: %+v %v", phone, err)
+	}
+	devices, _ := testStore.GetUserDevices(member.ID)
+	if len(devices) != 2 || devices[0].ID != account.ID || devices[1].ID != phone.ID {
+		t.Fatalf("Expected account and phone devices, got %+v", devices)
+	}
+
+	id, _ := testStore.CreateChat("Chat", owner.ID)
+	chatID := int(id)
+	testStore.AddParticipant(chatID, owner.ID, owner.ID, accountKey(t, owner.ID, "owner-1"))
+
+	// Invites must wrap the key for every one of the invitee's devices
+	_, err = testStore.AddParticipant(chatID, member.ID, member.ID, map[int]string{account.ID: "member-1"})
+	if !errors.Is(err, store.ErrKeyRecipientsMismatch) {
+		t.Errorf("Expected ErrKeyRecipientsMismatch missing the phone, got %v", err)
+	}
+	if ok, _ := testStore.IsParticipant(chatID, member.ID); ok {
+		t.Error("Expected failed invite not to add the participant")
+	}
+	if _, err := testStore.AddParticipant(chatID, member.ID, member.ID, map[int]string{account.ID: "member-1", phone.ID: "phone-1"}); err != nil {
+		t.Fatalf("AddParticipant failed: %v", err)
+	}
+
+	chats, _ := testStore.GetUserChats(member.ID, phone.ID)
+	if len(chats) != 1 || chats[0].EncryptedKey != "phone-1" {
+		t.Errorf("Expected the phone's wrapped key, got %+v", chats)
+	}
+	participants, _ := testStore.GetChatParticipants(chatID)
+	for _, p := range participants {
+		if p.ID == member.ID && len(p.Devices) != 2 {
+			t.Errorf("Expected participants to list both of member's devices, got %+v", p.Devices)
+		}
+	}
+
+	// A device added later gets keys uploaded for it; keys for epochs that
+	// haven't started are ignored
+	laptop := &models.Device{UserID: member.ID, Name: "Laptop", PublicKey: "member-laptop"}
+	testStore.CreateDevice(laptop)
+	err = testStore.AddDeviceChatKeys(laptop.ID, []models.ChatKey{
+		{ChatID: chatID, Epoch: 1, EncryptedKey: "laptop-1"},
+		{ChatID: chatID, Epoch: 2, EncryptedKey: "laptop-2"},
+	})
+	if err != nil {
+		t.Fatalf("AddDeviceChatKeys failed: %v", err)
+	}
+	if keys, _ := testStore.GetChatKeys(chatID, laptop.ID); len(keys) != 1 || keys[0].EncryptedKey != "laptop-1" {
+		t.Errorf("Expected only the epoch 1 key for the laptop, got %+v", keys)
+	}
+
+	// Rekeys have to cover every device, the laptop included
+	ownerDevice, _ := testStore.GetAccountDevice(owner.ID)
+	err = testStore.RotateChatKey(chatID, 2, map[int]string{ownerDevice.ID: "owner-2", account.ID: "member-2", phone.ID: "phone-2"})
+	if !errors.Is(err, store.ErrKeyRecipientsMismatch) {
+		t.Errorf("Expected ErrKeyRecipientsMismatch, got %v", err)
+	}
+
+	// Revoking the phone drops its keys and flags the chat for a rekey
+	chatIDs, err := testStore.DeleteDevice(phone.ID)
+	if err != nil || len(chatIDs) != 1 || chatIDs[0] != chatID {
+		t.Fatalf("Expected DeleteDevice to report the chat, got %v %v", chatIDs, err)
+	}
+	if keys, _ := testStore.GetChatKeys(chatID, phone.ID); len(keys) != 0 {
+		t.Errorf("Expected the phone's keys to be gone, got %+v", keys)
+	}
+	if _, err := testStore.GetDevice(phone.ID); err == nil {
+		t.Error("Expected the phone to be deleted")
+	}
+	chats, _ = testStore.GetUserChats(owner.ID, 0)
+	if !chats[0].RekeyNeeded {
+		t.Error("Expected the chat to be flagged for a rekey")
+	}
+}
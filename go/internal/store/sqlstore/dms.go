@@ -0,0 +1,63 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+)
+
+// dmKey identifies the direct chat between two users, whichever of them
+// started it.
+func dmKey(userID, peerID int) string {
+	return fmt.Sprintf("%d:%d", min(userID, peerID), max(userID, peerID))
+}
+
+func (s *SQLStore) GetOrCreateDirectChat(userID, peerID int, keys map[int]string) (int, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	// A concurrent create of the same pair conflicts on dm_key, and then
+	// finds the chat the other one made.
+	var chatID, epoch int
+	query := s.rebind(`
+		INSERT INTO chats (name, owner_id, type, dm_key) VALUES ('', ?, ?, ?)
+		ON CONFLICT (dm_key) DO NOTHING
+		RETURNING id, key_epoch
+	`)
+	err = tx.QueryRow(query, userID, models.ChatTypeDirect, dmKey(userID, peerID)).Scan(&chatID, &epoch)
+	if err == sql.ErrNoRows {
+		query = s.rebind("SELECT id FROM chats WHERE dm_key = ?")
+		if err := tx.QueryRow(query, dmKey(userID, peerID)).Scan(&chatID); err != nil {
+			return 0, false, err
+		}
+		query = s.rebind("UPDATE participants SET hidden = FALSE WHERE chat_id = ? AND user_id = ?")
+		if _, err := tx.Exec(query, chatID, userID); err != nil {
+			return 0, false, err
+		}
+		return chatID, false, tx.Commit()
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	now := time.Now().UTC()
+	query = s.rebind("INSERT INTO participants (chat_id, user_id, joined_at) VALUES (?, ?, ?), (?, ?, ?)")
+	if _, err := tx.Exec(query, chatID, userID, now, chatID, peerID, now); err != nil {
+		return 0, false, err
+	}
+	if err := s.insertChatKeys(tx, chatID, epoch, keys, "?, ?", userID, peerID); err != nil {
+		return 0, false, err
+	}
+	return chatID, true, tx.Commit()
+}
+
+func (s *SQLStore) SetChatHidden(chatID, userID int, hidden bool) error {
+	query := s.rebind("UPDATE participants SET hidden = ? WHERE chat_id = ? AND user_id = ?")
+	_, err := s.db.Exec(query, hidden, chatID, userID)
+	return err
+}
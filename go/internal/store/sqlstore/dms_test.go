@@ -0,0 +1,72 @@
+package sqlstore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func TestDirectChats(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "alice", Email: "alice@example.com", Password: "pass"})
+	testStore.CreateUser(&models.User{Username: "bob", Email: "bob@example.com", Password: "pass"})
+	alice, _ := testStore.GetUserByUsername("alice")
+	bob, _ := testStore.GetUserByUsername("bob")
+
+	keys := accountKey(t, alice.ID, "alice-key")
+	for deviceID, key := range accountKey(t, bob.ID, "bob-key") {
+		keys[deviceID] = key
+	}
+
+	if _, _, err := testStore.GetOrCreateDirectChat(alice.ID, bob.ID, accountKey(t, alice.ID, "alice-key")); !errors.Is(err, store.ErrKeyRecipientsMismatch) {
+		t.Errorf("Expected ErrKeyRecipientsMismatch without the peer's keys, got %v", err)
+	}
+	chatID, created, err := testStore.GetOrCreateDirectChat(alice.ID, bob.ID, keys)
+	if err != nil || !created {
+		t.Fatalf("Expected a new direct chat, got created=%v err=%v", created, err)
+	}
+
+	// Either side finds the same chat, without needing keys
+	again, created, err := testStore.GetOrCreateDirectChat(bob.ID, alice.ID, nil)
+	if err != nil || created || again != chatID {
+		t.Errorf("Expected the existing chat %d, got %d created=%v err=%v", chatID, again, created, err)
+	}
+
+	chat, _ := testStore.GetChat(chatID)
+	if chat.Type != models.ChatTypeDirect {
+		t.Errorf("Expected a direct chat, got %+v", chat)
+	}
+	if _, err := testStore.GetChat(chatID + 1); !errors.Is(err, store.ErrChatNotFound) {
+		t.Errorf("Expected ErrChatNotFound, got %v", err)
+	}
+
+	// Each member sees it under the other's name
+	aliceChats, _ := testStore.GetUserChats(alice.ID, 0)
+	bobChats, _ := testStore.GetUserChats(bob.ID, 0)
+	if len(aliceChats) != 1 || aliceChats[0].Name != "bob" || len(bobChats) != 1 || bobChats[0].Name != "alice" {
+		t.Errorf("Expected the chat named after the peer, got %+v and %+v", aliceChats, bobChats)
+	}
+
+	// Hiding only affects the hider, and a new message brings it back
+	testStore.SetChatHidden(chatID, alice.ID, true)
+	if chats, _ := testStore.GetUserChats(alice.ID, 0); len(chats) != 0 {
+		t.Errorf("Expected the hidden chat to be left out, got %+v", chats)
+	}
+	if chats, _ := testStore.GetUserChats(bob.ID, 0); len(chats) != 1 {
+		t.Errorf("Expected the peer to keep the chat, got %+v", chats)
+	}
+	testStore.SaveMessage(chatID, bob.ID, 1, 0, "hi", "", nil)
+	if chats, _ := testStore.GetUserChats(alice.ID, 0); len(chats) != 1 || chats[0].UnreadCount != 1 {
+		t.Errorf("Expected a new message to unhide the chat, got %+v", chats)
+	}
+
+	testStore.SetChatHidden(chatID, alice.ID, true)
+	testStore.GetOrCreateDirectChat(alice.ID, bob.ID, nil)
+	if chats, _ := testStore.GetUserChats(alice.ID, 0); len(chats) != 1 {
+		t.Errorf("Expected reopening the chat to unhide it, got %+v", chats)
+	}
+}
@@ -0,0 +1,93 @@
+package sqlstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func TestMembershipEvents(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	for _, name := range []string{"owner", "joiner", "leaver", "heir"} {
+		testStore.CreateUser(&models.User{Username: name, Email: name + "@example.com", Password: "pass"})
+	}
+	users := make(map[string]*models.User)
+	for _, name := range []string{"owner", "joiner", "leaver", "heir"} {
+		users[name], _ = testStore.GetUserByUsername(name)
+	}
+	owner, joiner, leaver, heir := users["owner"].ID, users["joiner"].ID, users["leaver"].ID, users["heir"].ID
+
+	id, _ := testStore.CreateChat("Chat", owner)
+	chatID := int(id)
+	testStore.AddParticipant(chatID, owner, owner, accountKey(t, owner, "key"))
+
+	// A failed join leaves nothing behind
+	if _, err := testStore.AddParticipant(chatID, joiner, owner, map[int]string{}); !errors.Is(err, store.ErrKeyRecipientsMismatch) {
+		t.Fatalf("Expected ErrKeyRecipientsMismatch, got %v", err)
+	}
+	if messages, _ := testStore.GetChatMessages(chatID); len(messages) != 1 {
+		t.Errorf("Expected only the owner's join after a failed one, got %+v", messages)
+	}
+
+	joined, err := testStore.AddParticipant(chatID, joiner, owner, accountKey(t, joiner, "key"))
+	if err != nil {
+		t.Fatalf("AddParticipant failed: %v", err)
+	}
+	if joined.Kind != models.MessageKindSystem || joined.UserID != owner || joined.Event.UserID != joiner || joined.Event.Username != "joiner" {
+		t.Errorf("Expected the owner to be recorded adding the joiner, got %+v", joined)
+	}
+	for _, userID := range []int{leaver, heir} {
+		testStore.AddParticipant(chatID, userID, owner, accountKey(t, userID, "key"))
+	}
+	if _, err := testStore.SetParticipantRole(chatID, heir, owner, models.RoleAdmin); err != nil {
+		t.Fatalf("SetParticipantRole failed: %v", err)
+	}
+	if _, err := testStore.RemoveParticipant(chatID, leaver, leaver); err != nil {
+		t.Fatalf("RemoveParticipant failed: %v", err)
+	}
+	if _, err := testStore.RemoveParticipant(chatID, joiner, owner); err != nil {
+		t.Fatalf("RemoveParticipant failed: %v", err)
+	}
+	if _, err := testStore.RemoveParticipant(chatID, joiner, owner); !errors.Is(err, store.ErrNotParticipant) {
+		t.Errorf("Expected ErrNotParticipant removing someone twice, got %v", err)
+	}
+	testStore.SetPendingOwner(chatID, heir)
+	entry, err := testStore.TransferOwnership(chatID, heir, time.Now().UTC())
+	if err != nil {
+		t.Fatalf("TransferOwnership failed: %v", err)
+	}
+	if entry.Message == nil || entry.Message.Event.Type != models.EventOwnerChanged || entry.Message.Event.Reason != models.AuditOwnershipTransferred {
+		t.Errorf("Expected the handover to come with its system message, got %+v", entry.Message)
+	}
+
+	// The whole story is in the history, including who has since left
+	want := []models.SystemEvent{
+		{Type: models.EventMemberJoined, UserID: owner},
+		{Type: models.EventMemberJoined, UserID: joiner},
+		{Type: models.EventMemberJoined, UserID: leaver},
+		{Type: models.EventMemberJoined, UserID: heir},
+		{Type: models.EventRoleChanged, UserID: heir, Role: models.RoleAdmin},
+		{Type: models.EventMemberLeft, UserID: leaver},
+		{Type: models.EventMemberRemoved, UserID: joiner},
+		{Type: models.EventOwnerChanged, UserID: heir, Reason: models.AuditOwnershipTransferred},
+	}
+	messages, _ := testStore.GetChatMessages(chatID)
+	if len(messages) != len(want) {
+		t.Fatalf("Expected %d system messages, got %+v", len(want), messages)
+	}
+	for i, m := range messages {
+		got := *m.Event
+		got.Username = ""
+		if m.Kind != models.MessageKindSystem || got != want[i] {
+			t.Errorf("Expected event %d to be %+v, got %+v", i, want[i], got)
+		}
+	}
+	if messages[5].Event.Username != "leaver" || messages[5].UserID != leaver {
+		t.Errorf("Expected the leaver to be recorded leaving, got %+v", messages[5])
+	}
+}
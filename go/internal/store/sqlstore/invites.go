@@ -0,0 +1,255 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+const inviteColumns = "id, chat_id, code, created_by, expires_at, max_uses, uses, requires_approval, created_at"
+
+func scanInvite(row interface{ Scan(...any) error }) (models.Invite, error) {
+	var i models.Invite
+	var expiresAt sql.NullTime
+	err := row.Scan(&i.ID, &i.ChatID, &i.Code, &i.CreatedBy, &expiresAt, &i.MaxUses, &i.Uses, &i.RequiresApproval, &i.CreatedAt)
+	if expiresAt.Valid {
+		i.ExpiresAt = &expiresAt.Time
+	}
+	return i, err
+}
+
+func (s *SQLStore) CreateInvite(invite *models.Invite) error {
+	query := s.rebind(`
+		INSERT INTO invites (chat_id, code, created_by, expires_at, max_uses, requires_approval)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id, created_at
+	`)
+	return s.db.QueryRow(query, invite.ChatID, invite.Code, invite.CreatedBy, invite.ExpiresAt, invite.MaxUses, invite.RequiresApproval).
+		Scan(&invite.ID, &invite.CreatedAt)
+}
+
+func (s *SQLStore) GetInvite(code string) (*models.Invite, error) {
+	query := s.rebind("SELECT " + inviteColumns + " FROM invites WHERE code = ?")
+	i, err := scanInvite(s.db.QueryRow(query, code))
+	if err == sql.ErrNoRows {
+		return nil, store.ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
+
+func (s *SQLStore) GetChatInvites(chatID int) ([]models.Invite, error) {
+	query := s.rebind("SELECT " + inviteColumns + " FROM invites WHERE chat_id = ? ORDER BY id")
+	rows, err := s.db.Query(query, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []models.Invite
+	for rows.Next() {
+		i, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, i)
+	}
+	return invites, rows.Err()
+}
+
+func (s *SQLStore) DeleteInvite(chatID int, code string) error {
+	query := s.rebind("DELETE FROM invites WHERE chat_id = ? AND code = ?")
+	result, err := s.db.Exec(query, chatID, code)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return store.ErrInviteNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) RedeemInvite(code string, userID int, now time.Time) (*models.JoinRequest, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	query := s.rebind("SELECT " + inviteColumns + " FROM invites WHERE code = ?")
+	invite, err := scanInvite(tx.QueryRow(query, code))
+	if err == sql.ErrNoRows {
+		return nil, false, store.ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Members can't ask to join again, and a pending request is returned
+	// as is, even if the invite has since run out.
+	var exists bool
+	query = s.rebind("SELECT EXISTS(SELECT 1 FROM participants WHERE chat_id = ? AND user_id = ?)")
+	if err := tx.QueryRow(query, invite.ChatID, userID).Scan(&exists); err != nil {
+		return nil, false, err
+	}
+	if exists {
+		return nil, false, store.ErrAlreadyParticipant
+	}
+
+	request, err := s.queryJoinRequest(tx, invite.ChatID, userID)
+	if err == nil {
+		return request, false, tx.Commit()
+	}
+	if err != store.ErrJoinRequestNotFound {
+		return nil, false, err
+	}
+
+	// Expiry is checked here rather than in SQL because SQLite compares
+	// timestamps as text.
+	if !invite.Usable(now) {
+		return nil, false, store.ErrInviteNotFound
+	}
+
+	// The uses guard makes concurrent redemptions of the last use race safely.
+	query = s.rebind("UPDATE invites SET uses = uses + 1 WHERE id = ? AND (max_uses = 0 OR uses < max_uses)")
+	result, err := tx.Exec(query, invite.ID)
+	if err != nil {
+		return nil, false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+	if rows == 0 {
+		return nil, false, store.ErrInviteNotFound
+	}
+
+	query = s.rebind("INSERT INTO join_requests (chat_id, user_id, requires_approval, created_at) VALUES (?, ?, ?, ?)")
+	if _, err := tx.Exec(query, invite.ChatID, userID, invite.RequiresApproval, now); err != nil {
+		return nil, false, err
+	}
+	request, err = s.queryJoinRequest(tx, invite.ChatID, userID)
+	if err != nil {
+		return nil, false, err
+	}
+	return request, true, tx.Commit()
+}
+
+const joinRequestColumns = "j.chat_id, j.user_id, u.username, j.requires_approval, j.created_at"
+
+func scanJoinRequest(row interface{ Scan(...any) error }) (models.JoinRequest, error) {
+	var j models.JoinRequest
+	err := row.Scan(&j.ChatID, &j.UserID, &j.Username, &j.RequiresApproval, &j.CreatedAt)
+	return j, err
+}
+
+// queryJoinRequest loads a join request through q, which may be the
+// database or a transaction.
+func (s *SQLStore) queryJoinRequest(q interface {
+	QueryRow(string, ...any) *sql.Row
+}, chatID, userID int) (*models.JoinRequest, error) {
+	query := s.rebind("SELECT " + joinRequestColumns + " FROM join_requests j JOIN users u ON u.id = j.user_id WHERE j.chat_id = ? AND j.user_id = ?")
+	j, err := scanJoinRequest(q.QueryRow(query, chatID, userID))
+	if err == sql.ErrNoRows {
+		return nil, store.ErrJoinRequestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func (s *SQLStore) GetJoinRequest(chatID, userID int) (*models.JoinRequest, error) {
+	return s.queryJoinRequest(s.db, chatID, userID)
+}
+
+func (s *SQLStore) GetJoinRequests(chatID int) ([]models.JoinRequest, error) {
+	query := s.rebind("SELECT " + joinRequestColumns + " FROM join_requests j JOIN users u ON u.id = j.user_id WHERE j.chat_id = ? ORDER BY j.created_at, j.user_id")
+	rows, err := s.db.Query(query, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []models.JoinRequest
+	for rows.Next() {
+		j, err := scanJoinRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	query = s.rebind(`
+		SELECT d.id, d.user_id, d.name, d.public_key, d.is_account, d.created_at
+		FROM devices d
+		JOIN join_requests j ON j.user_id = d.user_id
+		WHERE j.chat_id = ?
+		ORDER BY d.id
+	`)
+	devices, err := s.queryDevices(query, chatID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range requests {
+		for _, d := range devices {
+			if d.UserID == requests[i].UserID {
+				requests[i].Devices = append(requests[i].Devices, d)
+			}
+		}
+	}
+	return requests, nil
+}
+
+func (s *SQLStore) ApproveJoinRequest(chatID, userID, approvedBy int, keys map[int]string) (*models.Message, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := s.deleteJoinRequest(tx, chatID, userID); err != nil {
+		return nil, err
+	}
+	m, err := s.addParticipant(tx, chatID, userID, approvedBy, keys)
+	if err != nil {
+		return nil, err
+	}
+	return m, tx.Commit()
+}
+
+func (s *SQLStore) DeleteJoinRequest(chatID, userID int) error {
+	return s.deleteJoinRequest(s.db, chatID, userID)
+}
+
+// deleteJoinRequest removes a join request through q, which may be the
+// database or a transaction.
+func (s *SQLStore) deleteJoinRequest(q interface {
+	Exec(string, ...any) (sql.Result, error)
+}, chatID, userID int) error {
+	query := s.rebind("DELETE FROM join_requests WHERE chat_id = ? AND user_id = ?")
+	result, err := q.Exec(query, chatID, userID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return store.ErrJoinRequestNotFound
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package sqlstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func TestInvites(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	for _, name := range []string{"owner", "joiner", "other"} {
+		testStore.CreateUser(&models.User{Username: name, Email: name + "@example.com", Password: "pass"})
+	}
+	owner, _ := testStore.GetUserByUsername("owner")
+	joiner, _ := testStore.GetUserByUsername("joiner")
+	other, _ := testStore.GetUserByUsername("other")
+
+	id, _ := testStore.CreateChat("Chat", owner.ID)
+	chatID := int(id)
+	testStore.AddParticipant(chatID, owner.ID, owner.ID, accountKey(t, owner.ID, "key"))
+
+	now := time.Now().UTC()
+	expiresAt := now.Add(time.Hour)
+	invite := &models.Invite{ChatID: chatID, Code: "abc", CreatedBy: owner.ID, ExpiresAt: &expiresAt, MaxUses: 1}
+	if err := testStore.CreateInvite(invite); err != nil {
+		t.Fatalf("CreateInvite failed: %v", err)
+	}
+	if stored, err := testStore.GetInvite("abc"); err != nil || stored.ChatID != chatID || stored.ExpiresAt == nil || !stored.Usable(now) {
+		t.Errorf("Expected a usable invite to the chat, got %+v (%v)", stored, err)
+	}
+
+	if _, _, err := testStore.RedeemInvite("abc", owner.ID, now); !errors.Is(err, store.ErrAlreadyParticipant) {
+		t.Errorf("Expected ErrAlreadyParticipant for a member, got %v", err)
+	}
+	if _, _, err := testStore.RedeemInvite("abc", joiner.ID, expiresAt); !errors.Is(err, store.ErrInviteNotFound) {
+		t.Errorf("Expected ErrInviteNotFound once expired, got %v", err)
+	}
+
+	request, created, err := testStore.RedeemInvite("abc", joiner.ID, now)
+	if err != nil || !created || request.Username != "joiner" || request.RequiresApproval {
+		t.Fatalf("Expected a new join request, got %+v created=%v (%v)", request, created, err)
+	}
+	// Redeeming again finds the pending request without using the invite up
+	if _, created, err := testStore.RedeemInvite("abc", joiner.ID, now); err != nil || created {
+		t.Errorf("Expected the pending request back, got created=%v (%v)", created, err)
+	}
+	if _, _, err := testStore.RedeemInvite("abc", other.ID, now); !errors.Is(err, store.ErrInviteNotFound) {
+		t.Errorf("Expected ErrInviteNotFound once used up, got %v", err)
+	}
+
+	requests, _ := testStore.GetJoinRequests(chatID)
+	if len(requests) != 1 || len(requests[0].Devices) != 1 {
+		t.Fatalf("Expected one request with the joiner's device, got %+v", requests)
+	}
+
+	// Joining takes a key for exactly the joiner's devices
+	if _, err := testStore.ApproveJoinRequest(chatID, joiner.ID, joiner.ID, map[int]string{}); !errors.Is(err, store.ErrKeyRecipientsMismatch) {
+		t.Errorf("Expected ErrKeyRecipientsMismatch without keys, got %v", err)
+	}
+	if _, err := testStore.GetJoinRequest(chatID, joiner.ID); err != nil {
+		t.Errorf("Expected a failed approval to leave the request pending, got %v", err)
+	}
+	if _, err := testStore.ApproveJoinRequest(chatID, joiner.ID, joiner.ID, accountKey(t, joiner.ID, "key")); err != nil {
+		t.Fatalf("ApproveJoinRequest failed: %v", err)
+	}
+	if m, err := testStore.GetMembership(chatID, joiner.ID); err != nil || m.Role != models.RoleMember {
+		t.Errorf("Expected the joiner to be a member, got %+v (%v)", m, err)
+	}
+	if _, err := testStore.ApproveJoinRequest(chatID, joiner.ID, joiner.ID, accountKey(t, joiner.ID, "key")); !errors.Is(err, store.ErrJoinRequestNotFound) {
+		t.Errorf("Expected ErrJoinRequestNotFound approving twice, got %v", err)
+	}
+
+	// Rejecting and revoking
+	open := &models.Invite{ChatID: chatID, Code: "open", CreatedBy: owner.ID, RequiresApproval: true}
+	testStore.CreateInvite(open)
+	if request, _, err := testStore.RedeemInvite("open", other.ID, now.Add(24*time.Hour)); err != nil || !request.RequiresApproval {
+		t.Fatalf("Expected a request needing approval from a lasting invite, got %+v (%v)", request, err)
+	}
+	if err := testStore.DeleteJoinRequest(chatID, other.ID); err != nil {
+		t.Errorf("DeleteJoinRequest failed: %v", err)
+	}
+	if err := testStore.DeleteInvite(chatID, "open"); err != nil {
+		t.Errorf("DeleteInvite failed: %v", err)
+	}
+	if _, err := testStore.GetInvite("open"); !errors.Is(err, store.ErrInviteNotFound) {
+		t.Errorf("Expected ErrInviteNotFound after revoking, got %v", err)
+	}
+
+	if err := testStore.DeleteChat(chatID); err != nil {
+		t.Fatalf("DeleteChat with invites failed: %v", err)
+	}
+	if invites, _ := testStore.GetChatInvites(chatID); len(invites) != 0 {
+		t.Errorf("Expected invites to go with the chat, got %+v", invites)
+	}
+}
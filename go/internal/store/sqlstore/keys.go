@@ -0,0 +1,54 @@
+package sqlstore
+
+import (
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func (s *SQLStore) GetChatKeys(chatID, deviceID int) ([]models.ChatKey, error) {
+	query := s.rebind("SELECT epoch, encrypted_key FROM chat_keys WHERE chat_id = ? AND device_id = ? ORDER BY epoch")
+	rows, err := s.db.Query(query, chatID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []models.ChatKey
+	for rows.Next() {
+		var k models.ChatKey
+		if err := rows.Scan(&k.Epoch, &k.EncryptedKey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLStore) RotateChatKey(chatID, newEpoch int, keys map[int]string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Bumping the epoch first also serializes concurrent rekeys: only one
+	// of them can move the chat off newEpoch-1.
+	query := s.rebind("UPDATE chats SET key_epoch = ?, rekey_needed = FALSE WHERE id = ? AND key_epoch = ?")
+	result, err := tx.Exec(query, newEpoch, chatID, newEpoch-1)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return store.ErrStaleKeyEpoch
+	}
+
+	err = s.insertChatKeys(tx, chatID, newEpoch, keys, "SELECT user_id FROM participants WHERE chat_id = ?", chatID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
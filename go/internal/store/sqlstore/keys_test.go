@@ -0,0 +1,92 @@
+package sqlstore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func TestChatKeyEpochs(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	for _, name := range []string{"owner", "member", "leaver"} {
+		testStore.CreateUser(&models.User{Username: name, Email: name + "@example.com", Password: "pass"})
+	}
+	owner, _ := testStore.GetUserByUsername("owner")
+	member, _ := testStore.GetUserByUsername("member")
+	leaver, _ := testStore.GetUserByUsername("leaver")
+
+	ownerDevice, _ := testStore.GetAccountDevice(owner.ID)
+	memberDevice, _ := testStore.GetAccountDevice(member.ID)
+	leaverDevice, _ := testStore.GetAccountDevice(leaver.ID)
+	o, m, l := ownerDevice.ID, memberDevice.ID, leaverDevice.ID
+
+	id, _ := testStore.CreateChat("Chat", owner.ID)
+	chatID := int(id)
+	testStore.AddParticipant(chatID, owner.ID, owner.ID, map[int]string{o: "owner-1"})
+	testStore.AddParticipant(chatID, member.ID, member.ID, map[int]string{m: "member-1"})
+	testStore.AddParticipant(chatID, leaver.ID, leaver.ID, map[int]string{l: "leaver-1"})
+
+	if _, _, err := testStore.SaveMessage(chatID, owner.ID, 1, 0, "epoch 1", "pending-retry", nil); err != nil {
+		t.Fatalf("SaveMessage failed: %v", err)
+	}
+
+	testStore.RemoveParticipant(chatID, leaver.ID, leaver.ID)
+	chats, _ := testStore.GetUserChats(owner.ID, o)
+	if len(chats) != 1 || !chats[0].RekeyNeeded || chats[0].KeyEpoch != 1 {
+		t.Fatalf("Expected chat at epoch 1 flagged for rekey, got %+v", chats)
+	}
+
+	// The new key must go to exactly the remaining members
+	err := testStore.RotateChatKey(chatID, 2, map[int]string{o: "owner-2", m: "member-2", l: "leaver-2"})
+	if !errors.Is(err, store.ErrKeyRecipientsMismatch) {
+		t.Errorf("Expected ErrKeyRecipientsMismatch including the leaver, got %v", err)
+	}
+	err = testStore.RotateChatKey(chatID, 2, map[int]string{o: "owner-2"})
+	if !errors.Is(err, store.ErrKeyRecipientsMismatch) {
+		t.Errorf("Expected ErrKeyRecipientsMismatch missing a member, got %v", err)
+	}
+	err = testStore.RotateChatKey(chatID, 3, map[int]string{o: "owner-3", m: "member-3"})
+	if !errors.Is(err, store.ErrStaleKeyEpoch) {
+		t.Errorf("Expected ErrStaleKeyEpoch skipping an epoch, got %v", err)
+	}
+
+	if err := testStore.RotateChatKey(chatID, 2, map[int]string{o: "owner-2", m: "member-2"}); err != nil {
+		t.Fatalf("RotateChatKey failed: %v", err)
+	}
+	chats, _ = testStore.GetUserChats(member.ID, m)
+	if chats[0].KeyEpoch != 2 || chats[0].EncryptedKey != "member-2" || chats[0].RekeyNeeded {
+		t.Errorf("Expected member to see epoch 2 key, got %+v", chats[0])
+	}
+
+	keys, _ := testStore.GetChatKeys(chatID, m)
+	if len(keys) != 2 || keys[0].EncryptedKey != "member-1" || keys[1].EncryptedKey != "member-2" {
+		t.Errorf("Expected keys for both epochs, got %+v", keys)
+	}
+	if keys, _ := testStore.GetChatKeys(chatID, l); len(keys) != 0 {
+		t.Errorf("Expected leaver's keys to be gone, got %+v", keys)
+	}
+
+	// Stale messages are refused, but a retry of one saved before the rekey
+	// still resolves to the original
+	if _, _, err := testStore.SaveMessage(chatID, owner.ID, 1, 0, "too late", "", nil); !errors.Is(err, store.ErrStaleKeyEpoch) {
+		t.Errorf("Expected ErrStaleKeyEpoch, got %v", err)
+	}
+	retry, created, err := testStore.SaveMessage(chatID, owner.ID, 1, 0, "epoch 1", "pending-retry", nil)
+	if err != nil || created || retry.KeyEpoch != 1 {
+		t.Errorf("Expected duplicate of the epoch 1 message, got %+v created=%v err=%v", retry, created, err)
+	}
+	saved, _, err := testStore.SaveMessage(chatID, owner.ID, 2, 0, "epoch 2", "", nil)
+	if err != nil || saved.KeyEpoch != 2 {
+		t.Errorf("Expected message under epoch 2 to save, got %+v %v", saved, err)
+	}
+
+	// New members join at the current epoch
+	testStore.AddParticipant(chatID, leaver.ID, leaver.ID, map[int]string{l: "rejoined"})
+	if keys, _ := testStore.GetChatKeys(chatID, l); len(keys) != 1 || keys[0].Epoch != 2 {
+		t.Errorf("Expected rejoined member to get only epoch 2, got %+v", keys)
+	}
+}
@@ -0,0 +1,231 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+// messageColumns selects what scanMessage reads, from messages m joined
+// with users u.
+const messageColumns = `m.id, m.kind, m.chat_id, m.user_id, u.username, m.content, m.key_epoch, COALESCE(m.client_msg_id, ''), m.created_at,
+	COALESCE(m.reply_to, 0), COALESCE(m.thread_root_id, 0), m.reply_count, m.last_reply_at,
+	m.edited_at, m.deleted_at, COALESCE(m.deleted_by, 0), m.event, m.pinned_at, COALESCE(m.pinned_by, 0)`
+
+func scanMessage(row interface{ Scan(...any) error }) (models.Message, error) {
+	var m models.Message
+	var lastReplyAt, editedAt, deletedAt, pinnedAt sql.NullTime
+	var event sql.NullString
+	err := row.Scan(&m.ID, &m.Kind, &m.ChatID, &m.UserID, &m.Username, &m.Content, &m.KeyEpoch, &m.ClientMsgID, &m.CreatedAt,
+		&m.ReplyTo, &m.ThreadRootID, &m.ReplyCount, &lastReplyAt,
+		&editedAt, &deletedAt, &m.DeletedBy, &event, &pinnedAt, &m.PinnedBy)
+	if err != nil {
+		return m, err
+	}
+	if event.Valid {
+		m.Event = &models.SystemEvent{}
+		if err := json.Unmarshal([]byte(event.String), m.Event); err != nil {
+			return m, err
+		}
+	}
+	if lastReplyAt.Valid {
+		m.LastReplyAt = &lastReplyAt.Time
+	}
+	if editedAt.Valid {
+		m.EditedAt = &editedAt.Time
+	}
+	if deletedAt.Valid {
+		m.DeletedAt = &deletedAt.Time
+	}
+	if pinnedAt.Valid {
+		m.PinnedAt = &pinnedAt.Time
+	}
+	return m, nil
+}
+
+// insertSystemMessage records event in a chat's timeline within tx, as a
+// system message from userID. It has the database's timestamp like any
+// other message, so it sorts among them. The name of the participant the
+// event is about is kept with it, since they may leave.
+func (s *SQLStore) insertSystemMessage(tx txn, chatID, userID int, event models.SystemEvent) (*models.Message, error) {
+	if event.UserID != 0 {
+		query := s.rebind("SELECT username FROM users WHERE id = ?")
+		if err := tx.QueryRow(query, event.UserID).Scan(&event.Username); err != nil {
+			return nil, err
+		}
+	}
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	m := models.Message{Kind: models.MessageKindSystem, ChatID: chatID, UserID: userID, Event: &event}
+	query := s.rebind(`
+		INSERT INTO messages (chat_id, user_id, key_epoch, content, kind, event)
+		VALUES (?, ?, 0, '', ?, ?)
+		RETURNING id, created_at
+	`)
+	if err := tx.QueryRow(query, chatID, userID, models.MessageKindSystem, string(raw)).Scan(&m.ID, &m.CreatedAt); err != nil {
+		return nil, err
+	}
+	query = s.rebind("SELECT username FROM users WHERE id = ?")
+	if err := tx.QueryRow(query, userID).Scan(&m.Username); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *SQLStore) GetMessage(id int) (*models.Message, error) {
+	query := s.rebind("SELECT " + messageColumns + " FROM messages m JOIN users u ON m.user_id = u.id WHERE m.id = ?")
+	m, err := scanMessage(s.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, store.ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	messages := []models.Message{m}
+	if err := s.attachDetails(messages); err != nil {
+		return nil, err
+	}
+	return &messages[0], nil
+}
+
+func (s *SQLStore) EditMessage(id, userID, keyEpoch int, content string, editedAt time.Time) (*models.Message, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var senderID, previousEpoch int
+	var previousContent, kind string
+	var deletedAt sql.NullTime
+	query := s.rebind("SELECT user_id, content, key_epoch, deleted_at, kind FROM messages WHERE id = ?")
+	err = tx.QueryRow(query, id).Scan(&senderID, &previousContent, &previousEpoch, &deletedAt, &kind)
+	if err == sql.ErrNoRows || (err == nil && (senderID != userID || deletedAt.Valid || kind != models.MessageKindUser)) {
+		return nil, store.ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Like new messages, edits must be readable by exactly the current members.
+	query = s.rebind(`
+		UPDATE messages SET content = ?, key_epoch = ?, edited_at = ?
+		WHERE id = ? AND ? = (SELECT key_epoch FROM chats WHERE chats.id = messages.chat_id)
+	`)
+	result, err := tx.Exec(query, content, keyEpoch, editedAt, id, keyEpoch)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, store.ErrStaleKeyEpoch
+	}
+
+	query = s.rebind("INSERT INTO message_edits (message_id, content, key_epoch, replaced_at) VALUES (?, ?, ?, ?)")
+	if _, err := tx.Exec(query, id, previousContent, previousEpoch, editedAt); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.GetMessage(id)
+}
+
+func (s *SQLStore) DeleteMessage(id, deletedBy int, deletedAt time.Time) (*models.Message, *models.Message, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var chatID, senderID int
+	query := s.rebind(`
+		UPDATE messages SET content = '', deleted_at = ?, deleted_by = ?, pinned_at = NULL, pinned_by = NULL
+		WHERE id = ? AND deleted_at IS NULL AND kind = ?
+		RETURNING chat_id, user_id
+	`)
+	err = tx.QueryRow(query, deletedAt, deletedBy, id, models.MessageKindUser).Scan(&chatID, &senderID)
+	if err == sql.ErrNoRows {
+		return nil, nil, store.ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, table := range []string{"message_edits", "reactions", "attachments"} {
+		query = s.rebind("DELETE FROM " + table + " WHERE message_id = ?")
+		if _, err := tx.Exec(query, id); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Deleted replies no longer count towards their thread, nor date it
+	query = s.rebind(`
+		UPDATE messages SET reply_count = reply_count - 1,
+			last_reply_at = (SELECT MAX(r.created_at) FROM messages r WHERE r.thread_root_id = messages.id AND r.deleted_at IS NULL)
+		WHERE id = (SELECT thread_root_id FROM messages WHERE id = ?)
+	`)
+	if _, err := tx.Exec(query, id); err != nil {
+		return nil, nil, err
+	}
+
+	// Moderators leave a note of whose message they took down
+	var notice *models.Message
+	if deletedBy != senderID {
+		notice, err = s.insertSystemMessage(tx, chatID, deletedBy, models.SystemEvent{Type: models.EventMessageDeleted, UserID: senderID, MessageID: id})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	deleted, err := s.GetMessage(id)
+	return deleted, notice, err
+}
+
+func (s *SQLStore) GetThreadFollowers(rootID int) ([]int, error) {
+	query := s.rebind("SELECT DISTINCT user_id FROM messages WHERE (id = ? OR thread_root_id = ?) AND deleted_at IS NULL")
+	rows, err := s.db.Query(query, rootID, rootID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+func (s *SQLStore) GetMessageEdits(id int) ([]models.MessageEdit, error) {
+	query := s.rebind("SELECT content, key_epoch, replaced_at FROM message_edits WHERE message_id = ? ORDER BY id")
+	rows, err := s.db.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var edits []models.MessageEdit
+	for rows.Next() {
+		var e models.MessageEdit
+		if err := rows.Scan(&e.Content, &e.KeyEpoch, &e.ReplacedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, e)
+	}
+	return edits, rows.Err()
+}
@@ -0,0 +1,145 @@
+package sqlstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func TestEditAndDeleteMessage(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "sender", Email: "sender@example.com", Password: "pass"})
+	testStore.CreateUser(&models.User{Username: "other", Email: "other@example.com", Password: "pass"})
+	sender, _ := testStore.GetUserByUsername("sender")
+	other, _ := testStore.GetUserByUsername("other")
+
+	id, _ := testStore.CreateChat("Chat", sender.ID)
+	chatID := int(id)
+	testStore.AddParticipant(chatID, sender.ID, sender.ID, accountKey(t, sender.ID, "key"))
+	original, _, _ := testStore.SaveMessage(chatID, sender.ID, 1, 0, "v1", "", nil)
+
+	now := time.Now().UTC()
+	if _, err := testStore.EditMessage(original.ID, other.ID, 1, "hijacked", now); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Errorf("Expected ErrMessageNotFound editing someone else's message, got %v", err)
+	}
+	if _, err := testStore.EditMessage(original.ID, sender.ID, 2, "future", now); !errors.Is(err, store.ErrStaleKeyEpoch) {
+		t.Errorf("Expected ErrStaleKeyEpoch for a non-current epoch, got %v", err)
+	}
+
+	edited, err := testStore.EditMessage(original.ID, sender.ID, 1, "v2", now)
+	if err != nil {
+		t.Fatalf("EditMessage failed: %v", err)
+	}
+	if edited.Content != "v2" || edited.EditedAt == nil || !edited.CreatedAt.Equal(original.CreatedAt) {
+		t.Errorf("Expected edited content with edited_at and the original timestamp, got %+v", edited)
+	}
+	testStore.EditMessage(original.ID, sender.ID, 1, "v3", now.Add(time.Second))
+
+	edits, _ := testStore.GetMessageEdits(original.ID)
+	if len(edits) != 2 || edits[0].Content != "v1" || edits[1].Content != "v2" {
+		t.Errorf("Expected history v1, v2, got %+v", edits)
+	}
+
+	deleted, notice, err := testStore.DeleteMessage(original.ID, other.ID, now)
+	if err != nil {
+		t.Fatalf("DeleteMessage failed: %v", err)
+	}
+	if deleted.Content != "" || deleted.DeletedAt == nil || deleted.DeletedBy != other.ID {
+		t.Errorf("Expected a tombstone deleted by %d, got %+v", other.ID, deleted)
+	}
+	if notice == nil || notice.UserID != other.ID || notice.Event.Type != models.EventMessageDeleted || notice.Event.UserID != sender.ID || notice.Event.MessageID != original.ID {
+		t.Errorf("Expected a notice of the deletion of the sender's message, got %+v", notice)
+	}
+	if edits, _ := testStore.GetMessageEdits(original.ID); len(edits) != 0 {
+		t.Errorf("Expected history to be discarded with the message, got %+v", edits)
+	}
+	if _, _, err := testStore.DeleteMessage(original.ID, sender.ID, now); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Errorf("Expected ErrMessageNotFound deleting twice, got %v", err)
+	}
+	if _, err := testStore.EditMessage(original.ID, sender.ID, 1, "revived", now); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Errorf("Expected ErrMessageNotFound editing a tombstone, got %v", err)
+	}
+
+	// The tombstone keeps its place in history
+	messages, _, _ := testStore.GetChatMessagesPage(chatID, store.PageOptions{Limit: 10})
+	messages = userMessages(messages)
+	if len(messages) != 1 || messages[0].DeletedAt == nil || messages[0].Content != "" {
+		t.Errorf("Expected the tombstone in the chat history, got %+v", messages)
+	}
+}
+
+func TestThreads(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "author", Email: "author@example.com", Password: "pass"})
+	testStore.CreateUser(&models.User{Username: "replier", Email: "replier@example.com", Password: "pass"})
+	author, _ := testStore.GetUserByUsername("author")
+	replier, _ := testStore.GetUserByUsername("replier")
+
+	id, _ := testStore.CreateChat("Chat", author.ID)
+	chatID := int(id)
+	testStore.AddParticipant(chatID, author.ID, author.ID, accountKey(t, author.ID, "key"))
+	testStore.AddParticipant(chatID, replier.ID, replier.ID, accountKey(t, replier.ID, "key"))
+	otherID, _ := testStore.CreateChat("Other", author.ID)
+	testStore.AddParticipant(int(otherID), author.ID, author.ID, accountKey(t, author.ID, "key"))
+
+	root, _, _ := testStore.SaveMessage(chatID, author.ID, 1, 0, "root", "", nil)
+	testStore.SaveMessage(chatID, author.ID, 1, 0, "unrelated", "", nil)
+	reply, _, err := testStore.SaveMessage(chatID, replier.ID, 1, root.ID, "reply", "", nil)
+	if err != nil {
+		t.Fatalf("SaveMessage reply failed: %v", err)
+	}
+	if reply.ReplyTo != root.ID || reply.ThreadRootID != root.ID {
+		t.Errorf("Expected a reply in the root's thread, got %+v", reply)
+	}
+
+	// Replying to a reply stays in the same thread, and retries don't recount
+	nested, _, _ := testStore.SaveMessage(chatID, author.ID, 1, reply.ID, "nested", "nested-1", nil)
+	testStore.SaveMessage(chatID, author.ID, 1, reply.ID, "nested", "nested-1", nil)
+	if nested.ReplyTo != reply.ID || nested.ThreadRootID != root.ID {
+		t.Errorf("Expected a nested reply to join the root's thread, got %+v", nested)
+	}
+	updated, _ := testStore.GetMessage(root.ID)
+	if updated.ReplyCount != 2 || updated.LastReplyAt == nil || !updated.LastReplyAt.Equal(nested.CreatedAt) {
+		t.Errorf("Expected two replies ending with the nested one, got %+v", updated)
+	}
+
+	if _, _, err := testStore.SaveMessage(int(otherID), author.ID, 1, root.ID, "cross-chat", "", nil); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Errorf("Expected ErrMessageNotFound replying across chats, got %v", err)
+	}
+
+	thread, _, _ := testStore.GetChatMessagesPage(chatID, store.PageOptions{Limit: 10, ThreadRootID: root.ID})
+	if len(thread) != 3 || thread[0].ID != root.ID || thread[1].ID != reply.ID || thread[2].ID != nested.ID {
+		t.Errorf("Expected the root followed by its replies, got %+v", thread)
+	}
+
+	followers, _ := testStore.GetThreadFollowers(root.ID)
+	if len(followers) != 2 {
+		t.Errorf("Expected author and replier to follow the thread, got %v", followers)
+	}
+
+	testStore.DeleteMessage(reply.ID, replier.ID, time.Now().UTC())
+	if updated, _ := testStore.GetMessage(root.ID); updated.ReplyCount != 1 {
+		t.Errorf("Expected a deleted reply to leave the count, got %d", updated.ReplyCount)
+	}
+	if _, _, err := testStore.SaveMessage(chatID, author.ID, 1, reply.ID, "to a tombstone", "", nil); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Errorf("Expected ErrMessageNotFound replying to a tombstone, got %v", err)
+	}
+
+	// The thread is dated by its latest live reply
+	latest, _, _ := testStore.SaveMessage(chatID, replier.ID, 1, root.ID, "latest", "", nil)
+	testStore.DeleteMessage(latest.ID, replier.ID, time.Now().UTC())
+	if updated, _ := testStore.GetMessage(root.ID); updated.ReplyCount != 1 || updated.LastReplyAt == nil || !updated.LastReplyAt.Equal(nested.CreatedAt) {
+		t.Errorf("Expected the thread to fall back to the nested reply, got %+v", updated)
+	}
+	testStore.DeleteMessage(nested.ID, author.ID, time.Now().UTC())
+	if updated, _ := testStore.GetMessage(root.ID); updated.ReplyCount != 0 || updated.LastReplyAt != nil {
+		t.Errorf("Expected a thread without live replies to have no last reply, got %+v", updated)
+	}
+}
@@ -0,0 +1,87 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func (s *SQLStore) UpdateChat(chatID, userID int, changes models.ChatChanges) (*models.Message, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var keyEpoch int
+	query := s.rebind("SELECT key_epoch FROM chats WHERE id = ? AND type = ?")
+	if err := tx.QueryRow(query, chatID, models.ChatTypeGroup).Scan(&keyEpoch); err == sql.ErrNoRows {
+		return nil, store.ErrChatNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var sets []string
+	var args []interface{}
+	for _, f := range []struct {
+		column string
+		field  *models.ChatField
+	}{
+		{"name", changes.Name},
+		{"description", changes.Description},
+		{"topic", changes.Topic},
+	} {
+		if f.field == nil {
+			continue
+		}
+		if f.field.KeyEpoch != 0 && f.field.KeyEpoch != keyEpoch {
+			return nil, store.ErrStaleKeyEpoch
+		}
+		sets = append(sets, f.column+" = ?", f.column+"_key_epoch = ?")
+		args = append(args, f.field.Value, f.field.KeyEpoch)
+	}
+	if changes.AvatarAttachmentID != nil {
+		var avatar interface{}
+		if *changes.AvatarAttachmentID != 0 {
+			avatar = *changes.AvatarAttachmentID
+		}
+		sets = append(sets, "avatar_attachment_id = ?")
+		args = append(args, avatar)
+	}
+	query = s.rebind("UPDATE chats SET " + strings.Join(sets, ", ") + " WHERE id = ?")
+	if _, err := tx.Exec(query, append(args, chatID)...); err != nil {
+		return nil, err
+	}
+
+	m, err := s.insertSystemMessage(tx, chatID, userID, models.SystemEvent{Type: models.EventChatUpdated, Chat: &changes})
+	if err != nil {
+		return nil, err
+	}
+
+	// The avatar is sent with the system message, so it can't be sent again
+	// or deleted as an unsent upload.
+	if changes.AvatarAttachmentID != nil && *changes.AvatarAttachmentID != 0 {
+		query = s.rebind(`
+			UPDATE attachments SET message_id = ?
+			WHERE id = ? AND chat_id = ? AND user_id = ? AND received = size AND message_id IS NULL
+		`)
+		result, err := tx.Exec(query, m.ID, *changes.AvatarAttachmentID, chatID, userID)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if rows == 0 {
+			return nil, store.ErrAttachmentNotFound
+		}
+		query = s.rebind("SELECT " + attachmentColumns + " FROM attachments WHERE message_id = ? ORDER BY id")
+		if m.Attachments, err = queryAttachments(tx, query, m.ID); err != nil {
+			return nil, err
+		}
+	}
+	return m, tx.Commit()
+}
@@ -0,0 +1,103 @@
+package sqlstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func TestUpdateChat(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "owner", Email: "owner@example.com", Password: "pass"})
+	testStore.CreateUser(&models.User{Username: "other", Email: "other@example.com", Password: "pass"})
+	owner, _ := testStore.GetUserByUsername("owner")
+	other, _ := testStore.GetUserByUsername("other")
+
+	id, _ := testStore.CreateChat("Chat", owner.ID)
+	chatID := int(id)
+	testStore.AddParticipant(chatID, owner.ID, owner.ID, accountKey(t, owner.ID, "key"))
+	testStore.AddParticipant(chatID, other.ID, other.ID, accountKey(t, other.ID, "key"))
+	testStore.SaveMessage(chatID, other.ID, 1, 0, "hello", "", nil)
+
+	msg, err := testStore.UpdateChat(chatID, owner.ID, models.ChatChanges{
+		Name:  &models.ChatField{Value: "Renamed"},
+		Topic: &models.ChatField{Value: "sealed", KeyEpoch: 1},
+	})
+	if err != nil {
+		t.Fatalf("UpdateChat failed: %v", err)
+	}
+	if msg.Kind != models.MessageKindSystem || msg.Username != "owner" || msg.Event.Type != models.EventChatUpdated || msg.Event.Chat.Name.Value != "Renamed" {
+		t.Errorf("Expected a system message recording the rename, got %+v", msg)
+	}
+	chat, _ := testStore.GetChat(chatID)
+	if chat.Name != "Renamed" || chat.NameKeyEpoch != 0 || chat.Topic != "sealed" || chat.TopicKeyEpoch != 1 || chat.Description != "" {
+		t.Errorf("Expected only the name and topic to change, got %+v", chat)
+	}
+	if _, err := testStore.UpdateChat(chatID, owner.ID, models.ChatChanges{Topic: &models.ChatField{Value: "old", KeyEpoch: 2}}); !errors.Is(err, store.ErrStaleKeyEpoch) {
+		t.Errorf("Expected ErrStaleKeyEpoch for another epoch, got %v", err)
+	}
+
+	// The system message sits in the timeline, but isn't anyone's to edit,
+	// delete, answer or count as unread
+	messages, _ := testStore.GetChatMessages(chatID)
+	last := messages[len(messages)-1]
+	if messages[len(messages)-2].Content != "hello" || last.ID != msg.ID || last.Event == nil || last.Event.Chat.Topic.KeyEpoch != 1 {
+		t.Fatalf("Expected the update after the first message, got %+v", messages)
+	}
+	if _, err := testStore.EditMessage(msg.ID, owner.ID, 1, "edited", time.Now().UTC()); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Errorf("Expected ErrMessageNotFound editing a system message, got %v", err)
+	}
+	if _, _, err := testStore.DeleteMessage(msg.ID, owner.ID, time.Now().UTC()); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Errorf("Expected ErrMessageNotFound deleting a system message, got %v", err)
+	}
+	if _, _, err := testStore.SaveMessage(chatID, owner.ID, 1, msg.ID, "reply", "", nil); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Errorf("Expected ErrMessageNotFound replying to a system message, got %v", err)
+	}
+	if _, err := testStore.AddReaction(msg.ID, owner.ID, "👍"); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Errorf("Expected ErrMessageNotFound reacting to a system message, got %v", err)
+	}
+	if chats, _ := testStore.GetUserChats(other.ID, 0); len(chats) != 1 || chats[0].UnreadCount != 0 || chats[0].Topic != "sealed" {
+		t.Errorf("Expected the update not to count as unread, got %+v", chats)
+	}
+
+	// Avatars must be complete uploads of the updater's
+	avatar := &models.Attachment{ChatID: chatID, UserID: owner.ID, Size: 4, ContentType: "image/png", ChunkSize: 4}
+	testStore.CreateAttachment(avatar, 100)
+	avatarID := avatar.ID
+	if _, err := testStore.UpdateChat(chatID, owner.ID, models.ChatChanges{AvatarAttachmentID: &avatarID}); !errors.Is(err, store.ErrAttachmentNotFound) {
+		t.Errorf("Expected ErrAttachmentNotFound for an incomplete avatar, got %v", err)
+	}
+	testStore.AddAttachmentChunk(avatarID, 0, 4)
+	if _, err := testStore.UpdateChat(chatID, other.ID, models.ChatChanges{AvatarAttachmentID: &avatarID}); !errors.Is(err, store.ErrAttachmentNotFound) {
+		t.Errorf("Expected ErrAttachmentNotFound for someone else's upload, got %v", err)
+	}
+	msg, err = testStore.UpdateChat(chatID, owner.ID, models.ChatChanges{AvatarAttachmentID: &avatarID})
+	if err != nil {
+		t.Fatalf("UpdateChat failed: %v", err)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].ID != avatarID {
+		t.Errorf("Expected the avatar to go with the system message, got %+v", msg.Attachments)
+	}
+	if chat, _ := testStore.GetChat(chatID); chat.AvatarAttachmentID != avatarID || chat.Name != "Renamed" {
+		t.Errorf("Expected the chat to show the avatar, got %+v", chat)
+	}
+	none := 0
+	testStore.UpdateChat(chatID, owner.ID, models.ChatChanges{AvatarAttachmentID: &none})
+	if chat, _ := testStore.GetChat(chatID); chat.AvatarAttachmentID != 0 {
+		t.Errorf("Expected the avatar to be removed, got %+v", chat)
+	}
+
+	keys := accountKey(t, owner.ID, "key")
+	for deviceID, key := range accountKey(t, other.ID, "key") {
+		keys[deviceID] = key
+	}
+	dmID, _, _ := testStore.GetOrCreateDirectChat(owner.ID, other.ID, keys)
+	if _, err := testStore.UpdateChat(dmID, owner.ID, models.ChatChanges{Name: &models.ChatField{Value: "DM"}}); !errors.Is(err, store.ErrChatNotFound) {
+		t.Errorf("Expected ErrChatNotFound renaming a direct chat, got %v", err)
+	}
+}
@@ -0,0 +1,424 @@
+package sqlstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+var (
+	// ErrSchemaTooNew is returned when the database has migrations applied that
+	// this binary does not know about, i.e. it was migrated by a newer release.
+	ErrSchemaTooNew = errors.New("database schema is newer than this binary supports")
+
+	// ErrMigrationLocked is returned when another process holds the migration
+	// lock for longer than the lock timeout.
+	ErrMigrationLocked = errors.New("migration lock is held by another process")
+)
+
+// Migration is one numbered schema change with its reverse.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Checksum identifies the contents of a migration so that edits to an
+// already-applied migration are detected.
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up + "\x00" + m.Down))
+	return hex.EncodeToString(sum[:])
+}
+
+// MigrationStatus describes a known migration and whether it is applied.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type appliedMigration struct {
+	version   int
+	checksum  string
+	appliedAt time.Time
+}
+
+// Migrator applies the embedded migrations for a single SQL dialect.
+type Migrator struct {
+	db          *sql.DB
+	driverName  string
+	migrations  []Migration
+	lock        migrationLock
+	LockTimeout time.Duration
+}
+
+// NewMigrator loads the migrations for driverName ("sqlite3" or "postgres").
+func NewMigrator(db *sql.DB, driverName string) (*Migrator, error) {
+	migrations, err := loadMigrations(driverName)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock migrationLock
+	switch driverName {
+	case "postgres":
+		lock = &advisoryLock{db: db}
+	case "sqlite3":
+		lock = &tableLock{db: db}
+	default:
+		return nil, fmt.Errorf("unsupported driver %q", driverName)
+	}
+
+	return &Migrator{
+		db:          db,
+		driverName:  driverName,
+		migrations:  migrations,
+		lock:        lock,
+		LockTimeout: 30 * time.Second,
+	}, nil
+}
+
+// loadMigrations reads migrations/<dialect>/NNNN_name.{up,down}.sql.
+func loadMigrations(driverName string) ([]Migration, error) {
+	dir := path.Join("migrations", driverName)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for driver %q: %w", driverName, err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		prefix, label, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("malformed migration filename %q", name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("malformed migration version in %q", name)
+		}
+
+		body, err := fs.ReadFile(migrationFiles, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		}
+		if m.Name != label {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, label)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d is missing its up or down file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must be contiguous from 1, found %d at position %d", m.Version, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// Latest returns the highest migration version this binary knows about.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies every pending migration in order.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.withLock(ctx, func() error {
+		applied, err := m.verify(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if err := m.apply(ctx, migration, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Down reverts the most recently applied migrations, up to steps of them.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func() error {
+		applied, err := m.verify(ctx)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if err := m.apply(ctx, migration, false); err != nil {
+				return err
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// Status reports every known migration and whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	if err := m.ensureVersionTable(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if a, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = a.appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// CheckVersion returns ErrSchemaTooNew if the database has been migrated
+// past what this binary knows about.
+func (m *Migrator) CheckVersion(ctx context.Context) error {
+	if err := m.ensureVersionTable(ctx); err != nil {
+		return err
+	}
+	_, err := m.verify(ctx)
+	return err
+}
+
+// verify loads the applied migrations and checks them against the embedded
+// ones: unknown versions mean the schema is too new, and checksum mismatches
+// mean an applied migration was edited after the fact.
+func (m *Migrator) verify(ctx context.Context) (map[int]appliedMigration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for version, a := range applied {
+		if version > m.Latest() {
+			return nil, fmt.Errorf("%w: database is at version %d, binary knows up to %d", ErrSchemaTooNew, version, m.Latest())
+		}
+		if version < 1 {
+			return nil, fmt.Errorf("unknown applied migration version %d", version)
+		}
+		if want := m.migrations[version-1].Checksum(); a.checksum != want {
+			return nil, fmt.Errorf("checksum mismatch for applied migration %d (%s)", version, m.migrations[version-1].Name)
+		}
+	}
+	return applied, nil
+}
+
+func (m *Migrator) apply(ctx context.Context, migration Migration, up bool) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	script := migration.Down
+	if up {
+		script = migration.Up
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Name, err)
+	}
+
+	if up {
+		query := m.rebind("INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)")
+		_, err = tx.ExecContext(ctx, query, migration.Version, migration.Name, migration.Checksum(), time.Now().UTC())
+	} else {
+		query := m.rebind("DELETE FROM schema_migrations WHERE version = ?")
+		_, err = tx.ExecContext(ctx, query, migration.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]appliedMigration, error) {
+	rows, err := m.db.QueryContext(ctx, "SELECT version, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.version, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[a.version] = a
+	}
+	return applied, rows.Err()
+}
+
+func (m *Migrator) ensureVersionTable(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	return err
+}
+
+func (m *Migrator) withLock(ctx context.Context, fn func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, m.LockTimeout)
+	defer cancel()
+
+	for {
+		ok, err := m.lock.tryLock(ctx)
+		if err != nil {
+			return err
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ErrMigrationLocked
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+	defer m.lock.unlock(context.Background())
+
+	// Created under the lock so that concurrent first starts don't race on it.
+	if err := m.ensureVersionTable(ctx); err != nil {
+		return err
+	}
+	return fn()
+}
+
+func (m *Migrator) rebind(query string) string {
+	return rebind(m.driverName, query)
+}
+
+// migrationLock keeps two chatty instances from migrating at the same time.
+type migrationLock interface {
+	tryLock(ctx context.Context) (bool, error)
+	unlock(ctx context.Context) error
+}
+
+// migrationLockID is an arbitrary constant shared by every chatty instance.
+const migrationLockID = 7385092313
+
+// advisoryLock uses a Postgres session-level advisory lock, which is released
+// automatically if the holding connection dies.
+type advisoryLock struct {
+	db   *sql.DB
+	conn *sql.Conn
+}
+
+func (l *advisoryLock) tryLock(ctx context.Context) (bool, error) {
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	var ok bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", migrationLockID).Scan(&ok); err != nil {
+		conn.Close()
+		return false, err
+	}
+	if !ok {
+		conn.Close()
+		return false, nil
+	}
+	l.conn = conn
+	return true, nil
+}
+
+func (l *advisoryLock) unlock(ctx context.Context) error {
+	defer l.conn.Close()
+	_, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+	return err
+}
+
+// tableLock uses a single-row table for SQLite, which has no advisory locks.
+// A crashed migration leaves the row behind; delete it by hand to recover.
+type tableLock struct {
+	db *sql.DB
+}
+
+func (l *tableLock) tryLock(ctx context.Context) (bool, error) {
+	_, err := l.db.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		locked_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := l.db.ExecContext(ctx, "INSERT OR IGNORE INTO schema_migrations_lock (id, locked_at) VALUES (1, ?)", time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
+
+func (l *tableLock) unlock(ctx context.Context) error {
+	_, err := l.db.ExecContext(ctx, "DELETE FROM schema_migrations_lock WHERE id = 1")
+	return err
+}
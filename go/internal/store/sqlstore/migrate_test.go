@@ -0,0 +1,129 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrateUpDownStatus(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	migrator, err := NewMigrator(db, "sqlite3")
+	if err != nil {
+		t.Fatalf("Failed to create migrator: %v", err)
+	}
+
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	// Running Up again is a no-op
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatalf("Second Up failed: %v", err)
+	}
+
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if len(statuses) != migrator.Latest() {
+		t.Errorf("Expected %d statuses, got %d", migrator.Latest(), len(statuses))
+	}
+	for _, s := range statuses {
+		if !s.Applied {
+			t.Errorf("Expected migration %d to be applied", s.Version)
+		}
+	}
+
+	if err := migrator.Down(ctx, migrator.Latest()); err != nil {
+		t.Fatalf("Down failed: %v", err)
+	}
+	if _, err := db.Exec("SELECT 1 FROM users"); err == nil {
+		t.Error("Expected users table to be dropped after migrating all the way down")
+	}
+
+	statuses, _ = migrator.Status(ctx)
+	for _, s := range statuses {
+		if s.Applied {
+			t.Errorf("Expected migration %d to be pending", s.Version)
+		}
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	migrator, _ := NewMigrator(db, "sqlite3")
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+
+	// Simulate a newer release having migrated this database
+	_, err := db.Exec("INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)",
+		migrator.Latest()+1, "from_the_future", "x", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrator.Up(ctx); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew from Up, got %v", err)
+	}
+	if err := migrator.CheckVersion(ctx); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew from CheckVersion, got %v", err)
+	}
+}
+
+func TestMigrateDetectsChecksumMismatch(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	migrator, _ := NewMigrator(db, "sqlite3")
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+
+	if _, err := db.Exec("UPDATE schema_migrations SET checksum = 'tampered' WHERE version = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrator.Up(ctx); err == nil {
+		t.Error("Expected checksum mismatch error, got nil")
+	}
+}
+
+func TestMigrateLock(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	first, _ := NewMigrator(db, "sqlite3")
+	second, _ := NewMigrator(db, "sqlite3")
+	second.LockTimeout = 100 * time.Millisecond
+
+	ok, err := first.lock.tryLock(ctx)
+	if err != nil || !ok {
+		t.Fatalf("Expected to acquire lock, got ok=%v err=%v", ok, err)
+	}
+
+	if err := second.Up(ctx); !errors.Is(err, ErrMigrationLocked) {
+		t.Errorf("Expected ErrMigrationLocked while lock is held, got %v", err)
+	}
+
+	first.lock.unlock(ctx)
+	if err := second.Up(ctx); err != nil {
+		t.Errorf("Expected Up to succeed after lock release, got %v", err)
+	}
+}
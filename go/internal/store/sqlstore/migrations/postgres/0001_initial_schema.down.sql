@@ -0,0 +1,4 @@
+DROP TABLE messages;
+DROP TABLE participants;
+DROP TABLE chats;
+DROP TABLE users;
@@ -0,0 +1 @@
+CREATE INDEX idx_messages_chat_created_at ON messages (chat_id, created_at, id);
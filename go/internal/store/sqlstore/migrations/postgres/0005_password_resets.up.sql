@@ -0,0 +1,11 @@
+-- Only a hash of each reset token is stored, so a leaked table can't be
+-- used to take over accounts.
+CREATE TABLE password_resets (
+	token_hash TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	created_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	used_at TIMESTAMP
+);
+
+CREATE INDEX idx_password_resets_user_id ON password_resets (user_id);
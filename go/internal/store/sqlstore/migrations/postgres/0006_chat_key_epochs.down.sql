@@ -0,0 +1,15 @@
+-- Only the current epoch's keys survive; history from earlier epochs becomes
+-- unreadable.
+ALTER TABLE participants ADD COLUMN encrypted_chat_key TEXT;
+
+UPDATE participants SET encrypted_chat_key = (
+	SELECT k.encrypted_key
+	FROM chat_keys k
+	JOIN chats c ON c.id = k.chat_id
+	WHERE k.chat_id = participants.chat_id AND k.user_id = participants.user_id AND k.epoch = c.key_epoch
+);
+
+DROP TABLE chat_keys;
+ALTER TABLE messages DROP COLUMN key_epoch;
+ALTER TABLE chats DROP COLUMN rekey_needed;
+ALTER TABLE chats DROP COLUMN key_epoch;
@@ -0,0 +1,19 @@
+-- Chat keys are versioned by epoch. A new epoch starts whenever the owner
+-- rekeys the chat, which is required after a member leaves or is removed.
+ALTER TABLE chats ADD COLUMN key_epoch INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE chats ADD COLUMN rekey_needed BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE messages ADD COLUMN key_epoch INTEGER NOT NULL DEFAULT 1;
+
+-- One wrapped copy of each epoch's key per member.
+CREATE TABLE chat_keys (
+	chat_id INTEGER NOT NULL REFERENCES chats(id),
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	epoch INTEGER NOT NULL,
+	encrypted_key TEXT NOT NULL,
+	PRIMARY KEY (chat_id, user_id, epoch)
+);
+
+INSERT INTO chat_keys (chat_id, user_id, epoch, encrypted_key)
+SELECT chat_id, user_id, 1, COALESCE(encrypted_chat_key, '') FROM participants;
+
+ALTER TABLE participants DROP COLUMN encrypted_chat_key;
@@ -0,0 +1,40 @@
+-- Each device has its own keypair. Every user starts with an account device
+-- whose private key is the one wrapped with their password, so a password
+-- login can always act as it.
+CREATE TABLE devices (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	name TEXT NOT NULL,
+	public_key TEXT NOT NULL,
+	is_account BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_devices_user_id ON devices (user_id);
+CREATE UNIQUE INDEX idx_devices_account ON devices (user_id) WHERE is_account;
+
+INSERT INTO devices (user_id, name, public_key, is_account)
+SELECT id, 'Account key', COALESCE(public_key, ''), TRUE FROM users;
+
+-- Sessions act as one device.
+ALTER TABLE sessions ADD COLUMN device_id INTEGER;
+UPDATE sessions SET device_id = (SELECT id FROM devices WHERE devices.user_id = sessions.user_id AND is_account);
+
+-- Chat keys are wrapped per device rather than per user.
+CREATE TABLE device_chat_keys (
+	chat_id INTEGER NOT NULL REFERENCES chats(id),
+	device_id INTEGER NOT NULL REFERENCES devices(id),
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	epoch INTEGER NOT NULL,
+	encrypted_key TEXT NOT NULL,
+	PRIMARY KEY (chat_id, device_id, epoch)
+);
+
+INSERT INTO device_chat_keys (chat_id, device_id, user_id, epoch, encrypted_key)
+SELECT k.chat_id, d.id, k.user_id, k.epoch, k.encrypted_key
+FROM chat_keys k
+JOIN devices d ON d.user_id = k.user_id AND d.is_account;
+
+DROP TABLE chat_keys;
+ALTER TABLE device_chat_keys RENAME TO chat_keys;
+CREATE INDEX idx_chat_keys_user_id ON chat_keys (chat_id, user_id);
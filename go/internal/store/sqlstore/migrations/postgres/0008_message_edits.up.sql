@@ -0,0 +1,16 @@
+-- Deleted messages stay behind as tombstones with their content cleared, so
+-- history and pagination cursors stay intact.
+ALTER TABLE messages ADD COLUMN edited_at TIMESTAMP;
+ALTER TABLE messages ADD COLUMN deleted_at TIMESTAMP;
+ALTER TABLE messages ADD COLUMN deleted_by INTEGER;
+
+-- Previous versions of edited messages, discarded when the message is deleted.
+CREATE TABLE message_edits (
+	id SERIAL PRIMARY KEY,
+	message_id INTEGER NOT NULL REFERENCES messages(id),
+	content TEXT NOT NULL,
+	key_epoch INTEGER NOT NULL,
+	replaced_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_message_edits_message_id ON message_edits (message_id);
@@ -0,0 +1,6 @@
+DROP INDEX idx_messages_thread;
+
+ALTER TABLE messages DROP COLUMN last_reply_at;
+ALTER TABLE messages DROP COLUMN reply_count;
+ALTER TABLE messages DROP COLUMN thread_root_id;
+ALTER TABLE messages DROP COLUMN reply_to;
@@ -0,0 +1,9 @@
+-- Reactions are opaque strings chosen by clients; the server only counts
+-- them. Each user can add a given reaction to a message once.
+CREATE TABLE reactions (
+	message_id INTEGER NOT NULL REFERENCES messages(id),
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	reaction TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (message_id, user_id, reaction)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE chats DROP COLUMN last_message_at;
+ALTER TABLE participants DROP COLUMN last_read_message_id;
@@ -0,0 +1,19 @@
+-- Attachments are encrypted by clients and uploaded in chunks of chunk_size
+-- bytes to the blob store; received counts the bytes stored so far. Size
+-- and content_type are declared by the uploader. message_id is set once a
+-- complete attachment is sent with a message.
+CREATE TABLE attachments (
+	id SERIAL PRIMARY KEY,
+	chat_id INTEGER NOT NULL REFERENCES chats(id),
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	message_id INTEGER REFERENCES messages(id),
+	size BIGINT NOT NULL,
+	content_type TEXT NOT NULL,
+	chunk_size BIGINT NOT NULL,
+	received BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_attachments_chat_id ON attachments (chat_id);
+CREATE INDEX idx_attachments_user_id ON attachments (user_id);
+CREATE INDEX idx_attachments_message_id ON attachments (message_id);
@@ -0,0 +1,4 @@
+ALTER TABLE participants DROP COLUMN hidden;
+DROP INDEX idx_chats_dm_key;
+ALTER TABLE chats DROP COLUMN dm_key;
+ALTER TABLE chats DROP COLUMN type;
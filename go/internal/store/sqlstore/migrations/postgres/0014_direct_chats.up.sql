@@ -0,0 +1,9 @@
+-- Chats are either groups or direct chats between exactly two users. A
+-- direct chat is unique per pair: its dm_key is "<lower user ID>:<higher
+-- user ID>", and it is NULL for groups.
+ALTER TABLE chats ADD COLUMN type TEXT NOT NULL DEFAULT 'group';
+ALTER TABLE chats ADD COLUMN dm_key TEXT;
+CREATE UNIQUE INDEX idx_chats_dm_key ON chats (dm_key);
+
+-- Members can hide a direct chat from their list until it gets a new message.
+ALTER TABLE participants ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,9 @@
+-- Each participant has a role: 'owner', 'admin', 'member' or 'read_only'.
+-- Group chat owners become the owner participant; everyone else, including
+-- both members of a direct chat, starts as a member.
+ALTER TABLE participants ADD COLUMN role TEXT NOT NULL DEFAULT 'member';
+UPDATE participants SET role = 'owner'
+WHERE EXISTS (
+    SELECT 1 FROM chats
+    WHERE chats.id = participants.chat_id AND chats.owner_id = participants.user_id AND chats.type = 'group'
+);
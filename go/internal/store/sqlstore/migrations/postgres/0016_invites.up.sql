@@ -0,0 +1,26 @@
+-- Invite links let users ask to join a group chat. max_uses of 0 means no
+-- limit and a NULL expires_at means the invite never expires.
+CREATE TABLE invites (
+	id SERIAL PRIMARY KEY,
+	chat_id INTEGER NOT NULL REFERENCES chats(id),
+	code TEXT NOT NULL UNIQUE,
+	created_by INTEGER NOT NULL REFERENCES users(id),
+	expires_at TIMESTAMP,
+	max_uses INTEGER NOT NULL DEFAULT 0,
+	uses INTEGER NOT NULL DEFAULT 0,
+	requires_approval BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_invites_chat_id ON invites (chat_id);
+
+-- Users who redeemed an invite wait here until a member wraps the chat key
+-- for their devices. requires_approval is copied from the invite so that
+-- revoking it doesn't change how pending requests are handled.
+CREATE TABLE join_requests (
+	chat_id INTEGER NOT NULL REFERENCES chats(id),
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	requires_approval BOOLEAN NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (chat_id, user_id)
+);
@@ -0,0 +1,27 @@
+-- Deactivated users can't log in; chats they owned pass to a successor.
+ALTER TABLE users ADD COLUMN deactivated_at TIMESTAMP;
+
+-- The participant a chat's owner offered it to, until they accept.
+ALTER TABLE chats ADD COLUMN pending_owner_id INTEGER;
+
+-- Succession goes to the longest-standing participant. Existing members are
+-- dated by their first message, or else by this migration.
+ALTER TABLE participants ADD COLUMN joined_at TIMESTAMP;
+UPDATE participants SET joined_at = COALESCE(
+    (SELECT MIN(created_at) FROM messages
+     WHERE messages.chat_id = participants.chat_id AND messages.user_id = participants.user_id),
+    CURRENT_TIMESTAMP
+);
+
+-- Changes to who runs a chat. actor_id caused the change and target_id is
+-- who it happened to.
+CREATE TABLE audit_log (
+	id SERIAL PRIMARY KEY,
+	chat_id INTEGER NOT NULL REFERENCES chats(id),
+	action TEXT NOT NULL,
+	actor_id INTEGER NOT NULL REFERENCES users(id),
+	target_id INTEGER NOT NULL REFERENCES users(id),
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_audit_log_chat_id ON audit_log (chat_id, id);
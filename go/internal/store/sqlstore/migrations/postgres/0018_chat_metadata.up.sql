@@ -0,0 +1,10 @@
+-- Chat details besides the name. Each text field may be client-encrypted:
+-- its key epoch is that of the chat key it's encrypted under, or 0 for
+-- plain text. The avatar is an attachment sent with the system message
+-- that set it.
+ALTER TABLE chats ADD COLUMN name_key_epoch INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chats ADD COLUMN description TEXT NOT NULL DEFAULT '';
+ALTER TABLE chats ADD COLUMN description_key_epoch INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chats ADD COLUMN topic TEXT NOT NULL DEFAULT '';
+ALTER TABLE chats ADD COLUMN topic_key_epoch INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chats ADD COLUMN avatar_attachment_id INTEGER;
@@ -0,0 +1,4 @@
+DROP INDEX idx_messages_pinned;
+
+ALTER TABLE messages DROP COLUMN pinned_by;
+ALTER TABLE messages DROP COLUMN pinned_at;
@@ -0,0 +1,6 @@
+-- Pinned messages are listed with their chat, most recently pinned first.
+-- Deleting a message unpins it.
+ALTER TABLE messages ADD COLUMN pinned_at TIMESTAMP;
+ALTER TABLE messages ADD COLUMN pinned_by INTEGER;
+
+CREATE INDEX idx_messages_pinned ON messages (chat_id, pinned_at);
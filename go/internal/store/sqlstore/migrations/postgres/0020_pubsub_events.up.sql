@@ -0,0 +1,10 @@
+-- Events too large for a NOTIFY payload. The Postgres pub/sub broker stores
+-- them here and notifies every instance of the row instead; rows are pruned
+-- once listeners have had ample time to load them.
+CREATE TABLE pubsub_events (
+	id SERIAL PRIMARY KEY,
+	payload TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_pubsub_events_created_at ON pubsub_events (created_at);
@@ -0,0 +1,4 @@
+-- System messages are written by the server to record changes to the chat
+-- in its timeline. They have no content; event holds what happened as JSON.
+ALTER TABLE messages ADD COLUMN kind TEXT NOT NULL DEFAULT 'user';
+ALTER TABLE messages ADD COLUMN event TEXT;
@@ -0,0 +1,37 @@
+-- IF NOT EXISTS lets deployments that predate schema_migrations adopt this
+-- version without recreating their tables.
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL,
+	email TEXT UNIQUE NOT NULL,
+	password TEXT NOT NULL,
+	public_key TEXT,
+	encrypted_private_key TEXT,
+	is_verified BOOLEAN DEFAULT FALSE,
+	verification_token TEXT
+);
+
+CREATE TABLE IF NOT EXISTS chats (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	owner_id INTEGER REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS participants (
+	chat_id INTEGER,
+	user_id INTEGER,
+	encrypted_chat_key TEXT,
+	PRIMARY KEY (chat_id, user_id),
+	FOREIGN KEY (chat_id) REFERENCES chats(id),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	chat_id INTEGER,
+	user_id INTEGER,
+	content TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (chat_id) REFERENCES chats(id),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
@@ -0,0 +1 @@
+DROP INDEX idx_messages_chat_created_at;
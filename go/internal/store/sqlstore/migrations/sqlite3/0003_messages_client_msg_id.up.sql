@@ -0,0 +1,4 @@
+ALTER TABLE messages ADD COLUMN client_msg_id TEXT;
+
+-- NULLs are distinct, so messages sent without an idempotency key never conflict.
+CREATE UNIQUE INDEX idx_messages_client_msg_id ON messages (chat_id, user_id, client_msg_id);
@@ -0,0 +1,19 @@
+-- Only the account device's keys survive.
+CREATE TABLE user_chat_keys (
+	chat_id INTEGER NOT NULL REFERENCES chats(id),
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	epoch INTEGER NOT NULL,
+	encrypted_key TEXT NOT NULL,
+	PRIMARY KEY (chat_id, user_id, epoch)
+);
+
+INSERT INTO user_chat_keys (chat_id, user_id, epoch, encrypted_key)
+SELECT k.chat_id, k.user_id, k.epoch, k.encrypted_key
+FROM chat_keys k
+JOIN devices d ON d.id = k.device_id AND d.is_account;
+
+DROP TABLE chat_keys;
+ALTER TABLE user_chat_keys RENAME TO chat_keys;
+
+ALTER TABLE sessions DROP COLUMN device_id;
+DROP TABLE devices;
@@ -0,0 +1,8 @@
+DROP TABLE message_edits;
+
+-- Tombstones can't be told apart from messages without the columns.
+DELETE FROM messages WHERE deleted_at IS NOT NULL;
+
+ALTER TABLE messages DROP COLUMN deleted_by;
+ALTER TABLE messages DROP COLUMN deleted_at;
+ALTER TABLE messages DROP COLUMN edited_at;
@@ -0,0 +1,8 @@
+-- reply_to is the message being answered and thread_root_id the top of its
+-- thread. Roots keep a running count of their live replies.
+ALTER TABLE messages ADD COLUMN reply_to INTEGER;
+ALTER TABLE messages ADD COLUMN thread_root_id INTEGER;
+ALTER TABLE messages ADD COLUMN reply_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE messages ADD COLUMN last_reply_at TIMESTAMP;
+
+CREATE INDEX idx_messages_thread ON messages (thread_root_id, created_at, id);
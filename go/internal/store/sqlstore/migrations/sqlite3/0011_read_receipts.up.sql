@@ -0,0 +1,7 @@
+-- Each member's read pointer is the newest message they have seen; later
+-- messages from others count as unread.
+ALTER TABLE participants ADD COLUMN last_read_message_id INTEGER NOT NULL DEFAULT 0;
+
+-- Kept alongside the chat so listing chats doesn't scan their messages.
+ALTER TABLE chats ADD COLUMN last_message_at TIMESTAMP;
+UPDATE chats SET last_message_at = (SELECT MAX(created_at) FROM messages WHERE messages.chat_id = chats.id);
@@ -0,0 +1,3 @@
+-- When the user's last connection closed; live presence is kept in memory
+-- by the hubs.
+ALTER TABLE users ADD COLUMN last_seen_at TIMESTAMP;
@@ -0,0 +1,4 @@
+DROP TABLE audit_log;
+ALTER TABLE participants DROP COLUMN joined_at;
+ALTER TABLE chats DROP COLUMN pending_owner_id;
+ALTER TABLE users DROP COLUMN deactivated_at;
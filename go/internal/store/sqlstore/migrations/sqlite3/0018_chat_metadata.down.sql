@@ -0,0 +1,6 @@
+ALTER TABLE chats DROP COLUMN avatar_attachment_id;
+ALTER TABLE chats DROP COLUMN topic_key_epoch;
+ALTER TABLE chats DROP COLUMN topic;
+ALTER TABLE chats DROP COLUMN description_key_epoch;
+ALTER TABLE chats DROP COLUMN description;
+ALTER TABLE chats DROP COLUMN name_key_epoch;
@@ -0,0 +1 @@
+-- Intentionally empty; see 0020_pubsub_events.up.sql.
@@ -0,0 +1,4 @@
+-- Intentionally empty. pubsub_events holds events too large for a Postgres
+-- NOTIFY payload; SQLite deployments use the in-process broker and never
+-- spill, so they don't get the table. The version is kept so both dialects
+-- number their migrations alike.
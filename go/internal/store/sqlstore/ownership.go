@@ -0,0 +1,188 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func (s *SQLStore) SetPendingOwner(chatID, userID int) error {
+	var pending interface{}
+	if userID != 0 {
+		pending = userID
+	}
+	query := s.rebind("UPDATE chats SET pending_owner_id = ? WHERE id = ? AND type = ?")
+	result, err := s.db.Exec(query, pending, chatID, models.ChatTypeGroup)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return store.ErrChatNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) TransferOwnership(chatID, userID int, now time.Time) (*models.AuditEntry, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var ownerID int
+	var pendingOwnerID sql.NullInt64
+	query := s.rebind("SELECT owner_id, pending_owner_id FROM chats WHERE id = ?")
+	err = tx.QueryRow(query, chatID).Scan(&ownerID, &pendingOwnerID)
+	if err == sql.ErrNoRows || (err == nil && int(pendingOwnerID.Int64) != userID) {
+		return nil, store.ErrNoPendingTransfer
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := s.handOver(tx, chatID, ownerID, userID, models.RoleAdmin, models.AuditOwnershipTransferred, ownerID, now)
+	if err != nil {
+		return nil, err
+	}
+	return entry, tx.Commit()
+}
+
+// handOver makes to the owner of a chat in place of from, who is left with
+// formerRole, and records action by actorID in the audit log and the chat's
+// timeline.
+func (s *SQLStore) handOver(tx txn, chatID, from, to int, formerRole, action string, actorID int, now time.Time) (*models.AuditEntry, error) {
+	query := s.rebind("UPDATE participants SET role = ? WHERE chat_id = ? AND user_id = ?")
+	result, err := tx.Exec(query, models.RoleOwner, chatID, to)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, store.ErrNotParticipant
+	}
+	if _, err := tx.Exec(query, formerRole, chatID, from); err != nil {
+		return nil, err
+	}
+
+	query = s.rebind("UPDATE chats SET owner_id = ?, pending_owner_id = NULL WHERE id = ?")
+	if _, err := tx.Exec(query, to, chatID); err != nil {
+		return nil, err
+	}
+
+	entry := models.AuditEntry{ChatID: chatID, Action: action, ActorID: actorID, TargetID: to, CreatedAt: now}
+	query = s.rebind("INSERT INTO audit_log (chat_id, action, actor_id, target_id, created_at) VALUES (?, ?, ?, ?, ?) RETURNING id")
+	if err := tx.QueryRow(query, chatID, action, actorID, to, now).Scan(&entry.ID); err != nil {
+		return nil, err
+	}
+
+	entry.Message, err = s.insertSystemMessage(tx, chatID, actorID, models.SystemEvent{Type: models.EventOwnerChanged, UserID: to, Reason: action})
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (s *SQLStore) DeactivateUser(userID int, now time.Time) ([]models.AuditEntry, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := s.rebind("UPDATE users SET deactivated_at = ? WHERE id = ? AND deactivated_at IS NULL")
+	result, err := tx.Exec(query, now, userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, nil
+	}
+
+	query = s.rebind("DELETE FROM sessions WHERE user_id = ?")
+	if _, err := tx.Exec(query, userID); err != nil {
+		return nil, err
+	}
+
+	query = s.rebind("UPDATE chats SET pending_owner_id = NULL WHERE pending_owner_id = ?")
+	if _, err := tx.Exec(query, userID); err != nil {
+		return nil, err
+	}
+
+	query = s.rebind("SELECT id FROM chats WHERE owner_id = ? AND type = ? ORDER BY id")
+	chatRows, err := tx.Query(query, userID, models.ChatTypeGroup)
+	if err != nil {
+		return nil, err
+	}
+	var chatIDs []int
+	for chatRows.Next() {
+		var chatID int
+		if err := chatRows.Scan(&chatID); err != nil {
+			chatRows.Close()
+			return nil, err
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+	chatRows.Close()
+	if err := chatRows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Admins come before members, then whoever joined first
+	query = s.rebind(`
+		SELECT p.user_id
+		FROM participants p
+		JOIN users u ON u.id = p.user_id
+		WHERE p.chat_id = ? AND p.role IN (?, ?) AND u.deactivated_at IS NULL
+		ORDER BY CASE p.role WHEN ? THEN 0 ELSE 1 END, p.joined_at, p.user_id
+		LIMIT 1
+	`)
+	var entries []models.AuditEntry
+	for _, chatID := range chatIDs {
+		var successorID int
+		err := tx.QueryRow(query, chatID, models.RoleAdmin, models.RoleMember, models.RoleAdmin).Scan(&successorID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry, err := s.handOver(tx, chatID, userID, successorID, models.RoleMember, models.AuditOwnershipSucceeded, userID, now)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, tx.Commit()
+}
+
+func (s *SQLStore) GetAuditLog(chatID int) ([]models.AuditEntry, error) {
+	query := s.rebind("SELECT id, chat_id, action, actor_id, target_id, created_at FROM audit_log WHERE chat_id = ? ORDER BY id")
+	rows, err := s.db.Query(query, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.AuditEntry
+	for rows.Next() {
+		var e models.AuditEntry
+		if err := rows.Scan(&e.ID, &e.ChatID, &e.Action, &e.ActorID, &e.TargetID, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
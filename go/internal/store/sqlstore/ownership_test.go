@@ -0,0 +1,140 @@
+package sqlstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func TestTransferOwnership(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	for _, name := range []string{"owner", "heir", "other"} {
+		testStore.CreateUser(&models.User{Username: name, Email: name + "@example.com", Password: "pass"})
+	}
+	owner, _ := testStore.GetUserByUsername("owner")
+	heir, _ := testStore.GetUserByUsername("heir")
+	other, _ := testStore.GetUserByUsername("other")
+
+	id, _ := testStore.CreateChat("Chat", owner.ID)
+	chatID := int(id)
+	for _, u := range []*models.User{owner, heir, other} {
+		testStore.AddParticipant(chatID, u.ID, u.ID, accountKey(t, u.ID, "key"))
+	}
+
+	now := time.Now().UTC()
+	if _, err := testStore.TransferOwnership(chatID, heir.ID, now); !errors.Is(err, store.ErrNoPendingTransfer) {
+		t.Errorf("Expected ErrNoPendingTransfer without an offer, got %v", err)
+	}
+	if err := testStore.SetPendingOwner(chatID, heir.ID); err != nil {
+		t.Fatalf("SetPendingOwner failed: %v", err)
+	}
+	if chat, _ := testStore.GetChat(chatID); chat.PendingOwnerID != heir.ID {
+		t.Errorf("Expected the chat to be offered to the heir, got %+v", chat)
+	}
+	if _, err := testStore.TransferOwnership(chatID, other.ID, now); !errors.Is(err, store.ErrNoPendingTransfer) {
+		t.Errorf("Expected ErrNoPendingTransfer for someone else, got %v", err)
+	}
+
+	entry, err := testStore.TransferOwnership(chatID, heir.ID, now)
+	if err != nil {
+		t.Fatalf("TransferOwnership failed: %v", err)
+	}
+	if entry.Action != models.AuditOwnershipTransferred || entry.ActorID != owner.ID || entry.TargetID != heir.ID {
+		t.Errorf("Expected a transfer from the owner to the heir, got %+v", entry)
+	}
+	chat, _ := testStore.GetChat(chatID)
+	if chat.OwnerID != heir.ID || chat.PendingOwnerID != 0 {
+		t.Errorf("Expected the heir to own the chat with no offer pending, got %+v", chat)
+	}
+	for userID, want := range map[int]string{heir.ID: models.RoleOwner, owner.ID: models.RoleAdmin} {
+		if m, _ := testStore.GetMembership(chatID, userID); m.Role != want {
+			t.Errorf("Expected user %d to be %s, got %s", userID, want, m.Role)
+		}
+	}
+	if entries, _ := testStore.GetAuditLog(chatID); len(entries) != 1 || entries[0].ID != entry.ID {
+		t.Errorf("Expected the transfer in the audit log, got %+v", entries)
+	}
+
+	// Offers lapse when the nominee leaves
+	testStore.SetPendingOwner(chatID, other.ID)
+	testStore.RemoveParticipant(chatID, other.ID, other.ID)
+	if chat, _ := testStore.GetChat(chatID); chat.PendingOwnerID != 0 {
+		t.Errorf("Expected the offer to lapse, got %+v", chat)
+	}
+}
+
+func TestDeactivateUser(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	for _, name := range []string{"owner", "admin", "senior", "junior", "reader"} {
+		testStore.CreateUser(&models.User{Username: name, Email: name + "@example.com", Password: "pass"})
+	}
+	users := make(map[string]*models.User)
+	for _, name := range []string{"owner", "admin", "senior", "junior", "reader"} {
+		users[name], _ = testStore.GetUserByUsername(name)
+	}
+	newChat := func(members ...string) int {
+		id, _ := testStore.CreateChat("Chat", users["owner"].ID)
+		chatID := int(id)
+		for _, name := range append([]string{"owner"}, members...) {
+			testStore.AddParticipant(chatID, users[name].ID, users[name].ID, accountKey(t, users[name].ID, "key"))
+		}
+		return chatID
+	}
+
+	// The admin outranks longer-standing members; among members the first
+	// to join wins; read-only participants never take over
+	withAdmin := newChat("senior", "admin")
+	testStore.SetParticipantRole(withAdmin, users["admin"].ID, users["admin"].ID, models.RoleAdmin)
+	membersOnly := newChat("senior", "junior")
+	readersOnly := newChat("reader")
+	testStore.SetParticipantRole(readersOnly, users["reader"].ID, users["reader"].ID, models.RoleReadOnly)
+	testStore.SetPendingOwner(withAdmin, users["senior"].ID)
+
+	now := time.Now().UTC()
+	testStore.CreateSession(&models.Session{ID: "owner-session", UserID: users["owner"].ID, CreatedAt: now, LastSeenAt: now})
+
+	entries, err := testStore.DeactivateUser(users["owner"].ID, now)
+	if err != nil {
+		t.Fatalf("DeactivateUser failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected two successions, got %+v", entries)
+	}
+	for chatID, want := range map[int]string{withAdmin: "admin", membersOnly: "senior", readersOnly: "owner"} {
+		chat, _ := testStore.GetChat(chatID)
+		if chat.OwnerID != users[want].ID || chat.PendingOwnerID != 0 {
+			t.Errorf("Expected %s to own chat %d with no offer pending, got %+v", want, chatID, chat)
+		}
+	}
+	if m, _ := testStore.GetMembership(withAdmin, users["owner"].ID); m.Role != models.RoleMember {
+		t.Errorf("Expected the deactivated owner to stay on as a member, got %s", m.Role)
+	}
+	if log, _ := testStore.GetAuditLog(membersOnly); len(log) != 1 || log[0].Action != models.AuditOwnershipSucceeded || log[0].ActorID != users["owner"].ID {
+		t.Errorf("Expected the succession in the audit log, got %+v", log)
+	}
+
+	if user, _ := testStore.GetUserByID(users["owner"].ID); user.DeactivatedAt == nil {
+		t.Error("Expected the user to be deactivated")
+	}
+	if sessions, _ := testStore.GetUserSessions(users["owner"].ID); len(sessions) != 0 {
+		t.Errorf("Expected the user's sessions to end with the account, got %+v", sessions)
+	}
+	// A session that slips in afterwards still doesn't authenticate
+	testStore.CreateSession(&models.Session{ID: "late-session", UserID: users["owner"].ID, CreatedAt: now, LastSeenAt: now})
+	if _, err := testStore.GetSession("late-session"); err == nil {
+		t.Error("Expected a deactivated user's session to be rejected")
+	}
+	if found, _ := testStore.SearchUsers("owner"); len(found) != 0 {
+		t.Errorf("Expected deactivated users to be left out of searches, got %+v", found)
+	}
+	if entries, err := testStore.DeactivateUser(users["owner"].ID, time.Now().UTC()); err != nil || len(entries) != 0 {
+		t.Errorf("Expected deactivating again to do nothing, got %+v (%v)", entries, err)
+	}
+}
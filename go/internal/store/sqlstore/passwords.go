@@ -0,0 +1,89 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/pliu/chatty/internal/store"
+)
+
+func (s *SQLStore) UpdateUserCredentials(userID int, password, publicKey, encryptedPrivateKey string) ([]int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := s.rebind("UPDATE users SET password = ?, public_key = ?, encrypted_private_key = ? WHERE id = ?")
+	if _, err := tx.Exec(query, password, publicKey, encryptedPrivateKey, userID); err != nil {
+		return nil, err
+	}
+
+	// The account device is the password-wrapped keypair
+	var deviceID int
+	var oldKey string
+	query = s.rebind("SELECT id, public_key FROM devices WHERE user_id = ? AND is_account")
+	if err := tx.QueryRow(query, userID).Scan(&deviceID, &oldKey); err != nil {
+		return nil, err
+	}
+	if publicKey == oldKey {
+		return nil, tx.Commit()
+	}
+	query = s.rebind("UPDATE devices SET public_key = ? WHERE id = ?")
+	if _, err := tx.Exec(query, publicKey, deviceID); err != nil {
+		return nil, err
+	}
+
+	// Chat keys wrapped for the old keypair can't be unwrapped any more
+	chatIDs, err := s.dropDeviceKeys(tx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	return chatIDs, tx.Commit()
+}
+
+func (s *SQLStore) CreatePasswordReset(userID int, tokenHash string, expiresAt time.Time) error {
+	query := s.rebind("INSERT INTO password_resets (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)")
+	_, err := s.db.Exec(query, tokenHash, userID, time.Now().UTC(), expiresAt)
+	return err
+}
+
+func (s *SQLStore) ConsumePasswordReset(tokenHash string, now time.Time) (int, error) {
+	var userID int
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	query := s.rebind("SELECT user_id, expires_at, used_at FROM password_resets WHERE token_hash = ?")
+	err := s.db.QueryRow(query, tokenHash).Scan(&userID, &expiresAt, &usedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, store.ErrInvalidToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	// Expiry is checked here rather than in SQL because SQLite compares
+	// timestamps as text.
+	if usedAt.Valid || !now.Before(expiresAt) {
+		return 0, store.ErrInvalidToken
+	}
+
+	// The used_at guard makes concurrent redemptions of one token race safely.
+	query = s.rebind("UPDATE password_resets SET used_at = ? WHERE token_hash = ? AND used_at IS NULL")
+	result, err := s.db.Exec(query, now, tokenHash)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if rows == 0 {
+		return 0, store.ErrInvalidToken
+	}
+
+	query = s.rebind("DELETE FROM password_resets WHERE user_id = ? AND used_at IS NULL")
+	if _, err := s.db.Exec(query, userID); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
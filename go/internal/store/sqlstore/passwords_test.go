@@ -0,0 +1,85 @@
+package sqlstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func TestConsumePasswordReset(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	user, _ := testStore.GetUserByUsername("user1")
+
+	now := time.Now().UTC()
+	testStore.CreatePasswordReset(user.ID, "expired", now.Add(-time.Minute))
+	testStore.CreatePasswordReset(user.ID, "first", now.Add(time.Hour))
+	testStore.CreatePasswordReset(user.ID, "second", now.Add(time.Hour))
+
+	if _, err := testStore.ConsumePasswordReset("expired", now); !errors.Is(err, store.ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken for expired token, got %v", err)
+	}
+	if _, err := testStore.ConsumePasswordReset("unknown", now); !errors.Is(err, store.ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken for unknown token, got %v", err)
+	}
+
+	userID, err := testStore.ConsumePasswordReset("first", now)
+	if err != nil || userID != user.ID {
+		t.Fatalf("Expected token to redeem for user %d, got %d %v", user.ID, userID, err)
+	}
+	if _, err := testStore.ConsumePasswordReset("first", now); !errors.Is(err, store.ErrInvalidToken) {
+		t.Errorf("Expected token to be single-use, got %v", err)
+	}
+	if _, err := testStore.ConsumePasswordReset("second", now); !errors.Is(err, store.ErrInvalidToken) {
+		t.Errorf("Expected other outstanding tokens to be discarded, got %v", err)
+	}
+}
+
+func TestUpdateUserCredentials(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "old", PublicKey: "pub1", EncryptedPrivateKey: "priv1"})
+	user, _ := testStore.GetUserByUsername("user1")
+
+	id, _ := testStore.CreateChat("Chat", user.ID)
+	chatID := int(id)
+	testStore.AddParticipant(chatID, user.ID, user.ID, accountKey(t, user.ID, "key"))
+	device, _ := testStore.GetAccountDevice(user.ID)
+
+	// Re-wrapping the same keypair keeps its chat keys
+	if chatIDs, err := testStore.UpdateUserCredentials(user.ID, "same", "pub1", "rewrapped"); err != nil || len(chatIDs) != 0 {
+		t.Fatalf("Expected no rekey re-wrapping the keypair, got %v %v", chatIDs, err)
+	}
+	if keys, _ := testStore.GetChatKeys(chatID, device.ID); len(keys) != 1 {
+		t.Errorf("Expected the chat key to survive a re-wrap, got %+v", keys)
+	}
+
+	chatIDs, err := testStore.UpdateUserCredentials(user.ID, "new", "pub2", "priv2")
+	if err != nil {
+		t.Fatalf("UpdateUserCredentials failed: %v", err)
+	}
+	user, _ = testStore.GetUserByID(user.ID)
+	if user.Password != "new" || user.PublicKey != "pub2" || user.EncryptedPrivateKey != "priv2" {
+		t.Errorf("Credentials not updated: %+v", user)
+	}
+	if device, _ := testStore.GetAccountDevice(user.ID); device.PublicKey != "pub2" {
+		t.Errorf("Expected the account device to take the new key, got %q", device.PublicKey)
+	}
+
+	// Keys wrapped for the old keypair are dropped and the chat rekeyed
+	if len(chatIDs) != 1 || chatIDs[0] != chatID {
+		t.Errorf("Expected the chat to need a rekey, got %v", chatIDs)
+	}
+	if keys, _ := testStore.GetChatKeys(chatID, device.ID); len(keys) != 0 {
+		t.Errorf("Expected the stale chat key to be dropped, got %+v", keys)
+	}
+	if chats, _ := testStore.GetUserChats(user.ID, device.ID); len(chats) != 1 || !chats[0].RekeyNeeded {
+		t.Errorf("Expected the chat to be flagged for a rekey, got %+v", chats)
+	}
+}
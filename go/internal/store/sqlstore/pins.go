@@ -0,0 +1,74 @@
+package sqlstore
+
+import (
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func (s *SQLStore) PinMessage(messageID, userID int, now time.Time) (bool, error) {
+	// Tombstones and system messages can't be pinned
+	query := s.rebind("UPDATE messages SET pinned_at = ?, pinned_by = ? WHERE id = ? AND pinned_at IS NULL AND deleted_at IS NULL AND kind = ?")
+	result, err := s.db.Exec(query, now, userID, messageID, models.MessageKindUser)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rows > 0 {
+		return true, nil
+	}
+
+	// Nothing updated: either the message was already pinned or it is gone.
+	var exists bool
+	query = s.rebind("SELECT EXISTS (SELECT 1 FROM messages WHERE id = ? AND deleted_at IS NULL AND kind = ?)")
+	if err := s.db.QueryRow(query, messageID, models.MessageKindUser).Scan(&exists); err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, store.ErrMessageNotFound
+	}
+	return false, nil
+}
+
+func (s *SQLStore) UnpinMessage(messageID int) (bool, error) {
+	query := s.rebind("UPDATE messages SET pinned_at = NULL, pinned_by = NULL WHERE id = ? AND pinned_at IS NOT NULL")
+	result, err := s.db.Exec(query, messageID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+func (s *SQLStore) GetPinnedMessages(chatID int) ([]models.Message, error) {
+	query := s.rebind(`
+		SELECT ` + messageColumns + `
+		FROM messages m
+		JOIN users u ON m.user_id = u.id
+		WHERE m.chat_id = ? AND m.pinned_at IS NOT NULL
+		ORDER BY m.pinned_at DESC, m.id DESC
+	`)
+	rows, err := s.db.Query(query, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []models.Message
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return messages, s.attachDetails(messages)
+}
@@ -0,0 +1,64 @@
+package sqlstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func TestPins(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	testStore.CreateUser(&models.User{Username: "user2", Email: "user2@example.com", Password: "pass"})
+	user1, _ := testStore.GetUserByUsername("user1")
+	user2, _ := testStore.GetUserByUsername("user2")
+
+	id, _ := testStore.CreateChat("Chat", user1.ID)
+	chatID := int(id)
+	testStore.AddParticipant(chatID, user1.ID, user1.ID, accountKey(t, user1.ID, "key"))
+	testStore.AddParticipant(chatID, user2.ID, user2.ID, accountKey(t, user2.ID, "key"))
+	first, _, _ := testStore.SaveMessage(chatID, user1.ID, 1, 0, "first", "", nil)
+	second, _, _ := testStore.SaveMessage(chatID, user2.ID, 1, 0, "second", "", nil)
+
+	now := time.Now().UTC()
+	if pinned, err := testStore.PinMessage(first.ID, user2.ID, now); err != nil || !pinned {
+		t.Fatalf("Expected the message to be pinned, got %v %v", pinned, err)
+	}
+	if pinned, _ := testStore.PinMessage(first.ID, user1.ID, now); pinned {
+		t.Error("Expected pinning twice to be a no-op")
+	}
+	testStore.PinMessage(second.ID, user1.ID, now.Add(time.Second))
+
+	pins, _ := testStore.GetPinnedMessages(chatID)
+	if len(pins) != 2 || pins[0].ID != second.ID || pins[1].ID != first.ID {
+		t.Fatalf("Expected both messages, most recently pinned first, got %+v", pins)
+	}
+	if pins[1].PinnedBy != user2.ID || pins[1].PinnedAt == nil {
+		t.Errorf("Expected the first message to be pinned by user2, got %+v", pins[1])
+	}
+
+	if unpinned, _ := testStore.UnpinMessage(second.ID); !unpinned {
+		t.Error("Expected the second message to be unpinned")
+	}
+	if unpinned, _ := testStore.UnpinMessage(second.ID); unpinned {
+		t.Error("Expected nothing to unpin twice")
+	}
+
+	// Deleting a message unpins it, and tombstones and system messages can't be pinned
+	testStore.DeleteMessage(first.ID, user1.ID, now)
+	if pins, _ := testStore.GetPinnedMessages(chatID); len(pins) != 0 {
+		t.Errorf("Expected a deleted message to be unpinned, got %+v", pins)
+	}
+	if _, err := testStore.PinMessage(first.ID, user1.ID, now); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Errorf("Expected ErrMessageNotFound pinning a tombstone, got %v", err)
+	}
+	messages, _ := testStore.GetChatMessages(chatID)
+	if _, err := testStore.PinMessage(messages[0].ID, user1.ID, now); messages[0].Kind != models.MessageKindSystem || !errors.Is(err, store.ErrMessageNotFound) {
+		t.Errorf("Expected ErrMessageNotFound pinning a system message, got %v", err)
+	}
+}
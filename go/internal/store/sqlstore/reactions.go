@@ -0,0 +1,96 @@
+package sqlstore
+
+import (
+	"strings"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func (s *SQLStore) AddReaction(messageID, userID int, reaction string) (bool, error) {
+	// Tombstones and system messages can't collect reactions
+	query := s.rebind(`
+		INSERT INTO reactions (message_id, user_id, reaction)
+		SELECT id, ?, ? FROM messages WHERE id = ? AND deleted_at IS NULL AND kind = ?
+		ON CONFLICT (message_id, user_id, reaction) DO NOTHING
+	`)
+	result, err := s.db.Exec(query, userID, reaction, messageID, models.MessageKindUser)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rows > 0 {
+		return true, nil
+	}
+
+	// Nothing inserted: either the reaction was already there or the
+	// message is gone.
+	var exists bool
+	query = s.rebind("SELECT EXISTS (SELECT 1 FROM messages WHERE id = ? AND deleted_at IS NULL AND kind = ?)")
+	if err := s.db.QueryRow(query, messageID, models.MessageKindUser).Scan(&exists); err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, store.ErrMessageNotFound
+	}
+	return false, nil
+}
+
+func (s *SQLStore) RemoveReaction(messageID, userID int, reaction string) (bool, error) {
+	query := s.rebind("DELETE FROM reactions WHERE message_id = ? AND user_id = ? AND reaction = ?")
+	result, err := s.db.Exec(query, messageID, userID, reaction)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// attachReactions fills in the aggregated reactions of each message, in the
+// order each reaction was first used.
+func (s *SQLStore) attachReactions(messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	index := make(map[int]*models.Message, len(messages))
+	placeholders := make([]string, len(messages))
+	args := make([]interface{}, len(messages))
+	for i := range messages {
+		index[messages[i].ID] = &messages[i]
+		placeholders[i] = "?"
+		args[i] = messages[i].ID
+	}
+
+	query := s.rebind(`
+		SELECT message_id, reaction, user_id FROM reactions
+		WHERE message_id IN (` + strings.Join(placeholders, ", ") + `)
+		ORDER BY created_at, user_id
+	`)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID, userID int
+		var reaction string
+		if err := rows.Scan(&messageID, &reaction, &userID); err != nil {
+			return err
+		}
+		m := index[messageID]
+		i := 0
+		for i < len(m.Reactions) && m.Reactions[i].Reaction != reaction {
+			i++
+		}
+		if i == len(m.Reactions) {
+			m.Reactions = append(m.Reactions, models.ReactionCount{Reaction: reaction})
+		}
+		m.Reactions[i].Count++
+		m.Reactions[i].UserIDs = append(m.Reactions[i].UserIDs, userID)
+	}
+	return rows.Err()
+}
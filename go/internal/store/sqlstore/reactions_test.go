@@ -0,0 +1,63 @@
+package sqlstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func TestReactions(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	testStore.CreateUser(&models.User{Username: "user2", Email: "user2@example.com", Password: "pass"})
+	user1, _ := testStore.GetUserByUsername("user1")
+	user2, _ := testStore.GetUserByUsername("user2")
+
+	id, _ := testStore.CreateChat("Chat", user1.ID)
+	chatID := int(id)
+	testStore.AddParticipant(chatID, user1.ID, user1.ID, accountKey(t, user1.ID, "key"))
+	testStore.AddParticipant(chatID, user2.ID, user2.ID, accountKey(t, user2.ID, "key"))
+	msg, _, _ := testStore.SaveMessage(chatID, user1.ID, 1, 0, "hello", "", nil)
+
+	if added, err := testStore.AddReaction(msg.ID, user1.ID, "👍"); err != nil || !added {
+		t.Fatalf("Expected reaction to be added, got %v %v", added, err)
+	}
+	if added, _ := testStore.AddReaction(msg.ID, user1.ID, "👍"); added {
+		t.Error("Expected a repeated reaction to be a no-op")
+	}
+	testStore.AddReaction(msg.ID, user2.ID, "👍")
+	testStore.AddReaction(msg.ID, user2.ID, "opaque:party")
+
+	messages, _, _ := testStore.GetChatMessagesPage(chatID, store.PageOptions{Limit: 10})
+	reactions := userMessages(messages)[0].Reactions
+	if len(reactions) != 2 || reactions[0].Reaction != "👍" || reactions[0].Count != 2 || reactions[1].Count != 1 {
+		t.Fatalf("Expected 👍 x2 then opaque:party x1, got %+v", reactions)
+	}
+	if len(reactions[1].UserIDs) != 1 || reactions[1].UserIDs[0] != user2.ID {
+		t.Errorf("Expected user2 to hold the second reaction, got %+v", reactions[1])
+	}
+
+	if removed, _ := testStore.RemoveReaction(msg.ID, user1.ID, "opaque:party"); removed {
+		t.Error("Expected nothing to remove for a reaction user1 never added")
+	}
+	if removed, _ := testStore.RemoveReaction(msg.ID, user1.ID, "👍"); !removed {
+		t.Error("Expected user1's reaction to be removed")
+	}
+	if m, _ := testStore.GetMessage(msg.ID); len(m.Reactions) != 2 || m.Reactions[0].Count != 1 {
+		t.Errorf("Expected one 👍 left, got %+v", m.Reactions)
+	}
+
+	// Tombstones drop their reactions and take no new ones
+	testStore.DeleteMessage(msg.ID, user1.ID, time.Now().UTC())
+	if m, _ := testStore.GetMessage(msg.ID); len(m.Reactions) != 0 {
+		t.Errorf("Expected a tombstone to have no reactions, got %+v", m.Reactions)
+	}
+	if _, err := testStore.AddReaction(msg.ID, user2.ID, "👍"); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Errorf("Expected ErrMessageNotFound reacting to a tombstone, got %v", err)
+	}
+}
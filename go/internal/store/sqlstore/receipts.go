@@ -0,0 +1,40 @@
+package sqlstore
+
+import "github.com/pliu/chatty/internal/models"
+
+func (s *SQLStore) MarkRead(chatID, userID, messageID int) (bool, error) {
+	query := s.rebind(`
+		UPDATE participants SET last_read_message_id = ?
+		WHERE chat_id = ? AND user_id = ? AND last_read_message_id < ?
+		AND EXISTS (SELECT 1 FROM messages WHERE id = ? AND chat_id = ?)
+	`)
+	result, err := s.db.Exec(query, messageID, chatID, userID, messageID, messageID, chatID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+func (s *SQLStore) GetReadReceipts(chatID int) ([]models.ReadReceipt, error) {
+	query := s.rebind(`
+		SELECT chat_id, user_id, last_read_message_id FROM participants
+		WHERE chat_id = ? AND last_read_message_id > 0
+		ORDER BY user_id
+	`)
+	rows, err := s.db.Query(query, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var receipts []models.ReadReceipt
+	for rows.Next() {
+		var r models.ReadReceipt
+		if err := rows.Scan(&r.ChatID, &r.UserID, &r.MessageID); err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, r)
+	}
+	return receipts, rows.Err()
+}
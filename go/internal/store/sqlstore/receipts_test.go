@@ -0,0 +1,60 @@
+package sqlstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+)
+
+func TestReadReceipts(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "sender", Email: "sender@example.com", Password: "pass"})
+	testStore.CreateUser(&models.User{Username: "reader", Email: "reader@example.com", Password: "pass"})
+	sender, _ := testStore.GetUserByUsername("sender")
+	reader, _ := testStore.GetUserByUsername("reader")
+
+	id, _ := testStore.CreateChat("Chat", sender.ID)
+	chatID := int(id)
+	testStore.AddParticipant(chatID, sender.ID, sender.ID, accountKey(t, sender.ID, "key"))
+	testStore.AddParticipant(chatID, reader.ID, reader.ID, accountKey(t, reader.ID, "key"))
+	otherID, _ := testStore.CreateChat("Other", sender.ID)
+	testStore.AddParticipant(int(otherID), sender.ID, sender.ID, accountKey(t, sender.ID, "key"))
+	elsewhere, _, _ := testStore.SaveMessage(int(otherID), sender.ID, 1, 0, "elsewhere", "", nil)
+
+	if chats, _ := testStore.GetUserChats(reader.ID, 0); chats[0].UnreadCount != 0 || chats[0].LastMessageAt != nil {
+		t.Errorf("Expected an empty chat to have nothing unread, got %+v", chats[0])
+	}
+
+	first, _, _ := testStore.SaveMessage(chatID, sender.ID, 1, 0, "first", "", nil)
+	testStore.SaveMessage(chatID, sender.ID, 1, 0, "second", "", nil)
+	last, _, _ := testStore.SaveMessage(chatID, sender.ID, 1, 0, "third", "", nil)
+	testStore.SaveMessage(chatID, reader.ID, 1, 0, "own message", "", nil)
+	deleted, _, _ := testStore.SaveMessage(chatID, sender.ID, 1, 0, "deleted", "", nil)
+	testStore.DeleteMessage(deleted.ID, sender.ID, time.Now().UTC())
+
+	chats, _ := testStore.GetUserChats(reader.ID, 0)
+	if chats[0].UnreadCount != 3 || chats[0].LastMessageAt == nil {
+		t.Errorf("Expected 3 unread messages from others with a last message time, got %+v", chats[0])
+	}
+
+	if advanced, _ := testStore.MarkRead(chatID, reader.ID, elsewhere.ID); advanced {
+		t.Error("Expected a message from another chat to be refused")
+	}
+	if advanced, _ := testStore.MarkRead(chatID, reader.ID, last.ID); !advanced {
+		t.Error("Expected the read pointer to advance")
+	}
+	if advanced, _ := testStore.MarkRead(chatID, reader.ID, first.ID); advanced {
+		t.Error("Expected the read pointer never to move backwards")
+	}
+	if chats, _ := testStore.GetUserChats(reader.ID, 0); chats[0].UnreadCount != 0 || chats[0].LastReadMessageID != last.ID {
+		t.Errorf("Expected nothing unread after reading the latest, got %+v", chats[0])
+	}
+
+	receipts, _ := testStore.GetReadReceipts(chatID)
+	if len(receipts) != 1 || receipts[0].UserID != reader.ID || receipts[0].MessageID != last.ID {
+		t.Errorf("Expected only the reader's receipt, got %+v", receipts)
+	}
+}
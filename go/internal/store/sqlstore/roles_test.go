@@ -0,0 +1,54 @@
+package sqlstore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+func TestParticipantRoles(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "owner", Email: "owner@example.com", Password: "pass"})
+	testStore.CreateUser(&models.User{Username: "member", Email: "member@example.com", Password: "pass"})
+	owner, _ := testStore.GetUserByUsername("owner")
+	member, _ := testStore.GetUserByUsername("member")
+
+	id, _ := testStore.CreateChat("Chat", owner.ID)
+	chatID := int(id)
+	testStore.AddParticipant(chatID, owner.ID, owner.ID, accountKey(t, owner.ID, "key"))
+	testStore.AddParticipant(chatID, member.ID, member.ID, accountKey(t, member.ID, "key"))
+
+	// The chat's owner joins as its owner, everyone else as a member
+	for userID, want := range map[int]string{owner.ID: models.RoleOwner, member.ID: models.RoleMember} {
+		m, err := testStore.GetMembership(chatID, userID)
+		if err != nil || m.Role != want || m.ChatType != models.ChatTypeGroup {
+			t.Errorf("Expected user %d to be a %s of a group chat, got %+v (%v)", userID, want, m, err)
+		}
+	}
+
+	if _, err := testStore.SetParticipantRole(chatID, member.ID, member.ID, models.RoleAdmin); err != nil {
+		t.Fatalf("SetParticipantRole failed: %v", err)
+	}
+	participants, _ := testStore.GetChatParticipants(chatID)
+	for _, p := range participants {
+		if p.ID == member.ID && p.Role != models.RoleAdmin {
+			t.Errorf("Expected the participant list to show the new role, got %s", p.Role)
+		}
+	}
+	chats, _ := testStore.GetUserChats(member.ID, 0)
+	if len(chats) != 1 || chats[0].Role != models.RoleAdmin {
+		t.Errorf("Expected the chat list to carry the member's role, got %+v", chats)
+	}
+
+	testStore.RemoveParticipant(chatID, member.ID, member.ID)
+	if _, err := testStore.GetMembership(chatID, member.ID); !errors.Is(err, store.ErrNotParticipant) {
+		t.Errorf("Expected ErrNotParticipant after leaving, got %v", err)
+	}
+	if _, err := testStore.SetParticipantRole(chatID, member.ID, member.ID, models.RoleMember); !errors.Is(err, store.ErrNotParticipant) {
+		t.Errorf("Expected ErrNotParticipant changing a non-member's role, got %v", err)
+	}
+}
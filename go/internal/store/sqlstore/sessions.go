@@ -0,0 +1,71 @@
+package sqlstore
+
+import (
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+)
+
+func (s *SQLStore) CreateSession(session *models.Session) error {
+	query := s.rebind("INSERT INTO sessions (id, user_id, device_id, created_at, last_seen_at, user_agent, ip) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	_, err := s.db.Exec(query, session.ID, session.UserID, session.DeviceID, session.CreatedAt, session.LastSeenAt, session.UserAgent, session.IP)
+	return err
+}
+
+func (s *SQLStore) GetSession(id string) (*models.Session, error) {
+	var session models.Session
+	query := s.rebind(`
+		SELECT s.id, s.user_id, COALESCE(s.device_id, 0), s.created_at, s.last_seen_at, s.user_agent, s.ip
+		FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.id = ? AND u.deactivated_at IS NULL
+	`)
+	err := s.db.QueryRow(query, id).Scan(&session.ID, &session.UserID, &session.DeviceID, &session.CreatedAt, &session.LastSeenAt, &session.UserAgent, &session.IP)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *SQLStore) TouchSession(id string, lastSeenAt time.Time) error {
+	query := s.rebind("UPDATE sessions SET last_seen_at = ? WHERE id = ?")
+	_, err := s.db.Exec(query, lastSeenAt, id)
+	return err
+}
+
+func (s *SQLStore) SetSessionDevice(id string, deviceID int) error {
+	query := s.rebind("UPDATE sessions SET device_id = ? WHERE id = ?")
+	_, err := s.db.Exec(query, deviceID, id)
+	return err
+}
+
+func (s *SQLStore) GetUserSessions(userID int) ([]models.Session, error) {
+	query := s.rebind("SELECT id, user_id, COALESCE(device_id, 0), created_at, last_seen_at, user_agent, ip FROM sessions WHERE user_id = ? ORDER BY last_seen_at DESC")
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []models.Session
+	for rows.Next() {
+		var session models.Session
+		if err := rows.Scan(&session.ID, &session.UserID, &session.DeviceID, &session.CreatedAt, &session.LastSeenAt, &session.UserAgent, &session.IP); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *SQLStore) DeleteSession(id string) error {
+	query := s.rebind("DELETE FROM sessions WHERE id = ?")
+	_, err := s.db.Exec(query, id)
+	return err
+}
+
+func (s *SQLStore) DeleteUserSessions(userID int) error {
+	query := s.rebind("DELETE FROM sessions WHERE user_id = ?")
+	_, err := s.db.Exec(query, userID)
+	return err
+}
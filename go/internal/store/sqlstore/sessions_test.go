@@ -0,0 +1,51 @@
+package sqlstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+)
+
+func TestSessions(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	user, _ := testStore.GetUserByUsername("user1")
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, id := range []string{"a", "b"} {
+		err := testStore.CreateSession(&models.Session{ID: id, UserID: user.ID, CreatedAt: now, LastSeenAt: now, UserAgent: "test", IP: "127.0.0.1"})
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+	}
+
+	later := now.Add(time.Hour)
+	if err := testStore.TouchSession("a", later); err != nil {
+		t.Fatalf("Failed to touch session: %v", err)
+	}
+	session, err := testStore.GetSession("a")
+	if err != nil {
+		t.Fatalf("Failed to get session: %v", err)
+	}
+	if !session.LastSeenAt.Equal(later) || session.UserAgent != "test" {
+		t.Errorf("Unexpected session %+v", session)
+	}
+
+	sessions, _ := testStore.GetUserSessions(user.ID)
+	if len(sessions) != 2 || sessions[0].ID != "a" {
+		t.Errorf("Expected 2 sessions, most recently seen first, got %+v", sessions)
+	}
+
+	testStore.DeleteSession("a")
+	if _, err := testStore.GetSession("a"); err == nil {
+		t.Error("Expected deleted session to be gone")
+	}
+
+	testStore.DeleteUserSessions(user.ID)
+	if sessions, _ := testStore.GetUserSessions(user.ID); len(sessions) != 0 {
+		t.Errorf("Expected no sessions after DeleteUserSessions, got %d", len(sessions))
+	}
+}
@@ -1,17 +1,21 @@
 package sqlstore
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"slices"
 	"strings"
+	"time"
 
 	_ "github.com/lib/pq"           // Postgres driver
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
 	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
 )
 
 type SQLStore struct {
-	db         *sql.DB
+	db         conn
 	driverName string
 }
 
@@ -21,69 +25,35 @@ func New(driverName, dataSourceName string) (*SQLStore, error) {
 		return nil, err
 	}
 	if err = db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
+	if driverName == "sqlite3" {
+		// SQLite only allows one writer, and every connection to ":memory:"
+		// would otherwise get its own empty database.
+		db.SetMaxOpenConns(1)
+	}
 
-	s := &SQLStore{db: db, driverName: driverName}
-	s.createTables()
-	return s, nil
-}
-
-func (s *SQLStore) createTables() {
-	// Simplified for brevity, ideally use migrations
-	query := `
-	CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		username TEXT NOT NULL,
-		email TEXT UNIQUE NOT NULL,
-		password TEXT NOT NULL,
-		public_key TEXT,
-		encrypted_private_key TEXT,
-		is_verified BOOLEAN DEFAULT FALSE,
-		verification_token TEXT
-	);
-
-	CREATE TABLE IF NOT EXISTS chats (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		name TEXT NOT NULL,
-		owner_id INTEGER REFERENCES users(id)
-	);
-
-	CREATE TABLE IF NOT EXISTS participants (
-		chat_id INTEGER,
-		user_id INTEGER,
-		encrypted_chat_key TEXT,
-		PRIMARY KEY (chat_id, user_id),
-		FOREIGN KEY (chat_id) REFERENCES chats(id),
-		FOREIGN KEY (user_id) REFERENCES users(id)
-	);
-
-	CREATE TABLE IF NOT EXISTS messages (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		chat_id INTEGER,
-		user_id INTEGER,
-		content TEXT NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (chat_id) REFERENCES chats(id),
-		FOREIGN KEY (user_id) REFERENCES users(id)
-	);
-	`
-
-	if s.driverName == "postgres" {
-		// Adjust for Postgres syntax
-		query = strings.ReplaceAll(query, "INTEGER PRIMARY KEY AUTOINCREMENT", "SERIAL PRIMARY KEY")
-		query = strings.ReplaceAll(query, "DATETIME", "TIMESTAMP")
-	}
-
-	_, err := s.db.Exec(query)
-	if err != nil {
-		panic(err)
+	migrator, err := NewMigrator(db, driverName)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrator.Up(context.Background()); err != nil {
+		db.Close()
+		return nil, err
 	}
+
+	return &SQLStore{db: dbConn{db}, driverName: driverName}, nil
 }
 
 // Helper to handle placeholders
 func (s *SQLStore) rebind(query string) string {
-	if s.driverName == "postgres" {
+	return rebind(s.driverName, query)
+}
+
+func rebind(driverName, query string) string {
+	if driverName == "postgres" {
 		// Replace ? with $1, $2, etc.
 		n := strings.Count(query, "?")
 		for i := 1; i <= n; i++ {
@@ -94,16 +64,31 @@ func (s *SQLStore) rebind(query string) string {
 }
 
 func (s *SQLStore) CreateUser(user *models.User) error {
-	query := s.rebind("INSERT INTO users (username, email, password, public_key, encrypted_private_key, is_verified, verification_token) VALUES (?, ?, ?, ?, ?, ?, ?)")
-	_, err := s.db.Exec(query, user.Username, user.Email, user.Password, user.PublicKey, user.EncryptedPrivateKey, user.IsVerified, user.VerificationToken)
-	return err
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := s.rebind("INSERT INTO users (username, email, password, public_key, encrypted_private_key, is_verified, verification_token) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id")
+	err = tx.QueryRow(query, user.Username, user.Email, user.Password, user.PublicKey, user.EncryptedPrivateKey, user.IsVerified, user.VerificationToken).Scan(&user.ID)
+	if err != nil {
+		return err
+	}
+
+	// The password-wrapped keypair is the user's first device
+	query = s.rebind("INSERT INTO devices (user_id, name, public_key, is_account) VALUES (?, 'Account key', ?, TRUE)")
+	if _, err := tx.Exec(query, user.ID, user.PublicKey); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (s *SQLStore) GetUserByEmail(email string) (*models.User, error) {
 	var user models.User
-	query := s.rebind("SELECT id, username, email, password, COALESCE(public_key, ''), COALESCE(encrypted_private_key, ''), is_verified FROM users WHERE email = ?")
+	query := s.rebind("SELECT id, username, email, password, COALESCE(public_key, ''), COALESCE(encrypted_private_key, ''), is_verified, deactivated_at FROM users WHERE email = ?")
 
-	err := s.db.QueryRow(query, email).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.PublicKey, &user.EncryptedPrivateKey, &user.IsVerified)
+	err := s.db.QueryRow(query, email).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.PublicKey, &user.EncryptedPrivateKey, &user.IsVerified, &user.DeactivatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -128,9 +113,9 @@ func (s *SQLStore) VerifyUser(token string) error {
 
 func (s *SQLStore) GetUserByUsername(username string) (*models.User, error) {
 	var user models.User
-	query := s.rebind("SELECT id, username, email, password, COALESCE(public_key, ''), COALESCE(encrypted_private_key, ''), is_verified FROM users WHERE username = ?")
+	query := s.rebind("SELECT id, username, email, password, COALESCE(public_key, ''), COALESCE(encrypted_private_key, ''), is_verified, deactivated_at FROM users WHERE username = ?")
 
-	err := s.db.QueryRow(query, username).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.PublicKey, &user.EncryptedPrivateKey, &user.IsVerified)
+	err := s.db.QueryRow(query, username).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.PublicKey, &user.EncryptedPrivateKey, &user.IsVerified, &user.DeactivatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -139,8 +124,8 @@ func (s *SQLStore) GetUserByUsername(username string) (*models.User, error) {
 
 func (s *SQLStore) GetUserByID(id int) (*models.User, error) {
 	var user models.User
-	query := s.rebind("SELECT id, username, email, password, COALESCE(public_key, ''), COALESCE(encrypted_private_key, ''), is_verified FROM users WHERE id = ?")
-	err := s.db.QueryRow(query, id).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.PublicKey, &user.EncryptedPrivateKey, &user.IsVerified)
+	query := s.rebind("SELECT id, username, email, password, COALESCE(public_key, ''), COALESCE(encrypted_private_key, ''), is_verified, deactivated_at FROM users WHERE id = ?")
+	err := s.db.QueryRow(query, id).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.PublicKey, &user.EncryptedPrivateKey, &user.IsVerified, &user.DeactivatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -148,7 +133,7 @@ func (s *SQLStore) GetUserByID(id int) (*models.User, error) {
 }
 
 func (s *SQLStore) SearchUsers(queryStr string) ([]models.User, error) {
-	query := s.rebind("SELECT id, username, email, COALESCE(public_key, '') FROM users WHERE username LIKE ? LIMIT 10")
+	query := s.rebind("SELECT id, username, email, COALESCE(public_key, '') FROM users WHERE username LIKE ? AND deactivated_at IS NULL LIMIT 10")
 	rows, err := s.db.Query(query, "%"+queryStr+"%")
 	if err != nil {
 		return nil, err
@@ -164,6 +149,16 @@ func (s *SQLStore) SearchUsers(queryStr string) ([]models.User, error) {
 		user.Email = maskEmail(user.Email)
 		users = append(users, user)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range users {
+		if users[i].Devices, err = s.GetUserDevices(users[i].ID); err != nil {
+			return nil, err
+		}
+	}
 	return users, nil
 }
 
@@ -177,16 +172,104 @@ func (s *SQLStore) CreateChat(name string, ownerID int) (int64, error) {
 	return id, nil
 }
 
-func (s *SQLStore) AddParticipant(chatID, userID int, encryptedKey string) error {
-	query := s.rebind("INSERT INTO participants (chat_id, user_id, encrypted_chat_key) VALUES (?, ?, ?)")
-	_, err := s.db.Exec(query, chatID, userID, encryptedKey)
-	return err
+func (s *SQLStore) GetChat(chatID int) (*models.Chat, error) {
+	var chat models.Chat
+	query := s.rebind(`
+		SELECT id, name, type, owner_id, COALESCE(pending_owner_id, 0), key_epoch, rekey_needed,
+			name_key_epoch, description, description_key_epoch, topic, topic_key_epoch, COALESCE(avatar_attachment_id, 0)
+		FROM chats WHERE id = ?
+	`)
+	err := s.db.QueryRow(query, chatID).Scan(&chat.ID, &chat.Name, &chat.Type, &chat.OwnerID, &chat.PendingOwnerID, &chat.KeyEpoch, &chat.RekeyNeeded,
+		&chat.NameKeyEpoch, &chat.Description, &chat.DescriptionKeyEpoch, &chat.Topic, &chat.TopicKeyEpoch, &chat.AvatarAttachmentID)
+	if err == sql.ErrNoRows {
+		return nil, store.ErrChatNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &chat, nil
+}
+
+func (s *SQLStore) AddParticipant(chatID, userID, addedBy int, keys map[int]string) (*models.Message, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	m, err := s.addParticipant(tx, chatID, userID, addedBy, keys)
+	if err != nil {
+		return nil, err
+	}
+	return m, tx.Commit()
+}
+
+// addParticipant adds a member within tx, as AddParticipant describes.
+func (s *SQLStore) addParticipant(tx txn, chatID, userID, addedBy int, keys map[int]string) (*models.Message, error) {
+	query := s.rebind(`
+		INSERT INTO participants (chat_id, user_id, role, joined_at)
+		SELECT id, ?, CASE WHEN owner_id = ? AND type = ? THEN ? ELSE ? END, ? FROM chats WHERE id = ?
+	`)
+	if _, err := tx.Exec(query, userID, userID, models.ChatTypeGroup, models.RoleOwner, models.RoleMember, time.Now().UTC(), chatID); err != nil {
+		return nil, err
+	}
+
+	var epoch int
+	query = s.rebind("SELECT key_epoch FROM chats WHERE id = ?")
+	if err := tx.QueryRow(query, chatID).Scan(&epoch); err != nil {
+		return nil, err
+	}
+	if err := s.insertChatKeys(tx, chatID, epoch, keys, "?", userID); err != nil {
+		return nil, err
+	}
+	return s.insertSystemMessage(tx, chatID, addedBy, models.SystemEvent{Type: models.EventMemberJoined, UserID: userID})
 }
 
-func (s *SQLStore) RemoveParticipant(chatID, userID int) error {
+func (s *SQLStore) RemoveParticipant(chatID, userID, removedBy int) (*models.Message, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	query := s.rebind("DELETE FROM participants WHERE chat_id = ? AND user_id = ?")
-	_, err := s.db.Exec(query, chatID, userID)
-	return err
+	result, err := tx.Exec(query, chatID, userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, store.ErrNotParticipant
+	}
+
+	query = s.rebind("DELETE FROM chat_keys WHERE chat_id = ? AND user_id = ?")
+	if _, err := tx.Exec(query, chatID, userID); err != nil {
+		return nil, err
+	}
+
+	// The departed member still holds the current key, and can no longer
+	// take up an offer of ownership
+	query = s.rebind(`
+		UPDATE chats SET rekey_needed = TRUE,
+			pending_owner_id = CASE WHEN pending_owner_id = ? THEN NULL ELSE pending_owner_id END
+		WHERE id = ?
+	`)
+	if _, err := tx.Exec(query, userID, chatID); err != nil {
+		return nil, err
+	}
+
+	event := models.SystemEvent{Type: models.EventMemberRemoved, UserID: userID}
+	if removedBy == userID {
+		event.Type = models.EventMemberLeft
+	}
+	m, err := s.insertSystemMessage(tx, chatID, removedBy, event)
+	if err != nil {
+		return nil, err
+	}
+	return m, tx.Commit()
 }
 
 func (s *SQLStore) IsParticipant(chatID, userID int) (bool, error) {
@@ -196,14 +279,69 @@ func (s *SQLStore) IsParticipant(chatID, userID int) (bool, error) {
 	return exists, err
 }
 
-func (s *SQLStore) GetUserChats(userID int) ([]models.Chat, error) {
+func (s *SQLStore) GetMembership(chatID, userID int) (*models.Membership, error) {
+	m := models.Membership{ChatID: chatID, UserID: userID}
 	query := s.rebind(`
-		SELECT c.id, c.name, c.owner_id, p.encrypted_chat_key
+		SELECT c.type, p.role
+		FROM participants p
+		JOIN chats c ON c.id = p.chat_id
+		WHERE p.chat_id = ? AND p.user_id = ?
+	`)
+	err := s.db.QueryRow(query, chatID, userID).Scan(&m.ChatType, &m.Role)
+	if err == sql.ErrNoRows {
+		return nil, store.ErrNotParticipant
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *SQLStore) SetParticipantRole(chatID, userID, changedBy int, role string) (*models.Message, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := s.rebind("UPDATE participants SET role = ? WHERE chat_id = ? AND user_id = ?")
+	result, err := tx.Exec(query, role, chatID, userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, store.ErrNotParticipant
+	}
+
+	m, err := s.insertSystemMessage(tx, chatID, changedBy, models.SystemEvent{Type: models.EventRoleChanged, UserID: userID, Role: role})
+	if err != nil {
+		return nil, err
+	}
+	return m, tx.Commit()
+}
+
+func (s *SQLStore) GetUserChats(userID, deviceID int) ([]models.Chat, error) {
+	query := s.rebind(`
+		SELECT c.id, c.type, c.owner_id, COALESCE(c.pending_owner_id, 0), p.role, COALESCE(k.encrypted_key, ''), c.key_epoch, c.rekey_needed,
+			c.name_key_epoch, c.description, c.description_key_epoch, c.topic, c.topic_key_epoch, COALESCE(c.avatar_attachment_id, 0),
+			c.last_message_at, p.last_read_message_id,
+			(SELECT COUNT(*) FROM messages m
+			 WHERE m.chat_id = c.id AND m.id > p.last_read_message_id AND m.user_id <> p.user_id AND m.deleted_at IS NULL
+			   AND m.kind = 'user'),
+			CASE WHEN c.type = 'direct' THEN
+				(SELECT u.username FROM participants op JOIN users u ON u.id = op.user_id
+				 WHERE op.chat_id = c.id AND op.user_id <> p.user_id)
+			ELSE c.name END
 		FROM chats c
 		JOIN participants p ON c.id = p.chat_id
-		WHERE p.user_id = ?
+		LEFT JOIN chat_keys k ON k.chat_id = c.id AND k.device_id = ? AND k.epoch = c.key_epoch
+		WHERE p.user_id = ? AND NOT p.hidden
 	`)
-	rows, err := s.db.Query(query, userID)
+	rows, err := s.db.Query(query, deviceID, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -212,12 +350,39 @@ func (s *SQLStore) GetUserChats(userID int) ([]models.Chat, error) {
 	var chats []models.Chat
 	for rows.Next() {
 		var chat models.Chat
-		if err := rows.Scan(&chat.ID, &chat.Name, &chat.OwnerID, &chat.EncryptedKey); err != nil {
+		var lastMessageAt sql.NullTime
+		var name sql.NullString
+		if err := rows.Scan(&chat.ID, &chat.Type, &chat.OwnerID, &chat.PendingOwnerID, &chat.Role, &chat.EncryptedKey, &chat.KeyEpoch, &chat.RekeyNeeded,
+			&chat.NameKeyEpoch, &chat.Description, &chat.DescriptionKeyEpoch, &chat.Topic, &chat.TopicKeyEpoch, &chat.AvatarAttachmentID,
+			&lastMessageAt, &chat.LastReadMessageID, &chat.UnreadCount, &name); err != nil {
 			return nil, err
 		}
+		chat.Name = name.String
+		if lastMessageAt.Valid {
+			chat.LastMessageAt = &lastMessageAt.Time
+		}
 		chats = append(chats, chat)
 	}
-	return chats, nil
+	return chats, rows.Err()
+}
+
+func (s *SQLStore) GetUserChatIDs(userID int) ([]int, error) {
+	query := s.rebind("SELECT chat_id FROM participants WHERE user_id = ?")
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chatIDs []int
+	for rows.Next() {
+		var chatID int
+		if err := rows.Scan(&chatID); err != nil {
+			return nil, err
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+	return chatIDs, rows.Err()
 }
 
 func maskEmail(email string) string {
@@ -245,9 +410,15 @@ func maskEmail(email string) string {
 	return maskedLocal + "@" + domain
 }
 
+func (s *SQLStore) SetLastSeen(userID int, at time.Time) error {
+	query := s.rebind("UPDATE users SET last_seen_at = ? WHERE id = ?")
+	_, err := s.db.Exec(query, at, userID)
+	return err
+}
+
 func (s *SQLStore) GetChatParticipants(chatID int) ([]models.User, error) {
 	query := s.rebind(`
-		SELECT u.id, u.username, u.email, u.public_key, u.encrypted_private_key
+		SELECT u.id, u.username, u.email, u.public_key, u.encrypted_private_key, u.last_seen_at, p.role
 		FROM users u
 		JOIN participants p ON u.id = p.user_id
 		WHERE p.chat_id = ?
@@ -262,12 +433,39 @@ func (s *SQLStore) GetChatParticipants(chatID int) ([]models.User, error) {
 	var users []models.User
 	for rows.Next() {
 		var u models.User
-		if err := rows.Scan(&u.ID, &u.Username, &u.Email, &u.PublicKey, &u.EncryptedPrivateKey); err != nil {
+		var lastSeenAt sql.NullTime
+		if err := rows.Scan(&u.ID, &u.Username, &u.Email, &u.PublicKey, &u.EncryptedPrivateKey, &lastSeenAt, &u.Role); err != nil {
 			return nil, err
 		}
+		if lastSeenAt.Valid {
+			u.LastSeenAt = &lastSeenAt.Time
+		}
 		u.Email = maskEmail(u.Email)
 		users = append(users, u)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	query = s.rebind(`
+		SELECT d.id, d.user_id, d.name, d.public_key, d.is_account, d.created_at
+		FROM devices d
+		JOIN participants p ON p.user_id = d.user_id
+		WHERE p.chat_id = ?
+		ORDER BY d.id
+	`)
+	devices, err := s.queryDevices(query, chatID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		for _, d := range devices {
+			if d.UserID == users[i].ID {
+				users[i].Devices = append(users[i].Devices, d)
+			}
+		}
+	}
 	return users, nil
 }
 
@@ -279,37 +477,148 @@ func (s *SQLStore) GetChatOwner(chatID int) (int, error) {
 }
 
 func (s *SQLStore) DeleteChat(chatID int) error {
-	// Delete messages first (foreign key constraint)
-	query := s.rebind("DELETE FROM messages WHERE chat_id = ?")
-	if _, err := s.db.Exec(query, chatID); err != nil {
+	tx, err := s.db.Begin()
+	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	// Delete participants
-	query = s.rebind("DELETE FROM participants WHERE chat_id = ?")
-	if _, err := s.db.Exec(query, chatID); err != nil {
-		return err
+	// Delete messages and what hangs off them first (foreign key constraint)
+	for _, table := range []string{"reactions", "message_edits"} {
+		query := s.rebind("DELETE FROM " + table + " WHERE message_id IN (SELECT id FROM messages WHERE chat_id = ?)")
+		if _, err := tx.Exec(query, chatID); err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{"attachments", "messages"} {
+		query := s.rebind("DELETE FROM " + table + " WHERE chat_id = ?")
+		if _, err := tx.Exec(query, chatID); err != nil {
+			return err
+		}
+	}
+
+	// Delete keys, invites, the audit log and participants
+	for _, table := range []string{"chat_keys", "invites", "join_requests", "audit_log", "participants"} {
+		query := s.rebind("DELETE FROM " + table + " WHERE chat_id = ?")
+		if _, err := tx.Exec(query, chatID); err != nil {
+			return err
+		}
 	}
 
 	// Delete chat
-	query = s.rebind("DELETE FROM chats WHERE id = ?")
-	_, err := s.db.Exec(query, chatID)
-	return err
+	query := s.rebind("DELETE FROM chats WHERE id = ?")
+	if _, err := tx.Exec(query, chatID); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (s *SQLStore) SaveMessage(chatID, userID int, content string) error {
-	query := s.rebind("INSERT INTO messages (chat_id, user_id, content) VALUES (?, ?, ?)")
-	_, err := s.db.Exec(query, chatID, userID, content)
-	return err
+func (s *SQLStore) SaveMessage(chatID, userID, keyEpoch, replyTo int, content, clientMsgID string, attachmentIDs []int) (*models.Message, bool, error) {
+	m := models.Message{Kind: models.MessageKindUser, ChatID: chatID, UserID: userID, Content: content, KeyEpoch: keyEpoch, ClientMsgID: clientMsgID, ReplyTo: replyTo}
+	clientID := sql.NullString{String: clientMsgID, Valid: clientMsgID != ""}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	// Replies join the thread of the message they answer
+	var replyToID, threadRootID sql.NullInt64
+	if replyTo != 0 {
+		query := s.rebind("SELECT COALESCE(thread_root_id, id) FROM messages WHERE id = ? AND chat_id = ? AND deleted_at IS NULL AND kind = ?")
+		if err := tx.QueryRow(query, replyTo, chatID, models.MessageKindUser).Scan(&threadRootID); err == sql.ErrNoRows {
+			return nil, false, store.ErrMessageNotFound
+		} else if err != nil {
+			return nil, false, err
+		}
+		replyToID = sql.NullInt64{Int64: int64(replyTo), Valid: true}
+		m.ThreadRootID = int(threadRootID.Int64)
+	}
+
+	// The epoch is checked in the insert itself so a rekey can't slip in
+	// between the check and the write.
+	query := s.rebind(`
+		INSERT INTO messages (chat_id, user_id, key_epoch, content, client_msg_id, reply_to, thread_root_id)
+		SELECT id, ?, ?, ?, ?, ?, ? FROM chats WHERE id = ? AND key_epoch = ?
+		ON CONFLICT (chat_id, user_id, client_msg_id) DO NOTHING
+		RETURNING id, created_at
+	`)
+	err = tx.QueryRow(query, userID, keyEpoch, content, clientID, replyToID, threadRootID, chatID, keyEpoch).Scan(&m.ID, &m.CreatedAt)
+	created := err == nil
+	if err == sql.ErrNoRows {
+		// Either a retry of a send that already went through, which returns
+		// the original, or a stale epoch.
+		if clientMsgID == "" {
+			return nil, false, store.ErrStaleKeyEpoch
+		}
+		query = s.rebind("SELECT id, key_epoch, content, COALESCE(reply_to, 0), COALESCE(thread_root_id, 0), created_at FROM messages WHERE chat_id = ? AND user_id = ? AND client_msg_id = ?")
+		err = tx.QueryRow(query, chatID, userID, clientMsgID).Scan(&m.ID, &m.KeyEpoch, &m.Content, &m.ReplyTo, &m.ThreadRootID, &m.CreatedAt)
+		if err == sql.ErrNoRows {
+			return nil, false, store.ErrStaleKeyEpoch
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if created {
+		query = s.rebind("UPDATE chats SET last_message_at = ? WHERE id = ?")
+		if _, err := tx.Exec(query, m.CreatedAt, chatID); err != nil {
+			return nil, false, err
+		}
+		query = s.rebind("UPDATE participants SET hidden = FALSE WHERE chat_id = ? AND hidden")
+		if _, err := tx.Exec(query, chatID); err != nil {
+			return nil, false, err
+		}
+	}
+	if created && m.ThreadRootID != 0 {
+		query = s.rebind("UPDATE messages SET reply_count = reply_count + 1, last_reply_at = ? WHERE id = ?")
+		if _, err := tx.Exec(query, m.CreatedAt, m.ThreadRootID); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// Attachments must be the sender's own, fully uploaded to this chat and
+	// not already sent with another message.
+	if created {
+		query = s.rebind(`
+			UPDATE attachments SET message_id = ?
+			WHERE id = ? AND chat_id = ? AND user_id = ? AND received = size AND message_id IS NULL
+		`)
+		for _, attachmentID := range attachmentIDs {
+			result, err := tx.Exec(query, m.ID, attachmentID, chatID, userID)
+			if err != nil {
+				return nil, false, err
+			}
+			rows, err := result.RowsAffected()
+			if err != nil {
+				return nil, false, err
+			}
+			if rows == 0 {
+				return nil, false, store.ErrAttachmentNotFound
+			}
+		}
+	}
+	query = s.rebind("SELECT " + attachmentColumns + " FROM attachments WHERE message_id = ? ORDER BY id")
+	if m.Attachments, err = queryAttachments(tx, query, m.ID); err != nil {
+		return nil, false, err
+	}
+
+	query = s.rebind("SELECT username FROM users WHERE id = ?")
+	if err := tx.QueryRow(query, userID).Scan(&m.Username); err != nil {
+		return nil, false, err
+	}
+	return &m, created, tx.Commit()
 }
 
 func (s *SQLStore) GetChatMessages(chatID int) ([]models.Message, error) {
 	query := s.rebind(`
-		SELECT m.id, m.chat_id, m.user_id, u.username, m.content, m.created_at
+		SELECT ` + messageColumns + `
 		FROM messages m
 		JOIN users u ON m.user_id = u.id
 		WHERE m.chat_id = ?
-		ORDER BY m.created_at ASC
+		ORDER BY m.created_at ASC, m.id ASC
 	`)
 	rows, err := s.db.Query(query, chatID)
 	if err != nil {
@@ -319,11 +628,96 @@ func (s *SQLStore) GetChatMessages(chatID int) ([]models.Message, error) {
 
 	var messages []models.Message
 	for rows.Next() {
-		var m models.Message
-		if err := rows.Scan(&m.ID, &m.ChatID, &m.UserID, &m.Username, &m.Content, &m.CreatedAt); err != nil {
+		m, err := scanMessage(rows)
+		if err != nil {
 			return nil, err
 		}
 		messages = append(messages, m)
 	}
-	return messages, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return messages, s.attachDetails(messages)
+}
+
+func (s *SQLStore) GetChatMessagesPage(chatID int, opts store.PageOptions) ([]models.Message, bool, error) {
+	conditions := []string{"m.chat_id = ?"}
+	args := []interface{}{chatID}
+
+	// An anchor from another chat, or one that is gone, would match nothing
+	// and read as the end of history
+	for _, anchor := range []int{opts.Before, opts.After} {
+		if anchor == 0 {
+			continue
+		}
+		var exists int
+		query := s.rebind("SELECT 1 FROM messages WHERE id = ? AND chat_id = ?")
+		if err := s.db.QueryRow(query, anchor, chatID).Scan(&exists); err == sql.ErrNoRows {
+			return nil, false, store.ErrInvalidCursor
+		} else if err != nil {
+			return nil, false, err
+		}
+	}
+
+	// Cursors only carry a message ID; the anchor's (created_at, id) key is
+	// looked up here so the comparison never depends on timestamp encoding.
+	if opts.Before > 0 {
+		conditions = append(conditions, "(m.created_at, m.id) < (SELECT created_at, id FROM messages WHERE id = ? AND chat_id = ?)")
+		args = append(args, opts.Before, chatID)
+	}
+	if opts.After > 0 {
+		conditions = append(conditions, "(m.created_at, m.id) > (SELECT created_at, id FROM messages WHERE id = ? AND chat_id = ?)")
+		args = append(args, opts.After, chatID)
+	}
+	if opts.ThreadRootID > 0 {
+		conditions = append(conditions, "(m.id = ? OR m.thread_root_id = ?)")
+		args = append(args, opts.ThreadRootID, opts.ThreadRootID)
+	}
+
+	// Walk forward from After, otherwise backward from Before (or the end).
+	forward := opts.After > 0
+	order := "DESC"
+	if forward {
+		order = "ASC"
+	}
+
+	// Fetch one extra row to learn whether another page exists.
+	query := s.rebind(fmt.Sprintf(`
+		SELECT %s
+		FROM messages m
+		JOIN users u ON m.user_id = u.id
+		WHERE %s
+		ORDER BY m.created_at %s, m.id %s
+		LIMIT ?
+	`, messageColumns, strings.Join(conditions, " AND "), order, order))
+	args = append(args, opts.Limit+1)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var messages []models.Message
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	rows.Close()
+
+	hasMore := len(messages) > opts.Limit
+	if hasMore {
+		messages = messages[:opts.Limit]
+	}
+	if !forward {
+		slices.Reverse(messages)
+	}
+	return messages, hasMore, s.attachDetails(messages)
 }
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/pliu/chatty/internal/models"
 )
 
 var testStore *SQLStore
@@ -17,5 +18,26 @@ func SetupTestDB(t *testing.T) {
 }
 
 func TeardownTestDB() {
-	testStore.db.Close()
+	testStore.Close()
+}
+
+// userMessages leaves the system messages out of a chat's history.
+func userMessages(messages []models.Message) []models.Message {
+	var sent []models.Message
+	for _, m := range messages {
+		if m.Kind == models.MessageKindUser {
+			sent = append(sent, m)
+		}
+	}
+	return sent
+}
+
+// accountKey maps a user's account device to a wrapped chat key.
+func accountKey(t *testing.T, userID int, key string) map[int]string {
+	t.Helper()
+	device, err := testStore.GetAccountDevice(userID)
+	if err != nil {
+		t.Fatalf("Failed to get account device: %v", err)
+	}
+	return map[int]string{device.ID: key}
 }
@@ -0,0 +1,131 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/pliu/chatty/internal/store"
+)
+
+// conn is what the store runs its queries through: the database, or the
+// transaction of a WithTx. Begin starts a transaction on the database and a
+// savepoint inside a transaction, so the store's own multi-statement
+// operations compose into a caller's unit of work.
+type conn interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+	Begin() (txn, error)
+}
+
+// txn is a transaction or savepoint begun by a conn.
+type txn interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+	Commit() error
+	Rollback() error
+}
+
+type dbConn struct {
+	*sql.DB
+}
+
+func (c dbConn) Begin() (txn, error) {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+type txConn struct {
+	*sql.Tx
+	// savepoints numbers the savepoints so nested ones get distinct names
+	savepoints *int
+}
+
+func (c txConn) Begin() (txn, error) {
+	*c.savepoints++
+	name := fmt.Sprintf("sp%d", *c.savepoints)
+	if _, err := c.Tx.Exec("SAVEPOINT " + name); err != nil {
+		return nil, err
+	}
+	return &savepoint{tx: c.Tx, name: name}, nil
+}
+
+// savepoint scopes an operation inside a transaction, so rolling back a
+// failed operation undoes its own writes and, on Postgres, clears the
+// transaction's aborted state.
+type savepoint struct {
+	tx   *sql.Tx
+	name string
+	done bool
+}
+
+func (sp *savepoint) Exec(query string, args ...any) (sql.Result, error) {
+	return sp.tx.Exec(query, args...)
+}
+
+func (sp *savepoint) Query(query string, args ...any) (*sql.Rows, error) {
+	return sp.tx.Query(query, args...)
+}
+
+func (sp *savepoint) QueryRow(query string, args ...any) *sql.Row {
+	return sp.tx.QueryRow(query, args...)
+}
+
+func (sp *savepoint) Commit() error {
+	if sp.done {
+		return sql.ErrTxDone
+	}
+	sp.done = true
+	_, err := sp.tx.Exec("RELEASE SAVEPOINT " + sp.name)
+	return err
+}
+
+func (sp *savepoint) Rollback() error {
+	if sp.done {
+		return sql.ErrTxDone
+	}
+	sp.done = true
+	if _, err := sp.tx.Exec("ROLLBACK TO SAVEPOINT " + sp.name); err != nil {
+		return err
+	}
+	_, err := sp.tx.Exec("RELEASE SAVEPOINT " + sp.name)
+	return err
+}
+
+func (s *SQLStore) WithTx(ctx context.Context, fn func(store.Store) error) error {
+	var tx txn
+	switch c := s.db.(type) {
+	case dbConn:
+		sqlTx, err := c.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		tx = sqlTx
+		s = &SQLStore{db: txConn{Tx: sqlTx, savepoints: new(int)}, driverName: s.driverName}
+	default:
+		// Nested units of work share the outer transaction
+		var err error
+		if tx, err = s.db.Begin(); err != nil {
+			return err
+		}
+	}
+	defer tx.Rollback()
+
+	if err := fn(s); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close closes the database. Stores handed out by WithTx don't own it.
+func (s *SQLStore) Close() error {
+	if c, ok := s.db.(dbConn); ok {
+		return c.Close()
+	}
+	return nil
+}
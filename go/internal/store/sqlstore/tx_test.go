@@ -0,0 +1,200 @@
+package sqlstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/store"
+)
+
+var errInjected = errors.New("injected fault")
+
+func TestWithTx(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "owner", Email: "owner@example.com", Password: "pass"})
+	owner, _ := testStore.GetUserByUsername("owner")
+	// SQLite has one connection, which the transaction holds
+	keys := accountKey(t, owner.ID, "key")
+
+	// A failure after several writes undoes all of them
+	var chatID int
+	err := testStore.WithTx(context.Background(), func(tx store.Store) error {
+		id, err := tx.CreateChat("Doomed", owner.ID)
+		if err != nil {
+			return err
+		}
+		chatID = int(id)
+		if _, err := tx.AddParticipant(chatID, owner.ID, owner.ID, keys); err != nil {
+			return err
+		}
+		if _, _, err := tx.SaveMessage(chatID, owner.ID, 1, 0, "hello", "", nil); err != nil {
+			return err
+		}
+		return errInjected
+	})
+	if !errors.Is(err, errInjected) {
+		t.Fatalf("Expected the injected fault, got %v", err)
+	}
+	if _, err := testStore.GetChat(chatID); !errors.Is(err, store.ErrChatNotFound) {
+		t.Errorf("Expected the chat to be rolled back, got %v", err)
+	}
+	if chats, _ := testStore.GetUserChats(owner.ID, 0); len(chats) != 0 {
+		t.Errorf("Expected no chats after the rollback, got %+v", chats)
+	}
+
+	// A nested unit of work rolls back on its own, so the outer one may
+	// carry on after it fails
+	err = testStore.WithTx(context.Background(), func(tx store.Store) error {
+		id, err := tx.CreateChat("Kept", owner.ID)
+		if err != nil {
+			return err
+		}
+		chatID = int(id)
+		mismatched := tx.WithTx(context.Background(), func(tx store.Store) error {
+			_, err := tx.AddParticipant(chatID, owner.ID, owner.ID, map[int]string{0: "key"})
+			return err
+		})
+		if !errors.Is(mismatched, store.ErrKeyRecipientsMismatch) {
+			t.Errorf("Expected ErrKeyRecipientsMismatch, got %v", mismatched)
+		}
+		if _, err := tx.AddParticipant(chatID, owner.ID, owner.ID, keys); err != nil {
+			return err
+		}
+		nested := tx.WithTx(context.Background(), func(tx store.Store) error {
+			if _, _, err := tx.SaveMessage(chatID, owner.ID, 1, 0, "discarded", "", nil); err != nil {
+				return err
+			}
+			return errInjected
+		})
+		if !errors.Is(nested, errInjected) {
+			t.Errorf("Expected the nested unit of work to fail, got %v", nested)
+		}
+		_, _, err = tx.SaveMessage(chatID, owner.ID, 1, 0, "kept", "", nil)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WithTx failed: %v", err)
+	}
+	if participants, _ := testStore.GetChatParticipants(chatID); len(participants) != 1 {
+		t.Errorf("Expected the owner to be in the chat once, got %+v", participants)
+	}
+	messages, _, _ := testStore.GetChatMessagesPage(chatID, store.PageOptions{Limit: 10})
+	messages = userMessages(messages)
+	if len(messages) != 1 || messages[0].Content != "kept" {
+		t.Errorf("Expected only the message outside the nested unit of work, got %+v", messages)
+	}
+}
+
+func TestDeleteChatRollsBack(t *testing.T) {
+	SetupTestDB(t)
+	defer TeardownTestDB()
+
+	testStore.CreateUser(&models.User{Username: "owner", Email: "owner@example.com", Password: "pass"})
+	owner, _ := testStore.GetUserByUsername("owner")
+	id, _ := testStore.CreateChat("Chat", owner.ID)
+	chatID := int(id)
+	testStore.AddParticipant(chatID, owner.ID, owner.ID, accountKey(t, owner.ID, "key"))
+	msg, _, _ := testStore.SaveMessage(chatID, owner.ID, 1, 0, "hello", "", nil)
+	testStore.AddReaction(msg.ID, owner.ID, "👍")
+
+	// Fail the last step, after everything hanging off the chat is gone
+	fault := "CREATE TRIGGER fail_chat_delete BEFORE DELETE ON chats BEGIN SELECT RAISE(ABORT, 'injected fault'); END"
+	if _, err := testStore.db.Exec(fault); err != nil {
+		t.Fatalf("Failed to inject fault: %v", err)
+	}
+	if err := testStore.DeleteChat(chatID); err == nil {
+		t.Fatal("Expected DeleteChat to fail")
+	}
+
+	if _, err := testStore.GetChat(chatID); err != nil {
+		t.Errorf("Expected the chat to survive, got %v", err)
+	}
+	if participants, _ := testStore.GetChatParticipants(chatID); len(participants) != 1 {
+		t.Errorf("Expected the owner to stay in the chat, got %+v", participants)
+	}
+	if m, err := testStore.GetMessage(msg.ID); err != nil || len(m.Reactions) != 1 {
+		t.Errorf("Expected the message to keep its reaction, got %+v %v", m, err)
+	}
+	device, _ := testStore.GetAccountDevice(owner.ID)
+	if keys, _ := testStore.GetChatKeys(chatID, device.ID); len(keys) != 1 {
+		t.Errorf("Expected the chat keys to survive, got %+v", keys)
+	}
+
+	testStore.db.Exec("DROP TRIGGER fail_chat_delete")
+	if err := testStore.DeleteChat(chatID); err != nil {
+		t.Fatalf("DeleteChat failed: %v", err)
+	}
+	if _, err := testStore.GetChat(chatID); !errors.Is(err, store.ErrChatNotFound) {
+		t.Errorf("Expected the chat to be gone, got %v", err)
+	}
+}
+
+// TestWithTxPostgres checks the rules WithTx documents against Postgres,
+// where a failed statement aborts the whole transaction.
+func TestWithTxPostgres(t *testing.T) {
+	dsn := os.Getenv("CHATTY_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("CHATTY_TEST_POSTGRES_DSN not set")
+	}
+	pg, err := New("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Failed to connect to Postgres: %v", err)
+	}
+	defer pg.Close()
+
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	pg.CreateUser(&models.User{Username: "tx" + suffix, Email: "tx" + suffix + "@example.com", Password: "pass"})
+	user, err := pg.GetUserByEmail("tx" + suffix + "@example.com")
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	now := time.Now().UTC()
+	session := func(id string) *models.Session {
+		return &models.Session{ID: id + suffix, UserID: user.ID, CreatedAt: now, LastSeenAt: now}
+	}
+	pg.CreateSession(session("taken"))
+
+	// A single-statement operation that fails poisons the transaction, so
+	// fn has to give up
+	var after error
+	err = pg.WithTx(context.Background(), func(tx store.Store) error {
+		if err := tx.CreateSession(session("doomed")); err != nil {
+			return err
+		}
+		if err := tx.CreateSession(session("taken")); err == nil {
+			t.Fatal("Expected a duplicate session to fail")
+		}
+		_, after = tx.GetSession("doomed" + suffix)
+		return after
+	})
+	if err == nil || after == nil {
+		t.Errorf("Expected statements after the failure to fail too, got %v", after)
+	}
+	if _, err := pg.GetSession("doomed" + suffix); err == nil {
+		t.Error("Expected the unit of work to be rolled back")
+	}
+
+	// The same failure inside a nested unit of work leaves the outer one usable
+	err = pg.WithTx(context.Background(), func(tx store.Store) error {
+		nested := tx.WithTx(context.Background(), func(tx store.Store) error {
+			return tx.CreateSession(session("taken"))
+		})
+		if nested == nil {
+			t.Error("Expected a duplicate session to fail")
+		}
+		return tx.CreateSession(session("kept"))
+	})
+	if err != nil {
+		t.Fatalf("WithTx failed: %v", err)
+	}
+	if _, err := pg.GetSession("kept" + suffix); err != nil {
+		t.Errorf("Expected the session after the nested failure to be kept, got %v", err)
+	}
+}
@@ -1,8 +1,71 @@
 package store
 
-import "github.com/pliu/chatty/internal/models"
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+)
+
+var (
+	// ErrInvalidToken is returned when a one-time token is unknown, expired or
+	// already used.
+	ErrInvalidToken = errors.New("invalid or expired token")
+
+	// ErrStaleKeyEpoch is returned when a message or rekey is based on a chat
+	// key epoch that is no longer current.
+	ErrStaleKeyEpoch = errors.New("chat key epoch is not current")
+
+	// ErrKeyRecipientsMismatch is returned when a chat key isn't wrapped for
+	// exactly the devices of the members receiving it.
+	ErrKeyRecipientsMismatch = errors.New("chat key must be wrapped for exactly the recipients' devices")
+
+	// ErrChatNotFound is returned when a chat doesn't exist.
+	ErrChatNotFound = errors.New("chat not found")
+
+	// ErrNotParticipant is returned when a user isn't a member of a chat.
+	ErrNotParticipant = errors.New("not a participant of this chat")
+
+	// ErrAlreadyParticipant is returned when a user tries to join a chat
+	// they are already in.
+	ErrAlreadyParticipant = errors.New("already a participant of this chat")
+
+	// ErrInviteNotFound is returned when an invite doesn't exist, or can no
+	// longer be redeemed because it expired or was used up.
+	ErrInviteNotFound = errors.New("invite not found")
+
+	// ErrJoinRequestNotFound is returned when a user has no pending request
+	// to join a chat.
+	ErrJoinRequestNotFound = errors.New("join request not found")
+
+	// ErrNoPendingTransfer is returned when accepting ownership of a chat
+	// that wasn't offered to the user.
+	ErrNoPendingTransfer = errors.New("no pending ownership transfer")
+
+	// ErrMessageNotFound is returned when a message doesn't exist, has been
+	// deleted, or wasn't sent by the user editing it.
+	ErrMessageNotFound = errors.New("message not found")
+
+	// ErrAttachmentNotFound is returned when an attachment doesn't exist, or
+	// can't be sent because it is incomplete, belongs to someone else or a
+	// different chat, or was already sent.
+	ErrAttachmentNotFound = errors.New("attachment not found")
+
+	// ErrQuotaExceeded is returned when an upload would take a user past
+	// their attachment storage quota.
+	ErrQuotaExceeded = errors.New("attachment quota exceeded")
+)
 
 type Store interface {
+	// WithTx runs fn as a single unit of work against a Store that is
+	// bound to one transaction. It commits if fn returns nil and rolls back
+	// everything fn did otherwise. fn must return as soon as an operation
+	// fails: on Postgres a failed statement aborts the whole transaction.
+	// Calling WithTx on a transaction's Store nests within it, in a savepoint,
+	// so fn may handle the error of a nested unit of work and carry on.
+	WithTx(ctx context.Context, fn func(Store) error) error
+
 	// User operations
 	CreateUser(user *models.User) error
 	GetUserByUsername(username string) (*models.User, error)
@@ -10,16 +73,227 @@ type Store interface {
 	VerifyUser(token string) error
 	GetUserByID(id int) (*models.User, error)
 	SearchUsers(query string) ([]models.User, error)
+	// UpdateUserCredentials replaces a user's password hash and key material.
+	// A new public key drops the account device's chat keys, which were
+	// wrapped for the old one, as DeleteDevice does, and returns the chats
+	// flagged for a rekey.
+	UpdateUserCredentials(userID int, password, publicKey, encryptedPrivateKey string) (rekeyChatIDs []int, err error)
+	// SetLastSeen records when a user's last live connection closed.
+	SetLastSeen(userID int, at time.Time) error
+	// DeactivateUser marks a user deactivated at now, ends their sessions,
+	// withdraws ownership offers made to them and hands each group chat they
+	// own to a successor: the longest-standing admin, or failing that the
+	// longest-standing member, who hasn't been deactivated. The former owner
+	// stays on as a member, and a chat with no successor keeps its owner. It
+	// returns the audit entries of the handovers, each with the system message
+	// announcing it; deactivating a user again does nothing.
+	DeactivateUser(userID int, now time.Time) ([]models.AuditEntry, error)
+
+	// Device operations
+	CreateDevice(device *models.Device) error
+	GetDevice(id int) (*models.Device, error)
+	// GetAccountDevice returns the device holding a user's password-wrapped key.
+	GetAccountDevice(userID int) (*models.Device, error)
+	GetUserDevices(userID int) ([]models.Device, error)
+	// DeleteDevice removes a device, the sessions acting as it and its wrapped
+	// chat keys, flags every chat it held a key for for a rekey and returns
+	// those chats.
+	DeleteDevice(id int) (chatIDs []int, err error)
+	// AddDeviceChatKeys stores chat keys wrapped for a device that joined
+	// after its user, replacing any it already has. Keys for chats its user
+	// isn't in, or for epochs that haven't started, are ignored.
+	AddDeviceChatKeys(deviceID int, keys []models.ChatKey) error
+
+	// Password reset operations
+	CreatePasswordReset(userID int, tokenHash string, expiresAt time.Time) error
+	// ConsumePasswordReset marks a reset token used and returns its user. It
+	// returns ErrInvalidToken unless the token is unused and unexpired at now,
+	// and discards the user's other outstanding tokens.
+	ConsumePasswordReset(tokenHash string, now time.Time) (userID int, err error)
+
+	// Session operations
+	CreateSession(session *models.Session) error
+	// GetSession returns a session, unless its user has been deactivated.
+	GetSession(id string) (*models.Session, error)
+	TouchSession(id string, lastSeenAt time.Time) error
+	SetSessionDevice(id string, deviceID int) error
+	GetUserSessions(userID int) ([]models.Session, error)
+	DeleteSession(id string) error
+	DeleteUserSessions(userID int) error
 
 	// Chat operations
 	CreateChat(name string, ownerID int) (int64, error)
-	AddParticipant(chatID, userID int, encryptedKey string) error
-	RemoveParticipant(chatID, userID int) error
+	// GetChat returns a chat without any per-member state, or
+	// ErrChatNotFound.
+	GetChat(chatID int) (*models.Chat, error)
+	// UpdateChat applies changes to a group chat's details on behalf of
+	// userID and records them as a system message in its timeline, which it
+	// returns. Encrypted fields must use the chat's current key epoch,
+	// otherwise ErrStaleKeyEpoch is returned. A new avatar must be a complete
+	// attachment userID uploaded to the chat and hasn't sent, otherwise
+	// ErrAttachmentNotFound is returned. Direct chats return ErrChatNotFound.
+	UpdateChat(chatID, userID int, changes models.ChatChanges) (*models.Message, error)
+	// GetOrCreateDirectChat returns the direct chat between userID and
+	// peerID, unhiding it for userID, and reports whether it had to be
+	// created. A new chat starts with keys, mapping the ID of each of both
+	// users' devices to its wrapped copy of the chat key; it returns
+	// ErrKeyRecipientsMismatch unless keys covers exactly those devices.
+	GetOrCreateDirectChat(userID, peerID int, keys map[int]string) (chatID int, created bool, err error)
+	// SetChatHidden hides a chat from, or shows it in, a member's chat list.
+	// New messages show it again.
+	SetChatHidden(chatID, userID int, hidden bool) error
+	// AddParticipant adds a member with the chat key of the current epoch,
+	// mapping each of their device IDs to its wrapped copy. It returns
+	// ErrKeyRecipientsMismatch unless keys covers exactly their devices.
+	// The owner of a group chat joins as its owner, anyone else as a member.
+	// The join is recorded in the chat as a system message from addedBy,
+	// which it returns.
+	AddParticipant(chatID, userID, addedBy int, keys map[int]string) (*models.Message, error)
+	// RemoveParticipant removes a member and their keys, withdraws any
+	// offer of ownership to them and flags the chat for a rekey. It records
+	// a system message from removedBy, which it returns: a leave if that's
+	// the member themselves, otherwise a removal. Non-members return
+	// ErrNotParticipant.
+	RemoveParticipant(chatID, userID, removedBy int) (*models.Message, error)
 	IsParticipant(chatID, userID int) (bool, error)
-	GetUserChats(userID int) ([]models.Chat, error)
+	// GetMembership returns a user's role in a chat and the chat's type, or
+	// ErrNotParticipant.
+	GetMembership(chatID, userID int) (*models.Membership, error)
+	// SetParticipantRole changes a member's role, or returns
+	// ErrNotParticipant. The change is recorded in the chat as a system
+	// message from changedBy, which it returns.
+	SetParticipantRole(chatID, userID, changedBy int, role string) (*models.Message, error)
+	// GetUserChats returns a user's chats with their keys wrapped for deviceID
+	// and the user's roles and unread counts, leaving out chats they have
+	// hidden.
+	// Direct chats are named after the other member.
+	GetUserChats(userID, deviceID int) ([]models.Chat, error)
+	GetUserChatIDs(userID int) ([]int, error)
+	// GetChatParticipants returns a chat's members with their roles and
+	// devices.
 	GetChatParticipants(chatID int) ([]models.User, error)
 	GetChatOwner(chatID int) (int, error)
+	// SetPendingOwner records the group chat owner's offer of the chat to
+	// userID, replacing any earlier offer; zero withdraws it.
+	SetPendingOwner(chatID, userID int) error
+	// TransferOwnership makes userID the owner of a chat that was offered to
+	// them, demoting the previous owner to admin and recording it in the
+	// audit log and as a system message in the chat. It returns ErrNoPendingTransfer unless the chat was offered
+	// to userID and ErrNotParticipant if they are no longer in it.
+	TransferOwnership(chatID, userID int, now time.Time) (*models.AuditEntry, error)
+	// GetAuditLog returns a chat's audit entries, oldest first.
+	GetAuditLog(chatID int) ([]models.AuditEntry, error)
+	// DeleteChat removes a chat with its messages, members, keys, invites
+	// and audit log, all or nothing.
 	DeleteChat(chatID int) error
-	SaveMessage(chatID, userID int, content string) error
+	// GetChatKeys returns a device's wrapped chat key for every epoch it
+	// holds one for, oldest first.
+	GetChatKeys(chatID, deviceID int) ([]models.ChatKey, error)
+	// RotateChatKey starts epoch newEpoch with keys, mapping the ID of each
+	// current member's devices to its wrapped copy of the new key. It returns
+	// ErrStaleKeyEpoch unless newEpoch directly follows the current epoch,
+	// and ErrKeyRecipientsMismatch unless keys covers exactly the members'
+	// devices.
+	RotateChatKey(chatID, newEpoch int, keys map[int]string) error
+	// SaveMessage persists a message and returns it with its ID and timestamp.
+	// A non-empty clientMsgID makes the call idempotent per (chat, sender): a
+	// retry returns the original message and created is false. New messages
+	// must be encrypted under the chat's current key epoch, otherwise
+	// ErrStaleKeyEpoch is returned. A non-zero replyTo makes the message a
+	// reply in the thread of that message, which must be live and in the
+	// same chat, otherwise ErrMessageNotFound is returned. attachmentIDs
+	// are sent with the message; each must be a complete attachment the
+	// sender uploaded to the chat and hasn't sent before, otherwise
+	// ErrAttachmentNotFound is returned.
+	SaveMessage(chatID, userID, keyEpoch, replyTo int, content, clientMsgID string, attachmentIDs []int) (msg *models.Message, created bool, err error)
+	GetMessage(id int) (*models.Message, error)
+	// EditMessage replaces the content of a message sent by userID, keeping
+	// the previous version in its edit history. The new content must be
+	// encrypted under the chat's current key epoch, otherwise
+	// ErrStaleKeyEpoch is returned.
+	EditMessage(id, userID, keyEpoch int, content string, editedAt time.Time) (*models.Message, error)
+	// DeleteMessage turns a message into a tombstone, clearing its content,
+	// edit history, reactions and attachments. When deletedBy isn't the
+	// sender it also records the deletion as a system message, returned as
+	// notice.
+	DeleteMessage(id, deletedBy int, deletedAt time.Time) (deleted, notice *models.Message, err error)
+	// AddReaction records a user's reaction to a message, reporting whether
+	// it was new. Deleted and system messages return ErrMessageNotFound.
+	AddReaction(messageID, userID int, reaction string) (added bool, err error)
+	// RemoveReaction withdraws a user's reaction, reporting whether there was
+	// one to remove.
+	RemoveReaction(messageID, userID int, reaction string) (removed bool, err error)
+	// PinMessage pins a message on behalf of userID, reporting whether it
+	// wasn't pinned already. Deleted and system messages return
+	// ErrMessageNotFound; deleting a message unpins it.
+	PinMessage(messageID, userID int, now time.Time) (pinned bool, err error)
+	// UnpinMessage reports whether the message was pinned.
+	UnpinMessage(messageID int) (unpinned bool, err error)
+	// GetPinnedMessages returns a chat's pinned messages, most recently
+	// pinned first.
+	GetPinnedMessages(chatID int) ([]models.Message, error)
+	// GetThreadFollowers returns the users following a thread: its root's
+	// sender and everyone who has replied.
+	GetThreadFollowers(rootID int) ([]int, error)
+	// GetMessageEdits returns a message's previous versions, oldest first.
+	GetMessageEdits(id int) ([]models.MessageEdit, error)
+	// MarkRead moves a member's read pointer forward to messageID, which
+	// must be in the chat. It reports whether the pointer moved; it never
+	// moves backwards.
+	MarkRead(chatID, userID, messageID int) (advanced bool, err error)
+	// GetReadReceipts returns the read pointers of a chat's members who have
+	// read anything.
+	GetReadReceipts(chatID int) ([]models.ReadReceipt, error)
+	// GetChatMessages and GetChatMessagesPage return messages with their
+	// aggregated reactions and attachments.
 	GetChatMessages(chatID int) ([]models.Message, error)
+	// GetChatMessagesPage returns up to opts.Limit messages in ascending
+	// (created_at, id) order, and whether more exist beyond the page in the
+	// direction of travel (older, or newer when only After is set). It
+	// returns ErrInvalidCursor if a cursor's message isn't in the chat.
+	GetChatMessagesPage(chatID int, opts PageOptions) ([]models.Message, bool, error)
+
+	// Invite operations
+	// CreateInvite stores a new invite, setting its ID and creation time.
+	CreateInvite(invite *models.Invite) error
+	// GetInvite returns an invite by its code, usable or not, or
+	// ErrInviteNotFound.
+	GetInvite(code string) (*models.Invite, error)
+	GetChatInvites(chatID int) ([]models.Invite, error)
+	// DeleteInvite revokes one of a chat's invites, or returns
+	// ErrInviteNotFound.
+	DeleteInvite(chatID int, code string) error
+	// RedeemInvite files a request from userID to join the invite's chat,
+	// counting a use of the invite. It returns ErrInviteNotFound unless the
+	// invite is usable at now and ErrAlreadyParticipant if the user is in the
+	// chat. Redeeming an invite while a request is already pending returns
+	// that request and created is false, without counting another use.
+	RedeemInvite(code string, userID int, now time.Time) (request *models.JoinRequest, created bool, err error)
+	// GetJoinRequests returns a chat's pending join requests, oldest first,
+	// with the joiners' devices.
+	GetJoinRequests(chatID int) ([]models.JoinRequest, error)
+	GetJoinRequest(chatID, userID int) (*models.JoinRequest, error)
+	// ApproveJoinRequest turns a pending join request into a membership,
+	// as AddParticipant does with keys on behalf of approvedBy. It returns
+	// ErrJoinRequestNotFound if there is no request, so concurrent
+	// approvals let the joiner in once.
+	ApproveJoinRequest(chatID, userID, approvedBy int, keys map[int]string) (*models.Message, error)
+	// DeleteJoinRequest rejects a pending join request, or returns
+	// ErrJoinRequestNotFound.
+	DeleteJoinRequest(chatID, userID int) error
+
+	// Attachment operations
+	// CreateAttachment records a new upload, setting its ID and creation
+	// time. It returns ErrQuotaExceeded if the user's attachments, sent or
+	// not, would then total more than quota bytes.
+	CreateAttachment(attachment *models.Attachment, quota int64) error
+	GetAttachment(id int) (*models.Attachment, error)
+	GetChatAttachments(chatID int) ([]models.Attachment, error)
+	// AddAttachmentChunk counts n more bytes as received, provided offset
+	// bytes had been received so far. It reports whether it did, so
+	// concurrent uploads of the same chunk are counted once.
+	AddAttachmentChunk(id int, offset, n int64) (added bool, err error)
+	// DeleteAttachment discards an attachment that hasn't been sent. Sent
+	// attachments go with their message and return ErrAttachmentNotFound.
+	DeleteAttachment(id int) error
 }
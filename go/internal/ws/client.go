@@ -2,11 +2,17 @@ package ws
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/pubsub"
 )
 
 const (
@@ -19,8 +25,16 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// DefaultMaxMessageSize is the largest frame a peer may send unless the
+	// hub is configured otherwise. It fits an encrypted message of several
+	// kilobytes with its attachment IDs.
+	DefaultMaxMessageSize = 64 << 10
+
+	// Outbound messages buffered per client before it is considered stuck.
+	sendBufferSize = 256
+
+	// Maximum number of chats a client may resume in one connection.
+	maxResumeChats = 1000
 )
 
 var upgrader = websocket.Upgrader{
@@ -39,6 +53,25 @@ type Client struct {
 	send chan []byte
 
 	userID int
+
+	// Session the connection was opened under, and when that session hits
+	// its absolute timeout.
+	sessionID string
+	expiresAt time.Time
+
+	// Last message ID the client saw in each chat before reconnecting.
+	lastSeen map[int]int
+
+	// Chats the user participates in, and whether the user has gone idle on
+	// this connection; owned by the hub goroutine.
+	chats map[int]bool
+	away  bool
+
+	// Membership events that arrived while the chats loaded, and chat frames
+	// held back while the replay loads; owned by the hub goroutine.
+	missed    []pubsub.Event
+	replaying bool
+	held      [][]byte
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -47,7 +80,7 @@ func (c *Client) readPump() {
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadLimit(c.hub.MaxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
@@ -59,16 +92,79 @@ func (c *Client) readPump() {
 			break
 		}
 
-		var msg Message
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("error unmarshalling message: %v", err)
-			continue
+		c.handleFrame(message)
+	}
+}
+
+// handleFrame decodes an inbound envelope and dispatches it by type. Frames
+// that can't be handled are answered with an error frame rather than dropped.
+func (c *Client) handleFrame(raw []byte) {
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		c.reject("", ErrCodeBadRequest, "malformed frame")
+		return
+	}
+	if env.V != ProtocolVersion {
+		c.reject(env.ID, ErrCodeUnsupportedVersion, fmt.Sprintf("protocol version %d is not supported", env.V))
+		return
+	}
+
+	switch env.Type {
+	case TypeSend:
+		if env.ID == "" {
+			c.reject(env.ID, ErrCodeBadRequest, "send frames require a client message id")
+			return
+		}
+		var payload SendPayload
+		if err := json.Unmarshal(env.Payload, &payload); err != nil {
+			c.reject(env.ID, ErrCodeBadRequest, "malformed send payload")
+			return
+		}
+		c.hub.Submit(Message{
+			ChatID:        payload.ChatID,
+			UserID:        c.userID, // Never trust the client for the sender
+			Content:       payload.Content,
+			KeyEpoch:      payload.KeyEpoch,
+			ReplyTo:       payload.ReplyTo,
+			AttachmentIDs: payload.AttachmentIDs,
+			ClientMsgID:   env.ID,
+			sender:        c,
+		})
+	case TypeRead:
+		var payload ReadPayload
+		if err := json.Unmarshal(env.Payload, &payload); err != nil {
+			c.reject(env.ID, ErrCodeBadRequest, "malformed read payload")
+			return
 		}
-		msg.UserID = c.userID // Ensure user ID is correct
-		c.hub.broadcast <- msg
+		if err := c.hub.MarkRead(payload.ChatID, c.userID, payload.MessageID); err != nil {
+			log.Printf("Error marking chat %d read for user %d: %v", payload.ChatID, c.userID, err)
+			c.reject(env.ID, ErrCodeInternal, "could not update read pointer")
+		}
+	case TypeTyping:
+		var payload TypingPayload
+		if err := json.Unmarshal(env.Payload, &payload); err != nil {
+			c.reject(env.ID, ErrCodeBadRequest, "malformed typing payload")
+			return
+		}
+		c.hub.typing <- typingSignal{client: c, payload: payload}
+	case TypeStatus:
+		var payload StatusPayload
+		if err := json.Unmarshal(env.Payload, &payload); err != nil || (payload.Status != StatusOnline && payload.Status != StatusAway) {
+			c.reject(env.ID, ErrCodeBadRequest, "status must be online or away")
+			return
+		}
+		c.hub.status <- statusSignal{client: c, away: payload.Status == StatusAway}
+	default:
+		c.reject(env.ID, ErrCodeBadRequest, fmt.Sprintf("unknown frame type %q", env.Type))
 	}
 }
 
+// reject answers a frame with an error. It goes through the hub, which owns
+// c.send and may already have closed it.
+func (c *Client) reject(id, code, reason string) {
+	c.hub.direct <- directFrame{client: c, frame: errorFrame(id, code, reason)}
+}
+
 // writePump pumps messages from the hub to the websocket connection.
 func (c *Client) writePump() {
 	ticker := time.NewTicker(pingPeriod)
@@ -86,22 +182,15 @@ func (c *Client) writePump() {
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+			// Each message is its own frame; clients parse one JSON value per frame.
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
-			w.Write(message)
-
-			// Add queued chat messages to the current websocket message.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write(<-c.send)
-			}
-
-			if err := w.Close(); err != nil {
+		case <-ticker.C:
+			if !c.expiresAt.IsZero() && time.Now().After(c.expiresAt) {
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session expired"))
 				return
 			}
-		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
@@ -111,17 +200,66 @@ func (c *Client) writePump() {
 }
 
 // ServeWs handles websocket requests from the peer.
-func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, userID int) {
+// The optional last_seen query parameter ("chatID:messageID,...") asks for
+// messages missed since a previous connection to be replayed first.
+func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, session *models.Session, expiresAt time.Time) {
+	lastSeen, err := parseLastSeen(r.URL.Query().Get("last_seen"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), userID: userID}
-	client.hub.register <- client
+	// Leave room for the presence snapshot, the whole replay plus one gap
+	// notice per chat, and the frames held back while it loaded, so none of
+	// it overflows the buffer before writePump starts draining it.
+	bufferSize := sendBufferSize + 1 + maxReplayMessages + len(lastSeen)
+	client := &Client{
+		hub:       hub,
+		conn:      conn,
+		send:      make(chan []byte, bufferSize),
+		userID:    session.UserID,
+		sessionID: session.ID,
+		expiresAt: expiresAt,
+		lastSeen:  lastSeen,
+	}
+	client.hub.connect(client)
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
 	go client.writePump()
 	go client.readPump()
 }
+
+// parseLastSeen parses "chatID:messageID,chatID:messageID" into a map.
+func parseLastSeen(raw string) (map[int]int, error) {
+	lastSeen := make(map[int]int)
+	if raw == "" {
+		return lastSeen, nil
+	}
+
+	entries := strings.Split(raw, ",")
+	if len(entries) > maxResumeChats {
+		return nil, errors.New("too many chats in last_seen")
+	}
+	for _, entry := range entries {
+		chatStr, msgStr, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid last_seen entry %q", entry)
+		}
+		chatID, err := strconv.Atoi(chatStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid last_seen entry %q", entry)
+		}
+		messageID, err := strconv.Atoi(msgStr)
+		if err != nil || messageID < 1 {
+			return nil, fmt.Errorf("invalid last_seen entry %q", entry)
+		}
+		lastSeen[chatID] = messageID
+	}
+	return lastSeen, nil
+}
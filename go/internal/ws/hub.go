@@ -1,28 +1,70 @@
 package ws
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"errors"
 	"log"
 	"time"
 
 	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/pubsub"
 	"github.com/pliu/chatty/internal/store"
 )
 
-// Message represents a message received from a client.
-// For broadcasting, a more complete message (like models.Message) is constructed.
+// maxReplayMessages caps how many missed messages are replayed to a single
+// reconnecting client across all of its chats.
+const maxReplayMessages = 500
+
+// publishTimeout bounds publishing one event to the broker.
+const publishTimeout = 5 * time.Second
+
+// Message is a chat message sent by a client, on its way to the hub.
 type Message struct {
-	ChatID  int    `json:"chat_id"`
-	UserID  int    `json:"user_id"`
-	Content string `json:"content"`
+	ChatID   int
+	UserID   int
+	Content  string
+	KeyEpoch int
+	ReplyTo  int
+
+	// AttachmentIDs are uploaded attachments sent with the message.
+	AttachmentIDs []int
+
+	// ClientMsgID is the envelope ID the client sent it under.
+	ClientMsgID string
+
+	// sender receives the ack or error; nil for messages not sent over a socket.
+	sender *Client
+}
+
+// directFrame is a frame addressed to a single connection.
+type directFrame struct {
+	client *Client
+	frame  []byte
+}
+
+// chatList carries a connecting client's chats, loaded off the hub goroutine.
+type chatList struct {
+	client  *Client
+	chatIDs []int
+}
+
+// replayBatch carries the frames replayed to a reconnecting client.
+type replayBatch struct {
+	client *Client
+	frames [][]byte
 }
 
+// Hub owns the set of connections on this instance. Its indexes are only
+// touched from Run, which never waits on the database: chat membership is
+// loaded by each connection as it connects and kept current by membership
+// events.
 type Hub struct {
 	// Registered clients.
 	clients map[*Client]bool
 
-	// Inbound messages from the clients.
-	broadcast chan Message
+	// Connected clients by chat they participate in, and by user.
+	chats map[int]map[*Client]bool
+	users map[int]map[*Client]bool
 
 	// Register requests from the clients.
 	register chan *Client
@@ -30,16 +72,68 @@ type Hub struct {
 	// Unregister requests from clients.
 	unregister chan *Client
 
+	// Chats and replays loaded for connecting clients, and the clients
+	// whose chats are still loading.
+	attach   chan chatList
+	replayed chan replayBatch
+	loading  map[*Client]bool
+
+	// Frames addressed to one client, such as acks and protocol errors.
+	direct chan directFrame
+
+	// Typing and idle signals from clients.
+	typing chan typingSignal
+	status chan statusSignal
+
+	// Chat, user and membership events from every hub instance, this one
+	// included. Events are published through outbox, off the caller's
+	// goroutine, so the hub loop never waits on the broker.
+	outbox *pubsub.Outbox
+	events <-chan pubsub.Event
+
+	// instance identifies this hub in presence reports. reported is the
+	// status last reported for each user connected here, and presence the
+	// combined status of users sharing a chat with anyone connected here.
+	instance string
+	reported map[int]string
+	presence map[int]*presence
+
 	store store.Store
+
+	// MaxMessageSize is the largest frame a client may send; larger ones
+	// close the connection. Set it before serving connections.
+	MaxMessageSize int64
 }
 
+// NewHub returns a hub for a single-instance deployment.
 func NewHub(store store.Store) *Hub {
+	return NewHubWithBroker(store, pubsub.NewLocal())
+}
+
+// NewHubWithBroker returns a hub that shares deliveries with every other hub
+// subscribed to broker, so clients connected to any instance see each other's
+// messages and notifications.
+func NewHubWithBroker(store store.Store, broker pubsub.Broker) *Hub {
 	return &Hub{
-		broadcast:  make(chan Message),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		attach:     make(chan chatList),
+		replayed:   make(chan replayBatch),
+		loading:    make(map[*Client]bool),
+		direct:     make(chan directFrame),
+		typing:     make(chan typingSignal),
+		status:     make(chan statusSignal),
 		clients:    make(map[*Client]bool),
+		chats:      make(map[int]map[*Client]bool),
+		users:      make(map[int]map[*Client]bool),
+		outbox:     pubsub.NewOutbox(broker, publishTimeout),
+		events:     broker.Subscribe(),
+		instance:   rand.Text(),
+		reported:   make(map[int]string),
+		presence:   make(map[int]*presence),
 		store:      store,
+
+		MaxMessageSize: DefaultMaxMessageSize,
 	}
 }
 
@@ -47,74 +141,403 @@ func (h *Hub) Run() {
 	for {
 		select {
 		case client := <-h.register:
-			h.clients[client] = true
+			h.addClient(client)
+		case list := <-h.attach:
+			if h.clients[list.client] {
+				h.attachChats(list.client, list.chatIDs)
+			}
+		case batch := <-h.replayed:
+			if h.clients[batch.client] {
+				h.finishReplay(batch.client, batch.frames)
+			}
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+				h.removeClient(client)
 			}
-		case message := <-h.broadcast:
-			// Verify sender is a participant
-			isSenderParticipant, err := h.store.IsParticipant(message.ChatID, message.UserID)
-			if err != nil {
-				log.Printf("Error checking sender participant status: %v", err)
-				continue
+		case d := <-h.direct:
+			if _, ok := h.clients[d.client]; ok {
+				h.deliver(d.client, d.frame)
 			}
-			if !isSenderParticipant {
-				log.Printf("Unauthorized message attempt: User %d is not in Chat %d", message.UserID, message.ChatID)
+		case signal := <-h.typing:
+			h.relayTyping(signal)
+		case signal := <-h.status:
+			h.setAway(signal)
+		case event := <-h.events:
+			h.dispatch(event)
+		}
+	}
+}
+
+// connect registers a client and loads its chats and replay on the caller's
+// goroutine. The hub records membership events while the chats load and
+// holds chat frames back while the replay loads, so nothing slips in
+// between a query and delivery; at worst a message arrives twice, which
+// clients deduplicate by ID.
+func (h *Hub) connect(client *Client) {
+	h.register <- client
+
+	chatIDs, err := h.store.GetUserChatIDs(client.userID)
+	if err != nil {
+		log.Printf("Error loading chats for user %d: %v", client.userID, err)
+		h.unregister <- client
+		return
+	}
+	h.attach <- chatList{client: client, chatIDs: chatIDs}
+	h.replayed <- replayBatch{client: client, frames: h.loadReplay(client.lastSeen, chatIDs)}
+}
+
+func (h *Hub) addClient(client *Client) {
+	h.clients[client] = true
+	h.loading[client] = true
+	addToIndex(h.users, client.userID, client)
+}
+
+// attachChats indexes a client under its freshly loaded chats, applying the
+// membership events that arrived while they loaded; the query may or may not
+// have seen each one, and applying it again is harmless. Chat frames are
+// held back until the client's replay is in.
+func (h *Hub) attachChats(client *Client, chatIDs []int) {
+	delete(h.loading, client)
+	client.chats = make(map[int]bool, len(chatIDs))
+	for _, chatID := range chatIDs {
+		client.chats[chatID] = true
+	}
+	for _, event := range client.missed {
+		if event.Kind == pubsub.KindJoin {
+			client.chats[event.ChatID] = true
+		} else {
+			delete(client.chats, event.ChatID)
+		}
+	}
+	client.missed = nil
+	for chatID := range client.chats {
+		addToIndex(h.chats, chatID, client)
+	}
+	client.replaying = true
+
+	h.reportPresence(client.userID, client.chats)
+	h.sendPresence(client)
+}
+
+// finishReplay sends a client its replay, then the chat frames held back
+// while it loaded.
+func (h *Hub) finishReplay(client *Client, frames [][]byte) {
+	client.replaying = false
+	held := client.held
+	client.held = nil
+	for _, frame := range append(frames, held...) {
+		if !h.clients[client] {
+			return
+		}
+		h.deliver(client, frame)
+	}
+}
+
+func (h *Hub) removeClient(client *Client) {
+	delete(h.clients, client)
+	delete(h.loading, client)
+	removeFromIndex(h.users, client.userID, client)
+	for chatID := range client.chats {
+		removeFromIndex(h.chats, chatID, client)
+	}
+	close(client.send)
+	h.reportPresence(client.userID, client.chats)
+}
+
+func addToIndex(index map[int]map[*Client]bool, key int, client *Client) {
+	set, ok := index[key]
+	if !ok {
+		set = make(map[*Client]bool)
+		index[key] = set
+	}
+	set[client] = true
+}
+
+func removeFromIndex(index map[int]map[*Client]bool, key int, client *Client) {
+	set, ok := index[key]
+	if !ok {
+		return
+	}
+	delete(set, client)
+	if len(set) == 0 {
+		delete(index, key)
+	}
+}
+
+// Submit persists a client's message, answers the sender with an ack or
+// error frame, and publishes the message for fan-out. It runs on the
+// caller's goroutine so database latency never stalls the hub loop.
+func (h *Hub) Submit(message Message) {
+	// Verify sender is a participant allowed to post
+	membership, err := h.store.GetMembership(message.ChatID, message.UserID)
+	if errors.Is(err, store.ErrNotParticipant) {
+		log.Printf("Unauthorized message attempt: User %d is not in Chat %d", message.UserID, message.ChatID)
+		h.reply(message, errorFrame(message.ClientMsgID, ErrCodeForbidden, "not a participant of this chat"))
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking sender participant status: %v", err)
+		h.reply(message, errorFrame(message.ClientMsgID, ErrCodeInternal, "could not verify chat membership"))
+		return
+	}
+	if !membership.Can(models.ActionPost) {
+		h.reply(message, errorFrame(message.ClientMsgID, ErrCodeForbidden, "your role can't post in this chat"))
+		return
+	}
+
+	// Save message to DB
+	saved, created, err := h.store.SaveMessage(message.ChatID, message.UserID, message.KeyEpoch, message.ReplyTo, message.Content, message.ClientMsgID, message.AttachmentIDs)
+	if errors.Is(err, store.ErrStaleKeyEpoch) {
+		h.reply(message, errorFrame(message.ClientMsgID, ErrCodeStaleKeyEpoch, "chat has been rekeyed; fetch the new key and re-encrypt"))
+		return
+	}
+	if errors.Is(err, store.ErrMessageNotFound) {
+		h.reply(message, errorFrame(message.ClientMsgID, ErrCodeBadRequest, "reply target not found"))
+		return
+	}
+	if errors.Is(err, store.ErrAttachmentNotFound) {
+		h.reply(message, errorFrame(message.ClientMsgID, ErrCodeBadRequest, "attachment not found or not fully uploaded"))
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving message: %v", err)
+		h.reply(message, errorFrame(message.ClientMsgID, ErrCodeInternal, "could not save message"))
+		return
+	}
+	h.reply(message, encodeFrame(TypeAck, message.ClientMsgID, AckPayload{
+		MessageID: saved.ID,
+		ChatID:    saved.ChatID,
+		CreatedAt: saved.CreatedAt,
+		Duplicate: !created,
+	}))
+
+	// A retried send was already broadcast the first time around.
+	if !created {
+		return
+	}
+
+	// Fan out through the broker so participants on every instance get it.
+	h.publish(pubsub.Event{
+		Kind:   pubsub.KindChat,
+		ChatID: saved.ChatID,
+		Frame:  encodeFrame(TypeMessage, "", saved),
+	})
+
+	if saved.ThreadRootID != 0 {
+		h.notifyThreadFollowers(saved)
+	}
+}
+
+// notifyThreadFollowers tells everyone following a thread, other than the
+// replier, that it has a new reply.
+func (h *Hub) notifyThreadFollowers(reply *models.Message) {
+	root, err := h.store.GetMessage(reply.ThreadRootID)
+	if err != nil {
+		log.Printf("Error loading thread root %d: %v", reply.ThreadRootID, err)
+		return
+	}
+	followers, err := h.store.GetThreadFollowers(root.ID)
+	if err != nil {
+		log.Printf("Error loading followers of thread %d: %v", root.ID, err)
+		return
+	}
+
+	event := ThreadReplyEvent{
+		ChatID:       reply.ChatID,
+		ThreadRootID: root.ID,
+		MessageID:    reply.ID,
+		ReplyCount:   root.ReplyCount,
+		LastReplyAt:  root.LastReplyAt,
+	}
+	for _, userID := range followers {
+		if userID != reply.UserID {
+			h.SendNotification(userID, TypeThreadReply, event)
+		}
+	}
+}
+
+// MarkRead moves a member's read pointer forward and tells the chat, so
+// other members can show receipts and the reader's other connections can
+// clear their unread badges. Pointers that don't move are ignored.
+func (h *Hub) MarkRead(chatID, userID, messageID int) error {
+	advanced, err := h.store.MarkRead(chatID, userID, messageID)
+	if err != nil || !advanced {
+		return err
+	}
+	h.Broadcast(chatID, TypeReadReceipt, models.ReadReceipt{ChatID: chatID, UserID: userID, MessageID: messageID})
+	return nil
+}
+
+// reply sends a frame back to the client a message came from, if any.
+func (h *Hub) reply(message Message, frame []byte) {
+	if message.sender == nil {
+		return
+	}
+	h.direct <- directFrame{client: message.sender, frame: frame}
+}
+
+func (h *Hub) publish(event pubsub.Event) {
+	h.outbox.Publish(event)
+}
+
+// dispatch applies a brokered event to this instance's clients.
+func (h *Hub) dispatch(event pubsub.Event) {
+	switch event.Kind {
+	case pubsub.KindChat:
+		frame := event.Frame
+		if len(frame) == 0 {
+			// The frame was lost, so members reload the chat over REST
+			frame = encodeFrame(TypeReplayGap, "", ChatEvent{ChatID: event.ChatID})
+		}
+		for client := range h.chats[event.ChatID] {
+			h.deliverChat(client, frame)
+		}
+	case pubsub.KindUser:
+		if len(event.Frame) == 0 {
+			log.Printf("Dropping notification for user %d that lost its frame", event.UserID)
+			return
+		}
+		for client := range h.users[event.UserID] {
+			h.deliver(client, event.Frame)
+		}
+	case pubsub.KindJoin:
+		for client := range h.users[event.UserID] {
+			if h.loading[client] {
+				client.missed = append(client.missed, event)
 				continue
 			}
-
-			// Save message to DB
-			err = h.store.SaveMessage(message.ChatID, message.UserID, message.Content)
-			if err != nil {
-				log.Printf("Error saving message: %v", err)
+			client.chats[event.ChatID] = true
+			addToIndex(h.chats, event.ChatID, client)
+		}
+	case pubsub.KindLeave:
+		for client := range h.users[event.UserID] {
+			if h.loading[client] {
+				client.missed = append(client.missed, event)
 				continue
 			}
-
-			// Broadcast to clients in the same chat
-			for client := range h.clients {
-				// Check if client is participant of the chat
-				isParticipant, err := h.store.IsParticipant(message.ChatID, client.userID)
-				if err != nil {
-					log.Printf("Error checking participant: %v", err)
-					continue
-				}
-				if isParticipant {
-					// Fetch full message details including username and timestamp
-					user, _ := h.store.GetUserByID(message.UserID)
-					response := models.Message{
-						ChatID:    message.ChatID,
-						UserID:    message.UserID,
-						Username:  user.Username,
-						Content:   message.Content,
-						CreatedAt: time.Now(),
-					}
-
-					msgBytes, _ := json.Marshal(response)
-
-					select {
-					case client.send <- msgBytes:
-					default:
-						close(client.send)
-						delete(h.clients, client)
-					}
-				}
+			delete(client.chats, event.ChatID)
+			removeFromIndex(h.chats, event.ChatID, client)
+		}
+	case pubsub.KindDrop:
+		for client := range h.loading {
+			client.missed = append(client.missed, event)
+		}
+		for client := range h.chats[event.ChatID] {
+			delete(client.chats, event.ChatID)
+		}
+		delete(h.chats, event.ChatID)
+	case pubsub.KindPresence:
+		h.applyPresence(event)
+	case pubsub.KindCloseSession:
+		for client := range h.clients {
+			if client.sessionID == event.SessionID {
+				// Closing send makes writePump close the connection.
+				h.removeClient(client)
 			}
 		}
 	}
 }
 
-func (h *Hub) SendNotification(userID int, message interface{}) {
-	msgBytes, _ := json.Marshal(message)
-	for client := range h.clients {
-		if client.userID == userID {
-			select {
-			case client.send <- msgBytes:
-			default:
-				close(client.send)
-				delete(h.clients, client)
-			}
+// deliver queues a frame for a client, dropping the client if it has fallen
+// too far behind to keep up.
+func (h *Hub) deliver(client *Client, frame []byte) {
+	select {
+	case client.send <- frame:
+	default:
+		h.removeClient(client)
+	}
+}
+
+// deliverChat delivers a chat frame, or holds it back while the client's
+// replay is loading.
+func (h *Hub) deliverChat(client *Client, frame []byte) {
+	if !client.replaying {
+		h.deliver(client, frame)
+		return
+	}
+	if len(client.held) >= sendBufferSize {
+		h.removeClient(client)
+		return
+	}
+	client.held = append(client.held, frame)
+}
+
+// loadReplay returns the frames replaying the messages a reconnecting client
+// missed in each chat it resumed. The client's chat frames are held back
+// from before the queries run, so any message they miss follows the replay.
+// Chats with more missed messages than the remaining replay budget get a
+// replay_gap notification instead so the client reloads them over REST.
+func (h *Hub) loadReplay(lastSeen map[int]int, chatIDs []int) [][]byte {
+	member := make(map[int]bool, len(chatIDs))
+	for _, chatID := range chatIDs {
+		member[chatID] = true
+	}
+
+	var frames [][]byte
+	budget := maxReplayMessages
+	for chatID, lastSeen := range lastSeen {
+		if !member[chatID] {
+			continue
+		}
+
+		messages, hasMore, err := h.store.GetChatMessagesPage(chatID, store.PageOptions{After: lastSeen, Limit: budget})
+		if err != nil {
+			log.Printf("Error loading replay for chat %d: %v", chatID, err)
+			hasMore = true
+		}
+		if hasMore {
+			frames = append(frames, encodeFrame(TypeReplayGap, "", ChatEvent{ChatID: chatID}))
+			continue
+		}
+
+		budget -= len(messages)
+		for _, m := range messages {
+			frames = append(frames, encodeFrame(TypeMessage, "", m))
 		}
 	}
+	return frames
+}
+
+// SendNotification pushes an event frame to every connection of a user, on
+// whichever instance they are connected. It is safe to call from any goroutine.
+func (h *Hub) SendNotification(userID int, eventType string, payload interface{}) {
+	h.publish(pubsub.Event{
+		Kind:   pubsub.KindUser,
+		UserID: userID,
+		Frame:  encodeFrame(eventType, "", payload),
+	})
+}
+
+// Broadcast pushes an event frame to every connection participating in a
+// chat, on whichever instance they are connected. It is safe to call from
+// any goroutine.
+func (h *Hub) Broadcast(chatID int, eventType string, payload interface{}) {
+	h.publish(pubsub.Event{
+		Kind:   pubsub.KindChat,
+		ChatID: chatID,
+		Frame:  encodeFrame(eventType, "", payload),
+	})
+}
+
+// Subscribe starts delivering a chat's messages to a user's live connections.
+// Call it after adding the user as a participant.
+func (h *Hub) Subscribe(userID, chatID int) {
+	h.publish(pubsub.Event{Kind: pubsub.KindJoin, UserID: userID, ChatID: chatID})
+}
+
+// Unsubscribe stops delivering a chat's messages to a user's live connections.
+// Call it after removing the user from the chat.
+func (h *Hub) Unsubscribe(userID, chatID int) {
+	h.publish(pubsub.Event{Kind: pubsub.KindLeave, UserID: userID, ChatID: chatID})
+}
+
+// DropChat stops all delivery for a deleted chat.
+func (h *Hub) DropChat(chatID int) {
+	h.publish(pubsub.Event{Kind: pubsub.KindDrop, ChatID: chatID})
+}
+
+// CloseSession disconnects every connection opened under a revoked session,
+// on whichever instance it is connected.
+func (h *Hub) CloseSession(sessionID string) {
+	h.publish(pubsub.Event{Kind: pubsub.KindCloseSession, SessionID: sessionID})
 }
@@ -0,0 +1,39 @@
+package ws
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pliu/chatty/internal/pubsub"
+)
+
+// BenchmarkHubFanOut measures dispatching one chat message on a hub holding
+// thousands of connections spread over many chats. With the subscription
+// index the cost depends on the chat's size, not on the connection count.
+func BenchmarkHubFanOut(b *testing.B) {
+	const membersPerChat = 10
+
+	for _, connections := range []int{1000, 5000, 20000} {
+		b.Run(fmt.Sprintf("connections=%d", connections), func(b *testing.B) {
+			hub := NewHub(nil)
+			for i := 0; i < connections; i++ {
+				client := &Client{hub: hub, send: make(chan []byte, 1), userID: i}
+				hub.addClient(client)
+				hub.attachChats(client, []int{i / membersPerChat})
+				hub.finishReplay(client, nil)
+			}
+
+			event := pubsub.Event{Kind: pubsub.KindChat, ChatID: 0, Frame: []byte(`{}`)}
+			members := hub.chats[0]
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				hub.dispatch(event)
+				for client := range members {
+					<-client.send
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
@@ -1,57 +1,890 @@
 package ws
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/pubsub"
+	"github.com/pliu/chatty/internal/store"
 	"github.com/pliu/chatty/internal/store/sqlstore"
 )
 
 func TestHubAuthorization(t *testing.T) {
 	// Setup in-memory DB
 	store, _ := sqlstore.New("sqlite3", ":memory:")
-	store.CreateUser(&models.User{Username: "user1", Password: "pass"})
-	store.CreateUser(&models.User{Username: "attacker", Password: "pass"})
+	store.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	store.CreateUser(&models.User{Username: "attacker", Email: "attacker@example.com", Password: "pass"})
 
 	user1, _ := store.GetUserByUsername("user1")
 	attacker, _ := store.GetUserByUsername("attacker")
 
 	chatID, _ := store.CreateChat("Secret Chat", user1.ID)
-	store.AddParticipant(int(chatID), user1.ID, "key")
+	store.AddParticipant(int(chatID), user1.ID, user1.ID, accountKey(t, store, user1.ID))
 
 	hub := NewHub(store)
 	go hub.Run()
 
 	// Attacker tries to send message
 	msg := Message{
-		ChatID:  int(chatID),
-		UserID:  attacker.ID,
-		Content: "Malicious Message",
+		ChatID:   int(chatID),
+		UserID:   attacker.ID,
+		Content:  "Malicious Message",
+		KeyEpoch: 1,
 	}
 
-	// Send message to broadcast channel
-	hub.broadcast <- msg
+	// Submit the message as if it came from a connection
+	hub.Submit(msg)
 
 	// Wait a bit for processing
 	time.Sleep(100 * time.Millisecond)
 
 	// Verify message was NOT saved
 	messages, _ := store.GetChatMessages(int(chatID))
-	if len(messages) != 0 {
+	if messages = userMessages(messages); len(messages) != 0 {
 		t.Error("Expected 0 messages, got", len(messages))
 	}
 
 	// Now add attacker to chat
-	store.AddParticipant(int(chatID), attacker.ID, "key")
+	store.AddParticipant(int(chatID), attacker.ID, attacker.ID, accountKey(t, store, attacker.ID))
 
 	// Send again
-	hub.broadcast <- msg
+	hub.Submit(msg)
 	time.Sleep(100 * time.Millisecond)
 
 	// Verify message WAS saved
 	messages, _ = store.GetChatMessages(int(chatID))
-	if len(messages) != 1 {
+	if messages = userMessages(messages); len(messages) != 1 {
 		t.Error("Expected 1 message, got", len(messages))
 	}
 }
+
+// userMessages leaves the system messages out of a chat's history.
+func userMessages(messages []models.Message) []models.Message {
+	var sent []models.Message
+	for _, m := range messages {
+		if m.Kind == models.MessageKindUser {
+			sent = append(sent, m)
+		}
+	}
+	return sent
+}
+
+// accountKey wraps a placeholder chat key for a user's account device.
+func accountKey(t *testing.T, s *sqlstore.SQLStore, userID int) map[int]string {
+	t.Helper()
+	device, err := s.GetAccountDevice(userID)
+	if err != nil {
+		t.Fatalf("Failed to get account device: %v", err)
+	}
+	return map[int]string{device.ID: "key"}
+}
+
+// readFrame waits for the next frame queued for a client. Presence frames,
+// which arrive whenever anyone in a shared chat connects, are skipped.
+func readFrame(t *testing.T, client *Client) Envelope {
+	t.Helper()
+	for {
+		select {
+		case raw := <-client.send:
+			var env Envelope
+			if err := json.Unmarshal(raw, &env); err != nil {
+				t.Fatalf("Failed to decode frame %s: %v", raw, err)
+			}
+			if env.V != ProtocolVersion {
+				t.Errorf("Expected protocol version %d, got %d", ProtocolVersion, env.V)
+			}
+			if env.Type == TypePresence || env.Type == TypePresenceSnapshot {
+				continue
+			}
+			return env
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for frame")
+		}
+		return Envelope{}
+	}
+}
+
+// expectNoFrame checks that nothing but presence frames reaches a client for
+// a short while.
+func expectNoFrame(t *testing.T, client *Client, reason string) {
+	t.Helper()
+	timeout := time.After(50 * time.Millisecond)
+	for {
+		select {
+		case raw := <-client.send:
+			var env Envelope
+			if json.Unmarshal(raw, &env); env.Type != TypePresence && env.Type != TypePresenceSnapshot {
+				t.Errorf("Expected %s, got %s", reason, raw)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func TestHubReplayOnReconnect(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	store.CreateUser(&models.User{Username: "user2", Email: "user2@example.com", Password: "pass"})
+	user1, _ := store.GetUserByUsername("user1")
+	user2, _ := store.GetUserByUsername("user2")
+
+	chatID, _ := store.CreateChat("Chat", user1.ID)
+	store.AddParticipant(int(chatID), user1.ID, user1.ID, accountKey(t, store, user1.ID))
+	seen, _, _ := store.SaveMessage(int(chatID), user1.ID, 1, 0, "seen", "", nil)
+	store.SaveMessage(int(chatID), user1.ID, 1, 0, "missed 1", "", nil)
+	store.AddParticipant(int(chatID), user2.ID, user1.ID, accountKey(t, store, user2.ID))
+	store.SaveMessage(int(chatID), user1.ID, 1, 0, "missed 2", "", nil)
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	client := &Client{hub: hub, send: make(chan []byte, sendBufferSize+maxReplayMessages), userID: user1.ID,
+		lastSeen: map[int]int{int(chatID): seen.ID}}
+	hub.connect(client)
+
+	// Changes to the chat are replayed in place among the messages
+	for _, want := range []string{"missed 1", models.EventMemberJoined, "missed 2"} {
+		env := readFrame(t, client)
+		var msg models.Message
+		json.Unmarshal(env.Payload, &msg)
+		got := msg.Content
+		if msg.Kind == models.MessageKindSystem {
+			got = msg.Event.Type
+		}
+		if env.Type != TypeMessage || got != want {
+			t.Errorf("Expected replayed %q, got %s %q", want, env.Type, got)
+		}
+	}
+
+	// Live delivery follows the replay
+	hub.Submit(Message{ChatID: int(chatID), UserID: user1.ID, Content: "live", KeyEpoch: 1})
+	env := readFrame(t, client)
+	var msg models.Message
+	json.Unmarshal(env.Payload, &msg)
+	if env.Type != TypeMessage || msg.Content != "live" || msg.ID == 0 {
+		t.Errorf("Expected live message with an ID, got %s %+v", env.Type, msg)
+	}
+}
+
+func TestHubReplayGap(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	user1, _ := store.GetUserByUsername("user1")
+
+	chatID, _ := store.CreateChat("Chat", user1.ID)
+	store.AddParticipant(int(chatID), user1.ID, user1.ID, accountKey(t, store, user1.ID))
+	seen, _, _ := store.SaveMessage(int(chatID), user1.ID, 1, 0, "seen", "", nil)
+	for i := 0; i <= maxReplayMessages; i++ {
+		store.SaveMessage(int(chatID), user1.ID, 1, 0, "missed", "", nil)
+	}
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	client := &Client{hub: hub, send: make(chan []byte, sendBufferSize+maxReplayMessages+1), userID: user1.ID,
+		lastSeen: map[int]int{int(chatID): seen.ID}}
+	hub.connect(client)
+
+	env := readFrame(t, client)
+	var gap ChatEvent
+	json.Unmarshal(env.Payload, &gap)
+	if env.Type != TypeReplayGap || gap.ChatID != int(chatID) {
+		t.Errorf("Expected replay_gap for chat %d, got %s %+v", chatID, env.Type, gap)
+	}
+}
+
+func TestHubAcksAndErrors(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "member", Email: "member@example.com", Password: "pass"})
+	store.CreateUser(&models.User{Username: "outsider", Email: "outsider@example.com", Password: "pass"})
+	member, _ := store.GetUserByUsername("member")
+	outsider, _ := store.GetUserByUsername("outsider")
+
+	chatID, _ := store.CreateChat("Chat", member.ID)
+	store.AddParticipant(int(chatID), member.ID, member.ID, accountKey(t, store, member.ID))
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	memberClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: member.ID}
+	outsiderClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: outsider.ID}
+	hub.connect(memberClient)
+	hub.connect(outsiderClient)
+
+	send := func(client *Client, id string, chatID int) {
+		payload, _ := json.Marshal(SendPayload{ChatID: chatID, Content: "hello", KeyEpoch: 1})
+		frame, _ := json.Marshal(Envelope{V: ProtocolVersion, Type: TypeSend, ID: id, Payload: payload})
+		client.handleFrame(frame)
+	}
+
+	send(memberClient, "client-1", int(chatID))
+	ack := readFrame(t, memberClient)
+	var ackPayload AckPayload
+	json.Unmarshal(ack.Payload, &ackPayload)
+	if ack.Type != TypeAck || ack.ID != "client-1" || ackPayload.MessageID == 0 || ackPayload.CreatedAt.IsZero() {
+		t.Errorf("Expected ack for client-1 with message ID and timestamp, got %s %s %+v", ack.Type, ack.ID, ackPayload)
+	}
+	if env := readFrame(t, memberClient); env.Type != TypeMessage {
+		t.Errorf("Expected broadcast message after ack, got %s", env.Type)
+	}
+
+	send(outsiderClient, "client-2", int(chatID))
+	rejected := readFrame(t, outsiderClient)
+	var errPayload ErrorPayload
+	json.Unmarshal(rejected.Payload, &errPayload)
+	if rejected.Type != TypeError || rejected.ID != "client-2" || errPayload.Code != ErrCodeForbidden {
+		t.Errorf("Expected forbidden error for client-2, got %s %s %+v", rejected.Type, rejected.ID, errPayload)
+	}
+
+	// After a rekey, sends encrypted under the old key are refused
+	store.RotateChatKey(int(chatID), 2, accountKey(t, store, member.ID))
+	send(memberClient, "client-3", int(chatID))
+	stale := readFrame(t, memberClient)
+	json.Unmarshal(stale.Payload, &errPayload)
+	if stale.Type != TypeError || stale.ID != "client-3" || errPayload.Code != ErrCodeStaleKeyEpoch {
+		t.Errorf("Expected stale_key_epoch error for client-3, got %s %s %+v", stale.Type, stale.ID, errPayload)
+	}
+
+	for _, tc := range []struct {
+		frame string
+		code  string
+	}{
+		{`not json`, ErrCodeBadRequest},
+		{`{"v":99,"type":"send","id":"x"}`, ErrCodeUnsupportedVersion},
+		{`{"v":1,"type":"send","payload":{"chat_id":1}}`, ErrCodeBadRequest},
+		{`{"v":1,"type":"bogus","id":"x"}`, ErrCodeBadRequest},
+	} {
+		memberClient.handleFrame([]byte(tc.frame))
+		env := readFrame(t, memberClient)
+		json.Unmarshal(env.Payload, &errPayload)
+		if env.Type != TypeError || errPayload.Code != tc.code {
+			t.Errorf("Frame %s: expected %s error, got %s %+v", tc.frame, tc.code, env.Type, errPayload)
+		}
+	}
+	// Read-only participants can't post either
+	store.AddParticipant(int(chatID), outsider.ID, outsider.ID, accountKey(t, store, outsider.ID))
+	store.SetParticipantRole(int(chatID), outsider.ID, outsider.ID, models.RoleReadOnly)
+	send(outsiderClient, "client-4", int(chatID))
+	readOnly := readFrame(t, outsiderClient)
+	json.Unmarshal(readOnly.Payload, &errPayload)
+	if readOnly.Type != TypeError || readOnly.ID != "client-4" || errPayload.Code != ErrCodeForbidden {
+		t.Errorf("Expected forbidden error for a read-only participant, got %s %s %+v", readOnly.Type, readOnly.ID, errPayload)
+	}
+}
+
+func TestHubDeduplicatesRetries(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "sender", Email: "sender@example.com", Password: "pass"})
+	store.CreateUser(&models.User{Username: "reader", Email: "reader@example.com", Password: "pass"})
+	sender, _ := store.GetUserByUsername("sender")
+	reader, _ := store.GetUserByUsername("reader")
+
+	chatID, _ := store.CreateChat("Chat", sender.ID)
+	store.AddParticipant(int(chatID), sender.ID, sender.ID, accountKey(t, store, sender.ID))
+	store.AddParticipant(int(chatID), reader.ID, reader.ID, accountKey(t, store, reader.ID))
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	senderClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: sender.ID}
+	readerClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: reader.ID}
+	hub.connect(senderClient)
+	hub.connect(readerClient)
+
+	msg := Message{ChatID: int(chatID), UserID: sender.ID, Content: "hello", KeyEpoch: 1, ClientMsgID: "flaky-1", sender: senderClient}
+	hub.Submit(msg)
+	first := readFrame(t, senderClient)
+	readFrame(t, senderClient) // The sender's own copy of the broadcast
+	if env := readFrame(t, readerClient); env.Type != TypeMessage {
+		t.Fatalf("Expected reader to receive the message, got %s", env.Type)
+	}
+
+	hub.Submit(msg)
+	retry := readFrame(t, senderClient)
+	var firstAck, retryAck AckPayload
+	json.Unmarshal(first.Payload, &firstAck)
+	json.Unmarshal(retry.Payload, &retryAck)
+	if retry.Type != TypeAck || !retryAck.Duplicate || retryAck.MessageID != firstAck.MessageID {
+		t.Errorf("Expected duplicate ack for message %d, got %s %+v", firstAck.MessageID, retry.Type, retryAck)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if len(readerClient.send) != 0 || len(senderClient.send) != 0 {
+		t.Error("Expected the retry not to be broadcast again")
+	}
+
+	messages, _ := store.GetChatMessages(int(chatID))
+	if messages = userMessages(messages); len(messages) != 1 {
+		t.Errorf("Expected 1 stored message, got %d", len(messages))
+	}
+}
+
+func TestHubsShareBroker(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	testHubsShareBroker(t, store, func() pubsub.Broker { return pubsub.NewLocal() })
+}
+
+// TestHubsSharePostgres runs two hubs with separate LISTEN/NOTIFY brokers
+// against one Postgres database, like two chatty instances would.
+func TestHubsSharePostgres(t *testing.T) {
+	dsn := os.Getenv("CHATTY_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("CHATTY_TEST_POSTGRES_DSN not set")
+	}
+	store, err := sqlstore.New("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Failed to connect to Postgres: %v", err)
+	}
+	testHubsShareBroker(t, store, func() pubsub.Broker {
+		broker, err := pubsub.NewPostgres(dsn)
+		if err != nil {
+			t.Fatalf("Failed to create Postgres broker: %v", err)
+		}
+		t.Cleanup(func() { broker.Close() })
+		return broker
+	})
+}
+
+func testHubsShareBroker(t *testing.T, store *sqlstore.SQLStore, newBroker func() pubsub.Broker) {
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	store.CreateUser(&models.User{Username: "alice", Email: "alice" + suffix + "@example.com", Password: "pass"})
+	store.CreateUser(&models.User{Username: "bob", Email: "bob" + suffix + "@example.com", Password: "pass"})
+	alice, _ := store.GetUserByEmail("alice" + suffix + "@example.com")
+	bob, _ := store.GetUserByEmail("bob" + suffix + "@example.com")
+
+	chatID, _ := store.CreateChat("Cross-node", alice.ID)
+	store.AddParticipant(int(chatID), alice.ID, alice.ID, accountKey(t, store, alice.ID))
+	store.AddParticipant(int(chatID), bob.ID, bob.ID, accountKey(t, store, bob.ID))
+
+	// With the local broker both hubs share one instance; with Postgres each
+	// gets its own listener, exactly as separate processes would.
+	var brokerA, brokerB pubsub.Broker
+	brokerA = newBroker()
+	if _, ok := brokerA.(*pubsub.Local); ok {
+		brokerB = brokerA
+	} else {
+		brokerB = newBroker()
+	}
+
+	hubA := NewHubWithBroker(store, brokerA)
+	hubB := NewHubWithBroker(store, brokerB)
+	go hubA.Run()
+	go hubB.Run()
+
+	aliceClient := &Client{hub: hubA, send: make(chan []byte, sendBufferSize), userID: alice.ID}
+	bobClient := &Client{hub: hubB, send: make(chan []byte, sendBufferSize), userID: bob.ID}
+	hubA.connect(aliceClient)
+	hubB.connect(bobClient)
+
+	hubA.Submit(Message{ChatID: int(chatID), UserID: alice.ID, Content: "hello from A", KeyEpoch: 1, sender: aliceClient})
+	if env := readFrame(t, aliceClient); env.Type != TypeAck {
+		t.Errorf("Expected ack on the sending node, got %s", env.Type)
+	}
+
+	env := readFrame(t, bobClient)
+	var msg models.Message
+	json.Unmarshal(env.Payload, &msg)
+	if env.Type != TypeMessage || msg.Content != "hello from A" {
+		t.Errorf("Expected message relayed to the other node, got %s %+v", env.Type, msg)
+	}
+
+	// Notifications raised on one node reach connections on the other.
+	hubA.SendNotification(bob.ID, TypeNewChat, ChatEvent{ChatID: int(chatID)})
+	if env := readFrame(t, bobClient); env.Type != TypeNewChat {
+		t.Errorf("Expected new_chat notification on the other node, got %s", env.Type)
+	}
+
+	// So do messages too large for a single NOTIFY.
+	large := strings.Repeat("x", 10000)
+	hubA.Submit(Message{ChatID: int(chatID), UserID: alice.ID, Content: large, KeyEpoch: 1, sender: aliceClient})
+	readFrame(t, aliceClient)
+	env = readFrame(t, bobClient)
+	msg = models.Message{}
+	json.Unmarshal(env.Payload, &msg)
+	if env.Type != TypeMessage || msg.Content != large {
+		t.Errorf("Expected the large message relayed to the other node, got %s with %d bytes", env.Type, len(msg.Content))
+	}
+}
+
+func TestHubLostFrame(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "owner", Email: "owner@example.com", Password: "pass"})
+	owner, _ := store.GetUserByUsername("owner")
+	chatID, _ := store.CreateChat("Chat", owner.ID)
+	store.AddParticipant(int(chatID), owner.ID, owner.ID, accountKey(t, store, owner.ID))
+
+	hub := NewHub(store)
+	go hub.Run()
+	client := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: owner.ID}
+	hub.connect(client)
+
+	// A chat event the broker couldn't carry in full tells members to reload
+	hub.publish(pubsub.Event{Kind: pubsub.KindChat, ChatID: int(chatID)})
+	env := readFrame(t, client)
+	var gap ChatEvent
+	json.Unmarshal(env.Payload, &gap)
+	if env.Type != TypeReplayGap || gap.ChatID != int(chatID) {
+		t.Errorf("Expected a replay_gap for chat %d, got %s %+v", chatID, env.Type, gap)
+	}
+}
+
+func TestHubSubscriptionIndex(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "owner", Email: "owner@example.com", Password: "pass"})
+	store.CreateUser(&models.User{Username: "guest", Email: "guest@example.com", Password: "pass"})
+	owner, _ := store.GetUserByUsername("owner")
+	guest, _ := store.GetUserByUsername("guest")
+
+	chatID, _ := store.CreateChat("Chat", owner.ID)
+	store.AddParticipant(int(chatID), owner.ID, owner.ID, accountKey(t, store, owner.ID))
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	guestClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: guest.ID}
+	hub.connect(guestClient)
+
+	expectDelivery := func(want bool, content string) {
+		t.Helper()
+		hub.Submit(Message{ChatID: int(chatID), UserID: owner.ID, Content: content, KeyEpoch: 1})
+		select {
+		case raw := <-guestClient.send:
+			if !want {
+				t.Errorf("Expected no delivery of %q, got %s", content, raw)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if want {
+				t.Errorf("Expected delivery of %q", content)
+			}
+		}
+	}
+
+	expectDelivery(false, "before invite")
+
+	store.AddParticipant(int(chatID), guest.ID, guest.ID, accountKey(t, store, guest.ID))
+	hub.Subscribe(guest.ID, int(chatID))
+	expectDelivery(true, "after invite")
+
+	store.RemoveParticipant(int(chatID), guest.ID, guest.ID)
+	hub.Unsubscribe(guest.ID, int(chatID))
+	expectDelivery(false, "after removal")
+
+	store.AddParticipant(int(chatID), guest.ID, guest.ID, accountKey(t, store, guest.ID))
+	hub.Subscribe(guest.ID, int(chatID))
+	hub.DropChat(int(chatID))
+	expectDelivery(false, "after delete")
+}
+
+func TestHubBroadcast(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "member", Email: "member@example.com", Password: "pass"})
+	store.CreateUser(&models.User{Username: "outsider", Email: "outsider@example.com", Password: "pass"})
+	member, _ := store.GetUserByUsername("member")
+	outsider, _ := store.GetUserByUsername("outsider")
+
+	chatID, _ := store.CreateChat("Chat", member.ID)
+	store.AddParticipant(int(chatID), member.ID, member.ID, accountKey(t, store, member.ID))
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	memberClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: member.ID}
+	outsiderClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: outsider.ID}
+	hub.connect(memberClient)
+	hub.connect(outsiderClient)
+
+	hub.Broadcast(int(chatID), TypeMessageDeleted, MessageDeletedEvent{ChatID: int(chatID), MessageID: 1, DeletedBy: member.ID})
+	env := readFrame(t, memberClient)
+	var event MessageDeletedEvent
+	json.Unmarshal(env.Payload, &event)
+	if env.Type != TypeMessageDeleted || event.MessageID != 1 {
+		t.Errorf("Expected message_deleted for message 1, got %s %+v", env.Type, event)
+	}
+	expectNoFrame(t, outsiderClient, "nothing for a non-participant")
+}
+
+func TestHubThreadReplies(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	for _, name := range []string{"author", "replier", "bystander"} {
+		store.CreateUser(&models.User{Username: name, Email: name + "@example.com", Password: "pass"})
+	}
+	author, _ := store.GetUserByUsername("author")
+	replier, _ := store.GetUserByUsername("replier")
+	bystander, _ := store.GetUserByUsername("bystander")
+
+	chatID, _ := store.CreateChat("Chat", author.ID)
+	for _, user := range []*models.User{author, replier, bystander} {
+		store.AddParticipant(int(chatID), user.ID, user.ID, accountKey(t, store, user.ID))
+	}
+	root, _, _ := store.SaveMessage(int(chatID), author.ID, 1, 0, "root", "", nil)
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	authorClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: author.ID}
+	replierClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: replier.ID}
+	bystanderClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: bystander.ID}
+	for _, c := range []*Client{authorClient, replierClient, bystanderClient} {
+		hub.connect(c)
+	}
+
+	hub.Submit(Message{ChatID: int(chatID), UserID: replier.ID, Content: "reply", KeyEpoch: 1, ReplyTo: root.ID, ClientMsgID: "reply-1", sender: replierClient})
+	if env := readFrame(t, replierClient); env.Type != TypeAck {
+		t.Fatalf("Expected ack for the reply, got %s", env.Type)
+	}
+
+	// Everyone sees the reply; only the thread's followers are told about it
+	for _, c := range []*Client{authorClient, replierClient, bystanderClient} {
+		env := readFrame(t, c)
+		var msg models.Message
+		json.Unmarshal(env.Payload, &msg)
+		if env.Type != TypeMessage || msg.ReplyTo != root.ID || msg.ThreadRootID != root.ID {
+			t.Errorf("Expected the reply in the chat, got %s %+v", env.Type, msg)
+		}
+	}
+	env := readFrame(t, authorClient)
+	var event ThreadReplyEvent
+	json.Unmarshal(env.Payload, &event)
+	if env.Type != TypeThreadReply || event.ThreadRootID != root.ID || event.ReplyCount != 1 || event.LastReplyAt == nil {
+		t.Errorf("Expected thread_reply with one reply, got %s %+v", env.Type, event)
+	}
+	for _, c := range []*Client{replierClient, bystanderClient} {
+		expectNoFrame(t, c, "no thread notification")
+	}
+
+	hub.Submit(Message{ChatID: int(chatID), UserID: replier.ID, Content: "orphan", KeyEpoch: 1, ReplyTo: root.ID + 100, ClientMsgID: "reply-2", sender: replierClient})
+	env = readFrame(t, replierClient)
+	var errPayload ErrorPayload
+	json.Unmarshal(env.Payload, &errPayload)
+	if env.Type != TypeError || errPayload.Code != ErrCodeBadRequest {
+		t.Errorf("Expected bad_request for a missing reply target, got %s %+v", env.Type, errPayload)
+	}
+}
+
+func TestHubReadReceipts(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "sender", Email: "sender@example.com", Password: "pass"})
+	store.CreateUser(&models.User{Username: "reader", Email: "reader@example.com", Password: "pass"})
+	sender, _ := store.GetUserByUsername("sender")
+	reader, _ := store.GetUserByUsername("reader")
+
+	chatID, _ := store.CreateChat("Chat", sender.ID)
+	store.AddParticipant(int(chatID), sender.ID, sender.ID, accountKey(t, store, sender.ID))
+	store.AddParticipant(int(chatID), reader.ID, reader.ID, accountKey(t, store, reader.ID))
+	first, _, _ := store.SaveMessage(int(chatID), sender.ID, 1, 0, "first", "", nil)
+	second, _, _ := store.SaveMessage(int(chatID), sender.ID, 1, 0, "second", "", nil)
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	senderClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: sender.ID}
+	readerClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: reader.ID}
+	hub.connect(senderClient)
+	hub.connect(readerClient)
+
+	read := func(messageID int) {
+		payload, _ := json.Marshal(ReadPayload{ChatID: int(chatID), MessageID: messageID})
+		frame, _ := json.Marshal(Envelope{V: ProtocolVersion, Type: TypeRead, Payload: payload})
+		readerClient.handleFrame(frame)
+	}
+
+	read(second.ID)
+	env := readFrame(t, senderClient)
+	var receipt models.ReadReceipt
+	json.Unmarshal(env.Payload, &receipt)
+	if env.Type != TypeReadReceipt || receipt.UserID != reader.ID || receipt.MessageID != second.ID {
+		t.Errorf("Expected a read receipt for the second message, got %s %+v", env.Type, receipt)
+	}
+	readFrame(t, readerClient)
+
+	// Going backwards is ignored
+	read(first.ID)
+	expectNoFrame(t, senderClient, "no receipt for an older message")
+	if chats, _ := store.GetUserChats(reader.ID, 0); chats[0].LastReadMessageID != second.ID || chats[0].UnreadCount != 0 {
+		t.Errorf("Expected the read pointer to stay on the second message, got %+v", chats[0])
+	}
+}
+
+func TestHubCloseSession(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "user1", Email: "user1@example.com", Password: "pass"})
+	user, _ := store.GetUserByUsername("user1")
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	revoked := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: user.ID, sessionID: "revoked"}
+	other := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: user.ID, sessionID: "other"}
+	hub.connect(revoked)
+	hub.connect(other)
+
+	hub.CloseSession("revoked")
+
+	select {
+	case _, ok := <-revoked.send:
+		if ok {
+			t.Error("Expected revoked client's send channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for revoked client to be closed")
+	}
+
+	// The user's other session stays connected
+	hub.SendNotification(user.ID, TypeNewChat, ChatEvent{ChatID: 1})
+	if env := readFrame(t, other); env.Type != TypeNewChat {
+		t.Errorf("Expected other session to keep receiving, got %s", env.Type)
+	}
+}
+
+func TestParseLastSeen(t *testing.T) {
+	lastSeen, err := parseLastSeen("1:10,2:20")
+	if err != nil {
+		t.Fatalf("parseLastSeen failed: %v", err)
+	}
+	if lastSeen[1] != 10 || lastSeen[2] != 20 {
+		t.Errorf("Unexpected result %v", lastSeen)
+	}
+
+	for _, bad := range []string{"1", "a:1", "1:b", "1:0"} {
+		if _, err := parseLastSeen(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+func TestServeWsLargeFrame(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "member", Email: "member@example.com", Password: "pass"})
+	member, _ := store.GetUserByUsername("member")
+	chatID, _ := store.CreateChat("Chat", member.ID)
+	store.AddParticipant(int(chatID), member.ID, member.ID, accountKey(t, store, member.ID))
+
+	var attachmentIDs []int
+	for i := 0; i < 3; i++ {
+		attachment := &models.Attachment{ChatID: int(chatID), UserID: member.ID, Size: 3, ContentType: "text/plain", ChunkSize: 4}
+		store.CreateAttachment(attachment, 1<<20)
+		store.AddAttachmentChunk(attachment.ID, 0, 3)
+		attachmentIDs = append(attachmentIDs, attachment.ID)
+	}
+
+	hub := NewHub(store)
+	go hub.Run()
+	dial := func() *websocket.Conn {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ServeWs(hub, w, r, &models.Session{ID: "session", UserID: member.ID}, time.Time{})
+		}))
+		t.Cleanup(server.Close)
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	send := func(conn *websocket.Conn, id string, content string) {
+		payload, _ := json.Marshal(SendPayload{ChatID: int(chatID), Content: content, KeyEpoch: 1, AttachmentIDs: attachmentIDs})
+		frame, _ := json.Marshal(Envelope{V: ProtocolVersion, Type: TypeSend, ID: id, Payload: payload})
+		if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+	}
+	next := func(conn *websocket.Conn) (Envelope, error) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			_, raw, err := conn.ReadMessage()
+			if err != nil {
+				return Envelope{}, err
+			}
+			var env Envelope
+			json.Unmarshal(raw, &env)
+			if env.Type != TypePresence && env.Type != TypePresenceSnapshot {
+				return env, nil
+			}
+		}
+	}
+
+	// An encrypted message of a few kilobytes with its attachments fits
+	conn := dial()
+	send(conn, "large", strings.Repeat("x", 4000))
+	if env, err := next(conn); err != nil || env.Type != TypeAck || env.ID != "large" {
+		t.Fatalf("Expected an ack for the large frame, got %+v (%v)", env, err)
+	}
+	env, _ := next(conn)
+	var msg models.Message
+	json.Unmarshal(env.Payload, &msg)
+	if env.Type != TypeMessage || len(msg.Attachments) != len(attachmentIDs) {
+		t.Errorf("Expected the message with its attachments, got %s %+v", env.Type, msg)
+	}
+
+	// Frames over the configured limit close the connection
+	hub.MaxMessageSize = 1024
+	conn = dial()
+	send(conn, "too-large", strings.Repeat("x", 2000))
+	if _, err := next(conn); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("Expected the connection to close for a frame over the limit, got %v", err)
+	}
+}
+
+// TestServeWsReplayWithPresence reconnects to a busy chat: the snapshot of
+// everyone online and a full replay must both fit before writePump starts.
+func TestServeWsReplayWithPresence(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "owner", Email: "owner@example.com", Password: "pass"})
+	owner, _ := store.GetUserByUsername("owner")
+	chatID, _ := store.CreateChat("Chat", owner.ID)
+	store.AddParticipant(int(chatID), owner.ID, owner.ID, accountKey(t, store, owner.ID))
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	// More chat-mates online than the send buffer's slack
+	const online = 300
+	var first *Client
+	for i := 0; i < online; i++ {
+		name := fmt.Sprintf("member%d", i)
+		store.CreateUser(&models.User{Username: name, Email: name + "@example.com", Password: "pass"})
+		member, _ := store.GetUserByUsername(name)
+		store.AddParticipant(int(chatID), member.ID, owner.ID, accountKey(t, store, member.ID))
+		client := &Client{hub: hub, send: make(chan []byte, 2*online), userID: member.ID}
+		hub.connect(client)
+		if first == nil {
+			first = client
+		}
+	}
+	// Wait until everyone after the first has been announced
+	for i := 1; i < online; i++ {
+		readPresence(t, first)
+	}
+
+	seen, _, _ := store.SaveMessage(int(chatID), owner.ID, 1, 0, "seen", "", nil)
+	for i := 0; i < maxReplayMessages; i++ {
+		store.SaveMessage(int(chatID), owner.ID, 1, 0, fmt.Sprintf("missed %d", i), "", nil)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r, &models.Session{ID: "session", UserID: owner.ID}, time.Time{})
+	}))
+	defer server.Close()
+	url := fmt.Sprintf("ws%s?last_seen=%d:%d", strings.TrimPrefix(server.URL, "http"), chatID, seen.ID)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	var snapshot PresenceSnapshotEvent
+	replayed := 0
+	for replayed < maxReplayMessages {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Connection closed after %d replayed messages: %v", replayed, err)
+		}
+		var env Envelope
+		json.Unmarshal(raw, &env)
+		switch env.Type {
+		case TypePresenceSnapshot:
+			json.Unmarshal(env.Payload, &snapshot)
+		case TypeMessage:
+			replayed++
+		case TypePresence:
+		default:
+			t.Fatalf("Unexpected %s frame during the replay: %s", env.Type, raw)
+		}
+	}
+	if len(snapshot.Users) != online {
+		t.Errorf("Expected a snapshot of %d chat-mates, got %d", online, len(snapshot.Users))
+	}
+}
+
+// TestHubConnectGaps drives the hub through a connection's loading steps by
+// hand, with events arriving between the queries and delivery.
+func TestHubConnectGaps(t *testing.T) {
+	hub := NewHub(nil)
+	client := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: 1}
+	hub.addClient(client)
+
+	// Membership changes while the chats load apply on top of what the
+	// query saw
+	hub.dispatch(pubsub.Event{Kind: pubsub.KindJoin, UserID: 1, ChatID: 3})
+	hub.dispatch(pubsub.Event{Kind: pubsub.KindLeave, UserID: 1, ChatID: 2})
+	hub.dispatch(pubsub.Event{Kind: pubsub.KindDrop, ChatID: 1})
+	hub.attachChats(client, []int{1, 2, 4})
+	if len(client.chats) != 2 || !client.chats[3] || !client.chats[4] || len(hub.chats[1]) != 0 {
+		t.Errorf("Expected chats 3 and 4, got %v", client.chats)
+	}
+
+	// A message dispatched while the replay loads follows it
+	hub.dispatch(pubsub.Event{Kind: pubsub.KindChat, ChatID: 3, Frame: encodeFrame(TypeMessage, "", models.Message{ID: 11, ChatID: 3})})
+	select {
+	case raw := <-client.send:
+		t.Fatalf("Expected the live message to be held back, got %s", raw)
+	default:
+	}
+	hub.finishReplay(client, [][]byte{encodeFrame(TypeMessage, "", models.Message{ID: 10, ChatID: 3})})
+	for _, want := range []int{10, 11} {
+		env := readFrame(t, client)
+		var msg models.Message
+		json.Unmarshal(env.Payload, &msg)
+		if msg.ID != want {
+			t.Errorf("Expected message %d, got %+v", want, msg)
+		}
+	}
+}
+
+// slowChatsStore signals loading once a client has registered and is
+// loading its chats, then holds GetUserChatIDs until release is closed.
+type slowChatsStore struct {
+	store.Store
+	loading chan struct{}
+	release chan struct{}
+}
+
+func (s *slowChatsStore) GetUserChatIDs(userID int) ([]int, error) {
+	s.loading <- struct{}{}
+	<-s.release
+	return s.Store.GetUserChatIDs(userID)
+}
+
+func TestHubConnectOffLoop(t *testing.T) {
+	db, _ := sqlstore.New("sqlite3", ":memory:")
+	db.CreateUser(&models.User{Username: "member", Email: "member@example.com", Password: "pass"})
+	member, _ := db.GetUserByUsername("member")
+	chatID, _ := db.CreateChat("Chat", member.ID)
+	db.AddParticipant(int(chatID), member.ID, member.ID, accountKey(t, db, member.ID))
+
+	slow := &slowChatsStore{Store: db, loading: make(chan struct{}), release: make(chan struct{})}
+	hub := NewHub(slow)
+	go hub.Run()
+
+	// A connection whose chats are slow to load doesn't hold up the others
+	waiting := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: member.ID}
+	connected := make(chan struct{})
+	go func() {
+		hub.connect(waiting)
+		close(connected)
+	}()
+	<-slow.loading
+
+	hub.SendNotification(member.ID, TypeNewChat, ChatEvent{ChatID: int(chatID)})
+	if env := readFrame(t, waiting); env.Type != TypeNewChat {
+		t.Errorf("Expected the hub to keep delivering while chats load, got %s", env.Type)
+	}
+
+	close(slow.release)
+	<-connected
+	hub.Submit(Message{ChatID: int(chatID), UserID: member.ID, Content: "hello", KeyEpoch: 1})
+	if env := readFrame(t, waiting); env.Type != TypeMessage {
+		t.Errorf("Expected chat messages once the chats loaded, got %s", env.Type)
+	}
+}
@@ -0,0 +1,192 @@
+package ws
+
+import (
+	"log"
+	"time"
+
+	"github.com/pliu/chatty/internal/pubsub"
+)
+
+// Presence statuses.
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusOffline = "offline"
+)
+
+// typingTimeout is how long a typing indicator lasts unless it is repeated.
+const typingTimeout = 5 * time.Second
+
+// typingSignal and statusSignal carry a client's typing and status frames to
+// the hub goroutine, which owns the client's membership and idle state.
+type typingSignal struct {
+	client  *Client
+	payload TypingPayload
+}
+
+type statusSignal struct {
+	client *Client
+	away   bool
+}
+
+// presence is what this hub knows about a user's connections across every
+// instance.
+type presence struct {
+	// Status reported by each instance the user is connected to.
+	instances map[string]string
+	// Chats whose members hear about the user, as of the latest report.
+	chatIDs []int
+	// Combined status last pushed to clients.
+	status string
+}
+
+// combined is online if any instance has an active connection, away if all
+// of them are idle and offline if there are none.
+func (p *presence) combined() string {
+	status := StatusOffline
+	for _, s := range p.instances {
+		if s == StatusOnline {
+			return StatusOnline
+		}
+		status = StatusAway
+	}
+	return status
+}
+
+// reportPresence publishes this instance's view of a user after one of their
+// connections came, went or changed idle state. chats are those of the
+// connection that changed, since it may have been the user's last one here.
+func (h *Hub) reportPresence(userID int, chats map[int]bool) {
+	status := StatusOffline
+	for client := range h.users[userID] {
+		if !client.away {
+			status = StatusOnline
+			break
+		}
+		status = StatusAway
+	}
+	if h.reported[userID] == status {
+		return
+	}
+
+	chatIDs := make(map[int]bool, len(chats))
+	for chatID := range chats {
+		chatIDs[chatID] = true
+	}
+	for client := range h.users[userID] {
+		for chatID := range client.chats {
+			chatIDs[chatID] = true
+		}
+	}
+	event := pubsub.Event{Kind: pubsub.KindPresence, UserID: userID, Instance: h.instance, Status: status}
+	for chatID := range chatIDs {
+		event.ChatIDs = append(event.ChatIDs, chatID)
+	}
+	h.publish(event)
+
+	if status != StatusOffline {
+		h.reported[userID] = status
+		return
+	}
+	delete(h.reported, userID)
+	// Keep the database write off the hub goroutine.
+	go func() {
+		if err := h.store.SetLastSeen(userID, time.Now().UTC()); err != nil {
+			log.Printf("Error recording last seen for user %d: %v", userID, err)
+		}
+	}()
+}
+
+// applyPresence folds an instance's report into the user's combined presence
+// and, if that changed, tells this instance's clients in the user's chats.
+func (h *Hub) applyPresence(event pubsub.Event) {
+	p, ok := h.presence[event.UserID]
+	if !ok {
+		p = &presence{instances: make(map[string]string)}
+		h.presence[event.UserID] = p
+	}
+	if event.Status == StatusOffline {
+		delete(p.instances, event.Instance)
+	} else {
+		p.instances[event.Instance] = event.Status
+	}
+	p.chatIDs = event.ChatIDs
+
+	status := p.combined()
+	if status == StatusOffline {
+		delete(h.presence, event.UserID)
+	}
+	if status == p.status {
+		return
+	}
+	p.status = status
+
+	payload := PresenceEvent{UserID: event.UserID, Status: status}
+	if status == StatusOffline {
+		now := time.Now().UTC()
+		payload.LastSeen = &now
+	}
+	frame := encodeFrame(TypePresence, "", payload)
+
+	// A client in several of the user's chats hears about it once.
+	notified := make(map[*Client]bool)
+	for _, chatID := range p.chatIDs {
+		for client := range h.chats[chatID] {
+			if !notified[client] {
+				notified[client] = true
+				h.deliver(client, frame)
+			}
+		}
+	}
+}
+
+// sendPresence tells a newly registered client who else is already around
+// in its chats; everyone else is offline, with their last-seen time
+// available over REST. It is one frame however many there are, so it fits
+// the send buffer alongside a full replay.
+func (h *Hub) sendPresence(client *Client) {
+	var snapshot PresenceSnapshotEvent
+	for userID, p := range h.presence {
+		if userID == client.userID {
+			continue
+		}
+		for _, chatID := range p.chatIDs {
+			if client.chats[chatID] {
+				snapshot.Users = append(snapshot.Users, PresenceEvent{UserID: userID, Status: p.status})
+				break
+			}
+		}
+	}
+	if len(snapshot.Users) > 0 {
+		h.deliver(client, encodeFrame(TypePresenceSnapshot, "", snapshot))
+	}
+}
+
+// relayTyping fans a typing frame out to the chat's members. Nothing is
+// stored; indicators lapse after typingTimeout unless the client repeats it.
+func (h *Hub) relayTyping(signal typingSignal) {
+	client := signal.client
+	if !h.clients[client] {
+		return
+	}
+	if !client.chats[signal.payload.ChatID] {
+		h.deliver(client, errorFrame("", ErrCodeForbidden, "not a participant of this chat"))
+		return
+	}
+
+	event := TypingEvent{ChatID: signal.payload.ChatID, UserID: client.userID, Typing: signal.payload.Typing}
+	if event.Typing {
+		event.ExpiresIn = int(typingTimeout / time.Millisecond)
+	}
+	h.Broadcast(event.ChatID, TypeUserTyping, event)
+}
+
+// setAway records whether a connection's user has gone idle on it.
+func (h *Hub) setAway(signal statusSignal) {
+	client := signal.client
+	if !h.clients[client] || client.away == signal.away {
+		return
+	}
+	client.away = signal.away
+	h.reportPresence(client.userID, client.chats)
+}
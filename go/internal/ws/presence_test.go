@@ -0,0 +1,273 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pliu/chatty/internal/models"
+	"github.com/pliu/chatty/internal/pubsub"
+	"github.com/pliu/chatty/internal/store/sqlstore"
+)
+
+// readPresence waits for the next presence frame queued for a client,
+// skipping any other frames.
+func readPresence(t *testing.T, client *Client) PresenceEvent {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case raw := <-client.send:
+			var env Envelope
+			json.Unmarshal(raw, &env)
+			if env.Type != TypePresence {
+				continue
+			}
+			var event PresenceEvent
+			json.Unmarshal(env.Payload, &event)
+			return event
+		case <-timeout:
+			t.Fatal("Timed out waiting for presence")
+			return PresenceEvent{}
+		}
+	}
+}
+
+// readSnapshot waits for the presence snapshot queued for a newly connected
+// client, skipping any other frames.
+func readSnapshot(t *testing.T, client *Client) []PresenceEvent {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case raw := <-client.send:
+			var env Envelope
+			json.Unmarshal(raw, &env)
+			if env.Type != TypePresenceSnapshot {
+				continue
+			}
+			var snapshot PresenceSnapshotEvent
+			json.Unmarshal(env.Payload, &snapshot)
+			return snapshot.Users
+		case <-timeout:
+			t.Fatal("Timed out waiting for a presence snapshot")
+			return nil
+		}
+	}
+}
+
+// expectNoPresence checks that no presence frame reaches a client for a
+// short while.
+func expectNoPresence(t *testing.T, client *Client) {
+	t.Helper()
+	timeout := time.After(50 * time.Millisecond)
+	for {
+		select {
+		case raw := <-client.send:
+			var env Envelope
+			if json.Unmarshal(raw, &env); env.Type == TypePresence {
+				t.Errorf("Expected no presence change, got %s", raw)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func sendFrame(client *Client, frameType string, payload interface{}) {
+	raw, _ := json.Marshal(payload)
+	frame, _ := json.Marshal(Envelope{V: ProtocolVersion, Type: frameType, Payload: raw})
+	client.handleFrame(frame)
+}
+
+func TestPresence(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	for _, name := range []string{"alice", "bob", "stranger"} {
+		store.CreateUser(&models.User{Username: name, Email: name + "@example.com", Password: "pass"})
+	}
+	alice, _ := store.GetUserByUsername("alice")
+	bob, _ := store.GetUserByUsername("bob")
+	stranger, _ := store.GetUserByUsername("stranger")
+
+	chatID, _ := store.CreateChat("Chat", alice.ID)
+	store.AddParticipant(int(chatID), alice.ID, alice.ID, accountKey(t, store, alice.ID))
+	store.AddParticipant(int(chatID), bob.ID, bob.ID, accountKey(t, store, bob.ID))
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	bobClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: bob.ID}
+	strangerClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: stranger.ID}
+	hub.connect(bobClient)
+	hub.connect(strangerClient)
+
+	laptop := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: alice.ID}
+	phone := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: alice.ID}
+	hub.connect(laptop)
+	for {
+		// Skip bob's own status
+		if event := readPresence(t, bobClient); event.UserID == alice.ID {
+			if event.Status != StatusOnline {
+				t.Errorf("Expected alice online, got %+v", event)
+			}
+			break
+		}
+	}
+
+	// A second connection, and idling on only one of them, changes nothing
+	hub.connect(phone)
+	sendFrame(laptop, TypeStatus, StatusPayload{Status: StatusAway})
+	expectNoPresence(t, bobClient)
+
+	sendFrame(phone, TypeStatus, StatusPayload{Status: StatusAway})
+	if event := readPresence(t, bobClient); event.UserID != alice.ID || event.Status != StatusAway {
+		t.Errorf("Expected alice away once idle everywhere, got %+v", event)
+	}
+
+	// Someone connecting later learns who is around
+	late := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: bob.ID}
+	hub.connect(late)
+	if users := readSnapshot(t, late); len(users) != 1 || users[0].UserID != alice.ID || users[0].Status != StatusAway {
+		t.Errorf("Expected a snapshot with alice away, got %+v", users)
+	}
+
+	hub.unregister <- phone
+	expectNoPresence(t, bobClient)
+	hub.unregister <- laptop
+	event := readPresence(t, bobClient)
+	if event.UserID != alice.ID || event.Status != StatusOffline || event.LastSeen == nil {
+		t.Errorf("Expected alice offline with a last-seen time, got %+v", event)
+	}
+	expectNoPresence(t, strangerClient)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		participants, _ := store.GetChatParticipants(int(chatID))
+		found := false
+		for _, p := range participants {
+			found = found || (p.ID == alice.ID && p.LastSeenAt != nil)
+		}
+		if found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected alice's last-seen time to be stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPresenceAcrossInstances(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "alice", Email: "alice@example.com", Password: "pass"})
+	store.CreateUser(&models.User{Username: "bob", Email: "bob@example.com", Password: "pass"})
+	alice, _ := store.GetUserByUsername("alice")
+	bob, _ := store.GetUserByUsername("bob")
+
+	chatID, _ := store.CreateChat("Chat", alice.ID)
+	store.AddParticipant(int(chatID), alice.ID, alice.ID, accountKey(t, store, alice.ID))
+	store.AddParticipant(int(chatID), bob.ID, bob.ID, accountKey(t, store, bob.ID))
+
+	broker := pubsub.NewLocal()
+	hubA := NewHubWithBroker(store, broker)
+	hubB := NewHubWithBroker(store, broker)
+	go hubA.Run()
+	go hubB.Run()
+
+	bobClient := &Client{hub: hubB, send: make(chan []byte, sendBufferSize), userID: bob.ID}
+	hubB.connect(bobClient)
+
+	// Alice is active on one instance and idle on the other
+	onA := &Client{hub: hubA, send: make(chan []byte, sendBufferSize), userID: alice.ID}
+	onB := &Client{hub: hubB, send: make(chan []byte, sendBufferSize), userID: alice.ID}
+	hubA.connect(onA)
+	for readPresence(t, bobClient).UserID != alice.ID {
+	}
+	hubB.connect(onB)
+	sendFrame(onB, TypeStatus, StatusPayload{Status: StatusAway})
+	expectNoPresence(t, bobClient)
+
+	hubA.unregister <- onA
+	if event := readPresence(t, bobClient); event.UserID != alice.ID || event.Status != StatusAway {
+		t.Errorf("Expected alice away once only her idle connection is left, got %+v", event)
+	}
+}
+
+func TestTyping(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	for _, name := range []string{"alice", "bob", "stranger"} {
+		store.CreateUser(&models.User{Username: name, Email: name + "@example.com", Password: "pass"})
+	}
+	alice, _ := store.GetUserByUsername("alice")
+	bob, _ := store.GetUserByUsername("bob")
+	stranger, _ := store.GetUserByUsername("stranger")
+
+	chatID, _ := store.CreateChat("Chat", alice.ID)
+	store.AddParticipant(int(chatID), alice.ID, alice.ID, accountKey(t, store, alice.ID))
+	store.AddParticipant(int(chatID), bob.ID, bob.ID, accountKey(t, store, bob.ID))
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	aliceClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: alice.ID}
+	bobClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: bob.ID}
+	strangerClient := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: stranger.ID}
+	hub.connect(aliceClient)
+	hub.connect(bobClient)
+	hub.connect(strangerClient)
+
+	sendFrame(aliceClient, TypeTyping, TypingPayload{ChatID: int(chatID), Typing: true})
+	env := readFrame(t, bobClient)
+	var event TypingEvent
+	json.Unmarshal(env.Payload, &event)
+	if env.Type != TypeUserTyping || event.UserID != alice.ID || !event.Typing || event.ExpiresIn != int(typingTimeout/time.Millisecond) {
+		t.Errorf("Expected alice typing with an expiry, got %s %+v", env.Type, event)
+	}
+	expectNoFrame(t, strangerClient, "no typing for a non-participant")
+
+	sendFrame(strangerClient, TypeTyping, TypingPayload{ChatID: int(chatID), Typing: true})
+	env = readFrame(t, strangerClient)
+	var errPayload ErrorPayload
+	json.Unmarshal(env.Payload, &errPayload)
+	if env.Type != TypeError || errPayload.Code != ErrCodeForbidden {
+		t.Errorf("Expected forbidden typing in someone else's chat, got %s %+v", env.Type, errPayload)
+	}
+	readFrame(t, aliceClient)
+	expectNoFrame(t, bobClient, "no typing from a non-participant")
+}
+
+// stuckBroker delivers nothing and holds every publish until it times out,
+// like a Postgres broker whose database has stopped answering.
+type stuckBroker struct {
+	*pubsub.Local
+}
+
+func (b stuckBroker) Publish(ctx context.Context, event pubsub.Event) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestHubDoesNotWaitOnBroker(t *testing.T) {
+	store, _ := sqlstore.New("sqlite3", ":memory:")
+	store.CreateUser(&models.User{Username: "member", Email: "member@example.com", Password: "pass"})
+	member, _ := store.GetUserByUsername("member")
+	chatID, _ := store.CreateChat("Chat", member.ID)
+	store.AddParticipant(int(chatID), member.ID, member.ID, accountKey(t, store, member.ID))
+
+	hub := NewHubWithBroker(store, stuckBroker{pubsub.NewLocal()})
+	go hub.Run()
+
+	// Connecting reports presence, and typing is relayed, from the hub
+	// loop; neither holds it up
+	client := &Client{hub: hub, send: make(chan []byte, sendBufferSize), userID: member.ID}
+	hub.connect(client)
+	client.handleFrame([]byte(`{"v":1,"type":"typing","payload":{"chat_id":` + strconv.Itoa(int(chatID)) + `,"typing":true}}`))
+	client.handleFrame([]byte(`{"v":1,"type":"typing","payload":{"chat_id":` + strconv.Itoa(int(chatID)) + `,"typing":false}}`))
+
+	client.handleFrame([]byte(`{"v":1,"type":"bogus","id":"x"}`))
+	if env := readFrame(t, client); env.Type != TypeError || env.ID != "x" {
+		t.Errorf("Expected the hub to answer while publishes are stuck, got %s %s", env.Type, env.ID)
+	}
+}
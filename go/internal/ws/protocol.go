@@ -0,0 +1,228 @@
+package ws
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ProtocolVersion is bumped on incompatible changes to the frame format.
+const ProtocolVersion = 1
+
+// Envelope wraps every WebSocket frame in both directions. ID is chosen by
+// the client for frames it sends and echoed back on the matching ack or error.
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Frame types sent by clients.
+const (
+	TypeSend   = "send"
+	TypeRead   = "read"
+	TypeTyping = "typing"
+	TypeStatus = "status"
+)
+
+// Frame types sent by the server.
+const (
+	TypeMessage          = "message"
+	TypeAck              = "ack"
+	TypeError            = "error"
+	TypeReplayGap        = "replay_gap"
+	TypeNewChat          = "new_chat"
+	TypeChatDeleted      = "chat_deleted"
+	TypeChatHidden       = "chat_hidden"
+	TypeParticipantLeft  = "participant_left"
+	TypeRemovedFromChat  = "removed_from_chat"
+	TypeRoleChanged      = "role_changed"
+	TypeOwnershipOffer   = "ownership_offer"
+	TypeOwnerChanged     = "owner_changed"
+	TypeJoinRequest      = "join_request"
+	TypeJoinResolved     = "join_request_resolved"
+	TypeRekeyRequired    = "rekey_required"
+	TypeKeyRotated       = "key_rotated"
+	TypeMessageEdited    = "message_edited"
+	TypeMessageDeleted   = "message_deleted"
+	TypeThreadReply      = "thread_reply"
+	TypeReactionAdded    = "reaction_added"
+	TypeReactionRemoved  = "reaction_removed"
+	TypeMessagePinned    = "message_pinned"
+	TypeMessageUnpinned  = "message_unpinned"
+	TypeReadReceipt      = "read_receipt"
+	TypeUserTyping       = "user_typing"
+	TypePresence         = "presence"
+	TypePresenceSnapshot = "presence_snapshot"
+)
+
+// Reason codes carried by error frames.
+const (
+	ErrCodeBadRequest         = "bad_request"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeInternal           = "internal"
+	ErrCodeStaleKeyEpoch      = "stale_key_epoch"
+)
+
+// SendPayload is the payload of a client's send frame.
+type SendPayload struct {
+	ChatID        int    `json:"chat_id"`
+	Content       string `json:"content"`
+	KeyEpoch      int    `json:"key_epoch"`                // Epoch of the chat key Content is encrypted under
+	ReplyTo       int    `json:"reply_to,omitempty"`       // Message this one answers, if any
+	AttachmentIDs []int  `json:"attachment_ids,omitempty"` // Uploaded attachments sent with the message
+}
+
+// ReadPayload is the payload of a client's read frame, moving its read
+// pointer in a chat forward.
+type ReadPayload struct {
+	ChatID    int `json:"chat_id"`
+	MessageID int `json:"message_id"`
+}
+
+// TypingPayload is the payload of a client's typing frame. Clients repeat
+// it while the user keeps typing, since indicators expire on their own.
+type TypingPayload struct {
+	ChatID int  `json:"chat_id"`
+	Typing bool `json:"typing"`
+}
+
+// StatusPayload is the payload of a client's status frame, reporting whether
+// the user has gone idle on that connection.
+type StatusPayload struct {
+	Status string `json:"status"` // StatusOnline or StatusAway
+}
+
+// AckPayload confirms a send frame was persisted. Duplicate is set when the
+// frame was a retry of a send that had already been saved.
+type AckPayload struct {
+	MessageID int       `json:"message_id"`
+	ChatID    int       `json:"chat_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Duplicate bool      `json:"duplicate,omitempty"`
+}
+
+// ErrorPayload explains why a client frame was rejected.
+type ErrorPayload struct {
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// ChatEvent is the payload of notifications about a whole chat.
+type ChatEvent struct {
+	ChatID int `json:"chat_id"`
+}
+
+// ParticipantEvent is the payload of notifications about one member of a chat.
+type ParticipantEvent struct {
+	ChatID int `json:"chat_id"`
+	UserID int `json:"user_id"`
+}
+
+// RoleChangedEvent tells members that one of them has a new role.
+type RoleChangedEvent struct {
+	ChatID int    `json:"chat_id"`
+	UserID int    `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+// OwnershipOfferEvent tells a chat's owner and the participant they offered
+// it to that the offer was made, or withdrawn or declined when
+// PendingOwnerID is zero.
+type OwnershipOfferEvent struct {
+	ChatID         int `json:"chat_id"`
+	OwnerID        int `json:"owner_id"`
+	PendingOwnerID int `json:"pending_owner_id"`
+}
+
+// OwnerChangedEvent tells members that their chat has a new owner. Reason
+// is the audit log action: a transfer or succession.
+type OwnerChangedEvent struct {
+	ChatID          int    `json:"chat_id"`
+	OwnerID         int    `json:"owner_id"`
+	PreviousOwnerID int    `json:"previous_owner_id"`
+	Reason          string `json:"reason"`
+}
+
+// JoinResolvedEvent tells a joiner, and the members who could have let
+// them in, whether their join request was approved or rejected.
+type JoinResolvedEvent struct {
+	ChatID   int  `json:"chat_id"`
+	UserID   int  `json:"user_id"`
+	Approved bool `json:"approved"`
+}
+
+// KeyRotatedEvent tells members that a chat moved to a new key epoch; they
+// fetch their wrapped copy of the new key before sending again.
+type KeyRotatedEvent struct {
+	ChatID   int `json:"chat_id"`
+	KeyEpoch int `json:"key_epoch"`
+}
+
+// MessageDeletedEvent tells members that a message became a tombstone.
+// DeletedBy is the sender, or the chat owner or admin who removed it.
+type MessageDeletedEvent struct {
+	ChatID    int `json:"chat_id"`
+	MessageID int `json:"message_id"`
+	DeletedBy int `json:"deleted_by"`
+}
+
+// ThreadReplyEvent tells the followers of a thread that someone replied,
+// with the root's updated reply count and last reply time.
+type ThreadReplyEvent struct {
+	ChatID       int        `json:"chat_id"`
+	ThreadRootID int        `json:"thread_root_id"`
+	MessageID    int        `json:"message_id"`
+	ReplyCount   int        `json:"reply_count"`
+	LastReplyAt  *time.Time `json:"last_reply_at,omitempty"`
+}
+
+// ReactionEvent tells members that someone added or removed a reaction.
+type ReactionEvent struct {
+	ChatID    int    `json:"chat_id"`
+	MessageID int    `json:"message_id"`
+	UserID    int    `json:"user_id"`
+	Reaction  string `json:"reaction"`
+}
+
+// PinEvent tells members that someone pinned or unpinned a message.
+type PinEvent struct {
+	ChatID    int `json:"chat_id"`
+	MessageID int `json:"message_id"`
+	UserID    int `json:"user_id"`
+}
+
+// TypingEvent tells members that someone started or stopped typing. Clients
+// drop the indicator after ExpiresIn unless it is repeated.
+type TypingEvent struct {
+	ChatID    int  `json:"chat_id"`
+	UserID    int  `json:"user_id"`
+	Typing    bool `json:"typing"`
+	ExpiresIn int  `json:"expires_in_ms,omitempty"`
+}
+
+// PresenceEvent tells users who share a chat with someone that their
+// presence changed. LastSeen is set when they go offline.
+type PresenceEvent struct {
+	UserID   int        `json:"user_id"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// PresenceSnapshotEvent tells a newly connected client, in a single frame,
+// who is already around in its chats.
+type PresenceSnapshotEvent struct {
+	Users []PresenceEvent `json:"users"`
+}
+
+// encodeFrame builds an outbound frame.
+func encodeFrame(frameType, id string, payload interface{}) []byte {
+	raw, _ := json.Marshal(payload)
+	frame, _ := json.Marshal(Envelope{V: ProtocolVersion, Type: frameType, ID: id, Payload: raw})
+	return frame
+}
+
+func errorFrame(id, code, reason string) []byte {
+	return encodeFrame(TypeError, id, ErrorPayload{Code: code, Reason: reason})
+}
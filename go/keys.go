@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+
+	"github.com/pliu/chatty/internal/auth"
+)
+
+const keysUsage = "usage: chatty [flags] keys rotate [-keep n]|list"
+
+// loadKeyring installs the cookie signing keys from the environment or the
+// key file. Without either, cookies are signed with a throwaway key and every
+// session ends when the server restarts.
+func loadKeyring() {
+	var kr *auth.Keyring
+	var err error
+	if env := os.Getenv(auth.KeysEnvVar); env != "" {
+		kr, err = auth.ParseKeyring(env)
+	} else {
+		kr, err = auth.LoadKeyring(*keysFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("No cookie signing keys in $%s or %s; using a temporary key. Run `chatty keys rotate` to create one.", auth.KeysEnvVar, *keysFile)
+			return
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := auth.SetKeyring(kr); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runKeys implements `chatty keys rotate [-keep n]|list` against the key file.
+func runKeys(args []string) {
+	if len(args) == 0 {
+		log.Fatal(keysUsage)
+	}
+
+	switch args[0] {
+	case "rotate":
+		flags := flag.NewFlagSet("rotate", flag.ExitOnError)
+		keep := flags.Int("keep", 2, "number of keys to keep active, including the new one")
+		flags.Parse(args[1:])
+
+		kr, err := auth.LoadKeyring(*keysFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			kr, err = &auth.Keyring{}, nil
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		key, retired, err := kr.Rotate(*keep)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := kr.Save(*keysFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Generated signing key %s in %s", key.ID, *keysFile)
+		for _, k := range retired {
+			log.Printf("Retired key %s; cookies it signed are no longer accepted", k.ID)
+		}
+		log.Print("Restart every instance to pick up the new keys")
+	case "list":
+		kr, err := auth.LoadKeyring(*keysFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i, k := range kr.Keys {
+			role := "verify"
+			if i == 0 {
+				role = "sign"
+			}
+			fmt.Fprintf(os.Stdout, "%s  %-6s created %s\n", k.ID, role, k.CreatedAt.Format("2006-01-02 15:04:05"))
+		}
+	default:
+		log.Fatal(keysUsage)
+	}
+}
@@ -6,14 +6,16 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/pliu/chatty/internal/auth"
+	"github.com/pliu/chatty/internal/blob"
 	"github.com/pliu/chatty/internal/email"
 	"github.com/pliu/chatty/internal/handlers"
 	"github.com/pliu/chatty/internal/middleware"
+	"github.com/pliu/chatty/internal/pubsub"
 	"github.com/pliu/chatty/internal/store/sqlstore"
 	"github.com/pliu/chatty/internal/ws"
 )
@@ -32,40 +34,138 @@ var smtpUsername = flag.String("smtp-username", "", "SMTP username")
 var smtpPassword = flag.String("smtp-password", "", "SMTP password")
 var emailFrom = flag.String("email-from", "noreply@chatty.com", "From email address")
 
+// Database flags
+var dbDriver = flag.String("db-driver", "postgres", "database driver (postgres or sqlite3)")
+var dbDSN = flag.String("db-dsn", "user=user password=password dbname=chatty sslmode=disable host=localhost port=5432", "database connection string")
+
+// Session flags
+var sessionIdleTimeout = flag.Duration("session-idle-timeout", 7*24*time.Hour, "end sessions unused for this long")
+var sessionAbsoluteTimeout = flag.Duration("session-absolute-timeout", 30*24*time.Hour, "end sessions this long after login")
+var keysFile = flag.String("keys-file", "cookie_keys.json", "cookie signing key file, used unless $CHATTY_COOKIE_KEYS is set")
+
+// Attachment flags; S3 credentials come from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY
+var blobBackend = flag.String("blob-store", "fs", "attachment blob store (fs or s3)")
+var blobDir = flag.String("blob-dir", "attachments", "directory for the fs blob store")
+var s3Endpoint = flag.String("s3-endpoint", "", "S3-compatible endpoint URL, e.g. https://s3.us-east-1.amazonaws.com")
+var s3Region = flag.String("s3-region", "us-east-1", "S3 region")
+var s3Bucket = flag.String("s3-bucket", "chatty-attachments", "S3 bucket")
+var attachmentMaxSize = flag.Int64("attachment-max-size", handlers.DefaultAttachmentLimits.MaxSize, "largest attachment in bytes")
+var attachmentQuota = flag.Int64("attachment-quota", handlers.DefaultAttachmentLimits.Quota, "attachment storage per user in bytes")
+var attachmentChunkSize = flag.Int64("attachment-chunk-size", handlers.DefaultAttachmentLimits.ChunkSize, "attachment upload chunk size in bytes")
+var wsMaxMessageSize = flag.Int64("ws-max-message-size", ws.DefaultMaxMessageSize, "largest WebSocket frame a client may send in bytes")
+
+var pubsubBackend = flag.String("pubsub", "", "hub pub/sub backend (local or postgres); defaults to postgres when -db-driver is postgres")
+
 func main() {
 	flag.Parse()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	if flag.Arg(0) == "migrate" {
+		runMigrate(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "keys" {
+		runKeys(flag.Args()[1:])
+		return
+	}
+
 	if *baseURL == "" {
 		log.Fatal("Base URL must be set via -base-url flag")
 	}
 
 	// Initialize Database
-	// Connect to Postgres (running via docker-compose)
-	connStr := "user=user password=password dbname=chatty sslmode=disable host=localhost port=5432"
-	store, err := sqlstore.New("postgres", connStr)
-	// store, err := sqlstore.New("sqlite3", "chatty.db")
+	// Defaults to Postgres (running via docker-compose); pending migrations are
+	// applied on startup.
+	store, err := sqlstore.New(*dbDriver, *dbDSN)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// Initialize WebSocket Hub
-	hub := ws.NewHub(store)
+	// With the Postgres backend, several instances can share one database and
+	// deliver each other's messages.
+	backend := *pubsubBackend
+	if backend == "" {
+		backend = "local"
+		if *dbDriver == "postgres" {
+			backend = "postgres"
+		}
+	}
+	var broker pubsub.Broker
+	switch backend {
+	case "local":
+		broker = pubsub.NewLocal()
+	case "postgres":
+		broker, err = pubsub.NewPostgres(*dbDSN)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Unknown pub/sub backend %q", backend)
+	}
+	hub := ws.NewHubWithBroker(store, broker)
+	if *wsMaxMessageSize <= 0 {
+		log.Fatal("WebSocket max message size must be positive")
+	}
+	hub.MaxMessageSize = *wsMaxMessageSize
 	go hub.Run()
 
+	// Initialize Attachment Storage
+	var blobs blob.Store
+	switch *blobBackend {
+	case "fs":
+		blobs, err = blob.NewFS(*blobDir)
+	case "s3":
+		blobs, err = blob.NewS3(blob.S3Config{
+			Endpoint:  *s3Endpoint,
+			Region:    *s3Region,
+			Bucket:    *s3Bucket,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+	default:
+		log.Fatalf("Unknown blob store %q", *blobBackend)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *attachmentChunkSize <= 0 {
+		log.Fatal("Attachment chunk size must be positive")
+	}
+
 	// Initialize Email Sender
 	var emailSender *email.Sender
 	if *smtpHost != "" {
 		emailSender = email.NewSender(*smtpHost, *smtpPort, *smtpUsername, *smtpPassword, *emailFrom)
 	}
 
+	// Initialize Sessions; revoking one also drops its live WebSockets
+	loadKeyring()
+	sessions := auth.NewSessionManager(store)
+	sessions.IdleTimeout = *sessionIdleTimeout
+	sessions.AbsoluteTimeout = *sessionAbsoluteTimeout
+	sessions.OnRevoke(hub.CloseSession)
+	authMiddleware := middleware.NewAuthMiddleware(sessions)
+
 	// Initialize Handlers
 	authHandler := &handlers.AuthHandler{
 		Store:       store,
+		Sessions:    sessions,
 		BaseURL:     *baseURL,
 		EmailSender: emailSender,
+		Hub:         hub,
+	}
+	chatHandler := &handlers.ChatHandler{
+		Store: store,
+		Hub:   hub,
+		Blobs: blobs,
+		Attachments: handlers.AttachmentLimits{
+			MaxSize:   *attachmentMaxSize,
+			Quota:     *attachmentQuota,
+			ChunkSize: *attachmentChunkSize,
+		},
 	}
-	chatHandler := &handlers.ChatHandler{Store: store, Hub: hub}
+	deviceHandler := &handlers.DeviceHandler{Store: store, Sessions: sessions, Hub: hub}
 
 	r := mux.NewRouter()
 	r.Use(middleware.LoggingMiddleware)
@@ -74,38 +174,89 @@ func main() {
 	r.HandleFunc("/signup", authHandler.Signup).Methods("POST")
 	r.HandleFunc("/verify", authHandler.VerifyEmail).Methods("GET")
 	r.HandleFunc("/login", authHandler.Login).Methods("POST")
+	r.HandleFunc("/password/forgot", authHandler.ForgotPassword).Methods("POST")
+	r.HandleFunc("/password/reset", authHandler.ResetPassword).Methods("POST")
 	r.HandleFunc("/users/search", authHandler.SearchUsers).Methods("GET")
+	r.Handle("/logout", authMiddleware(http.HandlerFunc(authHandler.Logout))).Methods("POST")
+	r.Handle("/account/deactivate", authMiddleware(http.HandlerFunc(authHandler.DeactivateAccount))).Methods("POST")
+
+	// Session routes (protected)
+	sessionRouter := r.PathPrefix("/sessions").Subrouter()
+	sessionRouter.Use(authMiddleware)
+	sessionRouter.HandleFunc("", authHandler.GetSessions).Methods("GET")
+	sessionRouter.HandleFunc("/{id}", authHandler.RevokeSession).Methods("DELETE")
+
+	// Device routes (protected)
+	deviceRouter := r.PathPrefix("/devices").Subrouter()
+	deviceRouter.Use(authMiddleware)
+	deviceRouter.HandleFunc("", deviceHandler.RegisterDevice).Methods("POST")
+	deviceRouter.HandleFunc("", deviceHandler.GetDevices).Methods("GET")
+	deviceRouter.HandleFunc("/{id}", deviceHandler.RevokeDevice).Methods("DELETE")
+	deviceRouter.HandleFunc("/{id}/keys", deviceHandler.AddDeviceKeys).Methods("PUT")
 
 	// Chat routes (protected)
 	chatRouter := r.PathPrefix("/chats").Subrouter()
-	chatRouter.Use(middleware.AuthMiddleware)
+	chatRouter.Use(authMiddleware)
 	chatRouter.HandleFunc("", chatHandler.CreateChat).Methods("POST")
 	chatRouter.HandleFunc("", chatHandler.GetChats).Methods("GET")
 	chatRouter.HandleFunc("/{id}/invite", chatHandler.InviteUser).Methods("POST")
 	chatRouter.HandleFunc("/{id}/messages", chatHandler.GetChatMessages).Methods("GET")
+	chatRouter.HandleFunc("/{id}/messages/{messageID}", chatHandler.EditMessage).Methods("PATCH")
+	chatRouter.HandleFunc("/{id}/messages/{messageID}", chatHandler.DeleteMessage).Methods("DELETE")
+	chatRouter.HandleFunc("/{id}/messages/{messageID}/edits", chatHandler.GetMessageEdits).Methods("GET")
+	chatRouter.HandleFunc("/{id}/messages/{messageID}/reactions", chatHandler.AddReaction).Methods("POST")
+	chatRouter.HandleFunc("/{id}/messages/{messageID}/reactions", chatHandler.RemoveReaction).Methods("DELETE")
+	chatRouter.HandleFunc("/{id}/pins", chatHandler.GetPinnedMessages).Methods("GET")
+	chatRouter.HandleFunc("/{id}/pins/{messageID}", chatHandler.PinMessage).Methods("POST")
+	chatRouter.HandleFunc("/{id}/pins/{messageID}", chatHandler.UnpinMessage).Methods("DELETE")
+	chatRouter.HandleFunc("/{id}/attachments", chatHandler.CreateAttachment).Methods("POST")
+	chatRouter.HandleFunc("/{id}/attachments/{attachmentID}", chatHandler.GetAttachment).Methods("GET")
+	chatRouter.HandleFunc("/{id}/attachments/{attachmentID}", chatHandler.DeleteAttachment).Methods("DELETE")
+	chatRouter.HandleFunc("/{id}/attachments/{attachmentID}/chunks/{chunk}", chatHandler.UploadChunk).Methods("PUT")
+	chatRouter.HandleFunc("/{id}/attachments/{attachmentID}/content", chatHandler.DownloadAttachment).Methods("GET")
+	chatRouter.HandleFunc("/{id}/threads/{messageID}", chatHandler.GetThread).Methods("GET")
+	chatRouter.HandleFunc("/{id}/read", chatHandler.MarkRead).Methods("POST")
+	chatRouter.HandleFunc("/{id}/receipts", chatHandler.GetReadReceipts).Methods("GET")
 	chatRouter.HandleFunc("/{id}/participants", chatHandler.GetChatParticipants).Methods("GET")
+	chatRouter.HandleFunc("/{id}/keys", chatHandler.GetChatKeys).Methods("GET")
+	chatRouter.HandleFunc("/{id}/keys", chatHandler.RotateChatKey).Methods("POST")
 	chatRouter.HandleFunc("/{id}/leave", chatHandler.LeaveChat).Methods("DELETE")
+	chatRouter.HandleFunc("/{id}/hide", chatHandler.HideChat).Methods("POST")
 	chatRouter.HandleFunc("/{id}/participants/{userID}", chatHandler.RemoveParticipant).Methods("DELETE")
+	chatRouter.HandleFunc("/{id}/participants/{userID}/role", chatHandler.ChangeRole).Methods("PUT")
+	chatRouter.HandleFunc("/{id}/invites", chatHandler.GetInvites).Methods("GET")
+	chatRouter.HandleFunc("/{id}/invites", chatHandler.CreateInvite).Methods("POST")
+	chatRouter.HandleFunc("/{id}/invites/{code}", chatHandler.RevokeInvite).Methods("DELETE")
+	chatRouter.HandleFunc("/{id}/join-requests", chatHandler.GetJoinRequests).Methods("GET")
+	chatRouter.HandleFunc("/{id}/join-requests/{userID}", chatHandler.ApproveJoinRequest).Methods("POST")
+	chatRouter.HandleFunc("/{id}/join-requests/{userID}", chatHandler.RejectJoinRequest).Methods("DELETE")
+	chatRouter.HandleFunc("/{id}/transfer", chatHandler.OfferOwnership).Methods("POST")
+	chatRouter.HandleFunc("/{id}/transfer", chatHandler.CancelOwnershipOffer).Methods("DELETE")
+	chatRouter.HandleFunc("/{id}/transfer/accept", chatHandler.AcceptOwnership).Methods("POST")
+	chatRouter.HandleFunc("/{id}/audit", chatHandler.GetAuditLog).Methods("GET")
+	chatRouter.HandleFunc("/{id}", chatHandler.UpdateChat).Methods("PATCH")
 	chatRouter.HandleFunc("/{id}", chatHandler.DeleteChat).Methods("DELETE")
 
+	// Direct chat routes (protected)
+	dmRouter := r.PathPrefix("/dms").Subrouter()
+	dmRouter.Use(authMiddleware)
+	dmRouter.HandleFunc("", chatHandler.OpenDirectChat).Methods("POST")
+
+	// Invite link routes (protected)
+	inviteRouter := r.PathPrefix("/invites").Subrouter()
+	inviteRouter.Use(authMiddleware)
+	inviteRouter.HandleFunc("/{code}", chatHandler.PreviewInvite).Methods("GET")
+	inviteRouter.HandleFunc("/{code}/accept", chatHandler.AcceptInvite).Methods("POST")
+
 	// WebSocket Endpoint
 	r.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		// Get user ID from cookie
-		cookie, err := r.Cookie("user_id")
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		// Parse user ID
-		userIDStr, err := auth.VerifyCookie(cookie.Value)
+		session, err := sessions.Authenticate(r)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		userID, _ := strconv.Atoi(userIDStr)
 
-		ws.ServeWs(hub, w, r, userID)
+		ws.ServeWs(hub, w, r, session, sessions.ExpiresAt(session))
 	})
 
 	// Serve index.html with cache-busting timestamp
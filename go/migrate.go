@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/pliu/chatty/internal/store/sqlstore"
+)
+
+const migrateUsage = "usage: chatty [flags] migrate up|down [steps]|status"
+
+// runMigrate implements `chatty migrate up|down [steps]|status`.
+func runMigrate(args []string) {
+	if len(args) == 0 {
+		log.Fatal(migrateUsage)
+	}
+
+	db, err := sql.Open(*dbDriver, *dbDSN)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	migrator, err := sqlstore.NewMigrator(db, *dbDriver)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		if err := migrator.Up(ctx); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Database migrated to version %d", migrator.Latest())
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("invalid step count %q", args[1])
+			}
+		}
+		if err := migrator.Down(ctx, steps); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Reverted %d migration(s)", steps)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.Applied {
+				applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(os.Stdout, "%04d  %-30s %s\n", s.Version, s.Name, applied)
+		}
+		if err := migrator.CheckVersion(ctx); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatal(migrateUsage)
+	}
+}
@@ -2,12 +2,54 @@ let currentUser = null;
 let currentUserID = null;
 let currentChat = null;
 let ws = null;
+let olderMessagesCursor = null; // Cursor for the next page of older history
+let loadingOlderMessages = false;
+const WS_PROTOCOL_VERSION = 1;
+let pendingSends = {}; // Map client message ID -> serialized send frame, awaiting ack
+let lastSeenMessageIDs = {}; // Map chatID -> newest message ID received, for replay on reconnect
+let replyingTo = null; // Message the composer is replying to, if any
+let pendingAttachment = null; // {id, name} of an uploaded attachment the composer will send
+let messageReactions = {}; // Map message ID -> [{reaction, count, user_ids}] for messages on screen
+let unreadCounts = {}; // Map chat ID -> messages from others not yet read
+let readReceipts = {}; // Map user ID -> newest message ID they've read, for the current chat
+let participantNames = {}; // Map user ID -> username, for the current chat
+let presence = {}; // Map user ID -> {status, last_seen} for people we share a chat with
+let typingUsers = {}; // Map user ID -> timer clearing their typing indicator in the current chat
+let lastTypingSent = 0; // When we last told the current chat we're typing
+let idleTimer = null;
+const IDLE_TIMEOUT_MS = 2 * 60 * 1000;
+const TYPING_REPEAT_MS = 3000;
+
+// What each role may do in a group chat, mirroring the server's policy.
+// Either member of a direct chat may post, pin and rekey, and nothing else.
+const ROLE_PERMISSIONS = {
+    owner: ['invite', 'manage_invites', 'remove', 'rename', 'delete', 'post', 'pin', 'moderate', 'change_role', 'rekey', 'transfer', 'view_audit'],
+    admin: ['invite', 'manage_invites', 'remove', 'rename', 'post', 'pin', 'moderate', 'change_role', 'view_audit', 'leave'],
+    member: ['invite', 'post', 'pin', 'leave'],
+    read_only: ['leave'],
+};
+const DIRECT_PERMISSIONS = ['post', 'pin', 'rekey'];
+const ROLE_RANKS = { read_only: 1, member: 2, admin: 3, owner: 4 };
+const ROLE_LABELS = { owner: 'Owner', admin: 'Admin', member: 'Member', read_only: 'Read-only' };
+
+function can(chat, action) {
+    if (!chat) return false;
+    if (chat.type === 'direct') return DIRECT_PERMISSIONS.includes(action);
+    return (ROLE_PERMISSIONS[chat.role] || []).includes(action);
+}
+
+function outranks(role, other) {
+    return (ROLE_RANKS[role] || 0) > (ROLE_RANKS[other] || 0);
+}
 // Check for existing session
 // We do NOT auto-login because we need the password to decrypt the private key.
 // If the page is refreshed, the memory is cleared, so the user must log in again.
 document.getElementById('auth-section').style.display = 'block';
 document.getElementById('chat-section').style.display = 'none';
-showTab('login');
+const resetToken = new URLSearchParams(location.search).get('reset_token');
+// An invite link is followed once we've logged in
+let pendingInviteCode = new URLSearchParams(location.search).get('invite');
+showTab(resetToken ? 'reset' : 'login');
 
 // Theme Initialization
 const savedTheme = localStorage.getItem('theme') || 'light';
@@ -35,16 +77,17 @@ function toggleParticipants() {
 
 // Auth
 function showTab(tab) {
-    document.getElementById('login-form').style.display = tab === 'login' ? 'flex' : 'none';
-    document.getElementById('signup-form').style.display = tab === 'signup' ? 'flex' : 'none';
+    for (const form of ['login', 'signup', 'forgot', 'reset']) {
+        document.getElementById(`${form}-form`).style.display = tab === form ? 'flex' : 'none';
+    }
 
-    // Update active state
-    if (tab === 'login') {
-        document.getElementById('tab-login').classList.add('active');
-        document.getElementById('tab-signup').classList.remove('active');
-    } else {
+    // Update active state; the password reset forms live under the login tab
+    if (tab === 'signup') {
         document.getElementById('tab-login').classList.remove('active');
         document.getElementById('tab-signup').classList.add('active');
+    } else {
+        document.getElementById('tab-login').classList.add('active');
+        document.getElementById('tab-signup').classList.remove('active');
     }
 }
 
@@ -58,7 +101,8 @@ async function hashPassword(password) {
 
 
 let currentChatID = null;
-let chatKeys = {}; // Map chatID -> decrypted symmetric key
+let chatKeys = {}; // Map chatID -> key epoch -> decrypted symmetric key
+let chatEpochs = {}; // Map chatID -> current key epoch, which new messages must use
 let sessionPrivateKey = null; // CryptoKey object for ECDH
 
 // Helper functions for base64 encoding/decoding
@@ -211,6 +255,10 @@ async function handleLogin(e) {
 
             loadChats();
             connectWS();
+            if (pendingInviteCode) {
+                followInvite(pendingInviteCode);
+                pendingInviteCode = null;
+            }
         } else {
             alert('Login failed');
         }
@@ -267,48 +315,274 @@ async function handleSignup(e) {
     }
 }
 
-function logout() {
-    document.cookie = "user_id=; expires=Thu, 01 Jan 1970 00:00:00 UTC; path=/;";
+async function handleForgotPassword(e) {
+    e.preventDefault();
+    const email = document.getElementById('forgot-email').value;
+
+    try {
+        const res = await fetch('/password/forgot', {
+            method: 'POST',
+            body: JSON.stringify({ email }),
+            headers: { 'Content-Type': 'application/json' }
+        });
+        const data = await res.json();
+        alert(data.message);
+        document.getElementById('forgot-email').value = '';
+        showTab('login');
+    } catch (err) {
+        console.error(err);
+        alert('Error requesting password reset');
+    }
+}
+
+async function handleResetPassword(e) {
+    e.preventDefault();
+    const passwordRaw = document.getElementById('reset-password').value;
+
+    try {
+        const passwordHash = await hashPassword(passwordRaw);
+
+        // The old private key can't be unwrapped without the old password,
+        // so a reset starts over with a new key pair
+        const keyPair = await generateKeyPair();
+        const publicKeyRaw = await crypto.subtle.exportKey("jwk", keyPair.publicKey);
+        const publicKey = toBase64(new TextEncoder().encode(JSON.stringify(publicKeyRaw)));
+        const encryptedPrivateKey = await encryptPrivateKey(keyPair.privateKey, passwordRaw);
+
+        const res = await fetch('/password/reset', {
+            method: 'POST',
+            body: JSON.stringify({
+                token: resetToken,
+                password: passwordHash,
+                public_key: publicKey,
+                encrypted_private_key: encryptedPrivateKey
+            }),
+            headers: { 'Content-Type': 'application/json' }
+        });
+
+        if (res.ok) {
+            alert('Password reset. Please log in.');
+            document.getElementById('reset-password').value = '';
+            history.replaceState(null, '', '/');
+            showTab('login');
+        } else {
+            alert('Reset link is invalid or has expired');
+        }
+    } catch (err) {
+        console.error(err);
+        alert('Error resetting password');
+    }
+}
+
+async function logout() {
+    // The session cookie is HttpOnly, so the server has to end the session
+    try {
+        await fetch('/logout', { method: 'POST' });
+    } catch (err) {
+        console.error(err);
+    }
     document.cookie = "username=; expires=Thu, 01 Jan 1970 00:00:00 UTC; path=/;";
     location.reload();
 }
 
+// Close our account for good. Chats we own pass to their longest-standing
+// admin or member.
+async function deactivateAccount() {
+    const password = prompt('This permanently deactivates your account. Chats you own pass to another participant.\n\nEnter your password to confirm:');
+    if (!password) return;
+
+    try {
+        const res = await fetch('/account/deactivate', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ password })
+        });
+        if (!res.ok) {
+            alert('Failed to deactivate account: ' + await res.text());
+            return;
+        }
+        location.reload();
+    } catch (err) {
+        console.error(err);
+        alert('Error deactivating account');
+    }
+}
+
 // Chat Management
 async function loadChats() {
+    let chats = [];
     try {
         const res = await fetch('/chats');
-        const chats = await res.json();
+        chats = await res.json() || [];
         const list = document.getElementById('chat-list');
         list.innerHTML = '';
         chatKeys = {}; // Reset keys
+        chatEpochs = {};
 
         if (chats) {
             for (const chat of chats) {
-                // Decrypt chat key if we have it
-                if (chat.encrypted_key && sessionPrivateKey) {
-                    try {
-                        const decryptedKey = await decryptAsymmetric(chat.encrypted_key, sessionPrivateKey);
-                        chatKeys[chat.id] = decryptedKey;
-                        console.log(`Chat ${chat.id} (${chat.name}): Decrypted symmetric key:`, toBase64(decryptedKey));
-                    } catch (e) {
-                        console.error(`Failed to decrypt key for chat ${chat.id}:`, e);
-                    }
+                chatEpochs[chat.id] = chat.key_epoch;
+                await loadChatKeys(chat);
+                await decryptChatDetails(chat);
+
+                // A member left since the last rekey; only the owner can
+                // rotate, or either member of a direct chat
+                if (chat.rekey_needed && can(chat, 'rekey')) {
+                    rekeyChat(chat.id);
                 }
 
                 const div = document.createElement('div');
-                div.className = 'chat-item';
-                div.textContent = chat.name;
+                div.className = chat.type === 'direct' ? 'chat-item direct' : 'chat-item';
+                div.dataset.chatId = chat.id;
+                const name = document.createElement('span');
+                name.textContent = chat.name;
+                const badge = document.createElement('span');
+                badge.className = 'unread-badge';
+                div.appendChild(name);
+                div.appendChild(badge);
                 div.onclick = () => selectChat(chat);
                 list.appendChild(div);
+                setUnreadCount(chat.id, currentChat && currentChat.id === chat.id ? 0 : chat.unread_count);
             }
         }
     } catch (err) {
         console.error(err);
     }
+    return chats;
+}
+
+// readChatField returns a chat detail as plain text. Encrypted details carry
+// the epoch of the chat key they were sealed under.
+async function readChatField(chatID, value, epoch) {
+    if (!epoch || !value) return value || '';
+    const symmetricKey = (chatKeys[chatID] || {})[epoch];
+    if (!symmetricKey) return '[Encrypted]';
+    try {
+        return await decryptMessage(value, symmetricKey);
+    } catch (e) {
+        console.error(`Failed to decrypt details of chat ${chatID}:`, e);
+        return '[Decryption failed]';
+    }
+}
+
+// Replace a chat's encrypted details with their plain text, in place
+async function decryptChatDetails(chat) {
+    chat.name = await readChatField(chat.id, chat.name, chat.name_key_epoch);
+    chat.description = await readChatField(chat.id, chat.description, chat.description_key_epoch);
+    chat.topic = await readChatField(chat.id, chat.topic, chat.topic_key_epoch);
+}
+
+// Reload the chat list after a chat's details changed, and the header if
+// it's the chat on screen
+async function refreshChatDetails(chatID) {
+    const chats = await loadChats();
+    const updated = chats.find(c => c.id === chatID);
+    if (updated && currentChat && currentChat.id === chatID) {
+        currentChat = updated;
+        renderChatHeader(updated);
+        renderChatControls(updated);
+    }
+}
+
+// Show a chat's name, topic, description and avatar above its messages
+function renderChatHeader(chat) {
+    document.getElementById('active-chat-name').textContent = chat.name;
+    const topic = document.getElementById('active-chat-topic');
+    topic.textContent = chat.topic || '';
+    topic.style.display = chat.topic ? '' : 'none';
+    document.getElementById('active-chat-details').title = chat.description || '';
+
+    const avatar = document.getElementById('active-chat-avatar');
+    avatar.style.display = 'none';
+    avatar.removeAttribute('src');
+    if (chat.avatar_attachment_id) {
+        fetchAttachment({ chat_id: chat.id, id: chat.avatar_attachment_id })
+            .then(blob => {
+                if (currentChat && currentChat.id === chat.id) {
+                    avatar.src = URL.createObjectURL(blob);
+                    avatar.style.display = '';
+                }
+            })
+            .catch(err => console.error('Failed to load chat avatar:', err));
+    }
+}
+
+// Decrypt the chat keys we hold. Chats that have been rekeyed need every
+// earlier epoch's key too, to read older history.
+async function loadChatKeys(chat) {
+    if (!sessionPrivateKey) return;
+    let wrapped = [{ epoch: chat.key_epoch, encrypted_key: chat.encrypted_key }];
+    if (chat.key_epoch > 1) {
+        try {
+            const res = await fetch(`/chats/${chat.id}/keys`);
+            wrapped = await res.json();
+        } catch (e) {
+            console.error(`Failed to load key history for chat ${chat.id}:`, e);
+        }
+    }
+
+    chatKeys[chat.id] = {};
+    for (const key of wrapped) {
+        if (!key.encrypted_key) continue;
+        try {
+            chatKeys[chat.id][key.epoch] = await decryptAsymmetric(key.encrypted_key, sessionPrivateKey);
+        } catch (e) {
+            console.error(`Failed to decrypt epoch ${key.epoch} key for chat ${chat.id}:`, e);
+        }
+    }
+}
+
+// currentChatKey returns the key new messages in a chat are encrypted with.
+function currentChatKey(chatID) {
+    return (chatKeys[chatID] || {})[chatEpochs[chatID]];
+}
+
+// Wrap a chat key for each of a user's devices.
+async function wrapForDevices(symKey, devices) {
+    const keys = [];
+    for (const device of devices || []) {
+        keys.push({
+            device_id: device.id,
+            encrypted_key: await encryptAsymmetric(symKey, device.public_key)
+        });
+    }
+    return keys;
+}
+
+// Replace a chat's key after someone left or revoked a device, so they can't
+// read anything new. The fresh key is wrapped for each remaining member's
+// devices.
+async function rekeyChat(chatID) {
+    try {
+        const res = await fetch(`/chats/${chatID}/participants`);
+        const participants = await res.json();
+
+        const symKey = await generateSymKey();
+        const keys = [];
+        for (const participant of participants) {
+            keys.push(...await wrapForDevices(symKey, participant.devices));
+        }
+
+        const rotateRes = await fetch(`/chats/${chatID}/keys`, {
+            method: 'POST',
+            body: JSON.stringify({ epoch: chatEpochs[chatID] + 1, keys }),
+            headers: { 'Content-Type': 'application/json' }
+        });
+        // A conflict means membership or the epoch changed underneath us;
+        // the next rekey_required or key_rotated event brings us up to date.
+        if (!rotateRes.ok && rotateRes.status !== 409) {
+            console.error('Failed to rekey chat:', await rotateRes.text());
+        }
+    } catch (err) {
+        console.error('Error rekeying chat:', err);
+    }
 }
 
 async function selectChat(chat) {
     currentChat = chat;
+    cancelReply();
+    cancelAttachment();
+    clearTypingIndicators();
     document.getElementById('no-chat-selected').style.display = 'none';
     document.getElementById('active-chat').style.display = 'flex';
 
@@ -321,74 +595,144 @@ async function selectChat(chat) {
         toggleSidebar();
     }
 
-    document.getElementById('active-chat-name').textContent = chat.name;
-
-    // Show appropriate button based on ownership
-    const deleteBtn = document.getElementById('delete-chat-btn');
-    if (chat.owner_id === currentUserID) {
-        deleteBtn.textContent = 'Delete Chat';
-        deleteBtn.onclick = () => deleteChat(chat.id);
-        deleteBtn.style.display = 'block';
-    } else {
-        deleteBtn.textContent = 'Leave Chat';
-        deleteBtn.onclick = leaveChat;
-        deleteBtn.style.display = 'block';
-    }
+    renderChatHeader(chat);
+    renderChatControls(chat);
 
     document.getElementById('messages').innerHTML = '';
 
     // Update active state in sidebar
     document.querySelectorAll('.chat-item').forEach(el => {
         el.classList.remove('active');
-        if (el.textContent === chat.name) el.classList.add('active');
+        if (Number(el.dataset.chatId) === chat.id) el.classList.add('active');
     });
 
-    // Load messages
+    // Load the most recent page of messages
+    olderMessagesCursor = null;
     try {
         const res = await fetch(`/chats/${chat.id}/messages`);
-        const messages = await res.json();
+        const page = await res.json();
 
         // Prevent race condition: ensure we are still on the same chat
         if (currentChat && currentChat.id === chat.id) {
-            if (messages) {
-                messages.forEach(appendMessage);
+            olderMessagesCursor = page.next || null;
+            if (page.messages.length > 0) {
+                lastSeenMessageIDs[chat.id] = page.messages[page.messages.length - 1].id;
+            }
+            for (const msg of page.messages) {
+                await appendMessage(msg);
+            }
+            if (page.messages.length > 0) {
+                markChatRead(chat.id, page.messages[page.messages.length - 1].id);
             }
         }
     } catch (err) {
         console.error("Error loading messages:", err);
     }
 
-    // Load participants
-    loadParticipants(chat.id, chat.owner_id);
+    // Load participants, then who has read how far
+    await loadParticipants(chat.id);
+    loadReadReceipts(chat.id);
+    loadJoinRequests(chat.id);
+
+    // An offer made while we were away is answered when we open the chat
+    if (chat.pending_owner_id === currentUserID) {
+        answerOwnershipOffer(chat.id);
+    }
+}
+
+// Show the chat's buttons and composer according to our role in it
+function renderChatControls(chat) {
+    // Direct chats have no owner and take no invites; either member can
+    // hide them.
+    const deleteBtn = document.getElementById('delete-chat-btn');
+    document.getElementById('invite-btn').style.display = can(chat, 'invite') ? '' : 'none';
+    document.getElementById('invite-link-btn').style.display = can(chat, 'manage_invites') ? '' : 'none';
+    document.getElementById('edit-chat-btn').style.display = can(chat, 'rename') ? '' : 'none';
+    if (chat.type === 'direct') {
+        deleteBtn.textContent = 'Hide Chat';
+        deleteBtn.onclick = hideChat;
+    } else if (can(chat, 'delete')) {
+        deleteBtn.textContent = 'Delete Chat';
+        deleteBtn.onclick = () => deleteChat(chat.id);
+    } else if (can(chat, 'leave')) {
+        deleteBtn.textContent = 'Leave Chat';
+        deleteBtn.onclick = leaveChat;
+    }
+    deleteBtn.style.display = 'block';
+
+    // Read-only participants follow the chat without posting
+    const canPost = can(chat, 'post');
+    const input = document.getElementById('message-input');
+    input.disabled = !canPost;
+    input.placeholder = canPost ? 'Type a message...' : 'You can only read this chat';
+    document.getElementById('send-btn').disabled = !canPost;
+    document.getElementById('attach-btn').disabled = !canPost;
 }
 
-async function loadParticipants(chatID, ownerID) {
+async function loadParticipants(chatID) {
     try {
         const res = await fetch(`/chats/${chatID}/participants`);
         const participants = await res.json();
 
         const list = document.getElementById('participants-list');
         list.innerHTML = '';
+        participantNames = {};
 
         if (participants) {
             participants.forEach(participant => {
+                participantNames[participant.id] = participant.username;
+                if (!presence[participant.id]) {
+                    presence[participant.id] = { status: 'offline', last_seen: participant.last_seen_at };
+                }
+                const role = participant.role || 'member';
                 const div = document.createElement('div');
                 div.className = 'participant-item';
-                if (participant.id === ownerID) {
+                if (role === 'owner') {
                     div.classList.add('owner');
                 }
 
+                div.dataset.userId = participant.id;
+                const dot = document.createElement('span');
+                dot.className = 'presence-dot';
+                div.appendChild(dot);
+
                 const nameSpan = document.createElement('span');
                 nameSpan.textContent = `${participant.username} (${participant.email})`;
                 div.appendChild(nameSpan);
-
-                if (participant.id === ownerID) {
+                renderPresence(participant.id, div);
+
+                // We can manage participants below our own role
+                const manageable = participant.id !== currentUserID && outranks(currentChat.role, role);
+                if (manageable && can(currentChat, 'change_role')) {
+                    const select = document.createElement('select');
+                    select.className = 'role-select';
+                    select.title = 'Change Role';
+                    for (const option of ['admin', 'member', 'read_only']) {
+                        if (option !== role && !outranks(currentChat.role, option)) continue;
+                        select.add(new Option(ROLE_LABELS[option], option, false, option === role));
+                    }
+                    select.onchange = () => changeRole(chatID, participant.id, select.value);
+                    div.appendChild(select);
+                } else if (role !== 'member' && currentChat.type !== 'direct') {
                     const badge = document.createElement('span');
-                    badge.className = 'owner-badge';
-                    badge.textContent = 'OWNER';
+                    badge.className = 'role-badge';
+                    badge.textContent = ROLE_LABELS[role].toUpperCase();
                     div.appendChild(badge);
-                } else if (ownerID === currentUserID) {
-                    // If current user is owner, show remove button for others
+                }
+                if (participant.id !== currentUserID && can(currentChat, 'transfer')) {
+                    const transferBtn = document.createElement('button');
+                    transferBtn.className = 'icon-btn transfer-btn';
+                    transferBtn.title = participant.id === currentChat.pending_owner_id ? 'Withdraw Ownership Offer' : 'Offer Ownership';
+                    transferBtn.innerHTML = '<span class="material-icons">workspace_premium</span>';
+                    if (participant.id === currentChat.pending_owner_id) {
+                        transferBtn.classList.add('pending');
+                        transferBtn.onclick = () => cancelOwnershipOffer(chatID);
+                    } else {
+                        transferBtn.onclick = () => offerOwnership(chatID, participant.id, participant.username);
+                    }
+                    div.appendChild(transferBtn);
+                }
+                if (manageable && can(currentChat, 'remove')) {
                     const removeBtn = document.createElement('button');
                     removeBtn.textContent = '×';
                     removeBtn.title = 'Remove Participant';
@@ -417,7 +761,7 @@ async function removeParticipant(chatID, userID, username) {
         });
 
         if (res.ok) {
-            loadParticipants(chatID, currentChat.owner_id);
+            loadParticipants(chatID);
         } else {
             const err = await res.text();
             alert('Failed to remove participant: ' + err);
@@ -428,10 +772,228 @@ async function removeParticipant(chatID, userID, username) {
     }
 }
 
+async function changeRole(chatID, userID, role) {
+    try {
+        const res = await fetch(`/chats/${chatID}/participants/${userID}/role`, {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ role })
+        });
+        if (!res.ok) {
+            alert('Failed to change role: ' + await res.text());
+        }
+    } catch (err) {
+        console.error(err);
+        alert('Error changing role');
+    }
+    // The role_changed event refreshes the list; a failure restores it
+    loadParticipants(chatID);
+}
+
+async function offerOwnership(chatID, userID, username) {
+    if (!confirm(`Offer ownership of this chat to ${username}? You'll become an admin once they accept.`)) return;
+    try {
+        const res = await fetch(`/chats/${chatID}/transfer`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ user_id: userID })
+        });
+        if (!res.ok) {
+            alert('Failed to offer ownership: ' + await res.text());
+        }
+    } catch (err) {
+        console.error(err);
+        alert('Error offering ownership');
+    }
+}
+
+// Withdraw our offer, or decline one made to us
+async function cancelOwnershipOffer(chatID) {
+    try {
+        const res = await fetch(`/chats/${chatID}/transfer`, { method: 'DELETE' });
+        if (!res.ok && res.status !== 404) {
+            alert('Failed to cancel the offer: ' + await res.text());
+        }
+    } catch (err) {
+        console.error(err);
+        alert('Error cancelling the offer');
+    }
+}
+
+// Ask whether to take up an offer of ownership
+async function answerOwnershipOffer(chatID) {
+    const item = document.querySelector(`.chat-item[data-chat-id="${chatID}"] span`);
+    const name = item ? `"${item.textContent}"` : 'a chat';
+    if (!confirm(`You've been offered ownership of ${name}. Accept?`)) {
+        cancelOwnershipOffer(chatID);
+        return;
+    }
+    try {
+        const res = await fetch(`/chats/${chatID}/transfer/accept`, { method: 'POST' });
+        if (!res.ok) {
+            alert('Failed to accept ownership: ' + await res.text());
+        }
+    } catch (err) {
+        console.error(err);
+        alert('Error accepting ownership');
+    }
+}
+
+// Show who is waiting to join through an invite link. Anyone who can invite
+// lets open requests in by wrapping the chat key for the joiner's devices;
+// requests that need approval wait for an owner or admin.
+async function loadJoinRequests(chatID) {
+    const section = document.getElementById('join-requests');
+    const list = document.getElementById('join-requests-list');
+    if (!can(currentChat, 'invite')) {
+        section.style.display = 'none';
+        return;
+    }
+    try {
+        const res = await fetch(`/chats/${chatID}/join-requests`);
+        if (!res.ok) return;
+        const requests = await res.json() || [];
+        if (!currentChat || currentChat.id !== chatID) return;
+
+        list.innerHTML = '';
+        const waiting = [];
+        for (const request of requests) {
+            if (!request.requires_approval) {
+                approveJoinRequest(chatID, request);
+            } else {
+                waiting.push(request);
+            }
+        }
+        section.style.display = waiting.length > 0 ? 'block' : 'none';
+
+        for (const request of waiting) {
+            const div = document.createElement('div');
+            div.className = 'participant-item';
+            const nameSpan = document.createElement('span');
+            nameSpan.textContent = request.username;
+            div.appendChild(nameSpan);
+
+            if (can(currentChat, 'manage_invites')) {
+                const actions = document.createElement('span');
+                actions.className = 'join-request-actions';
+                const approveBtn = document.createElement('button');
+                approveBtn.className = 'btn-text';
+                approveBtn.textContent = 'Approve';
+                approveBtn.onclick = () => approveJoinRequest(chatID, request);
+                const rejectBtn = document.createElement('button');
+                rejectBtn.className = 'btn-text';
+                rejectBtn.textContent = 'Reject';
+                rejectBtn.onclick = () => rejectJoinRequest(chatID, request.user_id);
+                actions.appendChild(approveBtn);
+                actions.appendChild(rejectBtn);
+                div.appendChild(actions);
+            }
+            list.appendChild(div);
+        }
+    } catch (err) {
+        console.error('Error loading join requests:', err);
+    }
+}
+
+// Let a joiner in by handing them the chat key
+async function approveJoinRequest(chatID, request) {
+    const symKey = currentChatKey(chatID);
+    if (!symKey) return;
+    try {
+        const keys = await wrapForDevices(symKey, request.devices);
+        const res = await fetch(`/chats/${chatID}/join-requests/${request.user_id}`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ keys })
+        });
+        // Another member may have let them in first
+        if (!res.ok && res.status !== 404) {
+            console.error('Failed to approve join request:', await res.text());
+        }
+    } catch (err) {
+        console.error('Error approving join request:', err);
+    }
+}
+
+async function rejectJoinRequest(chatID, userID) {
+    try {
+        const res = await fetch(`/chats/${chatID}/join-requests/${userID}`, { method: 'DELETE' });
+        if (!res.ok && res.status !== 404) {
+            alert('Failed to reject request: ' + await res.text());
+        }
+    } catch (err) {
+        console.error(err);
+        alert('Error rejecting request');
+    }
+    loadJoinRequests(chatID);
+}
+
 function showCreateChat() {
     document.getElementById('create-chat-modal').style.display = 'block';
 }
 
+function showDirectChat() {
+    document.getElementById('dm-modal').style.display = 'block';
+}
+
+// Open the direct chat with someone. Asking without keys finds an existing
+// chat; only when there is none do we make a key for both of us.
+async function handleOpenDirectChat(e) {
+    e.preventDefault();
+    const username = document.getElementById('dm-username').value;
+    const open = keys => fetch('/dms', {
+        method: 'POST',
+        body: JSON.stringify({ username, keys }),
+        headers: { 'Content-Type': 'application/json' }
+    });
+
+    try {
+        let res = await open([]);
+        if (res.status === 409) {
+            const searchRes = await fetch(`/users/search?q=${encodeURIComponent(username)}`);
+            const peer = (await searchRes.json() || []).find(u => u.username === username);
+            const devicesRes = await fetch('/devices');
+            if (!peer || !devicesRes.ok) {
+                alert('User not found or has no public key');
+                return;
+            }
+            const symKey = await generateSymKey();
+            const keys = await wrapForDevices(symKey, await devicesRes.json());
+            keys.push(...await wrapForDevices(symKey, peer.devices));
+            res = await open(keys);
+        }
+        if (!res.ok) {
+            alert('Failed to open direct chat: ' + await res.text());
+            return;
+        }
+
+        const chat = await res.json();
+        document.getElementById('dm-username').value = '';
+        closeModal('dm-modal');
+        await loadChats();
+        const item = document.querySelector(`.chat-item[data-chat-id="${chat.id}"]`);
+        if (item) item.click();
+    } catch (err) {
+        console.error(err);
+        alert('Error opening direct chat');
+    }
+}
+
+// Hide the current direct chat until it gets a new message
+async function hideChat() {
+    if (!currentChat) return;
+    try {
+        const res = await fetch(`/chats/${currentChat.id}/hide`, { method: 'POST' });
+        if (!res.ok) {
+            alert('Failed to hide chat: ' + await res.text());
+        }
+        // The chat_hidden event clears it from every one of our devices
+    } catch (err) {
+        console.error(err);
+        alert('Error hiding chat');
+    }
+}
+
 function showInvite() {
     document.getElementById('invite-modal').style.display = 'block';
 }
@@ -583,17 +1145,15 @@ async function handleCreateChat(e) {
         const symKey = await generateSymKey();
         console.log('Generated symmetric key:', symKey);
 
-        const myPublicKey = localStorage.getItem('public_key');
-        if (!myPublicKey) {
-            alert('Public key not found. Please login again.');
+        // Wrap it for each of our own devices
+        const devicesRes = await fetch('/devices');
+        if (!devicesRes.ok) {
+            alert('Could not load your devices. Please login again.');
             return;
         }
-        console.log('My public key:', myPublicKey);
-
-        const encryptedKey = await encryptAsymmetric(symKey, myPublicKey);
-        console.log('Encrypted key:', encryptedKey);
+        const keys = await wrapForDevices(symKey, await devicesRes.json());
 
-        const payload = { name, encrypted_key: encryptedKey };
+        const payload = { name, keys };
         console.log('Sending payload:', payload);
 
         const res = await fetch('/chats', {
@@ -624,17 +1184,17 @@ async function handleInviteUser(e) {
     const chatID = currentChat.id;
 
     try {
-        // 1. Get invitee's public key
+        // 1. Get the public keys of the invitee's devices
         const searchRes = await fetch(`/users/search?q=${username}`);
         const users = await searchRes.json();
         const invitee = users.find(u => u.username === username);
-        if (!invitee || !invitee.public_key) {
+        if (!invitee || !invitee.devices || invitee.devices.length === 0) {
             alert('User not found or has no public key');
             return;
         }
 
         // 2. Get the chat's decrypted symmetric key
-        const decryptedChatKey = chatKeys[chatID];
+        const decryptedChatKey = currentChatKey(chatID);
         if (!decryptedChatKey) {
             alert('Chat key not found (or not decrypted). Cannot invite.');
             return;
@@ -643,13 +1203,12 @@ async function handleInviteUser(e) {
         console.log('Inviting user to chat:', chatID);
         console.log('Decrypted symmetric key to share:', toBase64(decryptedChatKey));
 
-        // 3. Encrypt the symmetric key for the invitee using their public key
-        const encryptedForInvitee = await encryptAsymmetric(decryptedChatKey, invitee.public_key);
-        console.log('Encrypted for invitee:', encryptedForInvitee);
+        // 3. Encrypt the symmetric key for each of the invitee's devices
+        const keys = await wrapForDevices(decryptedChatKey, invitee.devices);
 
         const res = await fetch(`/chats/${chatID}/invite`, {
             method: 'POST',
-            body: JSON.stringify({ username, encrypted_key: encryptedForInvitee }),
+            body: JSON.stringify({ username, keys }),
             headers: { 'Content-Type': 'application/json' }
         });
 
@@ -666,21 +1225,146 @@ async function handleInviteUser(e) {
     }
 }
 
-async function leaveChat() {
-    if (!currentChat) return;
-    if (!confirm('Are you sure you want to leave this chat?')) return;
+function showChatDetails() {
+    document.getElementById('chat-details-name').value = currentChat.name;
+    document.getElementById('chat-details-description').value = currentChat.description || '';
+    document.getElementById('chat-details-topic').value = currentChat.topic || '';
+    document.getElementById('chat-details-avatar').value = '';
+    document.getElementById('chat-details-remove-avatar').checked = false;
+    document.getElementById('chat-details-encrypt').checked =
+        !!(currentChat.name_key_epoch || currentChat.description_key_epoch || currentChat.topic_key_epoch);
+    document.getElementById('chat-details-modal').style.display = 'block';
+}
+
+// Send the details that changed. Encrypted details are sealed under the
+// current chat key, so members who join later can't read them until
+// they're set again.
+async function handleUpdateChat(e) {
+    e.preventDefault();
+    const chat = currentChat;
+    const encrypt = document.getElementById('chat-details-encrypt').checked;
+    const symmetricKey = currentChatKey(chat.id);
+    if (encrypt && !symmetricKey) {
+        alert('Chat key not available. Cannot encrypt chat details.');
+        return;
+    }
+
+    const changes = {};
+    const fields = { name: 'chat-details-name', description: 'chat-details-description', topic: 'chat-details-topic' };
+    for (const [field, id] of Object.entries(fields)) {
+        const value = document.getElementById(id).value.trim();
+        const wasEncrypted = !!chat[`${field}_key_epoch`];
+        if (value === (chat[field] || '') && (wasEncrypted === encrypt || !value)) continue;
+        changes[field] = encrypt && value
+            ? { value: await encryptMessage(value, symmetricKey), key_epoch: chatEpochs[chat.id] }
+            : { value };
+    }
 
     try {
-        const res = await fetch(`/chats/${currentChat.id}/leave`, {
-            method: 'DELETE'
+        const file = document.getElementById('chat-details-avatar').files[0];
+        if (file) {
+            const preview = document.getElementById('chat-details-status');
+            const attachment = await uploadAttachment(chat.id, file, preview);
+            preview.textContent = '';
+            changes.avatar_attachment_id = attachment.id;
+        } else if (document.getElementById('chat-details-remove-avatar').checked && chat.avatar_attachment_id) {
+            changes.avatar_attachment_id = 0;
+        }
+        if (Object.keys(changes).length === 0) {
+            closeModal('chat-details-modal');
+            return;
+        }
+
+        const res = await fetch(`/chats/${chat.id}`, {
+            method: 'PATCH',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(changes)
         });
+        if (!res.ok) {
+            alert('Failed to update chat: ' + await res.text());
+            return;
+        }
+        closeModal('chat-details-modal');
+    } catch (err) {
+        console.error(err);
+        alert('Error updating chat: ' + err.message);
+    }
+}
 
-        if (res.ok) {
-            currentChat = null;
-            currentChatID = null;
-            document.getElementById('messages').innerHTML = '';
-            document.getElementById('active-chat-name').textContent = '';
-            document.getElementById('message-input').disabled = true;
+function showInviteLink() {
+    document.getElementById('invite-link-result').style.display = 'none';
+    document.getElementById('invite-link-modal').style.display = 'block';
+}
+
+async function handleCreateInviteLink(e) {
+    e.preventDefault();
+    const maxUses = document.getElementById('invite-link-max-uses').value;
+
+    try {
+        const res = await fetch(`/chats/${currentChat.id}/invites`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                expires_in: Number(document.getElementById('invite-link-expiry').value),
+                max_uses: maxUses ? Number(maxUses) : 0,
+                requires_approval: document.getElementById('invite-link-approval').checked
+            })
+        });
+        if (!res.ok) {
+            alert('Failed to create invite link: ' + await res.text());
+            return;
+        }
+        const invite = await res.json();
+        document.getElementById('invite-link-url').value = `${location.origin}/?invite=${invite.code}`;
+        document.getElementById('invite-link-result').style.display = 'flex';
+    } catch (err) {
+        console.error(err);
+        alert('Error creating invite link');
+    }
+}
+
+// Ask to join the chat behind an invite link. We become a participant once
+// a member hands us the chat key.
+async function followInvite(code) {
+    history.replaceState(null, '', location.pathname);
+    try {
+        const res = await fetch(`/invites/${encodeURIComponent(code)}`);
+        if (!res.ok) {
+            alert('This invite link is invalid or has expired');
+            return;
+        }
+        const preview = await res.json();
+        if (preview.is_member) return;
+        const note = preview.requires_approval ? ' An admin will need to approve you.' : '';
+        if (!confirm(`Join "${preview.chat_name}" (${preview.member_count} members)?${note}`)) return;
+
+        const acceptRes = await fetch(`/invites/${encodeURIComponent(code)}/accept`, { method: 'POST' });
+        if (acceptRes.ok) {
+            alert(`Asked to join "${preview.chat_name}". It will appear once you're let in.`);
+        } else {
+            alert('Failed to join: ' + await acceptRes.text());
+        }
+    } catch (err) {
+        console.error(err);
+        alert('Error following invite link');
+    }
+}
+
+async function leaveChat() {
+    if (!currentChat) return;
+    if (!confirm('Are you sure you want to leave this chat?')) return;
+
+    try {
+        const res = await fetch(`/chats/${currentChat.id}/leave`, {
+            method: 'DELETE'
+        });
+
+        if (res.ok) {
+            currentChat = null;
+            currentChatID = null;
+            document.getElementById('messages').innerHTML = '';
+            document.getElementById('active-chat-name').textContent = '';
+            document.getElementById('message-input').disabled = true;
             document.getElementById('send-btn').disabled = true;
             document.getElementById('delete-chat-btn').style.display = 'none';
 
@@ -749,8 +1433,8 @@ function selectUser(username) {
 }
 
 // Message Encryption/Decryption
-async function encryptMessage(content, symmetricKey) {
-    // Convert symmetric key (Uint8Array) to CryptoKey
+// Payloads are sealed with AES-GCM as IV + ciphertext
+async function encryptBytes(bytes, symmetricKey) {
     const key = await crypto.subtle.importKey(
         "raw",
         symmetricKey,
@@ -759,27 +1443,21 @@ async function encryptMessage(content, symmetricKey) {
         ["encrypt"]
     );
 
-    // Generate IV
     const iv = crypto.getRandomValues(new Uint8Array(12));
-
-    // Encrypt the message
-    const contentBytes = new TextEncoder().encode(content);
     const encrypted = await crypto.subtle.encrypt(
         { name: "AES-GCM", iv: iv },
         key,
-        contentBytes
+        bytes
     );
 
     // Combine IV + ciphertext
     const combined = new Uint8Array(iv.length + encrypted.byteLength);
     combined.set(iv, 0);
     combined.set(new Uint8Array(encrypted), iv.length);
-
-    return toBase64(combined);
+    return combined;
 }
 
-async function decryptMessage(encryptedContent, symmetricKey) {
-    // Convert symmetric key (Uint8Array) to CryptoKey
+async function decryptBytes(combined, symmetricKey) {
     const key = await crypto.subtle.importKey(
         "raw",
         symmetricKey,
@@ -788,78 +1466,251 @@ async function decryptMessage(encryptedContent, symmetricKey) {
         ["decrypt"]
     );
 
-    // Parse encrypted data
-    const combined = fromBase64(encryptedContent);
     const iv = combined.slice(0, 12);
     const ciphertext = combined.slice(12);
-
-    // Decrypt the message
-    const decrypted = await crypto.subtle.decrypt(
+    return new Uint8Array(await crypto.subtle.decrypt(
         { name: "AES-GCM", iv: iv },
         key,
         ciphertext
-    );
+    ));
+}
 
+async function encryptMessage(content, symmetricKey) {
+    const contentBytes = new TextEncoder().encode(content);
+    return toBase64(await encryptBytes(contentBytes, symmetricKey));
+}
+
+async function decryptMessage(encryptedContent, symmetricKey) {
+    const decrypted = await decryptBytes(fromBase64(encryptedContent), symmetricKey);
     return new TextDecoder().decode(decrypted);
 }
 
 // WebSocket & Messaging
 function connectWS() {
     const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
-    ws = new WebSocket(`${protocol}//${location.host}/ws`);
+    const lastSeen = Object.entries(lastSeenMessageIDs).map(([chatID, msgID]) => `${chatID}:${msgID}`).join(',');
+    const query = lastSeen ? `?last_seen=${encodeURIComponent(lastSeen)}` : '';
+    ws = new WebSocket(`${protocol}//${location.host}/ws${query}`);
 
     ws.onmessage = (event) => {
-        const msg = JSON.parse(event.data);
-        if (msg.type === 'new_chat') {
-            loadChats();
-            // If we're viewing a chat, refresh participants list
-            if (currentChat) {
-                loadParticipants(currentChat.id, currentChat.owner_id);
-            }
+        const frame = JSON.parse(event.data);
+        if (frame.v !== WS_PROTOCOL_VERSION) {
+            console.warn('Unsupported protocol version:', frame.v);
             return;
         }
-        if (msg.type === 'chat_deleted') {
-            // Always reload the chat list to remove the deleted chat
-            loadChats();
+        const payload = frame.payload || {};
 
-            // If the deleted chat is the one currently being viewed, clear the view
-            if (currentChat && currentChat.id === msg.chat_id) {
-                document.getElementById('active-chat').style.display = 'none';
-                document.getElementById('no-chat-selected').style.display = 'flex';
-                document.getElementById('participants-sidebar').classList.remove('open');
-                currentChat = null;
-                alert('This chat has been deleted by the owner.');
-            }
-            return;
-        }
-        if (msg.type === 'participant_left') {
-            // Ignore if I'm the one who left (handled by leaveChat function)
-            if (msg.user_id === currentUserID) {
-                return;
-            }
-            // Refresh participant list if viewing this chat
-            if (currentChat && currentChat.id === msg.chat_id) {
-                loadParticipants(msg.chat_id, currentChat.owner_id);
-            }
-            return;
+        switch (frame.type) {
+            case 'message':
+                if (lastSeenMessageIDs[payload.chat_id] !== undefined) {
+                    lastSeenMessageIDs[payload.chat_id] = Math.max(lastSeenMessageIDs[payload.chat_id], payload.id);
+                }
+                if (currentChat && payload.chat_id === currentChat.id) {
+                    appendMessage(payload);
+                    markChatRead(payload.chat_id, payload.id);
+                    stopTypingIndicator(payload.user_id);
+                } else if (!document.querySelector(`.chat-item[data-chat-id="${payload.chat_id}"]`)) {
+                    // A hidden direct chat came back with this message
+                    loadChats();
+                } else if (payload.user_id !== currentUserID && payload.kind !== 'system') {
+                    setUnreadCount(payload.chat_id, (unreadCounts[payload.chat_id] || 0) + 1);
+                }
+                // Membership changes also arrive as their own events, which
+                // refresh the participant list
+                if (payload.kind === 'system' && payload.event && payload.event.type === 'chat_updated') {
+                    refreshChatDetails(payload.chat_id);
+                }
+                break;
+            case 'presence':
+                presence[payload.user_id] = { status: payload.status, last_seen: payload.last_seen };
+                document.querySelectorAll(`.participant-item[data-user-id="${payload.user_id}"]`).forEach(div => {
+                    renderPresence(payload.user_id, div);
+                });
+                break;
+            case 'presence_snapshot':
+                payload.users.forEach(user => {
+                    presence[user.user_id] = { status: user.status };
+                    document.querySelectorAll(`.participant-item[data-user-id="${user.user_id}"]`).forEach(div => {
+                        renderPresence(user.user_id, div);
+                    });
+                });
+                break;
+            case 'user_typing':
+                if (currentChat && payload.chat_id === currentChat.id && payload.user_id !== currentUserID) {
+                    if (payload.typing) {
+                        startTypingIndicator(payload.user_id, payload.expires_in_ms);
+                    } else {
+                        stopTypingIndicator(payload.user_id);
+                    }
+                }
+                break;
+            case 'read_receipt':
+                if (payload.user_id === currentUserID) {
+                    // Read on another of our devices
+                    setUnreadCount(payload.chat_id, 0);
+                } else if (currentChat && payload.chat_id === currentChat.id) {
+                    readReceipts[payload.user_id] = payload.message_id;
+                    renderReadReceipts();
+                }
+                break;
+            case 'message_edited':
+                if (currentChat && payload.chat_id === currentChat.id) {
+                    replaceMessage(payload);
+                }
+                break;
+            case 'message_deleted':
+                if (currentChat && payload.chat_id === currentChat.id) {
+                    markMessageDeleted(payload.message_id);
+                }
+                break;
+            case 'reaction_added':
+            case 'reaction_removed':
+                if (currentChat && payload.chat_id === currentChat.id) {
+                    applyReactionEvent(payload, frame.type === 'reaction_added');
+                }
+                break;
+            case 'thread_reply':
+                if (currentChat && payload.chat_id === currentChat.id) {
+                    updateThreadSummary(payload.thread_root_id, payload.reply_count, payload.last_reply_at);
+                }
+                break;
+            case 'ack':
+                delete pendingSends[frame.id];
+                break;
+            case 'error':
+                console.error('Server rejected frame', frame.id, payload.code, payload.reason);
+                if (pendingSends[frame.id]) {
+                    delete pendingSends[frame.id];
+                    if (payload.code === 'stale_key_epoch') {
+                        loadChats();
+                        alert('The chat key changed while sending. Please send your message again.');
+                    } else {
+                        alert(`Message not sent: ${payload.reason}`);
+                    }
+                }
+                break;
+            case 'rekey_required':
+                rekeyChat(payload.chat_id);
+                break;
+            case 'key_rotated':
+                loadChats();
+                break;
+            case 'replay_gap':
+                // Too much was missed to replay; reload the chat from scratch
+                delete lastSeenMessageIDs[payload.chat_id];
+                if (currentChat && currentChat.id === payload.chat_id) {
+                    selectChat(currentChat);
+                }
+                break;
+            case 'new_chat':
+                loadChats();
+                // If we're viewing a chat, refresh participants list
+                if (currentChat) {
+                    loadParticipants(currentChat.id);
+                }
+                break;
+            case 'chat_hidden':
+                loadChats();
+                if (currentChat && currentChat.id === payload.chat_id) {
+                    document.getElementById('active-chat').style.display = 'none';
+                    document.getElementById('no-chat-selected').style.display = 'flex';
+                    document.getElementById('participants-sidebar').classList.remove('open');
+                    currentChat = null;
+                }
+                break;
+            case 'chat_deleted':
+                // Always reload the chat list to remove the deleted chat
+                loadChats();
+
+                // If the deleted chat is the one currently being viewed, clear the view
+                if (currentChat && currentChat.id === payload.chat_id) {
+                    document.getElementById('active-chat').style.display = 'none';
+                    document.getElementById('no-chat-selected').style.display = 'flex';
+                    document.getElementById('participants-sidebar').classList.remove('open');
+                    currentChat = null;
+                    alert('This chat has been deleted by the owner.');
+                }
+                break;
+            case 'participant_left':
+                // Ignore if I'm the one who left (handled by leaveChat function)
+                if (payload.user_id === currentUserID) {
+                    break;
+                }
+                // Refresh participant list if viewing this chat
+                if (currentChat && currentChat.id === payload.chat_id) {
+                    loadParticipants(payload.chat_id);
+                }
+                break;
+            case 'role_changed':
+                if (payload.user_id === currentUserID) {
+                    loadChats();
+                    if (currentChat && currentChat.id === payload.chat_id) {
+                        currentChat.role = payload.role;
+                        renderChatControls(currentChat);
+                    }
+                }
+                if (currentChat && currentChat.id === payload.chat_id) {
+                    loadParticipants(payload.chat_id);
+                }
+                break;
+            case 'ownership_offer':
+                if (currentChat && currentChat.id === payload.chat_id) {
+                    currentChat.pending_owner_id = payload.pending_owner_id;
+                    loadParticipants(payload.chat_id);
+                }
+                if (payload.pending_owner_id === currentUserID) {
+                    answerOwnershipOffer(payload.chat_id);
+                }
+                break;
+            case 'owner_changed':
+                loadChats();
+                if (currentChat && currentChat.id === payload.chat_id) {
+                    currentChat.owner_id = payload.owner_id;
+                    currentChat.pending_owner_id = 0;
+                    if (payload.owner_id === currentUserID) {
+                        currentChat.role = 'owner';
+                    } else if (payload.previous_owner_id === currentUserID) {
+                        currentChat.role = 'admin';
+                    }
+                    renderChatControls(currentChat);
+                    loadParticipants(payload.chat_id);
+                }
+                break;
+            case 'join_request':
+                if (currentChat && currentChat.id === payload.chat_id) {
+                    loadJoinRequests(payload.chat_id);
+                } else if (!payload.requires_approval) {
+                    approveJoinRequest(payload.chat_id, payload);
+                }
+                break;
+            case 'join_request_resolved':
+                if (payload.user_id === currentUserID) {
+                    // Approval arrives as new_chat
+                    if (!payload.approved) alert('Your request to join a chat was declined.');
+                } else if (currentChat && currentChat.id === payload.chat_id) {
+                    loadJoinRequests(payload.chat_id);
+                }
+                break;
+            case 'removed_from_chat':
+                // Reload chat list to remove the chat
+                loadChats();
+
+                // If viewing the chat, clear it
+                if (currentChat && currentChat.id === payload.chat_id) {
+                    document.getElementById('active-chat').style.display = 'none';
+                    document.getElementById('no-chat-selected').style.display = 'flex';
+                    document.getElementById('participants-sidebar').style.display = 'none';
+                    currentChat = null;
+                    alert('You have been removed from this chat.');
+                }
+                break;
         }
-        if (msg.type === 'removed_from_chat') {
-            // Reload chat list to remove the chat
-            loadChats();
+    };
 
-            // If viewing the chat, clear it
-            if (currentChat && currentChat.id === msg.chat_id) {
-                document.getElementById('active-chat').style.display = 'none';
-                document.getElementById('no-chat-selected').style.display = 'flex';
-                document.getElementById('participants-sidebar').style.display = 'none';
-                currentChat = null;
-                alert('You have been removed from this chat.');
-            }
-            return;
-        }
-        if (currentChat && msg.chat_id === currentChat.id) {
-            appendMessage(msg);
-        }
+    ws.onopen = () => {
+        // Retry anything the previous connection never acknowledged
+        Object.values(pendingSends).forEach(frame => ws.send(frame));
+        resetIdleTimer();
     };
 
     ws.onclose = () => {
@@ -871,12 +1722,16 @@ function connectWS() {
 async function sendMessage(e) {
     e.preventDefault();
     const input = document.getElementById('message-input');
-    const content = input.value;
+    // Attachments are captioned with their file name unless the user typed one
+    const content = input.value || (pendingAttachment ? pendingAttachment.name : '');
+    if (!content) {
+        return;
+    }
 
     if (ws && currentChat) {
         try {
             // Get the symmetric key for this chat
-            const symmetricKey = chatKeys[currentChat.id];
+            const symmetricKey = currentChatKey(currentChat.id);
             if (!symmetricKey) {
                 alert('Chat key not available. Cannot send encrypted message.');
                 return;
@@ -885,13 +1740,25 @@ async function sendMessage(e) {
             // Encrypt the message
             const encryptedContent = await encryptMessage(content, symmetricKey);
 
-            const msg = {
-                chat_id: currentChat.id,
-                user_id: 0, // Backend handles this
-                content: encryptedContent
-            };
-            ws.send(JSON.stringify(msg));
+            // The id doubles as an idempotency key, so unacked sends can be
+            // retried after a reconnect without creating duplicates.
+            const id = crypto.randomUUID();
+            const payload = { chat_id: currentChat.id, content: encryptedContent, key_epoch: chatEpochs[currentChat.id] };
+            if (replyingTo) {
+                payload.reply_to = replyingTo.id;
+            }
+            if (pendingAttachment) {
+                payload.attachment_ids = [pendingAttachment.id];
+            }
+            const frame = JSON.stringify({ v: WS_PROTOCOL_VERSION, type: 'send', id: id, payload: payload });
+            pendingSends[id] = frame;
+            if (ws.readyState === WebSocket.OPEN) {
+                ws.send(frame);
+            }
             input.value = '';
+            cancelReply();
+            clearAttachment();
+            sendTyping(false);
         } catch (err) {
             console.error('Error encrypting message:', err);
             alert('Failed to encrypt message');
@@ -899,8 +1766,182 @@ async function sendMessage(e) {
     }
 }
 
+// Presence: a dot per participant, with last-seen for those offline
+function renderPresence(userID, div) {
+    const state = presence[userID] || { status: 'offline' };
+    const dot = div.querySelector('.presence-dot');
+    dot.className = `presence-dot ${state.status}`;
+    if (state.status === 'offline' && state.last_seen) {
+        dot.title = `Last seen ${new Date(state.last_seen).toLocaleString()}`;
+    } else {
+        dot.title = state.status;
+    }
+}
+
+function sendFrame(type, payload) {
+    if (ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({ v: WS_PROTOCOL_VERSION, type: type, payload: payload }));
+    }
+}
+
+// We're away after a while without input or while the tab is hidden
+let idle = false;
+function setIdle(value) {
+    if (idle === value) return;
+    idle = value;
+    sendFrame('status', { status: idle ? 'away' : 'online' });
+}
+
+function resetIdleTimer() {
+    clearTimeout(idleTimer);
+    if (!ws) return;
+    if (document.hidden) {
+        setIdle(true);
+        return;
+    }
+    setIdle(false);
+    idleTimer = setTimeout(() => setIdle(true), IDLE_TIMEOUT_MS);
+}
+
+['mousemove', 'keydown', 'click', 'visibilitychange'].forEach(event => {
+    document.addEventListener(event, resetIdleTimer);
+});
+
+// Typing indicators expire on their own, so repeat while the user types
+function sendTyping(typing) {
+    if (!currentChat) return;
+    const now = Date.now();
+    if (typing && now - lastTypingSent < TYPING_REPEAT_MS) return;
+    lastTypingSent = typing ? now : 0;
+    sendFrame('typing', { chat_id: currentChat.id, typing: typing });
+}
+
+document.getElementById('message-input').addEventListener('input', (e) => {
+    sendTyping(e.target.value !== '');
+});
+
+function startTypingIndicator(userID, expiresIn) {
+    clearTimeout(typingUsers[userID]);
+    typingUsers[userID] = setTimeout(() => stopTypingIndicator(userID), expiresIn);
+    renderTypingIndicator();
+}
+
+function stopTypingIndicator(userID) {
+    if (!(userID in typingUsers)) return;
+    clearTimeout(typingUsers[userID]);
+    delete typingUsers[userID];
+    renderTypingIndicator();
+}
+
+function clearTypingIndicators() {
+    Object.values(typingUsers).forEach(clearTimeout);
+    typingUsers = {};
+    renderTypingIndicator();
+}
+
+function renderTypingIndicator() {
+    const names = Object.keys(typingUsers).map(id => participantNames[id] || 'Someone');
+    const indicator = document.getElementById('typing-indicator');
+    if (names.length === 0) {
+        indicator.textContent = '';
+    } else if (names.length === 1) {
+        indicator.textContent = `${names[0]} is typing…`;
+    } else {
+        indicator.textContent = `${names.join(', ')} are typing…`;
+    }
+}
+
+// Move our read pointer forward, over the socket when it's up
+function markChatRead(chatID, messageID) {
+    setUnreadCount(chatID, 0);
+    const payload = { chat_id: chatID, message_id: messageID };
+    if (ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({ v: WS_PROTOCOL_VERSION, type: 'read', payload: payload }));
+    } else {
+        fetch(`/chats/${chatID}/read`, {
+            method: 'POST',
+            body: JSON.stringify(payload),
+            headers: { 'Content-Type': 'application/json' }
+        }).catch(err => console.error('Error marking chat read:', err));
+    }
+}
+
+function setUnreadCount(chatID, count) {
+    unreadCounts[chatID] = count;
+    const badge = document.querySelector(`.chat-item[data-chat-id="${chatID}"] .unread-badge`);
+    if (badge) badge.textContent = count > 0 ? count : '';
+}
+
+async function loadReadReceipts(chatID) {
+    try {
+        const res = await fetch(`/chats/${chatID}/receipts`);
+        const receipts = await res.json();
+        if (!currentChat || currentChat.id !== chatID) return;
+        readReceipts = {};
+        receipts.forEach(r => { readReceipts[r.user_id] = r.message_id; });
+        renderReadReceipts();
+    } catch (err) {
+        console.error('Error loading read receipts:', err);
+    }
+}
+
+// Mark each message with the other members whose read pointer stops there
+function renderReadReceipts() {
+    document.querySelectorAll('#messages .message-seen').forEach(el => el.remove());
+    const byMessage = {};
+    for (const [userID, messageID] of Object.entries(readReceipts)) {
+        if (Number(userID) === currentUserID || !participantNames[userID]) continue;
+        (byMessage[messageID] = byMessage[messageID] || []).push(participantNames[userID]);
+    }
+    for (const [messageID, names] of Object.entries(byMessage)) {
+        const div = document.querySelector(`#messages [data-message-id="${messageID}"]`);
+        if (!div) continue;
+        const seen = document.createElement('div');
+        seen.className = 'message-seen';
+        seen.textContent = `Seen by ${names.join(', ')}`;
+        div.appendChild(seen);
+    }
+}
+
+// Fetch the previous page of history when scrolled to the top
+async function loadOlderMessages() {
+    if (!currentChat || !olderMessagesCursor || loadingOlderMessages) return;
+    loadingOlderMessages = true;
+    const chatID = currentChat.id;
+    try {
+        const res = await fetch(`/chats/${chatID}/messages?before=${encodeURIComponent(olderMessagesCursor)}`);
+        const page = await res.json();
+        if (!currentChat || currentChat.id !== chatID) return;
+
+        olderMessagesCursor = page.next || null;
+        const container = document.getElementById('messages');
+        const previousHeight = container.scrollHeight;
+        const divs = await Promise.all(page.messages.map(renderMessage));
+        container.prepend(...divs);
+        // Keep the viewport anchored on the message the user was looking at
+        container.scrollTop += container.scrollHeight - previousHeight;
+    } catch (err) {
+        console.error("Error loading older messages:", err);
+    } finally {
+        loadingOlderMessages = false;
+    }
+}
+
 async function appendMessage(msg) {
+    // The same message can arrive twice, e.g. via replay and live delivery
+    if (document.querySelector(`#messages [data-message-id="${msg.id}"]`)) return;
+    const div = await renderMessage(msg);
+    const container = document.getElementById('messages');
+    container.appendChild(div);
+    container.scrollTop = container.scrollHeight;
+}
+
+async function renderMessage(msg) {
+    if (msg.kind === 'system') {
+        return renderSystemMessage(msg);
+    }
     const div = document.createElement('div');
+    div.dataset.messageId = msg.id;
     const isMe = msg.username === currentUser;
     div.className = `message ${isMe ? 'sent' : 'received'}`;
 
@@ -911,13 +1952,51 @@ async function appendMessage(msg) {
     const timeStr = date.toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
     meta.textContent = `${msg.username} • ${timeStr}`;
 
+    if (msg.edited_at && !msg.deleted_at) {
+        meta.textContent += ' • edited';
+    }
+
     const content = document.createElement('div');
+    content.className = 'message-content';
+    div.appendChild(meta);
+
+    // Quote the message being answered, if it's on screen
+    if (msg.reply_to && !msg.deleted_at) {
+        const quote = document.createElement('div');
+        quote.className = 'message-quote';
+        const original = document.querySelector(`#messages [data-message-id="${msg.reply_to}"] .message-content`);
+        quote.textContent = original ? original.textContent : 'Earlier message';
+        div.appendChild(quote);
+    }
+    div.appendChild(content);
+
+    // Thread roots link to their replies
+    if (!msg.thread_root_id) {
+        const summary = document.createElement('button');
+        summary.className = 'thread-summary';
+        summary.onclick = () => openThread(msg);
+        div.appendChild(summary);
+        setThreadSummary(summary, msg.reply_count, msg.last_reply_at);
+    }
+
+    if (msg.deleted_at) {
+        div.classList.add('deleted');
+        content.textContent = 'Message deleted';
+        return div;
+    }
+
+    const reactions = document.createElement('div');
+    reactions.className = 'message-reactions';
+    div.appendChild(reactions);
+    messageReactions[msg.id] = msg.reactions || [];
+    renderReactions(msg, reactions);
 
     // Decrypt the message content
+    let decryptedContent = null;
     try {
-        const symmetricKey = chatKeys[msg.chat_id];
+        const symmetricKey = (chatKeys[msg.chat_id] || {})[msg.key_epoch];
         if (symmetricKey) {
-            const decryptedContent = await decryptMessage(msg.content, symmetricKey);
+            decryptedContent = await decryptMessage(msg.content, symmetricKey);
             content.textContent = decryptedContent;
         } else {
             content.textContent = '[Encrypted - key not available]';
@@ -928,14 +2007,413 @@ async function appendMessage(msg) {
         content.textContent = '[Decryption failed]';
     }
 
-    div.appendChild(meta);
-    div.appendChild(content);
+    for (const attachment of msg.attachments || []) {
+        div.insertBefore(renderAttachment(msg, attachment, content.textContent), reactions);
+    }
 
-    const container = document.getElementById('messages');
-    container.appendChild(div);
-    container.scrollTop = container.scrollHeight;
+    // Anyone can reply; senders can edit and delete their messages and
+    // owners can delete any
+    const actions = document.createElement('div');
+    actions.className = 'message-actions';
+    const replyBtn = document.createElement('button');
+    replyBtn.textContent = 'Reply';
+    replyBtn.onclick = () => startReply(msg, content.textContent);
+    actions.appendChild(replyBtn);
+    const reactBtn = document.createElement('button');
+    reactBtn.textContent = 'React';
+    reactBtn.onclick = () => {
+        const reaction = prompt('React with', '👍');
+        if (reaction) toggleReaction(msg, reaction);
+    };
+    actions.appendChild(reactBtn);
+    if (isMe && decryptedContent !== null && can(currentChat, 'post')) {
+        const editBtn = document.createElement('button');
+        editBtn.textContent = 'Edit';
+        editBtn.onclick = () => editMessage(msg, decryptedContent);
+        actions.appendChild(editBtn);
+    }
+    if (isMe || can(currentChat, 'moderate')) {
+        const deleteBtn = document.createElement('button');
+        deleteBtn.textContent = 'Delete';
+        deleteBtn.onclick = () => deleteMessage(msg);
+        actions.appendChild(deleteBtn);
+    }
+    div.appendChild(actions);
+    return div;
+}
+
+// System messages record changes to the chat as a centered note
+async function renderSystemMessage(msg) {
+    const div = document.createElement('div');
+    div.dataset.messageId = msg.id;
+    div.className = 'message system';
+    const time = new Date(msg.created_at).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+
+    div.textContent = `${await describeSystemEvent(msg)} • ${time}`;
+
+    for (const attachment of msg.attachments || []) {
+        div.appendChild(renderAttachment(msg, attachment, 'Chat avatar'));
+    }
+    return div;
+}
+
+// Say what a system message records, e.g. "alice added bob"
+async function describeSystemEvent(msg) {
+    const event = msg.event || {};
+    const actor = msg.username;
+    const subject = event.username;
+    const self = msg.user_id === event.user_id;
+    switch (event.type) {
+        case 'member_joined':
+            return self ? `${subject} joined` : `${actor} added ${subject}`;
+        case 'member_left':
+            return `${subject} left`;
+        case 'member_removed':
+            return `${actor} removed ${subject}`;
+        case 'role_changed':
+            return `${actor} made ${subject} ${ROLE_LABELS[event.role] || event.role}`;
+        case 'owner_changed':
+            return event.reason === 'ownership_succeeded'
+                ? `${subject} took over the chat from ${actor}`
+                : `${actor} handed the chat to ${subject}`;
+        case 'message_deleted':
+            return `${actor} deleted a message from ${subject}`;
+        case 'chat_updated': {
+            const changes = event.chat || {};
+            const parts = [];
+            for (const [field, label] of [['name', 'renamed the chat to'], ['description', 'set the description to'], ['topic', 'set the topic to']]) {
+                const change = changes[field];
+                if (!change) continue;
+                const value = await readChatField(msg.chat_id, change.value, change.key_epoch);
+                parts.push(value ? `${label} "${value}"` : `cleared the ${field}`);
+            }
+            if (changes.avatar_attachment_id !== undefined) {
+                parts.push(changes.avatar_attachment_id ? 'changed the avatar' : 'removed the avatar');
+            }
+            return `${actor} ${parts.join(', ') || 'updated the chat'}`;
+        }
+    }
+    return `${actor} changed the chat`;
+}
+
+// Draw a message's reaction chips; clicking one toggles the user's own
+function renderReactions(msg, container) {
+    container.replaceChildren(...(messageReactions[msg.id] || []).map(r => {
+        const chip = document.createElement('button');
+        chip.className = 'reaction';
+        if (r.user_ids.includes(currentUserID)) chip.classList.add('mine');
+        chip.textContent = `${r.reaction} ${r.count}`;
+        chip.onclick = () => toggleReaction(msg, r.reaction);
+        return chip;
+    }));
+}
+
+async function toggleReaction(msg, reaction) {
+    const existing = (messageReactions[msg.id] || []).find(r => r.reaction === reaction);
+    const mine = existing && existing.user_ids.includes(currentUserID);
+    try {
+        const res = await fetch(`/chats/${msg.chat_id}/messages/${msg.id}/reactions`, {
+            method: mine ? 'DELETE' : 'POST',
+            body: JSON.stringify({ reaction: reaction }),
+            headers: { 'Content-Type': 'application/json' }
+        });
+        if (!res.ok) {
+            alert('Failed to react: ' + await res.text());
+        }
+    } catch (err) {
+        console.error('Error reacting:', err);
+    }
+}
+
+// Apply a live reaction change to a message on screen
+function applyReactionEvent(event, added) {
+    const reactions = messageReactions[event.message_id];
+    if (!reactions) return;
+    let entry = reactions.find(r => r.reaction === event.reaction);
+    if (added) {
+        if (!entry) {
+            entry = { reaction: event.reaction, count: 0, user_ids: [] };
+            reactions.push(entry);
+        }
+        if (entry.user_ids.includes(event.user_id)) return;
+        entry.user_ids.push(event.user_id);
+        entry.count++;
+    } else {
+        if (!entry || !entry.user_ids.includes(event.user_id)) return;
+        entry.user_ids = entry.user_ids.filter(id => id !== event.user_id);
+        entry.count--;
+        if (entry.count === 0) {
+            reactions.splice(reactions.indexOf(entry), 1);
+        }
+    }
+    document.querySelectorAll(`[data-message-id="${event.message_id}"] .message-reactions`).forEach(container => {
+        renderReactions({ id: event.message_id, chat_id: event.chat_id }, container);
+    });
+}
+
+function setThreadSummary(summary, replyCount, lastReplyAt) {
+    if (!replyCount) {
+        summary.style.display = 'none';
+        return;
+    }
+    const last = new Date(lastReplyAt).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+    summary.textContent = `${replyCount} ${replyCount === 1 ? 'reply' : 'replies'} • last ${last}`;
+    summary.style.display = 'block';
+}
+
+// Refresh a thread root's reply count after someone answers it
+function updateThreadSummary(rootID, replyCount, lastReplyAt) {
+    const summary = document.querySelector(`#messages [data-message-id="${rootID}"] .thread-summary`);
+    if (summary) setThreadSummary(summary, replyCount, lastReplyAt);
+}
+
+function startReply(msg, text) {
+    replyingTo = msg;
+    document.getElementById('reply-preview-text').textContent = `Replying to ${msg.username}: ${text}`;
+    document.getElementById('reply-preview').style.display = 'flex';
+    document.getElementById('message-input').focus();
+}
+
+function cancelReply() {
+    replyingTo = null;
+    document.getElementById('reply-preview').style.display = 'none';
+}
+
+// Attachments: files are encrypted under the chat's current key and
+// uploaded in chunks. The blob starts with the key epoch as 4 big-endian
+// bytes, followed by the sealed file.
+async function handleAttachmentSelected(e) {
+    const file = e.target.files[0];
+    e.target.value = '';
+    if (!file || !currentChat) {
+        return;
+    }
+    const chatID = currentChat.id;
+    const symmetricKey = currentChatKey(chatID);
+    if (!symmetricKey) {
+        alert('Chat key not available. Cannot send encrypted attachment.');
+        return;
+    }
+
+    cancelAttachment();
+    const preview = document.getElementById('attachment-preview-text');
+    preview.textContent = `Uploading ${file.name}...`;
+    document.getElementById('attachment-preview').style.display = 'flex';
+
+    try {
+        const attachment = await uploadAttachment(chatID, file, preview);
+        pendingAttachment = { id: attachment.id, chatID: chatID, name: file.name };
+        preview.textContent = `Attached ${file.name}`;
+    } catch (err) {
+        console.error('Error uploading attachment:', err);
+        cancelAttachment();
+        alert('Failed to upload attachment: ' + err.message);
+    }
+}
+
+// Encrypt a file under a chat's current key and upload it, reporting
+// progress in preview
+async function uploadAttachment(chatID, file, preview) {
+    const symmetricKey = currentChatKey(chatID);
+    if (!symmetricKey) {
+        throw new Error('chat key not available');
+    }
+    const sealed = await encryptBytes(new Uint8Array(await file.arrayBuffer()), symmetricKey);
+    const data = new Uint8Array(4 + sealed.length);
+    new DataView(data.buffer).setUint32(0, chatEpochs[chatID]);
+    data.set(sealed, 4);
+
+    const response = await fetch(`/chats/${chatID}/attachments`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ size: data.length, content_type: file.type || 'application/octet-stream' }),
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return uploadChunks(chatID, await response.json(), data, preview, file.name);
+}
+
+// Upload the chunks not yet received, resuming from the server's count
+// after a failed chunk
+async function uploadChunks(chatID, attachment, data, preview, name) {
+    const url = `/chats/${chatID}/attachments/${attachment.id}`;
+    let failures = 0;
+    while (attachment.received < attachment.size) {
+        const chunk = Math.floor(attachment.received / attachment.chunk_size);
+        const end = Math.min(attachment.received + attachment.chunk_size, attachment.size);
+        preview.textContent = `Uploading ${name}... ${Math.floor(100 * attachment.received / attachment.size)}%`;
+        try {
+            const response = await fetch(`${url}/chunks/${chunk}`, {
+                method: 'PUT',
+                body: data.slice(attachment.received, end),
+            });
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            attachment = await response.json();
+            failures = 0;
+        } catch (err) {
+            if (++failures > 3) {
+                throw err;
+            }
+            await new Promise(resolve => setTimeout(resolve, 1000 * failures));
+            const status = await fetch(url);
+            if (status.ok) {
+                attachment = await status.json();
+            }
+        }
+    }
+    return attachment;
+}
+
+// Forget the composer's attachment, discarding its upload
+function cancelAttachment() {
+    if (pendingAttachment) {
+        fetch(`/chats/${pendingAttachment.chatID}/attachments/${pendingAttachment.id}`, { method: 'DELETE' });
+    }
+    clearAttachment();
+}
+
+// Forget the composer's attachment once it has been sent
+function clearAttachment() {
+    pendingAttachment = null;
+    document.getElementById('attachment-preview').style.display = 'none';
 }
 
+// Download and decrypt an attachment, returning it as a Blob
+async function fetchAttachment(attachment) {
+    const response = await fetch(`/chats/${attachment.chat_id}/attachments/${attachment.id}/content`);
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    const data = new Uint8Array(await response.arrayBuffer());
+    const epoch = new DataView(data.buffer).getUint32(0);
+    const symmetricKey = (chatKeys[attachment.chat_id] || {})[epoch];
+    if (!symmetricKey) {
+        throw new Error('key not available');
+    }
+    const plain = await decryptBytes(data.slice(4), symmetricKey);
+    return new Blob([plain], { type: attachment.content_type });
+}
+
+// Images are shown inline; other files get a download button named after
+// the message's caption
+function renderAttachment(msg, attachment, name) {
+    const container = document.createElement('div');
+    container.className = 'message-attachment';
+    if (attachment.content_type.startsWith('image/')) {
+        const img = document.createElement('img');
+        img.alt = name;
+        container.appendChild(img);
+        fetchAttachment(attachment)
+            .then(blob => { img.src = URL.createObjectURL(blob); })
+            .catch(err => { container.textContent = `[Attachment unavailable: ${err.message}]`; });
+        return container;
+    }
+
+    const button = document.createElement('button');
+    button.textContent = `Download ${name} (${Math.ceil(attachment.size / 1024)} KB)`;
+    button.onclick = async () => {
+        try {
+            const link = document.createElement('a');
+            link.href = URL.createObjectURL(await fetchAttachment(attachment));
+            link.download = name;
+            link.click();
+            setTimeout(() => URL.revokeObjectURL(link.href), 0);
+        } catch (err) {
+            alert('Failed to download attachment: ' + err.message);
+        }
+    };
+    container.appendChild(button);
+    return container;
+}
+
+// Show a thread's root and replies in a modal
+async function openThread(root) {
+    try {
+        const res = await fetch(`/chats/${root.chat_id}/threads/${root.id}?limit=200`);
+        if (!res.ok) {
+            alert('Failed to load thread: ' + await res.text());
+            return;
+        }
+        const page = await res.json();
+        const container = document.getElementById('thread-messages');
+        container.replaceChildren(...await Promise.all(page.messages.map(renderMessage)));
+        document.getElementById('thread-modal').style.display = 'block';
+    } catch (err) {
+        console.error('Error loading thread:', err);
+    }
+}
+
+// Re-render a message already on screen, e.g. after an edit or delete
+async function replaceMessage(msg) {
+    const existing = document.querySelector(`#messages [data-message-id="${msg.id}"]`);
+    if (!existing) return;
+    existing.replaceWith(await renderMessage(msg));
+}
+
+// Turn a message on screen into a tombstone
+function markMessageDeleted(messageID) {
+    const div = document.querySelector(`#messages [data-message-id="${messageID}"]`);
+    if (!div) return;
+    div.classList.add('deleted');
+    div.querySelector('.message-content').textContent = 'Message deleted';
+    const actions = div.querySelector('.message-actions');
+    if (actions) actions.remove();
+    const reactions = div.querySelector('.message-reactions');
+    if (reactions) reactions.remove();
+    delete messageReactions[messageID];
+}
+
+async function editMessage(msg, currentText) {
+    const text = prompt('Edit message', currentText);
+    if (text === null || text === '' || text === currentText) return;
+
+    const symmetricKey = currentChatKey(msg.chat_id);
+    if (!symmetricKey) {
+        alert('Chat key not available. Cannot edit message.');
+        return;
+    }
+
+    try {
+        const res = await fetch(`/chats/${msg.chat_id}/messages/${msg.id}`, {
+            method: 'PATCH',
+            body: JSON.stringify({
+                content: await encryptMessage(text, symmetricKey),
+                key_epoch: chatEpochs[msg.chat_id]
+            }),
+            headers: { 'Content-Type': 'application/json' }
+        });
+        if (res.status === 409) {
+            loadChats();
+            alert('The chat key changed while editing. Please try again.');
+        } else if (!res.ok) {
+            alert('Failed to edit message: ' + await res.text());
+        }
+    } catch (err) {
+        console.error('Error editing message:', err);
+    }
+}
+
+async function deleteMessage(msg) {
+    if (!confirm('Delete this message for everyone?')) return;
+    try {
+        const res = await fetch(`/chats/${msg.chat_id}/messages/${msg.id}`, { method: 'DELETE' });
+        if (!res.ok) {
+            alert('Failed to delete message: ' + await res.text());
+        }
+    } catch (err) {
+        console.error('Error deleting message:', err);
+    }
+}
+
+document.getElementById('messages').addEventListener('scroll', (e) => {
+    if (e.target.scrollTop === 0) {
+        loadOlderMessages();
+    }
+});
+
 // Close modals when clicking outside
 window.onclick = function (event) {
     if (event.target.classList.contains('modal')) {